@@ -58,8 +58,24 @@ func main() {
 	// Initialize services
 	services := initializeServices(dbPool, config)
 
-	// Start schedule service
-	go services.Schedule.Start(ctx)
+	// Start schedule service, closes scheduleDone once in-flight outbox events are handled
+	scheduleDone := make(chan struct{})
+	go func() {
+		services.Schedule.Start(ctx)
+		close(scheduleDone)
+	}()
+
+	// Start webhook delivery
+	go services.Webhook.Start(ctx)
+
+	// Start email delivery
+	go services.Email.Start(ctx)
+
+	// Start broadcast delivery
+	go services.Broadcast.Start(ctx)
+
+	// Start listening for stream events, ends open streams on shutdown
+	go services.Stream.Listen(ctx)
 
 	// Initialize and start server
 	server := initializeServer(config, services)
@@ -68,37 +84,50 @@ func main() {
 			slog.Error("Server error", "error", err)
 		}
 	}()
-	gracefulShutdown(server, cancel)
+	gracefulShutdown(server, cancel, scheduleDone)
 }
 
 // initializeServer sets up the database, services, and HTTP server
 func initializeServer(config types.Config, services servicesContainer) *http.Server {
 	// create middleware
-	authorizer := middleware.NewAccessControl(services.JWT)
 	rateLimit := middleware.NewRateLimit(services.RateLimit, config.RateLimit)
+	authorizer := middleware.NewAccessControl(services.JWT, services.Permission, services.Revocation, services.APIKey, rateLimit)
+	audit := middleware.NewAudit(services.Audit)
 
 	// create router
 	router := mux.NewRouter()
+	router.Use(middleware.RequestID)
 	router.Use(middleware.RequestLog)
-	baseRouter := routes.NewRouter(router, authorizer, rateLimit)
+	baseRouter := routes.NewRouter(router, authorizer, rateLimit, audit)
 
 	// create routes
 	routes.RegisterAllRoutes(
+		routes.NewAPIKeyRoutes(services.APIKey, baseRouter),
+		routes.NewAuditRoutes(services.Audit, baseRouter),
+		routes.NewBroadcastRoutes(services.Broadcast, baseRouter),
 		routes.NewAddressRoutes(services.Address, services.Shipping, baseRouter),
 		routes.NewShippingZoneRoutes(services.Shipping, baseRouter),
 		routes.NewCartRoutes(services.Cart, services.Order, baseRouter),
 		routes.NewCategoryRoutes(services.Category, baseRouter),
-		routes.NewConversationRoutes(services.Conversation, baseRouter),
+		routes.NewConversationRoutes(services.Conversation, services.Attachment, config.Attachment, baseRouter),
 		routes.NewHealthRoutes(baseRouter),
+		routes.NewJWKSRoutes(services.JWT, baseRouter),
 		routes.NewImageRoutes(services.Image, services.Product, config.Image, baseRouter),
-		routes.NewOrderRoutes(services.Order, services.Tax, services.Payment, services.Cart, services.Address, baseRouter),
-		routes.NewPasswordRoutes(services.Password, services.User, services.Notification, baseRouter),
+		routes.NewOIDCRoutes(services.OIDC, services.JWT, services.Refresh, config.Environment, baseRouter),
+		routes.NewOrderRoutes(services.Order, services.Tax, services.Payment, services.Cart, services.Address, services.Offer, baseRouter),
+		routes.NewPasswordRoutes(services.Password, services.User, services.Notification, services.Lockout, services.Revocation, baseRouter),
 		routes.NewPaymentRoutes(services.Payment, baseRouter),
+		routes.NewPermissionRoutes(services.Permission, baseRouter),
 		routes.NewProductRoutes(services.Product, baseRouter),
-		routes.NewRegistrationRoutes(services.User, services.Registration, services.JWT, services.Refresh, services.Notification, baseRouter),
+		routes.NewRegistrationRoutes(services.User, services.Registration, services.JWT, services.Refresh, services.Notification, services.Lockout, baseRouter),
 		routes.NewTaxRoutes(services.Cart, services.Tax, baseRouter),
-		routes.NewUserRoutes(services.User, services.JWT, services.Refresh, baseRouter),
+		routes.NewUserRoutes(services.User, services.JWT, services.Refresh, services.Lockout, services.Notification, baseRouter),
 		routes.NewOfferRoutes(services.Offer, baseRouter),
+		routes.NewWebhookRoutes(services.Webhook, baseRouter),
+		routes.NewEmailRoutes(services.Email, baseRouter),
+		routes.NewNotificationRoutes(services.Notification, services.Template, baseRouter),
+		routes.NewTemplateRoutes(services.Template, baseRouter),
+		routes.NewStreamRoutes(services.Stream, config.Server, baseRouter),
 		routes.NewLocaleRoutes(baseRouter),
 	)
 
@@ -119,12 +148,18 @@ func initializeServer(config types.Config, services servicesContainer) *http.Ser
 func initializeServices(db *sql.DB, config types.Config) servicesContainer {
 	// create database repositories
 	addressRepository := repositories.NewAddressRepository(db)
+	apiKeyRepository := repositories.NewAPIKeyRepository(db)
+	auditRepository := repositories.NewAuditRepository(db)
 	userRepository := repositories.NewUserRepository(db)
 	categoryRepository := repositories.NewCategoryRepository(db)
 	productRepository := repositories.NewProductRepository(db)
 	cartRepository := repositories.NewCartRepository(db)
 	orderRepository := repositories.NewOrderRepository(db)
+	lockoutRepository := repositories.NewLockoutRepository(db)
+	identityRepository := repositories.NewIdentityRepository(db)
+	revocationRepository := repositories.NewRevocationRepository(db)
 	passwordRepository := repositories.NewPasswordRepository(db)
+	permissionRepository := repositories.NewPermissionRepository(db)
 	rateLimitRepository := repositories.NewRateLimitRepository(db)
 	refreshTokenRepository := repositories.NewRefreshRepository(db)
 	taxRepository := repositories.NewTaxRepository(db)
@@ -133,44 +168,85 @@ func initializeServices(db *sql.DB, config types.Config) servicesContainer {
 	offerRepository := repositories.NewOfferRepository(db)
 	conversationRepository := repositories.NewConversationRepository(db)
 	registrationRepository := repositories.NewRegistrationRepository(db)
+	webhookRepository := repositories.NewWebhookRepository(db)
+	outboxRepository := repositories.NewOutboxRepository(db)
+	emailRepository := repositories.NewEmailRepository(db)
+	notificationRepository := repositories.NewNotificationRepository(db)
+	templateRepository := repositories.NewTemplateRepository(db)
+	streamRepository := repositories.NewStreamRepository(db, config.Database.DataSourceName())
+	attachmentRepository := repositories.NewAttachmentRepository(db)
+	broadcastRepository := repositories.NewBroadcastRepository(db)
 
 	// create HTTP client
 	httpClient := utilities.NewDefaultHTTPClient(config.HTTPClientTimeout)
 
 	// create services
-	templateService := services.NewTemplateService()
-	scheduleService := services.NewScheduleService(db)
-	conversationService := services.NewConversationService(conversationRepository)
-	emailService := services.NewEmailService(config.Email)
-	notificationService := services.NewNotificationService(emailService, templateService, conversationService, config.BaseURL)
+	templateService := services.NewTemplateService(templateRepository)
+	outboxService := services.NewOutboxService(outboxRepository)
+	streamService := services.NewStreamService(streamRepository, config.Auth.HMACSecret)
+	attachmentService := services.NewAttachmentService(attachmentRepository, newAttachmentScanner(config), config.Attachment, config.BaseURL)
+	conversationService := services.NewConversationService(conversationRepository, streamService, attachmentService)
+	emailService := services.NewEmailService(emailRepository, config.Email)
+	webhookService := services.NewWebhookService(webhookRepository, httpClient, utilities.NewPublicHTTPClient(config.HTTPClientTimeout))
+	notificationService := services.NewNotificationService(emailService, templateService, conversationService, webhookService,
+		notificationRepository, userRepository, config.BaseURL, config.Auth.HMACSecret)
+	broadcastService := services.NewBroadcastService(broadcastRepository, notificationService)
 	addressService := services.NewAddressService(addressRepository)
+	apiKeyService := services.NewAPIKeyService(apiKeyRepository, config.Auth.HMACSecret)
+	auditService := services.NewAuditService(auditRepository)
 	shippingZoneService := services.NewShippingZoneService(shippingZoneRepository)
-	userService := services.NewUserService(userRepository)
+	revocationService := services.NewTokenRevocationService(revocationRepository, config.JWT.Expiry)
+	userService := services.NewUserService(userRepository, revocationService, attachmentService)
 	categoryService := services.NewCategoryService(categoryRepository)
 	productService := services.NewProductService(productRepository)
 	cartService := services.NewCartService(cartRepository)
-	paymentService := services.NewPaymentService(httpClient, config.Payment, notificationService, userService, orderRepository)
-	orderService := services.NewOrderService(orderRepository, cartRepository, paymentService, notificationService, httpClient)
+	paymentService := services.NewPaymentService(httpClient, config.Payment, orderRepository)
+	orderService := services.NewOrderService(orderRepository, cartRepository, paymentService, httpClient)
 	imageService := services.NewImageService(httpClient, imageRepository, config.Image)
+	lockoutService := services.NewLockoutService(lockoutRepository)
+	oidcService := services.NewOIDCService(identityRepository, userRepository, httpClient, config.OIDC)
 	passwordService := services.NewPasswordService(passwordRepository, config.Auth.HMACSecret)
+	permissionService := services.NewPermissionService(permissionRepository)
 	rateLimitService := services.NewRateLimitService(rateLimitRepository)
 	refreshService := services.NewRefreshService(refreshTokenRepository, config.Auth)
 	registrationService := services.NewRegistrationService(registrationRepository)
 	jwtService := services.NewJWTService(config.JWT)
 	taxService := services.NewTaxService(taxRepository, config.Payment, httpClient)
-	offerService := services.NewOfferService(productRepository, offerRepository, userService, productService, notificationService)
+	offerService := services.NewOfferService(productRepository, offerRepository, productService)
+	scheduleService := services.NewScheduleService(db, config.Audit, config.JWT, outboxService, offerService)
+
+	// register outbox event handlers
+	outboxService.Register("notifications", services.NewCustomerNotificationHandler(notificationService),
+		types.EventTypeOrderStatusChanged, types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged)
+	outboxService.Register("admin_notifications", services.NewAdminNotificationHandler(notificationService, userService),
+		types.EventTypeOrderStatusChanged, types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged)
+	outboxService.Register("order_emails", services.NewOrderEmailHandler(notificationService, orderRepository),
+		types.EventTypeOrderStatusChanged)
+	outboxService.Register("webhooks", services.NewWebhookHandler(webhookService, orderRepository, offerRepository),
+		types.EventTypeOrderStatusChanged, types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged, types.EventTypeInventoryChanged)
+	outboxService.Register("stream", services.NewStreamHandler(streamService),
+		types.EventTypeOrderStatusChanged, types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged)
 
 	return servicesContainer{
 		Address:      addressService,
+		APIKey:       apiKeyService,
+		Attachment:   attachmentService,
+		Audit:        auditService,
+		Broadcast:    broadcastService,
 		Category:     categoryService,
 		Cart:         cartService,
 		Conversation: conversationService,
+		Email:        emailService,
 		Image:        imageService,
 		JWT:          jwtService,
+		Lockout:      lockoutService,
 		Notification: notificationService,
+		OIDC:         oidcService,
 		Order:        orderService,
+		Outbox:       outboxService,
 		Password:     passwordService,
 		Payment:      paymentService,
+		Permission:   permissionService,
 		Product:      productService,
 		Offer:        offerService,
 		RateLimit:    rateLimitService,
@@ -178,38 +254,67 @@ func initializeServices(db *sql.DB, config types.Config) servicesContainer {
 		Registration: registrationService,
 		Shipping:     shippingZoneService,
 		Schedule:     scheduleService,
+		Revocation:   revocationService,
+		Stream:       streamService,
 		Tax:          taxService,
+		Template:     templateService,
 		User:         userService,
+		Webhook:      webhookService,
 	}
 }
 
 // servicesContainer holds all service dependencies
 type servicesContainer struct {
 	Address      services.AddressService
+	APIKey       services.APIKeyService
+	Attachment   services.AttachmentService
+	Audit        services.AuditService
+	Broadcast    services.BroadcastService
 	Cart         services.CartService
 	Category     services.CategoryService
 	Conversation services.ConversationService
+	Email        services.EmailService
 	Image        services.ImageService
 	JWT          services.JWTService
+	Lockout      services.LockoutService
 	Notification services.NotificationService
+	OIDC         services.OIDCService
 	Offer        services.OfferService
 	Order        services.OrderService
+	Outbox       services.OutboxService
 	Password     services.PasswordService
 	Payment      services.PaymentService
+	Permission   services.PermissionService
 	Product      services.ProductService
 	RateLimit    services.RateLimitService
 	Refresh      services.RefreshService
 	Registration services.RegistrationService
+	Revocation   services.TokenRevocationService
 	Shipping     services.ShippingZoneService
 	Schedule     services.ScheduleService
+	Stream       services.StreamService
 	Tax          services.TaxService
+	Template     services.TemplateService
 	User         services.UserService
+	Webhook      services.WebhookService
 }
 
 // gracefulShutdown handles termination signals and gracefully shuts down the server.
 // It does so by waiting for all active connections to finish, or until a timeout is reached.
 // If the timeout is reached, the server is forcefully shut down.
-func gracefulShutdown(server *http.Server, cancel context.CancelFunc) {
+// Background work signalling on done is given the same timeout to drain.
+// newAttachmentScanner returns the configured malware scanner for attachments
+func newAttachmentScanner(config types.Config) services.AttachmentScanner {
+	if config.Attachment.Scanner == types.ScannerClamAV {
+		return services.NewClamAVScanner(config.Attachment.ClamAVAddr, config.HTTPClientTimeout)
+	}
+	if config.Environment == types.Production {
+		slog.Warn("Attachments are not scanned for malware, set ATTACHMENT_SCANNER=clamav")
+	}
+	return services.NewLocalScanner()
+}
+
+func gracefulShutdown(server *http.Server, cancel context.CancelFunc, done <-chan struct{}) {
 	// Listen for OS signals
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -231,4 +336,11 @@ func gracefulShutdown(server *http.Server, cancel context.CancelFunc) {
 	} else {
 		slog.Info("Server gracefully stopped")
 	}
+
+	// Wait for in-flight background work
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Error("Timed out waiting for background work to finish")
+	}
 }
@@ -18,8 +18,7 @@ func Connect(c types.DBConfig) *sql.DB {
 	var err error
 	maxRetries := 10              // TODO make configurable
 	retryDelay := 5 * time.Second // TODO make configurable
-	dataSourceName := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+	dataSourceName := c.DataSourceName()
 
 	for i := 0; i < maxRetries; i++ {
 		db, err = sql.Open("postgres", dataSourceName)
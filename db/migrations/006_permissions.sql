@@ -0,0 +1,30 @@
+CREATE TABLE role_permissions (
+    role user_role_enum NOT NULL,
+    permission TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+-- Default bundles reproduce the previous role hierarchy
+INSERT INTO role_permissions (role, permission) VALUES
+    ('member', 'offers:create'),
+    ('staff', 'offers:create'),
+    ('staff', 'conversations:read'),
+    ('staff', 'conversations:write'),
+    ('staff', 'orders:read'),
+    ('staff', 'shipping:read'),
+    ('staff', 'users:read'),
+    ('admin', 'categories:write'),
+    ('admin', 'conversations:read'),
+    ('admin', 'conversations:write'),
+    ('admin', 'offers:create'),
+    ('admin', 'offers:read'),
+    ('admin', 'offers:write'),
+    ('admin', 'orders:read'),
+    ('admin', 'orders:fulfill'),
+    ('admin', 'products:write'),
+    ('admin', 'refunds:create'),
+    ('admin', 'shipping:read'),
+    ('admin', 'shipping:write'),
+    ('admin', 'users:read'),
+    ('admin', 'users:admin');
@@ -0,0 +1,18 @@
+CREATE TABLE audit_log (
+    id BIGINT PRIMARY KEY,
+    actor_id BIGINT NOT NULL, -- no FK, entries outlive removed users
+    actor_role user_role_enum NOT NULL,
+    action TEXT NOT NULL,
+    entity_type TEXT NOT NULL,
+    entity_id TEXT,
+    before JSONB,
+    after JSONB,
+    ip_address TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_audit_log_created_at ON audit_log (created_at DESC);
+CREATE INDEX idx_audit_log_actor_id ON audit_log (actor_id, created_at DESC);
+CREATE INDEX idx_audit_log_entity ON audit_log (entity_type, entity_id, created_at DESC);
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'audit:read');
@@ -0,0 +1,10 @@
+CREATE UNLOGGED TABLE lockouts (
+    scope TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, subject)
+);
+-- For cleanup queries
+CREATE INDEX idx_lockouts_updated_at ON lockouts (updated_at);
@@ -0,0 +1,8 @@
+-- Access tokens issued before revoked_at are rejected.
+-- No foreign key, revocations must outlive deleted users.
+CREATE TABLE token_revocations (
+    user_id BIGINT PRIMARY KEY,
+    revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- For cache reload and cleanup queries
+CREATE INDEX idx_token_revocations_revoked_at ON token_revocations (revoked_at);
@@ -0,0 +1,16 @@
+ALTER TABLE users
+    ADD COLUMN name VARCHAR(255),
+    ADD COLUMN phone VARCHAR(32),
+    ADD COLUMN deleted_at TIMESTAMP; -- set when the account is anonymized
+
+-- Pending self-service email changes, one per user
+CREATE UNLOGGED TABLE email_change_codes (
+    user_id BIGINT PRIMARY KEY,
+    new_email VARCHAR(255) NOT NULL,
+    code CHAR(6) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+-- For cleanup queries
+CREATE INDEX idx_email_change_codes_expires ON email_change_codes (expires_at);
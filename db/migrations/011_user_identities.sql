@@ -0,0 +1,22 @@
+-- External identities (OpenID Connect) linked to users
+CREATE TABLE user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL, -- sub claim, unique per provider
+    user_id BIGINT NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_user_identities_user_id ON user_identities (user_id);
+
+-- In-flight authorization requests
+CREATE UNLOGGED TABLE oidc_auth_states (
+    state TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+-- For cleanup queries
+CREATE INDEX idx_oidc_auth_states_expires ON oidc_auth_states (expires_at);
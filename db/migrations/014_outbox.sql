@@ -0,0 +1,21 @@
+-- Domain events are written in the same transaction as the state change they describe,
+-- then dispatched to handlers (notifications, webhooks) by the schedule service.
+CREATE TABLE outbox_events (
+    id BIGSERIAL PRIMARY KEY, -- insertion order, events of an aggregate are handled in this order
+    aggregate_type TEXT NOT NULL,
+    aggregate_id BIGINT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT DEFAULT 'pending' NOT NULL CHECK (status IN ('pending', 'processed', 'failed')),
+    attempts INTEGER DEFAULT 0 NOT NULL,
+    handled TEXT[] DEFAULT '{}' NOT NULL, -- handlers which have completed
+    last_error TEXT,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    processed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- For the dispatcher
+CREATE INDEX idx_outbox_events_pending ON outbox_events (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_outbox_events_aggregate ON outbox_events (aggregate_type, aggregate_id, id) WHERE status = 'pending';
+-- For cleanup queries
+CREATE INDEX idx_outbox_events_created_at ON outbox_events (created_at);
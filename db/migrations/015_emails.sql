@@ -0,0 +1,25 @@
+-- Outgoing emails, sent by a worker with retries
+CREATE TABLE emails (
+    id BIGINT PRIMARY KEY,
+    recipients TEXT[] NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    is_html BOOLEAN DEFAULT FALSE NOT NULL,
+    template TEXT,
+    status TEXT DEFAULT 'queued' NOT NULL CHECK (status IN ('queued', 'sent', 'failed', 'throttled')),
+    attempts INTEGER DEFAULT 0 NOT NULL,
+    response TEXT, -- SMTP reply to the last attempt
+    error TEXT,
+    next_attempt_at TIMESTAMP,
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- For the send worker
+CREATE INDEX idx_emails_queued ON emails (next_attempt_at) WHERE status = 'queued';
+-- For the recipient throttle and admin search
+CREATE INDEX idx_emails_recipients ON emails USING GIN (recipients);
+-- For cleanup queries
+CREATE INDEX idx_emails_created_at ON emails (created_at);
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'emails:admin');
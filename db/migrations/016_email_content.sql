@@ -0,0 +1,6 @@
+-- Plain-text alternatives, headers and attachments of outgoing emails
+ALTER TABLE emails
+    ADD COLUMN text_body TEXT,
+    ADD COLUMN reply_to TEXT,
+    ADD COLUMN list_unsubscribe TEXT,
+    ADD COLUMN attachments JSONB DEFAULT '[]' NOT NULL;
@@ -0,0 +1,13 @@
+-- Shipment tracking, set when an order is shipped
+ALTER TABLE orders
+    ADD COLUMN tracking_carrier TEXT,
+    ADD COLUMN tracking_number TEXT,
+    ADD COLUMN tracking_url TEXT;
+
+-- Categories of non-essential email a user has opted out of
+CREATE TABLE email_opt_outs (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, category)
+);
@@ -0,0 +1,14 @@
+-- Channels a user has enabled or disabled for each notification event.
+-- Events and channels without a row use the defaults in types.DefaultNotificationChannels.
+CREATE TABLE notification_preferences (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    channel TEXT NOT NULL CHECK (channel IN ('inbox', 'email', 'webhook')),
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, event, channel)
+);
+
+-- Webhooks owned by a user receive that user's notifications, instead of subscribed events
+ALTER TABLE webhooks ADD COLUMN user_id BIGINT REFERENCES users(id) ON DELETE CASCADE;
+CREATE UNIQUE INDEX idx_webhooks_user_id ON webhooks (user_id);
@@ -0,0 +1,15 @@
+-- Versions of templates edited by admins, per storefront language.
+-- The latest version of a template is rendered instead of its file in utilities/templates,
+-- unless its body is NULL, which reverts the template to the file.
+CREATE TABLE template_versions (
+    id BIGINT PRIMARY KEY,
+    name TEXT NOT NULL,
+    language TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    body TEXT,
+    created_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    UNIQUE (name, language, version)
+);
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'templates:write');
@@ -0,0 +1,13 @@
+-- Events streamed to users over SSE, kept for a day so reconnecting clients can catch up.
+-- New events are announced with NOTIFY on the stream_events channel, reaching every API instance.
+CREATE TABLE stream_events (
+    id BIGSERIAL PRIMARY KEY, -- insertion order, sent as the SSE event ID
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- For catching up after a reconnect
+CREATE INDEX idx_stream_events_user_id ON stream_events (user_id, id);
+-- For cleanup queries
+CREATE INDEX idx_stream_events_created_at ON stream_events (created_at);
@@ -0,0 +1,16 @@
+-- Support conversations are tickets customers may open and reply to.
+-- status, order_id, product_id and assignee_id are NULL for notifications.
+CREATE TYPE ticket_status_enum AS ENUM ('open', 'awaiting_customer', 'closed');
+
+ALTER TABLE conversations
+    ADD COLUMN status ticket_status_enum,
+    ADD COLUMN order_id BIGINT REFERENCES orders(id) ON DELETE SET NULL,
+    ADD COLUMN product_id BIGINT REFERENCES products(id) ON DELETE SET NULL,
+    ADD COLUMN assignee_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN staff_last_read_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL;
+
+-- support conversations so far were started by staff
+UPDATE conversations SET status = 'awaiting_customer' WHERE type = 'support';
+
+CREATE INDEX idx_conversations_tickets ON conversations(status, updated_at)
+WHERE type = 'support';
@@ -0,0 +1,14 @@
+-- Files attached to messages, stored on disk under ATTACHMENT_DIR/<conversation_id>/<id>
+CREATE TABLE attachments (
+    id BIGINT PRIMARY KEY,
+    message_id BIGINT NOT NULL,
+    conversation_id BIGINT NOT NULL,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_attachments_conversation_id ON attachments(conversation_id);
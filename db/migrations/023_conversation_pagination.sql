@@ -0,0 +1,9 @@
+-- Conversations and messages are paginated by cursor, ordered by time and then ID
+DROP INDEX idx_conversations_updated_at_is_deleted;
+CREATE INDEX idx_conversations_recipient_updated_at ON conversations(recipient_id, updated_at DESC, id DESC)
+WHERE is_deleted = false;
+
+DROP INDEX idx_messages_conversation_id;
+CREATE INDEX idx_messages_conversation_id ON messages(conversation_id, created_at DESC, id DESC);
+
+CREATE INDEX idx_attachments_message_id ON attachments(message_id);
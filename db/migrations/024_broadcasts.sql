@@ -0,0 +1,28 @@
+-- Announcements sent to a segment of users, fanned out by a worker in batches
+CREATE TABLE broadcasts (
+    id BIGINT PRIMARY KEY,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    segment TEXT NOT NULL CHECK (segment IN ('all', 'role', 'category', 'pending_offer')),
+    role user_role_enum,
+    category_id BIGINT REFERENCES categories(id) ON DELETE SET NULL,
+    email BOOLEAN DEFAULT FALSE NOT NULL,
+    status TEXT DEFAULT 'scheduled' NOT NULL CHECK (status IN ('scheduled', 'sending', 'completed', 'canceled')),
+    send_at TIMESTAMP NOT NULL,
+    recipient_count INTEGER DEFAULT 0 NOT NULL,
+    sent_count INTEGER DEFAULT 0 NOT NULL,
+    failed_count INTEGER DEFAULT 0 NOT NULL,
+    last_recipient_id BIGINT DEFAULT 0 NOT NULL, -- sending resumes after this user
+    claimed_until TIMESTAMP, -- lease of the instance sending the broadcast
+    created_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- For the send worker
+CREATE INDEX idx_broadcasts_due ON broadcasts (send_at) WHERE status IN ('scheduled', 'sending');
+-- For the pending offer segment
+CREATE INDEX idx_offers_pending_user_id ON offers (user_id) WHERE status = 'pending';
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'broadcasts:write');
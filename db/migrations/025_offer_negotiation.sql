@@ -0,0 +1,27 @@
+-- Counter-offers: the seller counters a pending offer, the buyer accepts or counters again.
+-- New values are committed with this migration, so they are not used below.
+ALTER TYPE offer_status_enum ADD VALUE 'countered'; -- awaiting the buyer's response to a counter-offer
+ALTER TYPE offer_status_enum ADD VALUE 'expired';
+
+-- Open offers (pending or countered) expire unless answered, NULL once closed
+ALTER TABLE offers ADD COLUMN expires_at TIMESTAMP;
+CREATE INDEX idx_offers_expires_at ON offers (expires_at) WHERE expires_at IS NOT NULL;
+
+-- Offers below the floor are rejected automatically, never shown to customers
+ALTER TABLE products ADD COLUMN offer_floor BIGINT CHECK (offer_floor >= 0);
+
+-- Every step of an offer's negotiation, oldest first
+CREATE TABLE offer_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    offer_id BIGINT NOT NULL REFERENCES offers(id) ON DELETE CASCADE,
+    author_id BIGINT REFERENCES users(id) ON DELETE SET NULL, -- NULL for the system, e.g. expiry
+    amount BIGINT NOT NULL,
+    status offer_status_enum NOT NULL,
+    comment TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_offer_revisions_offer_id ON offer_revisions (offer_id, id);
+
+-- Offers made before revisions were recorded start their history with the offer itself
+INSERT INTO offer_revisions (offer_id, author_id, amount, status, comment, created_at)
+SELECT id, user_id, amount, status, comment, created_at FROM offers;
@@ -0,0 +1,4 @@
+-- Orders checking out an accepted offer, at the offer's amount.
+-- The offer holds its unit of inventory until paid or expired, so canceling its order does not restock.
+ALTER TABLE orders ADD COLUMN offer_id BIGINT REFERENCES offers(id) ON DELETE SET NULL;
+CREATE INDEX idx_orders_offer_id ON orders (offer_id) WHERE offer_id IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Rate limits counted per key (e.g. an API key) regardless of client IP.
+-- Hits are counted in fixed windows, expires_at marks the end of the current window.
+CREATE UNLOGGED TABLE key_rate_limits (
+    key TEXT PRIMARY KEY,
+    hit_count INTEGER NOT NULL DEFAULT 1,
+    expires_at TIMESTAMP NOT NULL
+);
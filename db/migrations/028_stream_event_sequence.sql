@@ -0,0 +1,24 @@
+-- Stream events are numbered per user, in commit order. BIGSERIAL IDs are assigned at insert,
+-- so an event could commit after one with a higher ID and be skipped by streams catching up.
+-- The user's row in stream_sequences stays locked until the event commits, serializing their events.
+CREATE TABLE stream_sequences (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL
+);
+
+ALTER TABLE stream_events ADD COLUMN seq BIGINT;
+UPDATE stream_events e
+SET seq = n.seq
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY id) AS seq
+    FROM stream_events
+) n
+WHERE n.id = e.id;
+ALTER TABLE stream_events ALTER COLUMN seq SET NOT NULL;
+
+INSERT INTO stream_sequences (user_id, seq)
+SELECT user_id, MAX(seq) FROM stream_events GROUP BY user_id;
+
+-- seq is sent as the SSE event ID, and used for catching up after a reconnect
+DROP INDEX idx_stream_events_user_id;
+CREATE UNIQUE INDEX idx_stream_events_user_id_seq ON stream_events (user_id, seq);
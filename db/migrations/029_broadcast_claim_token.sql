@@ -0,0 +1,3 @@
+-- Identifies the claim of the instance sending a broadcast. Progress is only recorded under the
+-- current claim, so an instance whose lease expired cannot overwrite the progress of the one resuming.
+ALTER TABLE broadcasts ADD COLUMN claim_token UUID;
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dgyurics/marketplace/services"
 	"github.com/dgyurics/marketplace/types"
@@ -13,28 +14,49 @@ import (
 
 type Authorizer interface {
 	RequireRole(role types.Role) func(next http.HandlerFunc) http.HandlerFunc
+	RequirePermission(perm types.Permission) func(next http.HandlerFunc) http.HandlerFunc
+	Permitted(ctx context.Context, perm types.Permission) bool
 }
 
+// apiKeyHourlyLimit caps the number of requests made with a single API key per hour
+const apiKeyHourlyLimit = 3600
+
+var errRateLimited = errors.New("rate limit exceeded")
+
 type authorizer struct {
-	jwtService services.JWTService
+	jwtService        services.JWTService
+	permissionService services.PermissionService
+	revocationService services.TokenRevocationService
+	apiKeyService     services.APIKeyService
+	rateLimit         RateLimit
 }
 
-func NewAccessControl(jwtService services.JWTService) *authorizer {
-	return &authorizer{jwtService}
+func NewAccessControl(
+	jwtService services.JWTService,
+	permissionService services.PermissionService,
+	revocationService services.TokenRevocationService,
+	apiKeyService services.APIKeyService,
+	rateLimit RateLimit) *authorizer {
+	return &authorizer{jwtService, permissionService, revocationService, apiKeyService, rateLimit}
 }
 
 // RequireRole authenticates a user.
 // Upon successful authentication, checks if the user has a role equal to or higher than the specified.
 // The role hierarchy is defined in types.Role, where higher roles have more privileges.
+// API keys are rejected, as their scopes are permissions and cannot be checked against a role.
 func (a *authorizer) RequireRole(role types.Role) func(next http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			user, err := a.authenticateToken(r)
+			if err == errRateLimited {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
 			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			if !user.HasMinimumRole(role) {
+			if user.APIKeyID != "" || !user.HasMinimumRole(role) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
@@ -44,15 +66,71 @@ func (a *authorizer) RequireRole(role types.Role) func(next http.HandlerFunc) ht
 	}
 }
 
+// RequirePermission authenticates a user.
+// Upon successful authentication, checks if the user's role has been granted the specified permission.
+func (a *authorizer) RequirePermission(perm types.Permission) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := a.authenticateToken(r)
+			if err == errRateLimited {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !a.hasPermission(r.Context(), &user, perm) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(r.Context(), services.UserKey, &user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Permitted checks if the authenticated user stored in the context has the specified permission.
+// Useful for handlers where the required permission depends on the request payload.
+func (a *authorizer) Permitted(ctx context.Context, perm types.Permission) bool {
+	user, ok := ctx.Value(services.UserKey).(*types.User)
+	if !ok || user == nil {
+		return false
+	}
+	return a.hasPermission(ctx, user, perm)
+}
+
+// hasPermission checks the user's role grants the permission,
+// and that it is within the scopes of the API key used, if any.
+func (a *authorizer) hasPermission(ctx context.Context, user *types.User, perm types.Permission) bool {
+	if !a.permissionService.HasPermission(ctx, user.Role, perm) {
+		return false
+	}
+	if user.Scopes == nil {
+		return true
+	}
+	for _, scope := range user.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
 // authenticateToken checks the Authorization header for a token,
-// and validates it using the authService. If the token is valid,
-// the user is returned. If the token is invalid, an error is returned.
+// and validates it using the authService. If the token is valid and
+// has not been revoked, the user is returned. Otherwise an error is returned.
+// API keys are accepted using the "ApiKey" scheme.
 func (a *authorizer) authenticateToken(r *http.Request) (types.User, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return types.User{}, errors.New("authorization header missing")
 	}
 
+	if key, ok := strings.CutPrefix(authHeader, "ApiKey "); ok {
+		return a.authenticateAPIKey(r, key)
+	}
+
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	if tokenString == authHeader {
 		return types.User{}, errors.New("invalid token format")
@@ -62,5 +140,20 @@ func (a *authorizer) authenticateToken(r *http.Request) (types.User, error) {
 	if err != nil {
 		return types.User{}, fmt.Errorf("invalid or expired token: %w", err)
 	}
+	if a.revocationService.IsRevoked(r.Context(), user.ID, user.IssuedAt) {
+		return types.User{}, errors.New("token revoked")
+	}
+	return *user, nil
+}
+
+// authenticateAPIKey resolves an API key to its user, and records its use with the rate limiter
+func (a *authorizer) authenticateAPIKey(r *http.Request, key string) (types.User, error) {
+	user, err := a.apiKeyService.Authenticate(r.Context(), key)
+	if err != nil {
+		return types.User{}, fmt.Errorf("invalid or expired api key: %w", err)
+	}
+	if !a.rateLimit.RecordKeyHit(r, "api_key:"+user.APIKeyID, apiKeyHourlyLimit, time.Hour) {
+		return types.User{}, errRateLimited
+	}
 	return *user, nil
 }
@@ -1,10 +1,12 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/dgyurics/marketplace/services"
 	"github.com/dgyurics/marketplace/types"
@@ -28,13 +30,77 @@ func (m *MockJWTService) ParseToken(token string) (*types.User, error) {
 	return nil, errors.New("invalid token")
 }
 
+func (m *MockJWTService) JWKS() (*types.JWKS, error) {
+	return nil, errors.New("not implemented")
+}
+
+// MockPermissionService simulates PermissionService behavior for testing
+type MockPermissionService struct {
+	Grants map[types.Role][]types.Permission
+}
+
+func (m *MockPermissionService) HasPermission(ctx context.Context, role types.Role, perm types.Permission) bool {
+	for _, p := range m.Grants[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockPermissionService) GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *MockPermissionService) UpdateRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error {
+	return errors.New("not implemented")
+}
+
+// MockRevocationService simulates TokenRevocationService behavior for testing
+type MockRevocationService struct {
+	RevokedBefore map[string]time.Time
+}
+
+func (m *MockRevocationService) RevokeTokens(ctx context.Context, userID string) error {
+	return errors.New("not implemented")
+}
+
+func (m *MockRevocationService) IsRevoked(ctx context.Context, userID string, issuedAt time.Time) bool {
+	revokedAt, ok := m.RevokedBefore[userID]
+	return ok && issuedAt.Before(revokedAt)
+}
+
+// MockAPIKeyService simulates APIKeyService behavior for testing
+type MockAPIKeyService struct {
+	Keys map[string]*types.User
+}
+
+func (m *MockAPIKeyService) CreateKey(ctx context.Context, key *types.APIKey) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (m *MockAPIKeyService) GetKeys(ctx context.Context) ([]types.APIKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *MockAPIKeyService) RevokeKey(ctx context.Context, keyID string) error {
+	return errors.New("not implemented")
+}
+
+func (m *MockAPIKeyService) Authenticate(ctx context.Context, key string) (*types.User, error) {
+	if user, ok := m.Keys[key]; ok {
+		return user, nil
+	}
+	return nil, types.ErrNotFound
+}
+
 func TestAuthenticateUser_ValidToken(t *testing.T) {
 	mockJWTService := &MockJWTService{
 		ParseTokenFunc: func(token string) (*types.User, error) {
 			return &types.User{ID: "123", Email: utilities.StringPtr("test@example.com")}, nil
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with a valid token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -64,7 +130,7 @@ func TestAuthenticateUser_InvalidToken(t *testing.T) {
 			return nil, errors.New("invalid token")
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with an invalid token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -90,7 +156,7 @@ func TestAuthenticateAdmin_ValidAdminToken(t *testing.T) {
 			return &types.User{ID: "123", Email: utilities.StringPtr("admin@example.com"), Role: "admin"}, nil
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with a valid admin token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -121,7 +187,7 @@ func TestAuthenticateAdmin_NonAdminToken(t *testing.T) {
 			return &types.User{ID: "456", Email: utilities.StringPtr("user@example.com"), Role: "user"}, nil
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with a non-admin token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -147,7 +213,7 @@ func TestAuthenticateAdmin_InvalidToken(t *testing.T) {
 			return nil, errors.New("invalid token")
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with an invalid token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -173,7 +239,7 @@ func TestAuthenticateUser_GuestUser(t *testing.T) {
 			return &types.User{ID: "789", Role: "guest"}, nil
 		},
 	}
-	auth := NewAccessControl(mockJWTService)
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
 
 	// Create a test request with a guest token
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -197,3 +263,244 @@ func TestAuthenticateUser_GuestUser(t *testing.T) {
 	// Verify the response status code
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
+
+func TestRequirePermission_Granted(t *testing.T) {
+	mockJWTService := &MockJWTService{
+		ParseTokenFunc: func(token string) (*types.User, error) {
+			return &types.User{ID: "123", Role: types.RoleStaff}, nil
+		},
+	}
+	mockPermissionService := &MockPermissionService{
+		Grants: map[types.Role][]types.Permission{
+			types.RoleStaff: {types.PermOrdersRead, types.PermOrdersFulfill},
+		},
+	}
+	auth := NewAccessControl(mockJWTService, mockPermissionService, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer staff-token")
+	rr := httptest.NewRecorder()
+
+	// Mock next handler to verify user context
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(services.UserKey).(*types.User)
+		assert.True(t, ok, "expected user to be stored in context")
+		assert.Equal(t, "123", user.ID)
+		assert.True(t, auth.Permitted(r.Context(), types.PermOrdersRead), "expected orders:read to be permitted")
+		assert.False(t, auth.Permitted(r.Context(), types.PermUsersRead), "expected users:read to be denied")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := auth.RequirePermission(types.PermOrdersFulfill)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestRequirePermission_Denied(t *testing.T) {
+	mockJWTService := &MockJWTService{
+		ParseTokenFunc: func(token string) (*types.User, error) {
+			return &types.User{ID: "123", Role: types.RoleStaff}, nil
+		},
+	}
+	mockPermissionService := &MockPermissionService{
+		Grants: map[types.Role][]types.Permission{
+			types.RoleStaff: {types.PermOrdersFulfill},
+			types.RoleAdmin: {types.PermUsersAdmin},
+		},
+	}
+	auth := NewAccessControl(mockJWTService, mockPermissionService, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer staff-token")
+	rr := httptest.NewRecorder()
+
+	// Mock next handler to ensure it is not called
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called without permission")
+	})
+
+	handler := auth.RequirePermission(types.PermUsersAdmin)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestRequirePermission_InvalidToken(t *testing.T) {
+	mockJWTService := &MockJWTService{
+		ParseTokenFunc: func(token string) (*types.User, error) {
+			return nil, errors.New("invalid token")
+		},
+	}
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, &MockRevocationService{}, &MockAPIKeyService{}, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer invalid-token")
+	rr := httptest.NewRecorder()
+
+	// Mock next handler to ensure it is not called
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called for invalid token")
+	})
+
+	handler := auth.RequirePermission(types.PermOrdersRead)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRequireRole_RevokedToken(t *testing.T) {
+	issuedAt := time.Now().Add(-time.Minute)
+	mockJWTService := &MockJWTService{
+		ParseTokenFunc: func(token string) (*types.User, error) {
+			return &types.User{ID: "123", Role: types.RoleAdmin, IssuedAt: issuedAt}, nil
+		},
+	}
+	revocations := &MockRevocationService{RevokedBefore: map[string]time.Time{"123": time.Now()}}
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, revocations, &MockAPIKeyService{}, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer revoked-token")
+	rr := httptest.NewRecorder()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called for revoked token")
+	})
+
+	handler := auth.RequireRole(types.RoleUser)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRequireRole_TokenIssuedAfterRevocation(t *testing.T) {
+	mockJWTService := &MockJWTService{
+		ParseTokenFunc: func(token string) (*types.User, error) {
+			return &types.User{ID: "123", Role: types.RoleUser, IssuedAt: time.Now()}, nil
+		},
+	}
+	revocations := &MockRevocationService{RevokedBefore: map[string]time.Time{"123": time.Now().Add(-time.Minute)}}
+	auth := NewAccessControl(mockJWTService, &MockPermissionService{}, revocations, &MockAPIKeyService{}, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer new-token")
+	rr := httptest.NewRecorder()
+
+	called := false
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	handler := auth.RequireRole(types.RoleUser)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.True(t, called, "next handler should be called for token issued after revocation")
+}
+
+func TestRequirePermission_APIKey(t *testing.T) {
+	apiKeys := &MockAPIKeyService{Keys: map[string]*types.User{
+		"mk_valid": {ID: "123", Role: types.RoleStaff, APIKeyID: "1"},
+	}}
+	mockPermissionService := &MockPermissionService{
+		Grants: map[types.Role][]types.Permission{
+			types.RoleStaff: {types.PermOrdersRead},
+		},
+	}
+	auth := NewAccessControl(&MockJWTService{}, mockPermissionService, &MockRevocationService{}, apiKeys, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "ApiKey mk_valid")
+	rr := httptest.NewRecorder()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(services.UserKey).(*types.User)
+		assert.True(t, ok, "expected user to be stored in context")
+		assert.Equal(t, "123", user.ID)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := auth.RequirePermission(types.PermOrdersRead)(nextHandler)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// unknown keys are rejected
+	req.Header.Set("Authorization", "ApiKey mk_unknown")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRequirePermission_APIKeyOutOfScope(t *testing.T) {
+	apiKeys := &MockAPIKeyService{Keys: map[string]*types.User{
+		"mk_scoped": {ID: "123", Role: types.RoleAdmin, APIKeyID: "1", Scopes: []types.Permission{types.PermProductsWrite}},
+	}}
+	mockPermissionService := &MockPermissionService{
+		Grants: map[types.Role][]types.Permission{
+			types.RoleAdmin: {types.PermProductsWrite, types.PermUsersAdmin},
+		},
+	}
+	auth := NewAccessControl(&MockJWTService{}, mockPermissionService, &MockRevocationService{}, apiKeys, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	req.Header.Set("Authorization", "ApiKey mk_scoped")
+	rr := httptest.NewRecorder()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called for permission outside of key scope")
+	})
+
+	handler := auth.RequirePermission(types.PermUsersAdmin)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestRequireRole_APIKeyRateLimited(t *testing.T) {
+	apiKeys := &MockAPIKeyService{Keys: map[string]*types.User{
+		"mk_busy": {ID: "123", Role: types.RoleStaff, APIKeyID: "7"},
+	}}
+	var recorded *types.RateLimit
+	rateLimit := NewRateLimit(&MockRateLimitService{
+		RecordKeyHitFunc: func(ctx context.Context, rl *types.RateLimit) error {
+			recorded = rl
+			rl.HitCount = apiKeyHourlyLimit + 1
+			return nil
+		},
+	}, true)
+	auth := NewAccessControl(&MockJWTService{}, &MockPermissionService{}, &MockRevocationService{}, apiKeys, rateLimit)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "ApiKey mk_busy")
+	rr := httptest.NewRecorder()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called when key exceeds its limit")
+	})
+
+	handler := auth.RequireRole(types.RoleStaff)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "api_key:7", recorded.Path, "expected hit to be recorded against the key")
+	assert.Empty(t, recorded.IPAddress, "expected hits to be counted regardless of client IP")
+}
+
+func TestRequireRole_APIKeyRejected(t *testing.T) {
+	apiKeys := &MockAPIKeyService{Keys: map[string]*types.User{
+		"mk_scoped": {ID: "123", Role: types.RoleAdmin, APIKeyID: "1", Scopes: []types.Permission{types.PermProductsWrite}},
+	}}
+	auth := NewAccessControl(&MockJWTService{}, &MockPermissionService{}, &MockRevocationService{}, apiKeys, &noopRateLimit{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "ApiKey mk_scoped")
+	rr := httptest.NewRecorder()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be called for role restricted routes with an API key")
+	})
+
+	handler := auth.RequireRole(types.RoleStaff)(nextHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/gorilla/mux"
+)
+
+// SnapshotFunc loads the current state of the entity targeted by a request.
+// It is called before and after the mutation to compute the audit diff.
+type SnapshotFunc func(ctx context.Context, entityID string) (interface{}, error)
+
+type Audit interface {
+	Record(action, entityType string, snapshot SnapshotFunc, maxBytes int64) func(next http.HandlerFunc) http.HandlerFunc
+}
+
+type audit struct {
+	service services.AuditService
+}
+
+func NewAudit(service services.AuditService) Audit {
+	return &audit{service}
+}
+
+// Record writes an audit entry after the wrapped handler completes successfully.
+// Must be applied after authentication, so the actor is available in the context.
+//
+// The entity ID is taken from the {id} path variable, falling back to the "id"
+// field of the request or response payload. When snapshot is nil, the response
+// payload (or request payload when the response has none) is recorded as the after state.
+// Request bodies larger than maxBytes are rejected before being buffered.
+func (a *audit) Record(action, entityType string, snapshot SnapshotFunc, maxBytes int64) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(services.UserKey).(*types.User)
+			if !ok || user == nil {
+				next(w, r)
+				return
+			}
+
+			// buffer request payload so it can be read by both handler and audit
+			reqBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+			entityID := mux.Vars(r)["id"]
+			if entityID == "" {
+				entityID = payloadID(reqBody)
+			}
+
+			var before []byte
+			if snapshot != nil && entityID != "" {
+				before = loadSnapshot(r.Context(), snapshot, entityID)
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(rec, r)
+			if rec.status < 200 || rec.status >= 300 {
+				return
+			}
+
+			if entityID == "" {
+				entityID = payloadID(rec.body.Bytes())
+			}
+
+			var after []byte
+			switch {
+			case r.Method == http.MethodDelete:
+			case snapshot != nil && entityID != "":
+				after = loadSnapshot(r.Context(), snapshot, entityID)
+			case isJSONObject(rec.body.Bytes()):
+				after = rec.body.Bytes()
+			default:
+				after = reqBody
+			}
+
+			entry := &types.AuditEntry{
+				ActorID:    user.ID,
+				ActorRole:  user.Role,
+				Action:     action,
+				EntityType: entityType,
+				EntityID:   entityID,
+				IPAddress:  GetClientIP(r),
+				RequestID:  GetRequestID(r.Context()),
+			}
+			ctx := context.WithoutCancel(r.Context())
+			if err := a.service.Record(ctx, entry, before, after); err != nil {
+				slog.ErrorContext(ctx, "Error recording audit entry", "action", action, "entity_id", entityID, "error", err)
+			}
+		})
+	}
+}
+
+func loadSnapshot(ctx context.Context, snapshot SnapshotFunc, entityID string) []byte {
+	v, err := snapshot(ctx, entityID)
+	if err != nil {
+		if err != types.ErrNotFound {
+			slog.ErrorContext(ctx, "Error loading audit snapshot", "entity_id", entityID, "error", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// payloadID extracts the "id" field from a JSON object
+func payloadID(data []byte) string {
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return ""
+	}
+	return payload.ID
+}
+
+func isJSONObject(data []byte) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(data, &obj) == nil
+}
+
+// responseRecorder captures the status code and body written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockAuditService captures recorded audit entries
+type MockAuditService struct {
+	Entries []types.AuditEntry
+	Before  [][]byte
+	After   [][]byte
+}
+
+func (m *MockAuditService) Record(ctx context.Context, entry *types.AuditEntry, before, after []byte) error {
+	m.Entries = append(m.Entries, *entry)
+	m.Before = append(m.Before, before)
+	m.After = append(m.After, after)
+	return nil
+}
+
+func (m *MockAuditService) GetEntries(ctx context.Context, filter types.AuditFilter) ([]types.AuditEntry, error) {
+	return nil, errors.New("not implemented")
+}
+
+func withUser(r *http.Request, user *types.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), services.UserKey, user))
+}
+
+func TestAuditRecord_UpdateWithSnapshot(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	svc := &MockAuditService{}
+	audit := NewAudit(svc)
+
+	// snapshot reflects the state of the entity when called
+	state := map[string]interface{}{"id": "42", "price": 1000}
+	snapshot := func(ctx context.Context, id string) (interface{}, error) {
+		assert.Equal(t, "42", id)
+		copied := map[string]interface{}{}
+		for k, v := range state {
+			copied[k] = v
+		}
+		return copied, nil
+	}
+
+	handler := audit.Record("product.update", "product", snapshot, 1<<20)(func(w http.ResponseWriter, r *http.Request) {
+		state["price"] = 1200
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/products", bytes.NewBufferString(`{"id":"42","price":1200}`))
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req = withUser(req, &types.User{ID: "7", Role: types.RoleAdmin})
+	rr := httptest.NewRecorder()
+	RequestID(handler).ServeHTTP(rr, req)
+
+	assert.Len(t, svc.Entries, 1)
+	entry := svc.Entries[0]
+	assert.Equal(t, "7", entry.ActorID)
+	assert.Equal(t, types.RoleAdmin, entry.ActorRole)
+	assert.Equal(t, "product.update", entry.Action)
+	assert.Equal(t, "42", entry.EntityID)
+	assert.Equal(t, "10.0.0.1", entry.IPAddress)
+	assert.Equal(t, rr.Header().Get(RequestIDHeader), entry.RequestID)
+	assert.NotEmpty(t, entry.RequestID)
+	assert.JSONEq(t, `{"id":"42","price":1000}`, string(svc.Before[0]))
+	assert.JSONEq(t, `{"id":"42","price":1200}`, string(svc.After[0]))
+}
+
+func TestAuditRecord_DeleteUsesPathID(t *testing.T) {
+	svc := &MockAuditService{}
+	audit := NewAudit(svc)
+
+	handler := audit.Record("user.remove", "user", nil, 1<<20)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}", handler).Methods(http.MethodDelete)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/99", nil)
+	req = withUser(req, &types.User{ID: "7", Role: types.RoleAdmin})
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Len(t, svc.Entries, 1)
+	assert.Equal(t, "99", svc.Entries[0].EntityID)
+	assert.Nil(t, svc.After[0])
+}
+
+func TestAuditRecord_SkipsFailedRequests(t *testing.T) {
+	svc := &MockAuditService{}
+	audit := NewAudit(svc)
+
+	handler := audit.Record("order.update", "order", nil, 1<<20)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/orders", bytes.NewBufferString(`{"id":"1"}`))
+	req = withUser(req, &types.User{ID: "7", Role: types.RoleAdmin})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Empty(t, svc.Entries)
+}
+
+func TestAuditRecord_RejectsOversizedBody(t *testing.T) {
+	svc := &MockAuditService{}
+	audit := NewAudit(svc)
+
+	called := false
+	handler := audit.Record("product.update", "product", nil, 8)(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/products", bytes.NewBufferString(`{"id":"1","name":"too long"}`))
+	req = withUser(req, &types.User{ID: "7", Role: types.RoleAdmin})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.False(t, called)
+	assert.Empty(t, svc.Entries)
+}
+
+func TestRequestID_ReusesValidHeader(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "abc-123", GetRequestID(r.Context()))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, "abc-123", rr.Header().Get(RequestIDHeader))
+}
@@ -14,6 +14,7 @@ type RateLimit interface {
 	Limit(next http.HandlerFunc, limit int) http.HandlerFunc
 	LimitAndRecordHit(next http.HandlerFunc, limit int, expiry time.Duration) http.HandlerFunc
 	RecordHit(r *http.Request, expiry time.Duration)
+	RecordKeyHit(r *http.Request, key string, limit int, expiry time.Duration) bool
 }
 
 type rateLimit struct {
@@ -31,7 +32,7 @@ func NewRateLimit(service services.RateLimitService, enabled bool) RateLimit {
 func (m *rateLimit) Limit(next http.HandlerFunc, limit int) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rl := &types.RateLimit{
-			IPAddress: getClientIP(r),
+			IPAddress: GetClientIP(r),
 			Path:      r.URL.Path,
 		}
 		if err := m.service.GetHitCount(r.Context(), rl); err != nil {
@@ -52,7 +53,7 @@ func (m *rateLimit) Limit(next http.HandlerFunc, limit int) http.HandlerFunc {
 func (m *rateLimit) LimitAndRecordHit(next http.HandlerFunc, limit int, expiry time.Duration) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rl := &types.RateLimit{
-			IPAddress: getClientIP(r),
+			IPAddress: GetClientIP(r),
 			Path:      r.URL.Path,
 			Limit:     limit,
 			ExpiresAt: time.Now().UTC().Add(expiry),
@@ -77,7 +78,7 @@ func (m *rateLimit) LimitAndRecordHit(next http.HandlerFunc, limit int, expiry t
 // RecordHit logs a hit for the given request and expiry duration.
 func (m *rateLimit) RecordHit(r *http.Request, expiry time.Duration) {
 	rl := &types.RateLimit{
-		IPAddress: getClientIP(r),
+		IPAddress: GetClientIP(r),
 		Path:      r.URL.Path,
 		ExpiresAt: time.Now().UTC().Add(expiry),
 	}
@@ -86,8 +87,23 @@ func (m *rateLimit) RecordHit(r *http.Request, expiry time.Duration) {
 	}
 }
 
-// getClientIP extracts the client's IP address from the request.
-func getClientIP(r *http.Request) string {
+// RecordKeyHit records a hit against key, rather than the client IP and request path,
+// and reports whether the hit is within the limit. Hits are counted in fixed windows of expiry.
+func (m *rateLimit) RecordKeyHit(r *http.Request, key string, limit int, expiry time.Duration) bool {
+	rl := &types.RateLimit{
+		Path:      key,
+		Limit:     limit,
+		ExpiresAt: time.Now().UTC().Add(expiry),
+	}
+	if err := m.service.RecordKeyHit(r.Context(), rl); err != nil {
+		slog.Error("Error recording hit", "error", err)
+		return true
+	}
+	return rl.HitCount <= limit
+}
+
+// GetClientIP extracts the client's IP address from the request.
+func GetClientIP(r *http.Request) string {
 	// Check for X-Forwarded-For header first (common with proxies/load balancers)
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		ips := strings.Split(xff, ",")
@@ -124,3 +140,7 @@ func (m *noopRateLimit) LimitAndRecordHit(next http.HandlerFunc, limit int, expi
 func (m *noopRateLimit) RecordHit(r *http.Request, expiry time.Duration) {
 	// Do nothing
 }
+
+func (m *noopRateLimit) RecordKeyHit(r *http.Request, key string, limit int, expiry time.Duration) bool {
+	return true
+}
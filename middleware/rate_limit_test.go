@@ -14,8 +14,9 @@ import (
 
 // MockRateLimitService simulates RateLimitService behavior for testing
 type MockRateLimitService struct {
-	GetHitCountFunc func(ctx context.Context, rl *types.RateLimit) error
-	RecordHitFunc   func(ctx context.Context, rl *types.RateLimit) error
+	GetHitCountFunc  func(ctx context.Context, rl *types.RateLimit) error
+	RecordHitFunc    func(ctx context.Context, rl *types.RateLimit) error
+	RecordKeyHitFunc func(ctx context.Context, rl *types.RateLimit) error
 }
 
 func (m *MockRateLimitService) GetHitCount(ctx context.Context, rl *types.RateLimit) error {
@@ -32,6 +33,13 @@ func (m *MockRateLimitService) RecordHit(ctx context.Context, rl *types.RateLimi
 	return nil
 }
 
+func (m *MockRateLimitService) RecordKeyHit(ctx context.Context, rl *types.RateLimit) error {
+	if m.RecordKeyHitFunc != nil {
+		return m.RecordKeyHitFunc(ctx, rl)
+	}
+	return nil
+}
+
 func (m *MockRateLimitService) PurgeExpiredEntries(ctx context.Context) error {
 	return nil
 }
@@ -195,7 +203,7 @@ func TestGetClientIP_XForwardedFor(t *testing.T) {
 	req.Header.Set("X-Forwarded-For", "203.0.113.1, 192.168.1.1")
 	req.RemoteAddr = "127.0.0.1:12345"
 
-	ip := getClientIP(req)
+	ip := GetClientIP(req)
 	assert.Equal(t, "203.0.113.1", ip)
 }
 
@@ -203,6 +211,6 @@ func TestGetClientIP_RemoteAddr(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	req.RemoteAddr = "192.168.1.200:8080"
 
-	ip := getClientIP(req)
+	ip := GetClientIP(req)
 	assert.Equal(t, "192.168.1.200", ip)
 }
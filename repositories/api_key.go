@@ -0,0 +1,157 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
+)
+
+type APIKeyRepository interface {
+	CreateKey(ctx context.Context, key *types.APIKey) error
+	GetKeys(ctx context.Context, userID string) ([]types.APIKey, error)
+	RevokeKey(ctx context.Context, userID, keyID string) error
+	UseKey(ctx context.Context, keyHash string) (*types.APIKey, *types.User, error)
+}
+
+type apiKeyRepository struct {
+	db *sql.DB
+}
+
+func NewAPIKeyRepository(db *sql.DB) APIKeyRepository {
+	return &apiKeyRepository{db: db}
+}
+
+func (r *apiKeyRepository) CreateKey(ctx context.Context, key *types.APIKey) error {
+	query := `
+		INSERT INTO api_keys (id, user_id, name, prefix, key_hash, role, permissions, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created_at
+	`
+	permissions := make([]string, len(key.Permissions))
+	for i, perm := range key.Permissions {
+		permissions[i] = string(perm)
+	}
+	return r.db.QueryRowContext(ctx, query,
+		key.ID,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		key.Role,
+		pq.Array(permissions),
+		key.ExpiresAt,
+	).Scan(&key.CreatedAt)
+}
+
+// GetKeys returns the keys created by the user, newest first
+func (r *apiKeyRepository) GetKeys(ctx context.Context, userID string) ([]types.APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, role, permissions, expires_at,
+			last_used_at, revoked, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []types.APIKey{}
+	for rows.Next() {
+		var key types.APIKey
+		var permissions []string
+		if err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&key.Role,
+			pq.Array(&permissions),
+			&key.ExpiresAt,
+			&key.LastUsedAt,
+			&key.Revoked,
+			&key.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		key.Permissions = toPermissions(permissions)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r *apiKeyRepository) RevokeKey(ctx context.Context, userID, keyID string) error {
+	query := `
+		UPDATE api_keys
+		SET revoked = TRUE, updated_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND NOT revoked
+	`
+	res, err := r.db.ExecContext(ctx, query, keyID, userID)
+	if err != nil {
+		return err
+	}
+	// lib/pq always returns nil error for RowsAffected()
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+// UseKey looks up an active key by hash, records its use, and returns it along with its owner
+func (r *apiKeyRepository) UseKey(ctx context.Context, keyHash string) (*types.APIKey, *types.User, error) {
+	query := `
+		UPDATE api_keys k
+		SET last_used_at = NOW()
+		FROM users u
+		WHERE k.user_id = u.id
+			AND k.key_hash = $1
+			AND NOT k.revoked
+			AND k.expires_at > NOW()
+			AND u.deleted_at IS NULL
+		RETURNING
+			k.id, k.user_id, k.name, k.prefix, k.role, k.permissions,
+			k.expires_at, k.last_used_at, k.created_at,
+			u.id, u.email, u.role
+	`
+	var key types.APIKey
+	var user types.User
+	var permissions []string
+	err := r.db.QueryRowContext(ctx, query, keyHash).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Role,
+		pq.Array(&permissions),
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.CreatedAt,
+		&user.ID,
+		&user.Email,
+		&user.Role,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key.Permissions = toPermissions(permissions)
+	return &key, &user, nil
+}
+
+func toPermissions(values []string) []types.Permission {
+	if len(values) == 0 {
+		return nil
+	}
+	perms := make([]types.Permission, len(values))
+	for i, v := range values {
+		perms[i] = types.Permission(v)
+	}
+	return perms
+}
@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseKey(t *testing.T) {
+	repo := NewAPIKeyRepository(dbPool)
+	ctx := context.Background()
+	user := createUniqueTestUser(t, NewUserRepository(dbPool))
+
+	key := &types.APIKey{
+		ID:          utilities.MustGenerateIDString(),
+		UserID:      user.ID,
+		Name:        "sync",
+		Prefix:      "mk_test",
+		KeyHash:     "hash-" + utilities.MustGenerateIDString(),
+		Role:        types.RoleUser,
+		Permissions: []types.Permission{types.PermOrdersRead},
+		ExpiresAt:   time.Now().UTC().Add(time.Hour),
+	}
+	err := repo.CreateKey(ctx, key)
+	assert.NoError(t, err, "Expected no error creating key")
+
+	used, owner, err := repo.UseKey(ctx, key.KeyHash)
+	assert.NoError(t, err, "Expected no error using key")
+	assert.Equal(t, key.ID, used.ID)
+	assert.Equal(t, user.ID, owner.ID)
+	assert.Equal(t, key.Permissions, used.Permissions)
+	assert.NotNil(t, used.LastUsedAt, "Expected last used to be recorded")
+
+	err = repo.RevokeKey(ctx, user.ID, key.ID)
+	assert.NoError(t, err, "Expected no error revoking key")
+
+	_, _, err = repo.UseKey(ctx, key.KeyHash)
+	assert.Equal(t, types.ErrNotFound, err, "Expected revoked key to be rejected")
+
+	keys, err := repo.GetKeys(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error listing keys")
+	assert.Len(t, keys, 1)
+	assert.True(t, keys[0].Revoked, "Expected key to be listed as revoked")
+}
+
+func TestUseKey_Expired(t *testing.T) {
+	repo := NewAPIKeyRepository(dbPool)
+	ctx := context.Background()
+	user := createUniqueTestUser(t, NewUserRepository(dbPool))
+
+	key := &types.APIKey{
+		ID:        utilities.MustGenerateIDString(),
+		UserID:    user.ID,
+		Name:      "expired",
+		Prefix:    "mk_test",
+		KeyHash:   "hash-" + utilities.MustGenerateIDString(),
+		Role:      types.RoleUser,
+		ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	}
+	err := repo.CreateKey(ctx, key)
+	assert.NoError(t, err, "Expected no error creating key")
+
+	_, _, err = repo.UseKey(ctx, key.KeyHash)
+	assert.Equal(t, types.ErrNotFound, err, "Expected expired key to be rejected")
+}
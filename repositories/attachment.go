@@ -0,0 +1,65 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type AttachmentRepository interface {
+	GetAttachment(ctx context.Context, conversationID, id string) (types.Attachment, error)
+	GetAttachmentByUser(ctx context.Context, conversationID, id, userID string) (types.Attachment, error)
+}
+
+type attachmentRepository struct {
+	db *sql.DB
+}
+
+func NewAttachmentRepository(db *sql.DB) AttachmentRepository {
+	return &attachmentRepository{db: db}
+}
+
+const attachmentColumns = `id, conversation_id, message_id, filename, content_type, size, created_at`
+
+func scanAttachment(row rowScanner, attachment *types.Attachment) error {
+	return row.Scan(
+		&attachment.ID,
+		&attachment.ConversationID,
+		&attachment.MessageID,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.CreatedAt,
+	)
+}
+
+func (r *attachmentRepository) GetAttachment(ctx context.Context, conversationID, id string) (types.Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + `
+		FROM attachments
+		WHERE id = $1 AND conversation_id = $2
+	`
+	var attachment types.Attachment
+	err := scanAttachment(r.db.QueryRowContext(ctx, query, id, conversationID), &attachment)
+	if err == sql.ErrNoRows {
+		return attachment, types.ErrNotFound
+	}
+	return attachment, err
+}
+
+// GetAttachmentByUser returns an attachment of a conversation the user is the recipient of
+func (r *attachmentRepository) GetAttachmentByUser(ctx context.Context, conversationID, id, userID string) (types.Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + `
+		FROM attachments
+		WHERE id = $1 AND conversation_id = $2
+			AND EXISTS (SELECT 1 FROM conversations WHERE id = $2 AND recipient_id = $3)
+	`
+	var attachment types.Attachment
+	err := scanAttachment(r.db.QueryRowContext(ctx, query, id, conversationID, userID), &attachment)
+	if err == sql.ErrNoRows {
+		return attachment, types.ErrNotFound
+	}
+	return attachment, err
+}
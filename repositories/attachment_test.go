@@ -0,0 +1,61 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAttachment(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	conversationRepo := NewConversationRepository(dbPool)
+	repo := NewAttachmentRepository(dbPool)
+	ctx := context.Background()
+
+	customer := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, customer.ID)
+	other := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, other.ID)
+
+	ticket := types.Conversation{
+		ID:          utilities.MustGenerateIDString(),
+		Subject:     "Damaged lamp",
+		RecipientID: customer.ID,
+	}
+	message := types.Message{
+		ID:             utilities.MustGenerateIDString(),
+		ConversationID: ticket.ID,
+		SenderID:       customer.ID,
+		Body:           "It arrived broken",
+		Attachments: []types.Attachment{{
+			ID:          utilities.MustGenerateIDString(),
+			Filename:    "lamp.jpg",
+			ContentType: "image/jpeg",
+			Size:        2048,
+		}},
+	}
+	err := conversationRepo.CreateTicket(ctx, &ticket, &message)
+	assert.NoError(t, err, "Expected no error opening ticket with attachment")
+	attachmentID := message.Attachments[0].ID
+	assert.Equal(t, message.ID, message.Attachments[0].MessageID)
+
+	convo, err := conversationRepo.GetConversationByID(ctx, ticket.ID, nil, 50)
+	assert.NoError(t, err, "Expected no error fetching ticket")
+	assert.Len(t, convo.Messages, 1)
+	assert.Len(t, convo.Messages[0].Attachments, 1)
+	assert.Equal(t, "lamp.jpg", convo.Messages[0].Attachments[0].Filename)
+
+	attachment, err := repo.GetAttachmentByUser(ctx, ticket.ID, attachmentID, customer.ID)
+	assert.NoError(t, err, "Expected participant to get attachment")
+	assert.Equal(t, "image/jpeg", attachment.ContentType)
+	assert.Equal(t, int64(2048), attachment.Size)
+
+	_, err = repo.GetAttachmentByUser(ctx, ticket.ID, attachmentID, other.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected other users not to get attachment")
+
+	_, err = repo.GetAttachment(ctx, ticket.ID, attachmentID)
+	assert.NoError(t, err, "Expected staff to get attachment")
+}
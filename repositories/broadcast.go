@@ -0,0 +1,290 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type BroadcastRepository interface {
+	CreateBroadcast(ctx context.Context, broadcast *types.Broadcast) error
+	GetBroadcast(ctx context.Context, id string) (types.Broadcast, error)
+	GetBroadcasts(ctx context.Context, page, limit int) ([]types.Broadcast, error)
+	CancelBroadcast(ctx context.Context, id string) (types.Broadcast, error)
+	ClaimBroadcast(ctx context.Context, lease time.Duration) (types.Broadcast, error)
+	CountRecipients(ctx context.Context, broadcast types.Broadcast) (int, error)
+	GetRecipients(ctx context.Context, broadcast types.Broadcast, limit int) ([]string, error)
+	RenewClaim(ctx context.Context, broadcast types.Broadcast, lease time.Duration) error
+	UpdateProgress(ctx context.Context, broadcast *types.Broadcast, lease time.Duration) error
+}
+
+type broadcastRepository struct {
+	db *sql.DB
+}
+
+func NewBroadcastRepository(db *sql.DB) BroadcastRepository {
+	return &broadcastRepository{db: db}
+}
+
+const broadcastColumns = `
+	id, subject, body, segment, COALESCE(role::TEXT, ''), COALESCE(category_id::TEXT, ''), email, status,
+	send_at, recipient_count, sent_count, failed_count, last_recipient_id, COALESCE(created_by::TEXT, ''),
+	started_at, completed_at, created_at, updated_at`
+
+// scanBroadcast scans the broadcast columns, followed by any extra columns
+func scanBroadcast(row rowScanner, broadcast *types.Broadcast, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{
+		&broadcast.ID,
+		&broadcast.Subject,
+		&broadcast.Body,
+		&broadcast.Segment,
+		&broadcast.Role,
+		&broadcast.CategoryID,
+		&broadcast.Email,
+		&broadcast.Status,
+		&broadcast.SendAt,
+		&broadcast.RecipientCount,
+		&broadcast.SentCount,
+		&broadcast.FailedCount,
+		&broadcast.LastRecipientID,
+		&broadcast.CreatedBy,
+		&broadcast.StartedAt,
+		&broadcast.CompletedAt,
+		&broadcast.CreatedAt,
+		&broadcast.UpdatedAt,
+	}, extra...)...)
+}
+
+// CreateBroadcast schedules a broadcast, returning ErrInvalidInput for an unknown category
+func (r *broadcastRepository) CreateBroadcast(ctx context.Context, broadcast *types.Broadcast) error {
+	query := `
+		INSERT INTO broadcasts (id, subject, body, segment, role, category_id, email, send_at, created_by)
+		SELECT $1, $2, $3, $4, NULLIF($5, '')::user_role_enum, NULLIF($6, '')::BIGINT, $7, $8, $9
+		WHERE $6 = '' OR EXISTS (SELECT 1 FROM categories WHERE id = NULLIF($6, '')::BIGINT)
+		RETURNING ` + broadcastColumns + `
+	`
+	err := scanBroadcast(r.db.QueryRowContext(ctx, query,
+		broadcast.ID,
+		broadcast.Subject,
+		broadcast.Body,
+		broadcast.Segment,
+		broadcast.Role,
+		broadcast.CategoryID,
+		broadcast.Email,
+		broadcast.SendAt,
+		broadcast.CreatedBy,
+	), broadcast)
+	if err == sql.ErrNoRows {
+		return types.ErrInvalidInput
+	}
+	return err
+}
+
+func (r *broadcastRepository) GetBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	query := `SELECT ` + broadcastColumns + ` FROM broadcasts WHERE id = $1`
+	var broadcast types.Broadcast
+	err := scanBroadcast(r.db.QueryRowContext(ctx, query, id), &broadcast)
+	if err == sql.ErrNoRows {
+		return broadcast, types.ErrNotFound
+	}
+	return broadcast, err
+}
+
+// GetBroadcasts returns broadcasts newest first
+func (r *broadcastRepository) GetBroadcasts(ctx context.Context, page, limit int) ([]types.Broadcast, error) {
+	query := `
+		SELECT ` + broadcastColumns + `
+		FROM broadcasts
+		ORDER BY id DESC
+		LIMIT $1 OFFSET $2
+	`
+	rows, err := r.db.QueryContext(ctx, query, limit, (page-1)*limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	broadcasts := []types.Broadcast{}
+	for rows.Next() {
+		var broadcast types.Broadcast
+		if err := scanBroadcast(rows, &broadcast); err != nil {
+			return nil, err
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	return broadcasts, rows.Err()
+}
+
+// CancelBroadcast stops a scheduled or sending broadcast.
+// Returns ErrInvalidInput for completed and canceled broadcasts.
+func (r *broadcastRepository) CancelBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	query := `
+		UPDATE broadcasts
+		SET status = 'canceled', claimed_until = NULL, claim_token = NULL, completed_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status IN ('scheduled', 'sending')
+		RETURNING ` + broadcastColumns + `
+	`
+	var broadcast types.Broadcast
+	err := scanBroadcast(r.db.QueryRowContext(ctx, query, id), &broadcast)
+	if err == sql.ErrNoRows {
+		if _, err := r.GetBroadcast(ctx, id); err != nil {
+			return broadcast, err
+		}
+		return broadcast, types.ErrInvalidInput
+	}
+	return broadcast, err
+}
+
+// ClaimBroadcast returns a broadcast which is due, marking it sending. The claim is held for lease,
+// so other instances skip the broadcast while it is being sent, and resume it should this instance fail.
+// The broadcast's ClaimToken identifies the claim, required to renew it and record progress.
+// Returns ErrNotFound when none is due.
+func (r *broadcastRepository) ClaimBroadcast(ctx context.Context, lease time.Duration) (types.Broadcast, error) {
+	query := `
+		WITH due AS (
+			SELECT id AS due_id
+			FROM broadcasts
+			WHERE status IN ('scheduled', 'sending') AND send_at <= NOW()
+				AND (claimed_until IS NULL OR claimed_until < NOW())
+			ORDER BY send_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE broadcasts b
+		SET status = 'sending',
+			claimed_until = NOW() + make_interval(secs => $1),
+			claim_token = gen_random_uuid(),
+			started_at = COALESCE(started_at, NOW()),
+			updated_at = NOW()
+		FROM due
+		WHERE b.id = due.due_id
+		RETURNING ` + broadcastColumns + `, claim_token::TEXT
+	`
+	var broadcast types.Broadcast
+	err := scanBroadcast(r.db.QueryRowContext(ctx, query, lease.Seconds()), &broadcast, &broadcast.ClaimToken)
+	if err == sql.ErrNoRows {
+		return broadcast, types.ErrNotFound
+	}
+	return broadcast, err
+}
+
+// segmentQuery selects the users of a broadcast's segment after a user ID, with the parameters
+// $1 after user ID, $2 segment, $3 role and $4 category ID. Deleted accounts are never included.
+const segmentQuery = `
+	WITH RECURSIVE category_tree AS (
+		SELECT id FROM categories WHERE id = NULLIF($4, '')::BIGINT
+		UNION ALL
+		SELECT c.id FROM categories c
+		JOIN category_tree ct ON c.parent_id = ct.id
+	)
+	SELECT u.id
+	FROM users u
+	WHERE u.id > $1 AND u.deleted_at IS NULL AND u.role != 'system'
+		AND CASE $2
+			WHEN 'all' THEN u.role != 'guest'
+			WHEN 'role' THEN u.role::TEXT = $3
+			WHEN 'category' THEN EXISTS (
+				SELECT 1
+				FROM orders o
+				JOIN order_items oi ON oi.order_id = o.id
+				JOIN products p ON p.id = oi.product_id
+				JOIN category_tree ct ON ct.id = p.category_id
+				WHERE o.user_id = u.id AND o.status IN ('paid', 'shipped', 'delivered')
+			)
+			WHEN 'pending_offer' THEN EXISTS (
+				SELECT 1 FROM offers WHERE user_id = u.id AND status = 'pending'
+			)
+			ELSE FALSE
+		END
+`
+
+// CountRecipients counts the users currently in the broadcast's segment
+func (r *broadcastRepository) CountRecipients(ctx context.Context, broadcast types.Broadcast) (int, error) {
+	query := `SELECT COUNT(*) FROM (` + segmentQuery + `) recipients`
+	var count int
+	err := r.db.QueryRowContext(ctx, query,
+		"0",
+		broadcast.Segment,
+		broadcast.Role,
+		broadcast.CategoryID,
+	).Scan(&count)
+	return count, err
+}
+
+// GetRecipients returns the IDs of the next users in the broadcast's segment, after its last recipient
+func (r *broadcastRepository) GetRecipients(ctx context.Context, broadcast types.Broadcast, limit int) ([]string, error) {
+	query := segmentQuery + ` ORDER BY u.id LIMIT $5`
+	rows, err := r.db.QueryContext(ctx, query,
+		broadcast.LastRecipientID,
+		broadcast.Segment,
+		broadcast.Role,
+		broadcast.CategoryID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RenewClaim extends the claim of a broadcast being sent by lease.
+// Returns ErrNotFound once the broadcast is no longer sending under its claim, e.g. when canceled.
+func (r *broadcastRepository) RenewClaim(ctx context.Context, broadcast types.Broadcast, lease time.Duration) error {
+	query := `
+		UPDATE broadcasts
+		SET claimed_until = NOW() + make_interval(secs => $3)
+		WHERE id = $1 AND status = 'sending' AND claim_token::TEXT = $2
+	`
+	res, err := r.db.ExecContext(ctx, query, broadcast.ID, broadcast.ClaimToken, lease.Seconds())
+	if err != nil {
+		return err
+	}
+	// lib/pq always returns nil error for RowsAffected()
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+// UpdateProgress records the progress of a broadcast being sent, extending its claim by lease.
+// Returns ErrNotFound once the broadcast is no longer sending under its claim, e.g. when canceled
+// or resumed by another instance after the lease expired.
+func (r *broadcastRepository) UpdateProgress(ctx context.Context, broadcast *types.Broadcast, lease time.Duration) error {
+	query := `
+		UPDATE broadcasts
+		SET status = $2, recipient_count = $3, sent_count = $4, failed_count = $5, last_recipient_id = $6,
+			completed_at = CASE WHEN $2 = 'completed' THEN NOW() END,
+			claimed_until = CASE WHEN $2 = 'completed' THEN NULL ELSE NOW() + make_interval(secs => $7) END,
+			claim_token = CASE WHEN $2 = 'completed' THEN NULL ELSE claim_token END,
+			updated_at = NOW()
+		WHERE id = $1 AND status = 'sending' AND claim_token::TEXT = $8
+		RETURNING completed_at, updated_at
+	`
+	err := r.db.QueryRowContext(ctx, query,
+		broadcast.ID,
+		broadcast.Status,
+		broadcast.RecipientCount,
+		broadcast.SentCount,
+		broadcast.FailedCount,
+		broadcast.LastRecipientID,
+		lease.Seconds(),
+		broadcast.ClaimToken,
+	).Scan(&broadcast.CompletedAt, &broadcast.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcast(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewBroadcastRepository(dbPool)
+	ctx := context.Background()
+
+	admin := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, admin.ID)
+	member := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, member.ID)
+	_, err := userRepo.UpdateRole(ctx, member.ID, types.RoleMember)
+	assert.NoError(t, err, "Expected no error updating role")
+
+	// categories must exist
+	broadcast := types.Broadcast{
+		ID:         utilities.MustGenerateIDString(),
+		Subject:    "Spring sale",
+		Body:       "New arrivals",
+		Segment:    types.SegmentCategory,
+		CategoryID: utilities.MustGenerateIDString(),
+		SendAt:     time.Now().UTC().Add(time.Hour),
+		CreatedBy:  admin.ID,
+	}
+	assert.Equal(t, types.ErrInvalidInput, repo.CreateBroadcast(ctx, &broadcast), "Expected error for an unknown category")
+
+	broadcast.Segment = types.SegmentRole
+	broadcast.Role = types.RoleMember
+	broadcast.CategoryID = ""
+	assert.NoError(t, repo.CreateBroadcast(ctx, &broadcast), "Expected no error creating broadcast")
+	defer dbPool.ExecContext(ctx, "DELETE FROM broadcasts WHERE id = $1", broadcast.ID)
+	assert.Equal(t, types.BroadcastScheduled, broadcast.Status)
+	assert.Equal(t, "0", broadcast.LastRecipientID)
+
+	// recipients are the segment's users, in ID order
+	recipients, err := repo.GetRecipients(ctx, broadcast, 1000)
+	assert.NoError(t, err, "Expected no error fetching recipients")
+	assert.Contains(t, recipients, member.ID)
+	assert.NotContains(t, recipients, admin.ID)
+	count, err := repo.CountRecipients(ctx, broadcast)
+	assert.NoError(t, err, "Expected no error counting recipients")
+	assert.GreaterOrEqual(t, count, 1)
+
+	broadcast.LastRecipientID = member.ID
+	recipients, err = repo.GetRecipients(ctx, broadcast, 1000)
+	assert.NoError(t, err, "Expected no error fetching recipients")
+	assert.NotContains(t, recipients, member.ID, "Expected recipients after the last recipient only")
+
+	// progress is only recorded under the current claim
+	err = dbPool.QueryRowContext(ctx, `
+		UPDATE broadcasts SET status = 'sending', claim_token = gen_random_uuid()
+		WHERE id = $1 RETURNING claim_token::TEXT
+	`, broadcast.ID).Scan(&broadcast.ClaimToken)
+	assert.NoError(t, err, "Expected no error claiming broadcast")
+	broadcast.Status = types.BroadcastSending
+	stale := broadcast
+	stale.ClaimToken = "00000000-0000-0000-0000-000000000000"
+	assert.Equal(t, types.ErrNotFound, repo.RenewClaim(ctx, stale, time.Minute), "Expected a stale claim not to be renewed")
+	assert.Equal(t, types.ErrNotFound, repo.UpdateProgress(ctx, &stale, time.Minute), "Expected no progress under a stale claim")
+	assert.NoError(t, repo.RenewClaim(ctx, broadcast, time.Minute), "Expected no error renewing claim")
+	assert.NoError(t, repo.UpdateProgress(ctx, &broadcast, time.Minute), "Expected no error recording progress")
+
+	// canceled broadcasts stop sending
+	canceled, err := repo.CancelBroadcast(ctx, broadcast.ID)
+	assert.NoError(t, err, "Expected no error canceling broadcast")
+	assert.Equal(t, types.BroadcastCanceled, canceled.Status)
+	_, err = repo.CancelBroadcast(ctx, broadcast.ID)
+	assert.Equal(t, types.ErrInvalidInput, err, "Expected error canceling a canceled broadcast")
+	broadcast.Status = types.BroadcastSending
+	assert.Equal(t, types.ErrNotFound, repo.UpdateProgress(ctx, &broadcast, time.Minute))
+}
@@ -3,18 +3,27 @@ package repositories
 import (
 	"context"
 	"database/sql"
-	"time"
 
 	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
 )
 
 type ConversationRepository interface {
 	CreateConversation(ctx context.Context, conversation *types.Conversation) error
 	CreateMessage(ctx context.Context, message *types.Message) error
-	GetConversationByID(ctx context.Context, ID string) (types.Conversation, error)
-	GetConversationByIDAndUser(ctx context.Context, ID string, userID string) (types.Conversation, error)
-	GetConversations(ctx context.Context, userID string) ([]types.Conversation, error)
+	GetConversationByID(ctx context.Context, ID string, before *types.Cursor, limit int) (types.Conversation, error)
+	GetConversationByIDAndUser(ctx context.Context, ID string, userID string, before *types.Cursor, limit int) (types.Conversation, error)
+	GetConversations(ctx context.Context, userID string, before *types.Cursor, limit int) ([]types.Conversation, error)
 	RemoveConversation(ctx context.Context, id, userID string) error
+	ArchiveConversations(ctx context.Context, ids []string, userID string) error
+	MarkRead(ctx context.Context, ids []string, userID string) error
+	CountUnread(ctx context.Context, userID string) (int, error)
+	CreateTicket(ctx context.Context, conversation *types.Conversation, message *types.Message) error
+	CreateReply(ctx context.Context, message *types.Message) error
+	GetTickets(ctx context.Context, filter types.TicketFilter) ([]types.Conversation, error)
+	UpdateTicketStatus(ctx context.Context, id string, status types.TicketStatus) error
+	AssignTicket(ctx context.Context, id, assigneeID string) error
+	MarkReadByStaff(ctx context.Context, id string) error
 }
 
 type conversationRepository struct {
@@ -27,14 +36,15 @@ func NewConversationRepository(db *sql.DB) ConversationRepository {
 
 func (r *conversationRepository) CreateConversation(ctx context.Context, conversation *types.Conversation) error {
 	query := `
-		INSERT INTO conversations (id, type, subject, recipient_id)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO conversations (id, type, subject, recipient_id, status)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::ticket_status_enum)
 	`
 	_, err := r.db.ExecContext(ctx, query,
 		conversation.ID,
 		conversation.Type,
 		conversation.Subject,
 		conversation.RecipientID,
+		conversation.Status,
 	)
 	return err
 }
@@ -46,8 +56,55 @@ func (r *conversationRepository) CreateMessage(ctx context.Context, message *typ
 	}
 	defer tx.Rollback()
 
-	var createdAt time.Time
+	if err := insertMessage(ctx, tx, message, false); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateReply adds a message of the recipient to their support conversation,
+// returning ErrNotFound for conversations of others and notifications
+func (r *conversationRepository) CreateReply(ctx context.Context, message *types.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertMessage(ctx, tx, message, true); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMessage adds the message with its attachments and updates its conversation.
+// The message is read by the side which sent it, recipient or staff, and a ticket
+// awaits the other side. Archived conversations return to the recipient's inbox.
+// With reply, the sender must be the recipient of a support conversation.
+func insertMessage(ctx context.Context, tx *sql.Tx, message *types.Message, reply bool) error {
 	query := `
+		UPDATE conversations
+		SET updated_at = NOW(),
+			is_deleted = FALSE,
+			recipient_last_read_at = CASE WHEN recipient_id = $2 THEN NOW() ELSE recipient_last_read_at END,
+			staff_last_read_at = CASE WHEN recipient_id = $2 THEN staff_last_read_at ELSE NOW() END,
+			status = CASE
+				WHEN type != 'support' THEN status
+				WHEN recipient_id = $2 THEN 'open'
+				ELSE 'awaiting_customer'
+			END
+		WHERE id = $1 AND (NOT $3 OR (recipient_id = $2 AND type = 'support'))
+		RETURNING recipient_id
+	`
+	err := tx.QueryRowContext(ctx, query, message.ConversationID, message.SenderID, reply).Scan(&message.RecipientID)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	query = `
 		INSERT INTO messages (id, sender_id, conversation_id, body)
 		VALUES ($1, $2, $3, $4)
 		RETURNING created_at
@@ -56,36 +113,113 @@ func (r *conversationRepository) CreateMessage(ctx context.Context, message *typ
 		message.ID,
 		message.SenderID,
 		message.ConversationID,
-		message.Body).Scan(&createdAt)
+		message.Body).Scan(&message.CreatedAt)
 	if err != nil {
 		return err
 	}
 
 	query = `
-		UPDATE conversations
-		SET updated_at = $1
-		WHERE id = $2
+		INSERT INTO attachments (id, message_id, conversation_id, filename, content_type, size)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at
 	`
-	_, err = tx.ExecContext(ctx, query, createdAt, message.ConversationID)
+	for i := range message.Attachments {
+		attachment := &message.Attachments[i]
+		attachment.MessageID = message.ID
+		attachment.ConversationID = message.ConversationID
+		err = tx.QueryRowContext(ctx, query,
+			attachment.ID,
+			attachment.MessageID,
+			attachment.ConversationID,
+			attachment.Filename,
+			attachment.ContentType,
+			attachment.Size,
+		).Scan(&attachment.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateTicket opens a support conversation of the recipient with their first message.
+// Returns ErrInvalidInput when the order is not theirs or the product does not exist.
+func (r *conversationRepository) CreateTicket(ctx context.Context, conversation *types.Conversation, message *types.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return tx.Commit()
+	query := `
+		INSERT INTO conversations (id, type, subject, recipient_id, status, order_id, product_id)
+		SELECT $1, 'support', $2, $3, 'open', NULLIF($4, '')::BIGINT, NULLIF($5, '')::BIGINT
+		WHERE ($4 = '' OR EXISTS (SELECT 1 FROM orders WHERE id = NULLIF($4, '')::BIGINT AND user_id = $3))
+			AND ($5 = '' OR EXISTS (SELECT 1 FROM products WHERE id = NULLIF($5, '')::BIGINT))
+		RETURNING ` + conversationColumns + `
+	`
+	err = scanConversation(tx.QueryRowContext(ctx, query,
+		conversation.ID,
+		conversation.Subject,
+		conversation.RecipientID,
+		conversation.OrderID,
+		conversation.ProductID,
+	), conversation)
+	if err == sql.ErrNoRows {
+		return types.ErrInvalidInput
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := insertMessage(ctx, tx, message, true); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	conversation.Status = types.TicketOpen
+	conversation.UpdatedAt = message.CreatedAt
+	conversation.RecipientLastReadAt = message.CreatedAt
+	conversation.StaffUnread = true
+	conversation.Messages = []types.Message{*message}
+	return nil
 }
 
-func (r *conversationRepository) GetConversationByID(ctx context.Context, conversationID string) (types.Conversation, error) {
+const conversationColumns = `
+	id, type, subject, recipient_id, recipient_last_read_at, COALESCE(status::TEXT, ''),
+	COALESCE(order_id::TEXT, ''), COALESCE(product_id::TEXT, ''), COALESCE(assignee_id::TEXT, ''),
+	updated_at > staff_last_read_at, updated_at, created_at
+`
+
+// scanConversation scans the conversation columns, followed by any extra columns
+func scanConversation(row rowScanner, convo *types.Conversation, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{
+		&convo.ID,
+		&convo.Type,
+		&convo.Subject,
+		&convo.RecipientID,
+		&convo.RecipientLastReadAt,
+		&convo.Status,
+		&convo.OrderID,
+		&convo.ProductID,
+		&convo.AssigneeID,
+		&convo.StaffUnread,
+		&convo.UpdatedAt,
+		&convo.CreatedAt,
+	}, extra...)...)
+}
+
+func (r *conversationRepository) GetConversationByID(ctx context.Context, conversationID string, before *types.Cursor, limit int) (types.Conversation, error) {
 	var convo types.Conversation
 
 	// Get conversation details
 	query := `
-		SELECT id, type, subject, recipient_id, recipient_last_read_at, updated_at, created_at
+		SELECT ` + conversationColumns + `
 		FROM conversations
 		WHERE id = $1
 	`
-	err := r.db.QueryRowContext(ctx, query, conversationID).Scan(
-		&convo.ID, &convo.Type, &convo.Subject,
-		&convo.RecipientID, &convo.RecipientLastReadAt, &convo.UpdatedAt, &convo.CreatedAt)
+	err := scanConversation(r.db.QueryRowContext(ctx, query, conversationID), &convo)
 	if err == sql.ErrNoRows {
 		return convo, types.ErrNotFound
 	}
@@ -93,43 +227,31 @@ func (r *conversationRepository) GetConversationByID(ctx context.Context, conver
 		return convo, err
 	}
 
-	// Get messages for conversation
-	query = `
-		SELECT id, sender_id, conversation_id, body, created_at
-		FROM messages
-		WHERE conversation_id = $1
-		ORDER BY created_at ASC
-	`
-	rows, err := r.db.QueryContext(ctx, query, conversationID)
-	if err != nil {
-		return convo, err
-	}
-	defer rows.Close()
-
-	convo.Messages = []types.Message{}
-	for rows.Next() {
-		var msg types.Message
-		if err = rows.Scan(&msg.ID, &msg.SenderID, &msg.ConversationID, &msg.Body, &msg.CreatedAt); err != nil {
-			return convo, err
-		}
-		convo.Messages = append(convo.Messages, msg)
-	}
-
-	return convo, nil
+	convo.Messages, err = r.getMessages(ctx, conversationID, before, limit)
+	return convo, err
 }
 
-func (r *conversationRepository) GetConversationByIDAndUser(ctx context.Context, conversationID string, userID string) (types.Conversation, error) {
+func (r *conversationRepository) GetConversationByIDAndUser(ctx context.Context, conversationID string, userID string, before *types.Cursor, limit int) (types.Conversation, error) {
 	var convo types.Conversation
-	// Update recipient last read timestamp + return conversation details
+	// Update recipient last read timestamp + return conversation details,
+	// with the number of messages unread until now
 	query := `
-		UPDATE conversations
+		UPDATE conversations c
 		SET recipient_last_read_at = NOW()
-		WHERE id = $1 AND recipient_id = $2
-		RETURNING id, type, subject, recipient_id, recipient_last_read_at, updated_at, created_at
+		FROM (
+			SELECT id AS prev_id, recipient_last_read_at AS prev_read_at
+			FROM conversations
+			WHERE id = $1 AND recipient_id = $2 AND is_deleted = FALSE
+			FOR UPDATE
+		) prev
+		WHERE c.id = prev.prev_id
+		RETURNING ` + conversationColumns + `, (
+			SELECT COUNT(*)
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.created_at > prev.prev_read_at
+		)
 	`
-	err := r.db.QueryRowContext(ctx, query, conversationID, userID).Scan(
-		&convo.ID, &convo.Type, &convo.Subject,
-		&convo.RecipientID, &convo.RecipientLastReadAt, &convo.UpdatedAt, &convo.CreatedAt)
+	err := scanConversation(r.db.QueryRowContext(ctx, query, conversationID, userID), &convo, &convo.UnreadCount)
 	if err == sql.ErrNoRows {
 		return convo, types.ErrNotFound
 	}
@@ -137,40 +259,98 @@ func (r *conversationRepository) GetConversationByIDAndUser(ctx context.Context,
 		return convo, err
 	}
 
-	// Get messages for conversation
-	query = `
+	convo.Messages, err = r.getMessages(ctx, conversationID, before, limit)
+	return convo, err
+}
+
+// cursorArgs returns the arguments for a cursor, which match every row when the cursor is nil
+func cursorArgs(cursor *types.Cursor) (interface{}, string) {
+	if cursor == nil {
+		return nil, "0"
+	}
+	return cursor.Time, cursor.ID
+}
+
+// getMessages returns the latest messages of a conversation before the cursor with their attachments,
+// oldest first
+func (r *conversationRepository) getMessages(ctx context.Context, conversationID string, before *types.Cursor, limit int) ([]types.Message, error) {
+	beforeTime, beforeID := cursorArgs(before)
+	query := `
 		SELECT id, sender_id, conversation_id, body, created_at
-		FROM messages
-		WHERE conversation_id = $1
-		ORDER BY created_at ASC
+		FROM (
+			SELECT id, sender_id, conversation_id, body, created_at
+			FROM messages
+			WHERE conversation_id = $1
+				AND ($2::TIMESTAMP IS NULL OR (created_at, id) < ($2, $3))
+			ORDER BY created_at DESC, id DESC
+			LIMIT $4
+		) latest
+		ORDER BY created_at ASC, id ASC
 	`
-	rows, err := r.db.QueryContext(ctx, query, conversationID)
+	rows, err := r.db.QueryContext(ctx, query, conversationID, beforeTime, beforeID, limit)
 	if err != nil {
-		return convo, err
+		return nil, err
 	}
 	defer rows.Close()
 
-	convo.Messages = []types.Message{}
+	messages := []types.Message{}
+	ids := []string{}
+	byID := map[string]int{}
 	for rows.Next() {
 		var msg types.Message
 		if err = rows.Scan(&msg.ID, &msg.SenderID, &msg.ConversationID, &msg.Body, &msg.CreatedAt); err != nil {
-			return convo, err
+			return nil, err
 		}
-		convo.Messages = append(convo.Messages, msg)
+		byID[msg.ID] = len(messages)
+		ids = append(ids, msg.ID)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return convo, nil
+	query = `
+		SELECT ` + attachmentColumns + `
+		FROM attachments
+		WHERE message_id = ANY($1)
+		ORDER BY id
+	`
+	rows, err = r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment types.Attachment
+		if err := scanAttachment(rows, &attachment); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[attachment.MessageID]; ok {
+			messages[i].Attachments = append(messages[i].Attachments, attachment)
+		}
+	}
+	return messages, rows.Err()
 }
 
-func (r *conversationRepository) GetConversations(ctx context.Context, userID string) ([]types.Conversation, error) {
+// GetConversations returns the user's conversations before the cursor, most recently updated first,
+// with their number of unread messages
+func (r *conversationRepository) GetConversations(ctx context.Context, userID string, before *types.Cursor, limit int) ([]types.Conversation, error) {
+	beforeTime, beforeID := cursorArgs(before)
 	conversations := []types.Conversation{}
 	query := `
-		SELECT id, type, subject, recipient_id, recipient_last_read_at, updated_at, created_at
-		FROM conversations
+		SELECT ` + conversationColumns + `, (
+			SELECT COUNT(*)
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.created_at > c.recipient_last_read_at
+		)
+		FROM conversations c
 		WHERE recipient_id = $1 AND is_deleted = FALSE
-		ORDER BY updated_at DESC
+			AND ($2::TIMESTAMP IS NULL OR (updated_at, id) < ($2, $3))
+		ORDER BY updated_at DESC, id DESC
+		LIMIT $4
 	`
-	rows, err := r.db.QueryContext(ctx, query, userID)
+	rows, err := r.db.QueryContext(ctx, query, userID, beforeTime, beforeID, limit)
 	if err != nil {
 		return conversations, err
 	}
@@ -178,25 +358,19 @@ func (r *conversationRepository) GetConversations(ctx context.Context, userID st
 
 	for rows.Next() {
 		var conversation types.Conversation
-		if err := rows.Scan(
-			&conversation.ID,
-			&conversation.Type,
-			&conversation.Subject,
-			&conversation.RecipientID,
-			&conversation.RecipientLastReadAt,
-			&conversation.UpdatedAt,
-			&conversation.CreatedAt,
-		); err != nil {
+		if err := scanConversation(rows, &conversation, &conversation.UnreadCount); err != nil {
 			return conversations, err
 		}
 		conversations = append(conversations, conversation)
 	}
 
-	return conversations, nil
+	return conversations, rows.Err()
 }
 
+// RemoveConversation removes a conversation from the user's inbox.
+// It's kept for staff, and returns to the inbox should a new message arrive.
 func (r *conversationRepository) RemoveConversation(ctx context.Context, id, userID string) error {
-	query := `DELETE FROM conversations WHERE id = $1 AND recipient_id = $2`
+	query := `UPDATE conversations SET is_deleted = TRUE WHERE id = $1 AND recipient_id = $2 AND is_deleted = FALSE`
 	res, err := r.db.ExecContext(ctx, query, id, userID)
 	if err != nil {
 		return err
@@ -208,3 +382,118 @@ func (r *conversationRepository) RemoveConversation(ctx context.Context, id, use
 	}
 	return nil
 }
+
+// ArchiveConversations removes the user's conversations with the given IDs from their inbox,
+// ignoring IDs of other conversations
+func (r *conversationRepository) ArchiveConversations(ctx context.Context, ids []string, userID string) error {
+	query := `UPDATE conversations SET is_deleted = TRUE WHERE id = ANY($1) AND recipient_id = $2`
+	_, err := r.db.ExecContext(ctx, query, pq.Array(ids), userID)
+	return err
+}
+
+// MarkRead marks the user's conversations with the given IDs read, ignoring IDs of other conversations
+func (r *conversationRepository) MarkRead(ctx context.Context, ids []string, userID string) error {
+	query := `UPDATE conversations SET recipient_last_read_at = NOW() WHERE id = ANY($1) AND recipient_id = $2`
+	_, err := r.db.ExecContext(ctx, query, pq.Array(ids), userID)
+	return err
+}
+
+// CountUnread returns the number of the user's conversations with messages they have not read
+func (r *conversationRepository) CountUnread(ctx context.Context, userID string) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM conversations
+		WHERE recipient_id = $1 AND is_deleted = FALSE AND updated_at > recipient_last_read_at
+	`
+	var count int
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// GetTickets returns the support conversations matching the filter, longest waiting first
+func (r *conversationRepository) GetTickets(ctx context.Context, filter types.TicketFilter) ([]types.Conversation, error) {
+	query := `
+		SELECT ` + conversationColumns + `
+		FROM conversations
+		WHERE type = 'support'
+			AND ($1 = '' OR status::TEXT = $1)
+			AND ($2 = '' OR ($2 = 'none' AND assignee_id IS NULL) OR assignee_id::TEXT = $2)
+			AND (NOT $3 OR updated_at > staff_last_read_at)
+		ORDER BY updated_at ASC
+		LIMIT $4 OFFSET $5
+	`
+	rows, err := r.db.QueryContext(ctx, query,
+		filter.Status,
+		filter.Assignee,
+		filter.Unread,
+		filter.Limit,
+		(filter.Page-1)*filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []types.Conversation{}
+	for rows.Next() {
+		var ticket types.Conversation
+		if err := scanConversation(rows, &ticket); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+func (r *conversationRepository) UpdateTicketStatus(ctx context.Context, id string, status types.TicketStatus) error {
+	query := `UPDATE conversations SET status = $2 WHERE id = $1 AND type = 'support'`
+	res, err := r.db.ExecContext(ctx, query, id, status)
+	if err != nil {
+		return err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+// AssignTicket assigns the ticket to a user whose role may write conversations,
+// or unassigns it when assigneeID is empty. Returns ErrInvalidInput for other users.
+func (r *conversationRepository) AssignTicket(ctx context.Context, id, assigneeID string) error {
+	if assigneeID != "" {
+		query := `
+			SELECT EXISTS (
+				SELECT 1
+				FROM users u
+				JOIN role_permissions rp ON rp.role = u.role
+				WHERE u.id = $1 AND rp.permission = $2
+			)
+		`
+		var staff bool
+		if err := r.db.QueryRowContext(ctx, query, assigneeID, types.PermConversationsWrite).Scan(&staff); err != nil {
+			return err
+		}
+		if !staff {
+			return types.ErrInvalidInput
+		}
+	}
+
+	query := `UPDATE conversations SET assignee_id = NULLIF($2, '')::BIGINT WHERE id = $1 AND type = 'support'`
+	res, err := r.db.ExecContext(ctx, query, id, assigneeID)
+	if err != nil {
+		return err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+// MarkReadByStaff marks the conversation's messages read by staff
+func (r *conversationRepository) MarkReadByStaff(ctx context.Context, id string) error {
+	query := `UPDATE conversations SET staff_last_read_at = NOW() WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id)
+	return err
+}
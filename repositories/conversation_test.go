@@ -0,0 +1,174 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupportTicket(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewConversationRepository(dbPool)
+	ctx := context.Background()
+
+	customer := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, customer.ID)
+	other := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, other.ID)
+	staff := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, staff.ID)
+	_, err := userRepo.UpdateRole(ctx, staff.ID, types.RoleStaff)
+	assert.NoError(t, err, "Expected no error updating role")
+
+	newMessage := func(conversationID, senderID, body string) *types.Message {
+		return &types.Message{
+			ID:             utilities.MustGenerateIDString(),
+			ConversationID: conversationID,
+			SenderID:       senderID,
+			Body:           body,
+		}
+	}
+
+	// tickets may only reference the customer's own orders
+	ticket := types.Conversation{
+		ID:          utilities.MustGenerateIDString(),
+		Subject:     "Damaged lamp",
+		RecipientID: customer.ID,
+		OrderID:     utilities.MustGenerateIDString(),
+	}
+	err = repo.CreateTicket(ctx, &ticket, newMessage(ticket.ID, customer.ID, "It arrived broken"))
+	assert.Equal(t, types.ErrInvalidInput, err, "Expected error for an unknown order")
+
+	ticket.OrderID = ""
+	err = repo.CreateTicket(ctx, &ticket, newMessage(ticket.ID, customer.ID, "It arrived broken"))
+	assert.NoError(t, err, "Expected no error opening ticket")
+	assert.Equal(t, types.TicketOpen, ticket.Status)
+	assert.True(t, ticket.StaffUnread, "Expected new ticket to be unread by staff")
+
+	// customers may only reply to their own tickets
+	err = repo.CreateReply(ctx, newMessage(ticket.ID, other.ID, "Not mine"))
+	assert.Equal(t, types.ErrNotFound, err, "Expected error replying to another customer's ticket")
+
+	// staff responses await the customer and are read by staff
+	err = repo.CreateMessage(ctx, newMessage(ticket.ID, staff.ID, "Sorry to hear, a replacement is on its way"))
+	assert.NoError(t, err, "Expected no error creating staff message")
+	convo, err := repo.GetConversationByID(ctx, ticket.ID, nil, 50)
+	assert.NoError(t, err, "Expected no error fetching ticket")
+	assert.Equal(t, types.TicketAwaitingCustomer, convo.Status)
+	assert.False(t, convo.StaffUnread)
+	assert.Len(t, convo.Messages, 2)
+
+	// customer replies reopen the ticket for staff
+	assert.NoError(t, repo.UpdateTicketStatus(ctx, ticket.ID, types.TicketClosed))
+	reply := newMessage(ticket.ID, customer.ID, "Thanks!")
+	assert.NoError(t, repo.CreateReply(ctx, reply), "Expected no error replying to own ticket")
+	assert.Equal(t, customer.ID, reply.RecipientID)
+	convo, err = repo.GetConversationByID(ctx, ticket.ID, nil, 50)
+	assert.NoError(t, err, "Expected no error fetching ticket")
+	assert.Equal(t, types.TicketOpen, convo.Status)
+	assert.True(t, convo.StaffUnread)
+
+	unreadCount, err := repo.CountUnread(ctx, customer.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, unreadCount, "Expected customer's own reply to be read")
+
+	// assignment is limited to staff
+	assert.Equal(t, types.ErrInvalidInput, repo.AssignTicket(ctx, ticket.ID, other.ID))
+	assert.NoError(t, repo.AssignTicket(ctx, ticket.ID, staff.ID))
+
+	tickets, err := repo.GetTickets(ctx, types.TicketFilter{Assignee: staff.ID, Unread: true, Page: 1, Limit: 10})
+	assert.NoError(t, err, "Expected no error fetching queue")
+	assert.Len(t, tickets, 1)
+	assert.Equal(t, ticket.ID, tickets[0].ID)
+
+	assert.NoError(t, repo.MarkReadByStaff(ctx, ticket.ID))
+	tickets, err = repo.GetTickets(ctx, types.TicketFilter{Assignee: staff.ID, Unread: true, Page: 1, Limit: 10})
+	assert.NoError(t, err, "Expected no error fetching queue")
+	assert.Empty(t, tickets, "Expected read tickets to be filtered out")
+}
+
+func TestConversationPagination(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewConversationRepository(dbPool)
+	ctx := context.Background()
+
+	customer := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, customer.ID)
+	staff := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, staff.ID)
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		convo := types.Conversation{
+			ID:          utilities.MustGenerateIDString(),
+			Type:        types.Notification,
+			Subject:     "Order update",
+			RecipientID: customer.ID,
+		}
+		assert.NoError(t, repo.CreateConversation(ctx, &convo), "Expected no error creating conversation")
+		for j := 0; j <= i; j++ {
+			err := repo.CreateMessage(ctx, &types.Message{
+				ID:             utilities.MustGenerateIDString(),
+				ConversationID: convo.ID,
+				SenderID:       staff.ID,
+				Body:           "Your order shipped",
+			})
+			assert.NoError(t, err, "Expected no error creating message")
+		}
+		ids = append(ids, convo.ID)
+	}
+
+	// most recently updated first, with unread counts
+	page, err := repo.GetConversations(ctx, customer.ID, nil, 2)
+	assert.NoError(t, err, "Expected no error fetching conversations")
+	assert.Len(t, page, 2)
+	assert.Equal(t, ids[2], page[0].ID)
+	assert.Equal(t, 3, page[0].UnreadCount)
+	assert.Equal(t, ids[1], page[1].ID)
+
+	last := page[1]
+	page, err = repo.GetConversations(ctx, customer.ID, &types.Cursor{Time: last.UpdatedAt, ID: last.ID}, 2)
+	assert.NoError(t, err, "Expected no error fetching next page")
+	assert.Len(t, page, 1)
+	assert.Equal(t, ids[0], page[0].ID)
+
+	// latest messages, oldest first
+	convo, err := repo.GetConversationByIDAndUser(ctx, ids[2], customer.ID, nil, 2)
+	assert.NoError(t, err, "Expected no error fetching conversation")
+	assert.Len(t, convo.Messages, 2)
+	assert.Equal(t, 3, convo.UnreadCount, "Expected messages unread until opened")
+	oldest := convo.Messages[0]
+	assert.True(t, !oldest.CreatedAt.After(convo.Messages[1].CreatedAt), "Expected messages oldest first")
+	convo, err = repo.GetConversationByIDAndUser(ctx, ids[2], customer.ID, &types.Cursor{Time: oldest.CreatedAt, ID: oldest.ID}, 2)
+	assert.NoError(t, err, "Expected no error fetching older messages")
+	assert.Len(t, convo.Messages, 1)
+	assert.Equal(t, 0, convo.UnreadCount, "Expected conversation to be read once opened")
+
+	assert.NoError(t, repo.MarkRead(ctx, ids, customer.ID))
+	unreadCount, err := repo.CountUnread(ctx, customer.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, unreadCount, "Expected conversations to be read")
+
+	// archived conversations leave the inbox until a new message arrives
+	assert.NoError(t, repo.ArchiveConversations(ctx, ids, customer.ID))
+	page, err = repo.GetConversations(ctx, customer.ID, nil, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, page, "Expected archived conversations to be hidden")
+	_, err = repo.GetConversationByIDAndUser(ctx, ids[0], customer.ID, nil, 10)
+	assert.Equal(t, types.ErrNotFound, err, "Expected archived conversation not to be found")
+
+	err = repo.CreateMessage(ctx, &types.Message{
+		ID:             utilities.MustGenerateIDString(),
+		ConversationID: ids[0],
+		SenderID:       staff.ID,
+		Body:           "Your order was delivered",
+	})
+	assert.NoError(t, err, "Expected no error creating message")
+	page, err = repo.GetConversations(ctx, customer.ID, nil, 10)
+	assert.NoError(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, ids[0], page[0].ID)
+}
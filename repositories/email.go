@@ -0,0 +1,263 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
+)
+
+type EmailRepository interface {
+	CreateEmail(ctx context.Context, email *types.Email) error
+	GetEmail(ctx context.Context, id string) (types.Email, error)
+	GetEmails(ctx context.Context, status types.EmailStatus, recipient string, page, limit int) ([]types.Email, error)
+	CreateEmailThrottled(ctx context.Context, email *types.Email, limit int, since time.Time) error
+	CountRecent(ctx context.Context, recipient string, since time.Time) (int, error)
+	ClaimEmails(ctx context.Context, limit int, lease time.Duration) ([]types.Email, error)
+	UpdateEmail(ctx context.Context, email *types.Email) error
+}
+
+type emailRepository struct {
+	db *sql.DB
+}
+
+func NewEmailRepository(db *sql.DB) EmailRepository {
+	return &emailRepository{db: db}
+}
+
+// rowQueryer is implemented by *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (r *emailRepository) CreateEmail(ctx context.Context, email *types.Email) error {
+	return createEmail(ctx, r.db, email)
+}
+
+// CreateEmailThrottled creates the email, or records it as throttled when any recipient has
+// been sent limit emails since the given time. Concurrent calls for a recipient are serialized,
+// so the limit cannot be exceeded by emails created at the same time.
+func (r *emailRepository) CreateEmailThrottled(ctx context.Context, email *types.Email, limit int, since time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock in a consistent order, to avoid deadlocks between emails with several recipients
+	recipients := append([]string(nil), email.To...)
+	sort.Strings(recipients)
+	for _, recipient := range recipients {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('emails:' || $1))`, recipient); err != nil {
+			return err
+		}
+	}
+	for _, recipient := range recipients {
+		count, err := countRecent(ctx, tx, recipient, since)
+		if err != nil {
+			return err
+		}
+		if count >= limit {
+			email.Status = types.EmailThrottled
+			email.NextAttemptAt = nil
+			break
+		}
+	}
+
+	if err := createEmail(ctx, tx, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func createEmail(ctx context.Context, q rowQueryer, email *types.Email) error {
+	query := `
+		INSERT INTO emails (id, recipients, subject, body, text_body, is_html, template,
+			reply_to, list_unsubscribe, attachments, status, next_attempt_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), $10, $11, $12)
+		RETURNING created_at, updated_at
+	`
+	attachments := email.Attachments
+	if attachments == nil {
+		attachments = []types.EmailAttachment{}
+	}
+	attachmentsJSON, err := json.Marshal(attachments)
+	if err != nil {
+		return err
+	}
+	return q.QueryRowContext(ctx, query,
+		email.ID,
+		pq.Array(email.To),
+		email.Subject,
+		email.Body,
+		email.TextBody,
+		email.IsHTML,
+		email.Template,
+		email.ReplyTo,
+		email.ListUnsubscribe,
+		attachmentsJSON,
+		email.Status,
+		email.NextAttemptAt,
+	).Scan(&email.CreatedAt, &email.UpdatedAt)
+}
+
+// contentColumns are the columns holding the message, omitted when listing
+const contentColumns = `body, COALESCE(text_body, ''), COALESCE(reply_to, ''), COALESCE(list_unsubscribe, ''), attachments`
+
+// scanContent scans the email and content columns
+func scanContent(row rowScanner, email *types.Email) error {
+	var attachments []byte
+	if err := scanEmail(row, email,
+		&email.Body,
+		&email.TextBody,
+		&email.ReplyTo,
+		&email.ListUnsubscribe,
+		&attachments,
+	); err != nil {
+		return err
+	}
+	return json.Unmarshal(attachments, &email.Attachments)
+}
+
+const emailColumns = `
+	id, recipients, subject, is_html, COALESCE(template, ''), status, attempts, response,
+	error, next_attempt_at, sent_at, created_at, updated_at`
+
+// GetEmail returns an email, including its body and attachments
+func (r *emailRepository) GetEmail(ctx context.Context, id string) (types.Email, error) {
+	query := `SELECT ` + emailColumns + `, ` + contentColumns + ` FROM emails WHERE id = $1`
+	var email types.Email
+	err := scanContent(r.db.QueryRowContext(ctx, query, id), &email)
+	if err == sql.ErrNoRows {
+		return email, types.ErrNotFound
+	}
+	return email, err
+}
+
+// GetEmails returns the delivery log newest first, without bodies and attachments.
+// Empty status and recipient match any.
+func (r *emailRepository) GetEmails(ctx context.Context, status types.EmailStatus, recipient string, page, limit int) ([]types.Email, error) {
+	query := `
+		SELECT ` + emailColumns + `
+		FROM emails
+		WHERE ($1 = '' OR status = $1)
+			AND ($2 = '' OR $2 = ANY(recipients))
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4
+	`
+	rows, err := r.db.QueryContext(ctx, query, status, recipient, limit, (page-1)*limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []types.Email{}
+	for rows.Next() {
+		var email types.Email
+		if err := scanEmail(rows, &email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// CountRecent counts the emails to recipient created since the given time, excluding throttled emails
+func (r *emailRepository) CountRecent(ctx context.Context, recipient string, since time.Time) (int, error) {
+	return countRecent(ctx, r.db, recipient, since)
+}
+
+func countRecent(ctx context.Context, q rowQueryer, recipient string, since time.Time) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM emails
+		WHERE $1 = ANY(recipients) AND created_at >= $2 AND status != 'throttled'
+	`
+	var count int
+	err := q.QueryRowContext(ctx, query, recipient, since).Scan(&count)
+	return count, err
+}
+
+// ClaimEmails returns queued emails which are due, including their bodies and attachments.
+// Claimed emails are pushed back by lease, so other instances skip them while
+// they are being sent, and they are retried should this instance fail.
+func (r *emailRepository) ClaimEmails(ctx context.Context, limit int, lease time.Duration) ([]types.Email, error) {
+	query := `
+		WITH due AS (
+			SELECT id AS due_id
+			FROM emails
+			WHERE status = 'queued' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE emails e
+		SET next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM due
+		WHERE e.id = due.due_id
+		RETURNING ` + emailColumns + `, ` + contentColumns + `
+	`
+	rows, err := r.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []types.Email{}
+	for rows.Next() {
+		var email types.Email
+		if err := scanContent(rows, &email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// UpdateEmail records the outcome of a send attempt
+func (r *emailRepository) UpdateEmail(ctx context.Context, email *types.Email) error {
+	query := `
+		UPDATE emails
+		SET status = $2, attempts = $3, response = $4, error = $5,
+			next_attempt_at = $6, sent_at = $7, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`
+	err := r.db.QueryRowContext(ctx, query,
+		email.ID,
+		email.Status,
+		email.Attempts,
+		email.Response,
+		email.Error,
+		email.NextAttemptAt,
+		email.SentAt,
+	).Scan(&email.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	return err
+}
+
+// scanEmail scans the email columns, followed by any extra columns
+func scanEmail(row rowScanner, email *types.Email, extra ...interface{}) error {
+	dest := []interface{}{
+		&email.ID,
+		pq.Array(&email.To),
+		&email.Subject,
+		&email.IsHTML,
+		&email.Template,
+		&email.Status,
+		&email.Attempts,
+		&email.Response,
+		&email.Error,
+		&email.NextAttemptAt,
+		&email.SentAt,
+		&email.CreatedAt,
+		&email.UpdatedAt,
+	}
+	return row.Scan(append(dest, extra...)...)
+}
@@ -0,0 +1,149 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountRecentEmails(t *testing.T) {
+	repo := NewEmailRepository(dbPool)
+	ctx := context.Background()
+	recipient := "email-" + utilities.MustGenerateIDString() + "@example.com"
+	defer dbPool.ExecContext(ctx, "DELETE FROM emails WHERE $1 = ANY(recipients)", recipient)
+
+	for _, status := range []types.EmailStatus{types.EmailQueued, types.EmailSent, types.EmailThrottled} {
+		email := &types.Email{
+			ID:      utilities.MustGenerateIDString(),
+			To:      []string{recipient},
+			Subject: "Hello",
+			Body:    "Hello",
+			Status:  status,
+		}
+		err := repo.CreateEmail(ctx, email)
+		assert.NoError(t, err, "Expected no error creating email")
+	}
+
+	count, err := repo.CountRecent(ctx, recipient, time.Now().UTC().Add(-time.Hour))
+	assert.NoError(t, err, "Expected no error counting emails")
+	assert.Equal(t, 2, count, "Expected throttled emails not to be counted")
+
+	emails, err := repo.GetEmails(ctx, types.EmailThrottled, recipient, 1, 10)
+	assert.NoError(t, err, "Expected no error fetching emails")
+	assert.Len(t, emails, 1, "Expected emails to be filtered by status")
+	assert.Empty(t, emails[0].Body, "Expected body to be omitted when listing")
+}
+
+func TestCreateEmailThrottled(t *testing.T) {
+	repo := NewEmailRepository(dbPool)
+	ctx := context.Background()
+	recipient := "email-" + utilities.MustGenerateIDString() + "@example.com"
+	defer dbPool.ExecContext(ctx, "DELETE FROM emails WHERE $1 = ANY(recipients)", recipient)
+	since := time.Now().UTC().Add(-time.Hour)
+
+	// emails created at the same time cannot exceed the limit
+	const limit = 3
+	statuses := make(chan types.EmailStatus, limit+2)
+	var wg sync.WaitGroup
+	for i := 0; i < limit+2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := time.Now().UTC()
+			email := &types.Email{
+				ID:            utilities.MustGenerateIDString(),
+				To:            []string{recipient},
+				Subject:       "Hello",
+				Body:          "Hello",
+				Status:        types.EmailQueued,
+				NextAttemptAt: &now,
+			}
+			err := repo.CreateEmailThrottled(ctx, email, limit, since)
+			assert.NoError(t, err, "Expected no error creating email")
+			statuses <- email.Status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	var queued, throttled int
+	for status := range statuses {
+		switch status {
+		case types.EmailQueued:
+			queued++
+		case types.EmailThrottled:
+			throttled++
+		}
+	}
+	assert.Equal(t, limit, queued, "Expected emails up to the limit to be queued")
+	assert.Equal(t, 2, throttled, "Expected emails over the limit to be throttled")
+
+	count, err := repo.CountRecent(ctx, recipient, since)
+	assert.NoError(t, err, "Expected no error counting emails")
+	assert.Equal(t, limit, count)
+}
+
+func TestClaimEmails(t *testing.T) {
+	repo := NewEmailRepository(dbPool)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	email := &types.Email{
+		ID:       utilities.MustGenerateIDString(),
+		To:       []string{"claim@example.com"},
+		Subject:  "Hello",
+		Body:     "<p>Hello</p>",
+		IsHTML:   true,
+		Template: "test.html",
+		Attachments: []types.EmailAttachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")},
+		},
+		Status:        types.EmailQueued,
+		NextAttemptAt: &now,
+	}
+	err := repo.CreateEmail(ctx, email)
+	assert.NoError(t, err, "Expected no error creating email")
+	defer dbPool.ExecContext(ctx, "DELETE FROM emails WHERE id = $1", email.ID)
+
+	emails, err := repo.ClaimEmails(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming emails")
+	claimed, ok := findEmail(emails, email.ID)
+	assert.True(t, ok, "Expected queued email to be claimed")
+	assert.Equal(t, email.Body, claimed.Body)
+	assert.Equal(t, email.Template, claimed.Template)
+	assert.Equal(t, email.Attachments, claimed.Attachments)
+
+	// claimed emails are leased
+	emails, err = repo.ClaimEmails(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming emails")
+	_, ok = findEmail(emails, email.ID)
+	assert.False(t, ok, "Expected leased email to be skipped")
+
+	response := "250 2.0.0 Ok"
+	claimed.Status = types.EmailSent
+	claimed.Attempts = 1
+	claimed.Response = &response
+	claimed.NextAttemptAt = nil
+	claimed.SentAt = &now
+	err = repo.UpdateEmail(ctx, &claimed)
+	assert.NoError(t, err, "Expected no error updating email")
+
+	stored, err := repo.GetEmail(ctx, email.ID)
+	assert.NoError(t, err, "Expected no error fetching email")
+	assert.Equal(t, types.EmailSent, stored.Status)
+	assert.Equal(t, response, *stored.Response)
+}
+
+func findEmail(emails []types.Email, id string) (types.Email, bool) {
+	for _, email := range emails {
+		if email.ID == id {
+			return email, true
+		}
+	}
+	return types.Email{}, false
+}
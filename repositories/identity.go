@@ -0,0 +1,133 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+// IdentityRepository stores external (OpenID Connect) identities and in-flight authorization requests
+type IdentityRepository interface {
+	CreateAuthState(ctx context.Context, state *types.OIDCAuthState) error
+	ConsumeAuthState(ctx context.Context, state string) (*types.OIDCAuthState, error)
+	GetIdentity(ctx context.Context, provider, subject string) (*types.UserIdentity, error)
+	CreateIdentity(ctx context.Context, identity *types.UserIdentity) error
+	CreateUserWithIdentity(ctx context.Context, user *types.User, identity *types.UserIdentity) error
+}
+
+type identityRepository struct {
+	db *sql.DB
+}
+
+func NewIdentityRepository(db *sql.DB) IdentityRepository {
+	return &identityRepository{db: db}
+}
+
+func (r *identityRepository) CreateAuthState(ctx context.Context, state *types.OIDCAuthState) error {
+	query := `
+		INSERT INTO oidc_auth_states (state, provider, code_verifier, nonce, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := r.db.ExecContext(ctx, query, state.State, state.Provider, state.CodeVerifier, state.Nonce, state.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthState removes and returns an unexpired authorization state, so it can only be used once
+func (r *identityRepository) ConsumeAuthState(ctx context.Context, state string) (*types.OIDCAuthState, error) {
+	query := `
+		DELETE FROM oidc_auth_states
+		WHERE state = $1 AND expires_at > NOW()
+		RETURNING state, provider, code_verifier, nonce, expires_at
+	`
+	var authState types.OIDCAuthState
+	err := r.db.QueryRowContext(ctx, query, state).Scan(
+		&authState.State,
+		&authState.Provider,
+		&authState.CodeVerifier,
+		&authState.Nonce,
+		&authState.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authState, nil
+}
+
+func (r *identityRepository) GetIdentity(ctx context.Context, provider, subject string) (*types.UserIdentity, error) {
+	query := `
+		SELECT provider, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2
+	`
+	var identity types.UserIdentity
+	err := r.db.QueryRowContext(ctx, query, provider, subject).Scan(
+		&identity.Provider,
+		&identity.Subject,
+		&identity.UserID,
+		&identity.Email,
+		&identity.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (r *identityRepository) CreateIdentity(ctx context.Context, identity *types.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`
+	err := r.db.QueryRowContext(ctx, query, identity.Provider, identity.Subject, identity.UserID, identity.Email).
+		Scan(&identity.CreatedAt)
+	if isUniqueViolation(err) {
+		return types.ErrUniqueConstraintViolation
+	}
+	return err
+}
+
+// CreateUserWithIdentity creates a user without a password along with its external identity
+func (r *identityRepository) CreateUserWithIdentity(ctx context.Context, user *types.User, identity *types.UserIdentity) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (id, email, name, role, verified)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, email, name, role, verified, created_at, updated_at`,
+		user.ID, user.Email, user.Name, user.Role, user.Verified).
+		Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.Verified, &user.CreatedAt, &user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return types.ErrUniqueConstraintViolation
+	}
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email).
+		Scan(&identity.CreatedAt)
+	if isUniqueViolation(err) {
+		return types.ErrUniqueConstraintViolation
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
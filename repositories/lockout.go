@@ -0,0 +1,91 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type LockoutRepository interface {
+	GetLockout(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error)
+	RecordFailure(ctx context.Context, scope types.LockoutScope, subject string, window time.Duration) (*types.Lockout, error)
+	SetLockedUntil(ctx context.Context, scope types.LockoutScope, subject string, lockedUntil time.Time) error
+	RemoveLockout(ctx context.Context, scope types.LockoutScope, subject string) error
+}
+
+type lockoutRepository struct {
+	db *sql.DB
+}
+
+func NewLockoutRepository(db *sql.DB) LockoutRepository {
+	return &lockoutRepository{db: db}
+}
+
+func (r *lockoutRepository) GetLockout(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error) {
+	query := `
+		SELECT scope, subject, failures, locked_until, updated_at
+		FROM lockouts
+		WHERE scope = $1 AND subject = $2
+	`
+	var lockout types.Lockout
+	err := r.db.QueryRowContext(ctx, query, scope, subject).Scan(
+		&lockout.Scope,
+		&lockout.Subject,
+		&lockout.Failures,
+		&lockout.LockedUntil,
+		&lockout.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// RecordFailure increments the failure count for the subject.
+// The count starts over when the previous failure is older than window.
+func (r *lockoutRepository) RecordFailure(ctx context.Context, scope types.LockoutScope, subject string, window time.Duration) (*types.Lockout, error) {
+	query := `
+		INSERT INTO lockouts (scope, subject, failures, updated_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (scope, subject) DO UPDATE
+		SET failures = CASE
+				WHEN lockouts.updated_at < NOW() - make_interval(secs => $3) THEN 1
+				ELSE lockouts.failures + 1
+			END,
+			updated_at = NOW()
+		RETURNING scope, subject, failures, locked_until, updated_at
+	`
+	var lockout types.Lockout
+	err := r.db.QueryRowContext(ctx, query, scope, subject, window.Seconds()).Scan(
+		&lockout.Scope,
+		&lockout.Subject,
+		&lockout.Failures,
+		&lockout.LockedUntil,
+		&lockout.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+func (r *lockoutRepository) SetLockedUntil(ctx context.Context, scope types.LockoutScope, subject string, lockedUntil time.Time) error {
+	query := `
+		UPDATE lockouts
+		SET locked_until = $3, updated_at = NOW()
+		WHERE scope = $1 AND subject = $2
+	`
+	_, err := r.db.ExecContext(ctx, query, scope, subject, lockedUntil)
+	return err
+}
+
+func (r *lockoutRepository) RemoveLockout(ctx context.Context, scope types.LockoutScope, subject string) error {
+	query := `DELETE FROM lockouts WHERE scope = $1 AND subject = $2`
+	_, err := r.db.ExecContext(ctx, query, scope, subject)
+	return err
+}
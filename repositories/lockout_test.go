@@ -0,0 +1,59 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordFailure_Increments(t *testing.T) {
+	repo := NewLockoutRepository(dbPool)
+	ctx := context.Background()
+	subject := "lockout-" + utilities.MustGenerateIDString() + "@example.com"
+	defer repo.RemoveLockout(ctx, types.LockoutLogin, subject)
+
+	for i := 1; i <= 3; i++ {
+		lockout, err := repo.RecordFailure(ctx, types.LockoutLogin, subject, time.Hour)
+		assert.NoError(t, err, "Expected no error on failure %d", i)
+		assert.Equal(t, i, lockout.Failures, "Expected failure count to be %d", i)
+		assert.Nil(t, lockout.LockedUntil, "Expected no lock to be set")
+	}
+}
+
+func TestSetLockedUntil(t *testing.T) {
+	repo := NewLockoutRepository(dbPool)
+	ctx := context.Background()
+	subject := "lockout-" + utilities.MustGenerateIDString() + "@example.com"
+	defer repo.RemoveLockout(ctx, types.LockoutLogin, subject)
+
+	_, err := repo.RecordFailure(ctx, types.LockoutLogin, subject, time.Hour)
+	assert.NoError(t, err, "Expected no error recording failure")
+
+	lockedUntil := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	err = repo.SetLockedUntil(ctx, types.LockoutLogin, subject, lockedUntil)
+	assert.NoError(t, err, "Expected no error setting lock")
+
+	lockout, err := repo.GetLockout(ctx, types.LockoutLogin, subject)
+	assert.NoError(t, err, "Expected no error fetching lockout")
+	assert.NotNil(t, lockout.LockedUntil, "Expected lock to be set")
+	assert.WithinDuration(t, lockedUntil, *lockout.LockedUntil, time.Second)
+}
+
+func TestRemoveLockout(t *testing.T) {
+	repo := NewLockoutRepository(dbPool)
+	ctx := context.Background()
+	subject := "lockout-" + utilities.MustGenerateIDString() + "@example.com"
+
+	_, err := repo.RecordFailure(ctx, types.LockoutLogin, subject, time.Hour)
+	assert.NoError(t, err, "Expected no error recording failure")
+
+	err = repo.RemoveLockout(ctx, types.LockoutLogin, subject)
+	assert.NoError(t, err, "Expected no error removing lockout")
+
+	_, err = repo.GetLockout(ctx, types.LockoutLogin, subject)
+	assert.Equal(t, types.ErrNotFound, err, "Expected lockout to be removed")
+}
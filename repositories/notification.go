@@ -0,0 +1,68 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type NotificationRepository interface {
+	GetPreferences(ctx context.Context, userID string) ([]types.NotificationPreference, error)
+	SetPreferences(ctx context.Context, userID string, prefs []types.NotificationPreference) error
+}
+
+type notificationRepository struct {
+	db *sql.DB
+}
+
+func NewNotificationRepository(db *sql.DB) NotificationRepository {
+	return &notificationRepository{db: db}
+}
+
+// GetPreferences returns the preferences a user has set, without defaults
+func (r *notificationRepository) GetPreferences(ctx context.Context, userID string) ([]types.NotificationPreference, error) {
+	query := `
+		SELECT event, channel, enabled
+		FROM notification_preferences
+		WHERE user_id = $1
+		ORDER BY event, channel
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := []types.NotificationPreference{}
+	for rows.Next() {
+		var pref types.NotificationPreference
+		if err := rows.Scan(&pref.Event, &pref.Channel, &pref.Enabled); err != nil {
+			return nil, err
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, rows.Err()
+}
+
+// SetPreferences stores the given preferences, leaving others unchanged
+func (r *notificationRepository) SetPreferences(ctx context.Context, userID string, prefs []types.NotificationPreference) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO notification_preferences (user_id, event, channel, enabled)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, event, channel) DO UPDATE
+		SET enabled = EXCLUDED.enabled, updated_at = NOW()
+	`
+	for _, pref := range prefs {
+		if _, err := tx.ExecContext(ctx, query, userID, pref.Event, pref.Channel, pref.Enabled); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
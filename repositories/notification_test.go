@@ -0,0 +1,36 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetPreferences(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewNotificationRepository(dbPool)
+	ctx := context.Background()
+	user := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, user.ID)
+
+	err := repo.SetPreferences(ctx, user.ID, []types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelEmail, Enabled: false},
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelWebhook, Enabled: true},
+	})
+	assert.NoError(t, err, "Expected no error setting preferences")
+
+	// updates existing preferences, leaving others unchanged
+	err = repo.SetPreferences(ctx, user.ID, []types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelEmail, Enabled: true},
+	})
+	assert.NoError(t, err, "Expected no error updating preferences")
+
+	prefs, err := repo.GetPreferences(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error fetching preferences")
+	assert.Equal(t, []types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelEmail, Enabled: true},
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelWebhook, Enabled: true},
+	}, prefs)
+}
@@ -9,11 +9,14 @@ import (
 
 type OfferRepository interface {
 	CreateOffer(ctx context.Context, offer *types.Offer) error
-	UpdateOffer(ctx context.Context, offer *types.Offer) error
+	ReviseOffer(ctx context.Context, offer *types.Offer, authorID string, from ...types.OfferStatus) error
+	ExpireOffers(ctx context.Context, limit int) (int, error)
 	GetOfferByID(ctx context.Context, id string) (types.Offer, error)
 	GetOfferByIDAndUser(ctx context.Context, id, userID string) (types.Offer, error)
 	GetOffersByProductIDAndUser(ctx context.Context, productID, userID string) ([]types.Offer, error)
 	GetOffers(ctx context.Context) ([]types.Offer, error)
+	GetOfferFloor(ctx context.Context, productID string) (types.OfferFloor, error)
+	SetOfferFloor(ctx context.Context, floor *types.OfferFloor) error
 }
 
 type offerRepository struct {
@@ -24,6 +27,25 @@ func NewOfferRepository(db *sql.DB) OfferRepository {
 	return &offerRepository{db: db}
 }
 
+const offerColumns = `
+	id, user_id, product_id, amount, status, comment, expires_at, created_at, updated_at`
+
+func scanOffer(row rowScanner, offer *types.Offer) error {
+	return row.Scan(
+		&offer.ID,
+		&offer.UserID,
+		&offer.Product.ID,
+		&offer.Amount,
+		&offer.Status,
+		&offer.Comment,
+		&offer.ExpiresAt,
+		&offer.CreatedAt,
+		&offer.UpdatedAt,
+	)
+}
+
+// CreateOffer records a new offer, rejecting it in place when its amount is below the product's floor.
+// Returns ErrConstraintViolation when the user has an open offer for the product, or it is out of stock.
 func (r *offerRepository) CreateOffer(ctx context.Context, offer *types.Offer) error {
 	// Begin a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
@@ -32,28 +54,29 @@ func (r *offerRepository) CreateOffer(ctx context.Context, offer *types.Offer) e
 	}
 	defer tx.Rollback()
 
-	// Abort if user has pending offer
-	var pendingExists bool
+	// Abort if user has an open offer
+	var openExists bool
 	err = tx.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1
 			FROM offers
 			WHERE user_id = $1
 				AND product_id = $2
-				AND status = 'pending'
+				AND status IN ('pending', 'countered')
 		)
-	`, offer.UserID, offer.Product.ID).Scan(&pendingExists)
+	`, offer.UserID, offer.Product.ID).Scan(&openExists)
 	if err != nil {
 		return err
 	}
-	if pendingExists {
+	if openExists {
 		return types.ErrConstraintViolation
 	}
 
 	// Lock product row and check inventory atomically
 	var inventory int
-	err = tx.QueryRowContext(ctx, `SELECT inventory FROM products WHERE id = $1 AND negotiable = true FOR UPDATE`, offer.Product.ID).
-		Scan(&inventory)
+	var floor *int64
+	err = tx.QueryRowContext(ctx, `SELECT inventory, offer_floor FROM products WHERE id = $1 AND negotiable = true FOR UPDATE`, offer.Product.ID).
+		Scan(&inventory, &floor)
 	if err == sql.ErrNoRows {
 		return types.ErrNotFound
 	}
@@ -71,10 +94,19 @@ func (r *offerRepository) CreateOffer(ctx context.Context, offer *types.Offer) e
 		}
 	}
 
+	// the buyer's offer is kept in the history of a rejected offer
+	offered := offer.Status
+	updatedBy := offer.UserID
+	if offer.Status == types.OfferPending && floor != nil && offer.Amount < *floor {
+		offer.Status = types.OfferRejected
+		offer.ExpiresAt = nil
+		updatedBy = ""
+	}
+
 	// Insert record into offers
 	query := `
-		INSERT INTO offers (id, user_id, product_id, amount, status, comment)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO offers (id, user_id, product_id, amount, status, comment, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`
 	if _, err := tx.ExecContext(ctx,
 		query,
@@ -84,14 +116,52 @@ func (r *offerRepository) CreateOffer(ctx context.Context, offer *types.Offer) e
 		offer.Amount,
 		offer.Status,
 		offer.Comment,
+		offer.ExpiresAt,
 	); err != nil {
 		return err
 	}
+	if err := insertRevision(ctx, tx, offer.ID, offer.UserID, offer.Amount, offered, offer.Comment); err != nil {
+		return err
+	}
+	if updatedBy == "" {
+		if err := insertRevision(ctx, tx, offer.ID, "", offer.Amount, offer.Status, nil); err != nil {
+			return err
+		}
+	}
+
+	err = insertEvent(ctx, tx, "offer", offer.ID, types.EventTypeOfferCreated, types.OfferStatusChange{
+		OfferID:   offer.ID,
+		UserID:    offer.UserID,
+		ProductID: offer.Product.ID,
+		Status:    offer.Status,
+		Amount:    offer.Amount,
+		UpdatedBy: updatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	if offer.Status == types.OfferAccepted {
+		err = insertEvent(ctx, tx, "product", offer.Product.ID, types.EventTypeInventoryChanged, types.InventoryUpdate{
+			ProductID: offer.Product.ID,
+			Inventory: inventory - 1,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-func (r *offerRepository) UpdateOffer(ctx context.Context, offer *types.Offer) error {
+// ReviseOffer moves an offer to offer.Status on behalf of authorID, recording the revision.
+// A zero offer.Amount keeps the current amount, and offer.ExpiresAt is only kept while the offer is open,
+// or accepted and awaiting payment.
+// When offer.UserID is set, only that user's offer is revised.
+// Accepting an offer takes one item from inventory, which closing an accepted offer returns.
+// Countering with a pending amount below the product's floor rejects the offer instead.
+// Returns ErrConstraintViolation when the offer's status is not one of from (any, when empty),
+// or an accepted product is out of stock.
+func (r *offerRepository) ReviseOffer(ctx context.Context, offer *types.Offer, authorID string, from ...types.OfferStatus) error {
 	// Begin a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -99,17 +169,32 @@ func (r *offerRepository) UpdateOffer(ctx context.Context, offer *types.Offer) e
 	}
 	defer tx.Rollback()
 
-	// decrement inventory when offer has been accepted
-	if offer.Status == types.OfferAccepted {
-		// get the product ID
-		offer.Product = types.Product{}
-		err := r.db.QueryRowContext(ctx, "SELECT product_id FROM offers WHERE id = $1", offer.ID).Scan(&offer.Product.ID)
-		if err == sql.ErrNoRows {
-			return types.ErrNotFound
-		}
+	// Lock the offer, so concurrent responses apply one at a time
+	var amount int64
+	var current types.OfferStatus
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, product_id, amount, status
+		FROM offers
+		WHERE id = $1 AND ($2 = '' OR user_id::TEXT = $2)
+		FOR UPDATE
+	`, offer.ID, offer.UserID).Scan(&offer.UserID, &offer.Product.ID, &amount, &current)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !hasOfferStatus(from, current) {
+		return types.ErrConstraintViolation
+	}
+	if offer.Amount == 0 {
+		offer.Amount = amount
+	}
 
+	// decrement inventory when offer has been accepted
+	var inventory int
+	if offer.Status == types.OfferAccepted && current != types.OfferAccepted {
 		// Lock product row and check inventory atomically
-		var inventory int
 		err = tx.QueryRowContext(ctx, `SELECT inventory FROM products WHERE id = $1 AND negotiable = true FOR UPDATE`, offer.Product.ID).
 			Scan(&inventory)
 		if err == sql.ErrNoRows {
@@ -127,165 +212,318 @@ func (r *offerRepository) UpdateOffer(ctx context.Context, offer *types.Offer) e
 		}
 	}
 
+	if err := insertRevision(ctx, tx, offer.ID, authorID, offer.Amount, offer.Status, offer.Comment); err != nil {
+		return err
+	}
+	updatedBy := authorID
+
+	// reject new amounts below the floor
+	if offer.Status == types.OfferPending && offer.Amount != amount {
+		var floor *int64
+		if err := tx.QueryRowContext(ctx, "SELECT offer_floor FROM products WHERE id = $1", offer.Product.ID).Scan(&floor); err != nil {
+			return err
+		}
+		if floor != nil && offer.Amount < *floor {
+			offer.Status = types.OfferRejected
+			updatedBy = ""
+			if err := insertRevision(ctx, tx, offer.ID, "", offer.Amount, offer.Status, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if !offer.Status.IsOpen() && offer.Status != types.OfferAccepted {
+		offer.ExpiresAt = nil
+	}
+
 	query := `
-		UPDATE offers SET status = $2, updated_at = NOW()
+		UPDATE offers SET amount = $2, status = $3, expires_at = $4, updated_at = NOW()
 		WHERE id = $1
-		RETURNING product_id, user_id
 	`
-	err = tx.QueryRowContext(ctx, query, offer.ID, offer.Status).Scan(&offer.Product.ID, &offer.UserID)
-	if err == sql.ErrNoRows {
-		return types.ErrNotFound
+	if _, err := tx.ExecContext(ctx, query, offer.ID, offer.Amount, offer.Status, offer.ExpiresAt); err != nil {
+		return err
 	}
+
+	err = insertEvent(ctx, tx, "offer", offer.ID, types.EventTypeOfferStatusChanged, types.OfferStatusChange{
+		OfferID:   offer.ID,
+		UserID:    offer.UserID,
+		ProductID: offer.Product.ID,
+		Status:    offer.Status,
+		Amount:    offer.Amount,
+		UpdatedBy: updatedBy,
+	})
 	if err != nil {
 		return err
 	}
+	if offer.Status == types.OfferAccepted && current != types.OfferAccepted {
+		err = insertEvent(ctx, tx, "product", offer.Product.ID, types.EventTypeInventoryChanged, types.InventoryUpdate{
+			ProductID: offer.Product.ID,
+			Inventory: inventory - 1,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if current == types.OfferAccepted && offer.Status != types.OfferAccepted {
+		err = releaseOffer(ctx, tx, types.OfferStatusChange{OfferID: offer.ID, ProductID: offer.Product.ID})
+		if err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-func (r *offerRepository) GetOffersByProductIDAndUser(ctx context.Context, productID, userID string) ([]types.Offer, error) {
-	offers := []types.Offer{}
+func hasOfferStatus(statuses []types.OfferStatus, status types.OfferStatus) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireOffers expires up to limit offers which are past their expiry, returning how many were expired.
+// Open offers expire unanswered, and accepted offers unpaid, returning their unit to stock and
+// canceling their pending order.
+func (r *offerRepository) ExpireOffers(ctx context.Context, limit int) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH due AS (
+			SELECT id, status
+			FROM offers
+			WHERE expires_at < NOW() AND status IN ('pending', 'countered', 'accepted')
+			ORDER BY expires_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE offers o
+		SET status = 'expired', expires_at = NULL, updated_at = NOW()
+		FROM due
+		WHERE o.id = due.id
+		RETURNING o.id, o.user_id, o.product_id, o.amount, due.status
+	`, limit)
+	if err != nil {
+		return 0, err
+	}
+	changes := []types.OfferStatusChange{}
+	accepted := map[string]bool{}
+	for rows.Next() {
+		var previous types.OfferStatus
+		change := types.OfferStatusChange{Status: types.OfferExpired}
+		if err := rows.Scan(&change.OfferID, &change.UserID, &change.ProductID, &change.Amount, &previous); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		changes = append(changes, change)
+		accepted[change.OfferID] = previous == types.OfferAccepted
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, change := range changes {
+		if err := insertRevision(ctx, tx, change.OfferID, "", change.Amount, change.Status, nil); err != nil {
+			return 0, err
+		}
+		if err := insertEvent(ctx, tx, "offer", change.OfferID, types.EventTypeOfferStatusChanged, change); err != nil {
+			return 0, err
+		}
+		if accepted[change.OfferID] {
+			if err := releaseOffer(ctx, tx, change); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(changes), tx.Commit()
+}
+
+// releaseOffer returns the unit reserved by an accepted offer to stock, canceling its pending order
+func releaseOffer(ctx context.Context, tx *sql.Tx, change types.OfferStatusChange) error {
+	_, err := tx.ExecContext(ctx, `
+		WITH canceled AS (
+			UPDATE orders SET status = 'canceled', updated_at = NOW()
+			WHERE offer_id = $1 AND status = 'pending'
+			RETURNING id
+		)
+		DELETE FROM order_items
+		WHERE order_id IN (SELECT id FROM canceled)`,
+		change.OfferID)
+	if err != nil {
+		return err
+	}
+
+	var inventory int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE products SET inventory = inventory + 1
+		WHERE id = $1
+		RETURNING inventory`,
+		change.ProductID).Scan(&inventory)
+	if err != nil {
+		return err
+	}
+	return insertEvent(ctx, tx, "product", change.ProductID, types.EventTypeInventoryChanged, types.InventoryUpdate{
+		ProductID: change.ProductID,
+		Inventory: inventory,
+	})
+}
+
+// completeOffer marks an accepted offer completed, within the transaction of its paid order.
+// Returns ErrConstraintViolation when the offer expired, was closed by an admin or completed meanwhile,
+// so the order is not paid and the payment can be refunded.
+func completeOffer(ctx context.Context, tx *sql.Tx, offerID string) error {
+	change := types.OfferStatusChange{OfferID: offerID, Status: types.OfferCompleted}
+	err := tx.QueryRowContext(ctx, `
+		UPDATE offers SET status = 'completed', expires_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND status = 'accepted'
+		RETURNING user_id, product_id, amount
+	`, offerID).Scan(&change.UserID, &change.ProductID, &change.Amount)
+	if err == sql.ErrNoRows {
+		return types.ErrConstraintViolation
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertRevision(ctx, tx, offerID, "", change.Amount, change.Status, nil); err != nil {
+		return err
+	}
+	return insertEvent(ctx, tx, "offer", offerID, types.EventTypeOfferStatusChanged, change)
+}
+
+// insertRevision records a step of an offer's negotiation, authorID is empty for the system
+func insertRevision(ctx context.Context, tx *sql.Tx, offerID, authorID string, amount int64, status types.OfferStatus, comment *string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO offer_revisions (offer_id, author_id, amount, status, comment)
+		VALUES ($1, NULLIF($2, '')::BIGINT, $3, $4, $5)
+	`, offerID, authorID, amount, status, comment)
+	return err
+}
+
+// getRevisions returns the negotiation history of an offer, oldest first.
+// When buyerID is set, the authors of revisions the buyer did not write are left out, so staff stay anonymous.
+func (r *offerRepository) getRevisions(ctx context.Context, offerID, buyerID string) ([]types.OfferRevision, error) {
 	query := `
-	SELECT 
-		id,
-		user_id,
-		product_id,
-		amount,
-		status,
-		comment,
-		created_at,
-		updated_at
-	FROM offers
-	WHERE product_id = $1 AND user_id = $2
+		SELECT id, offer_id,
+			CASE WHEN $2 = '' OR author_id::TEXT = $2 THEN COALESCE(author_id::TEXT, '') ELSE '' END,
+			amount, status, comment, created_at
+		FROM offer_revisions
+		WHERE offer_id = $1
+		ORDER BY id
 	`
-	rows, err := r.db.QueryContext(ctx, query, productID, userID)
+	rows, err := r.db.QueryContext(ctx, query, offerID, buyerID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	revisions := []types.OfferRevision{}
 	for rows.Next() {
-		var pi types.Offer
-		pi.Product = types.Product{}
-		if err = rows.Scan(
-			&pi.ID,
-			&pi.UserID,
-			&pi.Product.ID,
-			&pi.Amount,
-			&pi.Status,
-			&pi.Comment,
-			&pi.CreatedAt,
-			&pi.UpdatedAt,
+		var revision types.OfferRevision
+		if err := rows.Scan(
+			&revision.ID,
+			&revision.OfferID,
+			&revision.AuthorID,
+			&revision.Amount,
+			&revision.Status,
+			&revision.Comment,
+			&revision.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
-
-		offers = append(offers, pi)
+		revisions = append(revisions, revision)
 	}
+	return revisions, rows.Err()
+}
 
-	return offers, nil
+func (r *offerRepository) GetOffersByProductIDAndUser(ctx context.Context, productID, userID string) ([]types.Offer, error) {
+	query := `SELECT ` + offerColumns + ` FROM offers WHERE product_id = $1 AND user_id = $2`
+	return r.queryOffers(ctx, query, productID, userID)
 }
 
 func (r *offerRepository) GetOfferByIDAndUser(ctx context.Context, id, userID string) (types.Offer, error) {
-	query := `
-	SELECT
-		id,
-		user_id,
-		product_id,
-		amount,
-		status,
-		comment,
-		created_at,
-		updated_at
-	FROM offers
-	WHERE id = $1 AND user_id = $2
-	`
-	var pi types.Offer
-	err := r.db.QueryRowContext(ctx, query, id, userID).Scan(
-		&pi.ID,
-		&pi.UserID,
-		&pi.Product.ID,
-		&pi.Amount,
-		&pi.Status,
-		&pi.Comment,
-		&pi.CreatedAt,
-		&pi.UpdatedAt,
-	)
+	query := `SELECT ` + offerColumns + ` FROM offers WHERE id = $1 AND user_id = $2`
+	var offer types.Offer
+	err := scanOffer(r.db.QueryRowContext(ctx, query, id, userID), &offer)
 	if err == sql.ErrNoRows {
-		return pi, types.ErrNotFound
+		return offer, types.ErrNotFound
+	}
+	if err != nil {
+		return offer, err
 	}
-	return pi, err
+	offer.Revisions, err = r.getRevisions(ctx, offer.ID, userID)
+	return offer, err
 }
 
 func (r *offerRepository) GetOfferByID(ctx context.Context, id string) (types.Offer, error) {
-	query := `
-	SELECT
-		id,
-		user_id,
-		product_id,
-		amount,
-		status,
-		comment,
-		created_at,
-		updated_at
-	FROM offers
-	WHERE id = $1
-	`
+	query := `SELECT ` + offerColumns + ` FROM offers WHERE id = $1`
 	var offer types.Offer
-	err := r.db.QueryRowContext(ctx, query, id).Scan(
-		&offer.ID,
-		&offer.UserID,
-		&offer.Product.ID,
-		&offer.Amount,
-		&offer.Status,
-		&offer.Comment,
-		&offer.CreatedAt,
-		&offer.UpdatedAt,
-	)
+	err := scanOffer(r.db.QueryRowContext(ctx, query, id), &offer)
 	if err == sql.ErrNoRows {
 		return offer, types.ErrNotFound
 	}
+	if err != nil {
+		return offer, err
+	}
+	offer.Revisions, err = r.getRevisions(ctx, offer.ID, "")
 	return offer, err
 }
 
 func (r *offerRepository) GetOffers(ctx context.Context) ([]types.Offer, error) {
-	offers := []types.Offer{}
-	query := `
-	SELECT
-		id,
-		user_id,
-		product_id,
-		amount,
-		status,
-		comment,
-		created_at,
-		updated_at
-	FROM offers
-	`
-	rows, err := r.db.QueryContext(ctx, query)
+	query := `SELECT ` + offerColumns + ` FROM offers`
+	return r.queryOffers(ctx, query)
+}
+
+func (r *offerRepository) queryOffers(ctx context.Context, query string, args ...interface{}) ([]types.Offer, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	offers := []types.Offer{}
 	for rows.Next() {
-		var pi types.Offer
-		pi.Product = types.Product{}
-		if err = rows.Scan(
-			&pi.ID,
-			&pi.UserID,
-			&pi.Product.ID,
-			&pi.Amount,
-			&pi.Status,
-			&pi.Comment,
-			&pi.CreatedAt,
-			&pi.UpdatedAt,
-		); err != nil {
+		var offer types.Offer
+		if err := scanOffer(rows, &offer); err != nil {
 			return nil, err
 		}
+		offers = append(offers, offer)
+	}
+	return offers, rows.Err()
+}
 
-		offers = append(offers, pi)
+func (r *offerRepository) GetOfferFloor(ctx context.Context, productID string) (types.OfferFloor, error) {
+	floor := types.OfferFloor{ProductID: productID}
+	err := r.db.QueryRowContext(ctx, "SELECT offer_floor FROM products WHERE id = $1", productID).Scan(&floor.Floor)
+	if err == sql.ErrNoRows {
+		return floor, types.ErrNotFound
 	}
+	return floor, err
+}
 
-	return offers, nil
+// SetOfferFloor sets the lowest amount a product accepts offers for, a nil floor removes it.
+// Offers already made are not affected.
+func (r *offerRepository) SetOfferFloor(ctx context.Context, floor *types.OfferFloor) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE products SET offer_floor = $2, updated_at = NOW()
+		WHERE id = $1
+	`, floor.ProductID, floor.Floor)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,248 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfferNegotiation(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewOfferRepository(dbPool)
+	ctx := context.Background()
+
+	admin := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, admin.ID)
+	buyer := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, buyer.ID)
+
+	productID := utilities.MustGenerateIDString()
+	_, err := dbPool.ExecContext(ctx, `
+		INSERT INTO products (id, name, price, summary, inventory, negotiable)
+		VALUES ($1, 'Negotiable Product', 10000, 'A negotiable product', 2, TRUE)
+	`, productID)
+	assert.NoError(t, err, "Expected no error creating product")
+	defer dbPool.ExecContext(ctx, "DELETE FROM products WHERE id = $1", productID)
+	defer dbPool.ExecContext(ctx, "DELETE FROM offers WHERE product_id = $1", productID)
+
+	floor := int64(5000)
+	assert.NoError(t, repo.SetOfferFloor(ctx, &types.OfferFloor{ProductID: productID, Floor: &floor}))
+	saved, err := repo.GetOfferFloor(ctx, productID)
+	assert.NoError(t, err, "Expected no error fetching floor")
+	assert.Equal(t, floor, *saved.Floor)
+
+	// offers below the floor are rejected, keeping the buyer's offer in their history
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	lowball := types.Offer{
+		ID:        utilities.MustGenerateIDString(),
+		UserID:    buyer.ID,
+		Product:   types.Product{ID: productID},
+		Amount:    1000,
+		Status:    types.OfferPending,
+		ExpiresAt: &expiresAt,
+	}
+	assert.NoError(t, repo.CreateOffer(ctx, &lowball), "Expected no error creating offer")
+	saved1, err := repo.GetOfferByID(ctx, lowball.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, types.OfferRejected, saved1.Status)
+	assert.Nil(t, saved1.ExpiresAt)
+	if assert.Len(t, saved1.Revisions, 2) {
+		assert.Equal(t, buyer.ID, saved1.Revisions[0].AuthorID)
+		assert.Equal(t, types.OfferPending, saved1.Revisions[0].Status)
+		assert.Empty(t, saved1.Revisions[1].AuthorID, "Expected the rejection by the system")
+	}
+
+	offer := types.Offer{
+		ID:        utilities.MustGenerateIDString(),
+		UserID:    buyer.ID,
+		Product:   types.Product{ID: productID},
+		Amount:    8000,
+		Status:    types.OfferPending,
+		ExpiresAt: &expiresAt,
+	}
+	assert.NoError(t, repo.CreateOffer(ctx, &offer), "Expected no error creating offer")
+	assert.Equal(t, types.OfferPending, offer.Status)
+	assert.Equal(t, types.ErrConstraintViolation, repo.CreateOffer(ctx, &types.Offer{
+		ID:      utilities.MustGenerateIDString(),
+		UserID:  buyer.ID,
+		Product: types.Product{ID: productID},
+		Amount:  8000,
+		Status:  types.OfferPending,
+	}), "Expected error for a second open offer")
+
+	// buyers can only accept countered offers
+	accept := types.Offer{ID: offer.ID, UserID: buyer.ID, Status: types.OfferAccepted}
+	assert.Equal(t, types.ErrConstraintViolation, repo.ReviseOffer(ctx, &accept, buyer.ID, types.OfferCountered))
+
+	counter := types.Offer{ID: offer.ID, Amount: 9000, Status: types.OfferCountered, ExpiresAt: &expiresAt}
+	assert.NoError(t, repo.ReviseOffer(ctx, &counter, admin.ID, types.OfferPending), "Expected no error countering offer")
+	assert.Equal(t, buyer.ID, counter.UserID)
+
+	// only the buyer responds to their offer
+	accept = types.Offer{ID: offer.ID, UserID: admin.ID, Status: types.OfferAccepted}
+	assert.Equal(t, types.ErrNotFound, repo.ReviseOffer(ctx, &accept, admin.ID, types.OfferCountered))
+
+	accept = types.Offer{ID: offer.ID, UserID: buyer.ID, Status: types.OfferAccepted}
+	assert.NoError(t, repo.ReviseOffer(ctx, &accept, buyer.ID, types.OfferCountered), "Expected no error accepting offer")
+	saved2, err := repo.GetOfferByIDAndUser(ctx, offer.ID, buyer.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, types.OfferAccepted, saved2.Status)
+	assert.Equal(t, int64(9000), saved2.Amount, "Expected the countered amount")
+	assert.Nil(t, saved2.ExpiresAt)
+	if assert.Len(t, saved2.Revisions, 3) {
+		assert.Equal(t, buyer.ID, saved2.Revisions[0].AuthorID)
+		assert.Empty(t, saved2.Revisions[1].AuthorID, "Expected the admin's counter-offer to be anonymous to the buyer")
+		assert.Equal(t, buyer.ID, saved2.Revisions[2].AuthorID)
+	}
+	saved2, err = repo.GetOfferByID(ctx, offer.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, admin.ID, saved2.Revisions[1].AuthorID)
+
+	var inventory int
+	err = dbPool.QueryRowContext(ctx, "SELECT inventory FROM products WHERE id = $1", productID).Scan(&inventory)
+	assert.NoError(t, err, "Expected no error fetching inventory")
+	assert.Equal(t, 1, inventory)
+
+	// open offers past their expiry are expired
+	expiredAt := time.Now().UTC().Add(-time.Minute)
+	stale := types.Offer{
+		ID:        utilities.MustGenerateIDString(),
+		UserID:    buyer.ID,
+		Product:   types.Product{ID: productID},
+		Amount:    7000,
+		Status:    types.OfferPending,
+		ExpiresAt: &expiredAt,
+	}
+	assert.NoError(t, repo.CreateOffer(ctx, &stale), "Expected no error creating offer")
+	count, err := repo.ExpireOffers(ctx, 1000)
+	assert.NoError(t, err, "Expected no error expiring offers")
+	assert.GreaterOrEqual(t, count, 1)
+	saved3, err := repo.GetOfferByID(ctx, stale.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, types.OfferExpired, saved3.Status)
+	assert.Nil(t, saved3.ExpiresAt)
+}
+
+func TestOfferCheckout(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	orderRepo := NewOrderRepository(dbPool)
+	repo := NewOfferRepository(dbPool)
+	ctx := context.Background()
+
+	buyer := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, buyer.ID)
+	addressID := createTestAddress(t, dbPool, buyer.ID)
+
+	productID := utilities.MustGenerateIDString()
+	_, err := dbPool.ExecContext(ctx, `
+		INSERT INTO products (id, name, price, summary, inventory, negotiable)
+		VALUES ($1, 'Negotiable Product', 10000, 'A negotiable product', 3, TRUE)
+	`, productID)
+	assert.NoError(t, err, "Expected no error creating product")
+	defer dbPool.ExecContext(ctx, "DELETE FROM products WHERE id = $1", productID)
+	defer dbPool.ExecContext(ctx, "DELETE FROM offers WHERE product_id = $1", productID)
+	defer dbPool.ExecContext(ctx, "DELETE FROM orders WHERE user_id = $1", buyer.ID)
+
+	inventory := func() int {
+		var inventory int
+		err := dbPool.QueryRowContext(ctx, "SELECT inventory FROM products WHERE id = $1", productID).Scan(&inventory)
+		assert.NoError(t, err, "Expected no error fetching inventory")
+		return inventory
+	}
+	acceptedOffer := func(expiresAt time.Time) types.Offer {
+		offer := types.Offer{
+			ID:      utilities.MustGenerateIDString(),
+			UserID:  buyer.ID,
+			Product: types.Product{ID: productID},
+			Amount:  7000,
+			Status:  types.OfferPending,
+		}
+		assert.NoError(t, repo.CreateOffer(ctx, &offer), "Expected no error creating offer")
+		offer.Status = types.OfferAccepted
+		offer.ExpiresAt = &expiresAt
+		assert.NoError(t, repo.ReviseOffer(ctx, &offer, buyer.ID), "Expected no error accepting offer")
+		return offer
+	}
+	offerOrder := func(offerID string) *types.Order {
+		return &types.Order{
+			ID:          utilities.MustGenerateIDString(),
+			UserID:      buyer.ID,
+			Address:     types.Address{ID: addressID},
+			Amount:      7000,
+			TotalAmount: 7000,
+			OfferID:     offerID,
+			Items:       []types.OrderItem{{Product: types.Product{ID: productID}, Quantity: 1, UnitPrice: 7000}},
+		}
+	}
+
+	// the offer's unit is reserved once
+	offer := acceptedOffer(time.Now().UTC().Add(time.Hour))
+	assert.Equal(t, 2, inventory())
+	order := offerOrder(offer.ID)
+	assert.NoError(t, orderRepo.CreateOrder(ctx, order), "Expected no error creating order")
+	assert.Equal(t, 2, inventory(), "Expected no further reservation")
+	saved, err := orderRepo.GetOrderByID(ctx, order.ID)
+	assert.NoError(t, err, "Expected no error fetching order")
+	assert.Equal(t, offer.ID, saved.OfferID)
+	assert.Equal(t, int64(7000), saved.Items[0].UnitPrice)
+
+	// canceling the order keeps the unit for the offer
+	order.Status = types.OrderCanceled
+	assert.NoError(t, orderRepo.UpdateOrder(ctx, order), "Expected no error canceling order")
+	assert.Equal(t, 2, inventory())
+
+	// paying completes the offer, once
+	order = offerOrder(offer.ID)
+	assert.NoError(t, orderRepo.CreateOrder(ctx, order), "Expected no error creating order")
+	other := offerOrder(offer.ID)
+	assert.NoError(t, orderRepo.CreateOrder(ctx, other), "Expected no error creating order")
+	order.Status = types.OrderPaid
+	assert.NoError(t, orderRepo.UpdateOrder(ctx, order), "Expected no error paying order")
+	assert.Equal(t, types.ErrConstraintViolation, orderRepo.UpdateOrder(ctx, order), "Expected error paying a paid order")
+	other.Status = types.OrderPaid
+	assert.Equal(t, types.ErrConstraintViolation, orderRepo.UpdateOrder(ctx, other), "Expected error paying for a completed offer")
+	unpaidOther, err := orderRepo.GetOrderByID(ctx, other.ID)
+	assert.NoError(t, err, "Expected no error fetching order")
+	assert.Equal(t, types.OrderPending, unpaidOther.Status)
+	completed, err := repo.GetOfferByID(ctx, offer.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, types.OfferCompleted, completed.Status)
+	assert.Nil(t, completed.ExpiresAt)
+	assert.Equal(t, 2, inventory())
+	assert.Equal(t, types.ErrConstraintViolation, orderRepo.CreateOrder(ctx, offerOrder(offer.ID)),
+		"Expected error checking out a completed offer")
+
+	// closing an accepted offer returns its unit and cancels its order
+	closed := acceptedOffer(time.Now().UTC().Add(time.Hour))
+	assert.Equal(t, 1, inventory())
+	order = offerOrder(closed.ID)
+	assert.NoError(t, orderRepo.CreateOrder(ctx, order), "Expected no error creating order")
+	closed.Status = types.OfferCanceled
+	assert.NoError(t, repo.ReviseOffer(ctx, &closed, buyer.ID, types.OfferAccepted), "Expected no error canceling offer")
+	assert.Equal(t, 2, inventory())
+	canceled, err := orderRepo.GetOrderByID(ctx, order.ID)
+	assert.NoError(t, err, "Expected no error fetching order")
+	assert.Equal(t, types.OrderCanceled, canceled.Status)
+	closed.Status = types.OfferAccepted
+	assert.Equal(t, types.ErrConstraintViolation, repo.ReviseOffer(ctx, &closed, buyer.ID, types.OfferPending),
+		"Expected error accepting a closed offer")
+
+	// unpaid offers expire, returning their unit and canceling their order
+	unpaid := acceptedOffer(time.Now().UTC().Add(-time.Minute))
+	assert.Equal(t, 1, inventory())
+	order = offerOrder(unpaid.ID)
+	assert.NoError(t, orderRepo.CreateOrder(ctx, order), "Expected no error creating order")
+	_, err = repo.ExpireOffers(ctx, 1000)
+	assert.NoError(t, err, "Expected no error expiring offers")
+	expired, err := repo.GetOfferByID(ctx, unpaid.ID)
+	assert.NoError(t, err, "Expected no error fetching offer")
+	assert.Equal(t, types.OfferExpired, expired.Status)
+	assert.Equal(t, 2, inventory())
+	canceled, err = orderRepo.GetOrderByID(ctx, order.ID)
+	assert.NoError(t, err, "Expected no error fetching order")
+	assert.Equal(t, types.OrderCanceled, canceled.Status)
+}
@@ -32,29 +32,50 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *types.Order) e
 	}
 	defer tx.Rollback()
 
-	// Cancel any existing pending order and restore its inventory
+	// Cancel any existing pending order and restore its inventory,
+	// unless held by an accepted offer
 	_, err = tx.ExecContext(ctx, `
 		WITH canceled AS (
 			UPDATE orders SET status = 'canceled', updated_at = NOW()
 			WHERE user_id = $1 AND status = 'pending'
-			RETURNING id
+			RETURNING id, offer_id
 		), restored AS (
-			DELETE FROM order_items
-			WHERE order_id IN (SELECT id FROM canceled)
-			RETURNING product_id, quantity
+			DELETE FROM order_items oi
+			USING canceled c
+			WHERE oi.order_id = c.id
+			RETURNING oi.product_id, oi.quantity, c.offer_id
 		)
 		UPDATE products
 		SET inventory = inventory + restored.quantity
 		FROM restored
-		WHERE products.id = restored.product_id`,
+		WHERE products.id = restored.product_id
+		AND NOT EXISTS (SELECT 1 FROM offers WHERE id = restored.offer_id AND status = 'accepted')`,
 		order.UserID)
 	if err != nil {
 		return err
 	}
 
-	// Reserve inventory (decrement stock, fail if insufficient)
+	// Reserve inventory (decrement stock, fail if insufficient),
+	// the unit of an accepted offer is already reserved by the offer
+	reserve := order.Items
+	if order.OfferID != "" {
+		var status types.OfferStatus
+		err = tx.QueryRowContext(ctx,
+			`SELECT status FROM offers WHERE id = $1 AND user_id = $2 FOR UPDATE`,
+			order.OfferID, order.UserID).Scan(&status)
+		if err == sql.ErrNoRows {
+			return types.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status != types.OfferAccepted {
+			return types.ErrConstraintViolation
+		}
+		reserve = nil
+	}
 	var insufStockErr types.InsufficientStockError
-	for _, item := range order.Items {
+	for _, item := range reserve {
 		res, err := tx.ExecContext(ctx, `
 			UPDATE products
 			SET inventory = inventory - $1
@@ -102,12 +123,12 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *types.Order) e
 
 	// Insert order with idempotency check
 	query := `
-		INSERT INTO orders (id, user_id, address_id, amount, tax_amount, shipping_amount, total_amount, status, idempotency_key)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, 'pending', $8)
+		INSERT INTO orders (id, user_id, address_id, amount, tax_amount, shipping_amount, total_amount, status, idempotency_key, offer_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 'pending', $8, NULLIF($9, '')::BIGINT)
 		ON CONFLICT (idempotency_key) WHERE idempotency_key IS NOT NULL
 		DO NOTHING`
 	res, err := tx.ExecContext(ctx, query, order.ID, order.UserID, order.Address.ID, order.Amount,
-		order.TaxAmount, order.ShippingAmount, order.TotalAmount, order.IdempotencyKey)
+		order.TaxAmount, order.ShippingAmount, order.TotalAmount, order.IdempotencyKey, order.OfferID)
 	if err != nil {
 		return err
 	}
@@ -208,8 +229,18 @@ func (r *orderRepository) GetOrders(ctx context.Context, page, limit int) ([]typ
 	return result, nil
 }
 
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
 // populateOrderItems populates the order items for a list of orders
 func (r *orderRepository) populateOrderItems(ctx context.Context, orderID string) ([]types.OrderItem, error) {
+	return queryOrderItems(ctx, r.db, orderID)
+}
+
+// queryOrderItems returns the items of an order, within a transaction if one is given
+func queryOrderItems(ctx context.Context, q queryer, orderID string) ([]types.OrderItem, error) {
 	query := `
 		SELECT
 			product_id,
@@ -222,7 +253,7 @@ func (r *orderRepository) populateOrderItems(ctx context.Context, orderID string
 		FROM v_order_items
 		WHERE order_id = $1
 	`
-	rows, err := r.db.QueryContext(ctx, query, orderID)
+	rows, err := q.QueryContext(ctx, query, orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -256,14 +287,21 @@ func (r *orderRepository) populateOrderItems(ctx context.Context, orderID string
 
 func (r *orderRepository) GetOrderByIDAndUser(ctx context.Context, orderID, userID string) (types.Order, error) {
 	var order types.Order
+	var carrier, number sql.NullString
+	var trackingURL *string
 	query := `
 		SELECT
 			o.id,
 			o.user_id,
 			o.amount,
 			o.tax_amount,
+			o.shipping_amount,
 			o.total_amount,
 			o.status,
+			o.tracking_carrier,
+			o.tracking_number,
+			o.tracking_url,
+			COALESCE(o.offer_id::TEXT, ''),
 			o.address_id,
 			a.name,
 			a.line1,
@@ -287,8 +325,13 @@ func (r *orderRepository) GetOrderByIDAndUser(ctx context.Context, orderID, user
 		&order.UserID,
 		&order.Amount,
 		&order.TaxAmount,
+		&order.ShippingAmount,
 		&order.TotalAmount,
 		&order.Status,
+		&carrier,
+		&number,
+		&trackingURL,
+		&order.OfferID,
 		&order.Address.ID,
 		&order.Address.Name,
 		&order.Address.Line1,
@@ -307,6 +350,7 @@ func (r *orderRepository) GetOrderByIDAndUser(ctx context.Context, orderID, user
 	if err != nil {
 		return order, err
 	}
+	order.Tracking = tracking(carrier, number, trackingURL)
 
 	// Populate order items
 	if order.Items, err = r.populateOrderItems(ctx, order.ID); err != nil {
@@ -356,6 +400,8 @@ func (r *orderRepository) GetOrderByIDPublic(ctx context.Context, orderID string
 
 func (r *orderRepository) GetOrderByID(ctx context.Context, orderID string) (types.Order, error) {
 	var order types.Order
+	var carrier, number sql.NullString
+	var trackingURL *string
 	order.Address = types.Address{}
 	query := `
 		SELECT
@@ -363,8 +409,13 @@ func (r *orderRepository) GetOrderByID(ctx context.Context, orderID string) (typ
 			o.user_id,
 			o.amount,
 			o.tax_amount,
+			o.shipping_amount,
 			o.total_amount,
 			o.status,
+			o.tracking_carrier,
+			o.tracking_number,
+			o.tracking_url,
+			COALESCE(o.offer_id::TEXT, ''),
 			o.address_id,
 			a.name,
 			a.line1,
@@ -385,8 +436,13 @@ func (r *orderRepository) GetOrderByID(ctx context.Context, orderID string) (typ
 		&order.UserID,
 		&order.Amount,
 		&order.TaxAmount,
+		&order.ShippingAmount,
 		&order.TotalAmount,
 		&order.Status,
+		&carrier,
+		&number,
+		&trackingURL,
+		&order.OfferID,
 		&order.Address.ID,
 		&order.Address.Name,
 		&order.Address.Line1,
@@ -405,6 +461,7 @@ func (r *orderRepository) GetOrderByID(ctx context.Context, orderID string) (typ
 	if err != nil {
 		return order, err
 	}
+	order.Tracking = tracking(carrier, number, trackingURL)
 
 	// Populate order items for this order
 	if order.Items, err = r.populateOrderItems(ctx, order.ID); err != nil {
@@ -414,6 +471,17 @@ func (r *orderRepository) GetOrderByID(ctx context.Context, orderID string) (typ
 	return order, nil
 }
 
+// tracking returns the shipment tracking details of an order, or nil if it has not shipped
+func tracking(carrier, number sql.NullString, url *string) *types.Tracking {
+	if !carrier.Valid && !number.Valid {
+		return nil
+	}
+	return &types.Tracking{Carrier: carrier.String, Number: number.String, URL: url}
+}
+
+// UpdateOrder sets the status and tracking of an order. Only pending orders are paid, completing the
+// offer checked out, if any. Returns ErrConstraintViolation when the order is no longer pending, or its
+// offer is no longer accepted, leaving the order as is.
 func (r *orderRepository) UpdateOrder(ctx context.Context, order *types.Order) error {
 	// Begin a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
@@ -422,18 +490,36 @@ func (r *orderRepository) UpdateOrder(ctx context.Context, order *types.Order) e
 	}
 	defer tx.Rollback()
 
+	var carrier, number, trackingURL *string
+	if order.Tracking != nil {
+		carrier, number, trackingURL = &order.Tracking.Carrier, &order.Tracking.Number, order.Tracking.URL
+	}
 	query := `
-		UPDATE orders SET status = $1, updated_at = NOW()
-		WHERE id = $2
-		RETURNING user_id
+		UPDATE orders SET
+			status = $1,
+			tracking_carrier = COALESCE($3, tracking_carrier),
+			tracking_number = COALESCE($4, tracking_number),
+			tracking_url = COALESCE($5, tracking_url),
+			updated_at = NOW()
+		WHERE id = $2 AND ($1 != 'paid' OR status = 'pending')
+		RETURNING user_id, COALESCE(offer_id::TEXT, '')
 	`
-	if err := tx.QueryRowContext(ctx, query, order.Status, order.ID).Scan(&order.UserID); err != nil {
+	err = tx.QueryRowContext(ctx, query, order.Status, order.ID, carrier, number, trackingURL).Scan(&order.UserID, &order.OfferID)
+	if err == sql.ErrNoRows && order.Status == types.OrderPaid {
+		return types.ErrConstraintViolation
+	}
+	if err != nil {
 		return err
 	}
 
-	// restock inventory
+	// restock inventory, unless held by an accepted offer awaiting payment
+	var removed []types.OrderItem
 	if order.Status == types.OrderRefunded ||
 		order.Status == types.OrderCanceled {
+		// keep a copy of the items for the event, as they are deleted below
+		if removed, err = queryOrderItems(ctx, tx, order.ID); err != nil {
+			return err
+		}
 		query = `
 			WITH deleted_items AS (
 				DELETE FROM order_items oi
@@ -444,14 +530,22 @@ func (r *orderRepository) UpdateOrder(ctx context.Context, order *types.Order) e
 			SET inventory = inventory + di.quantity
 			FROM deleted_items di
 			WHERE products.id = di.product_id
+			AND NOT EXISTS (SELECT 1 FROM offers WHERE id = NULLIF($2, '')::BIGINT AND status = 'accepted')
 		`
-		if _, err := tx.ExecContext(ctx, query, order.ID); err != nil {
+		if _, err := tx.ExecContext(ctx, query, order.ID, order.OfferID); err != nil {
 			return err
 		}
 	}
 
-	// clear cart
-	if order.Status == types.OrderPaid {
+	// complete the offer checked out
+	if order.Status == types.OrderPaid && order.OfferID != "" {
+		if err := completeOffer(ctx, tx, order.OfferID); err != nil {
+			return err
+		}
+	}
+
+	// clear cart, offers are not bought from the cart
+	if order.Status == types.OrderPaid && order.OfferID == "" {
 		query = `
 			WITH ordered AS (
 				SELECT product_id, quantity
@@ -475,5 +569,15 @@ func (r *orderRepository) UpdateOrder(ctx context.Context, order *types.Order) e
 		}
 	}
 
+	err = insertEvent(ctx, tx, "order", order.ID, types.EventTypeOrderStatusChanged, types.OrderStatusChange{
+		OrderID: order.ID,
+		UserID:  order.UserID,
+		Status:  order.Status,
+		Items:   removed,
+	})
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
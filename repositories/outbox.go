@@ -0,0 +1,128 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
+)
+
+type OutboxRepository interface {
+	ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]types.DomainEvent, error)
+	UpdateEvent(ctx context.Context, event *types.DomainEvent) error
+}
+
+type outboxRepository struct {
+	db *sql.DB
+}
+
+func NewOutboxRepository(db *sql.DB) OutboxRepository {
+	return &outboxRepository{db: db}
+}
+
+// insertEvent records a domain event as part of tx, so it is dispatched if and only if tx commits
+func insertEvent(ctx context.Context, tx *sql.Tx, aggregateType, aggregateID string, eventType types.DomainEventType, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO outbox_events (aggregate_type, aggregate_id, event_type, payload)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err = tx.ExecContext(ctx, query, aggregateType, aggregateID, eventType, payload)
+	return err
+}
+
+// ClaimEvents returns pending events which are due, oldest first.
+// An event is only returned once every earlier pending event of its aggregate has been handled,
+// so handlers observe the events of an aggregate in order.
+// Claimed events are pushed back by lease, so other instances skip them while they are being handled.
+func (r *outboxRepository) ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]types.DomainEvent, error) {
+	query := `
+		WITH due AS (
+			SELECT e.id
+			FROM outbox_events e
+			WHERE e.status = 'pending'
+				AND e.next_attempt_at <= NOW()
+				AND NOT EXISTS (
+					SELECT 1
+					FROM outbox_events p
+					WHERE p.aggregate_type = e.aggregate_type
+						AND p.aggregate_id = e.aggregate_id
+						AND p.status = 'pending'
+						AND p.id < e.id
+				)
+			ORDER BY e.id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE outbox_events e
+		SET next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM due
+		WHERE e.id = due.id
+		RETURNING e.id, e.aggregate_type, e.aggregate_id, e.event_type, e.payload, e.status,
+			e.attempts, e.handled, e.last_error, e.next_attempt_at, e.processed_at, e.created_at
+	`
+	rows, err := r.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []types.DomainEvent{}
+	for rows.Next() {
+		var event types.DomainEvent
+		var payload []byte
+		if err := rows.Scan(
+			&event.ID,
+			&event.AggregateType,
+			&event.AggregateID,
+			&event.Type,
+			&payload,
+			&event.Status,
+			&event.Attempts,
+			pq.Array(&event.Handled),
+			&event.LastError,
+			&event.NextAttemptAt,
+			&event.ProcessedAt,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// UpdateEvent records the outcome of handling an event
+func (r *outboxRepository) UpdateEvent(ctx context.Context, event *types.DomainEvent) error {
+	query := `
+		UPDATE outbox_events
+		SET status = $2, attempts = $3, handled = $4, last_error = $5,
+			next_attempt_at = $6, processed_at = $7
+		WHERE id = $1
+	`
+	res, err := r.db.ExecContext(ctx, query,
+		event.ID,
+		event.Status,
+		event.Attempts,
+		pq.Array(event.Handled),
+		event.LastError,
+		event.NextAttemptAt,
+		event.ProcessedAt,
+	)
+	if err != nil {
+		return err
+	}
+	// lib/pq always returns nil error for RowsAffected()
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
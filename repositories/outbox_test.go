@@ -0,0 +1,63 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimEvents_OrderedPerAggregate(t *testing.T) {
+	repo := NewOutboxRepository(dbPool)
+	ctx := context.Background()
+	orderID := utilities.MustGenerateIDString()
+	defer dbPool.ExecContext(ctx, "DELETE FROM outbox_events WHERE aggregate_type = 'order' AND aggregate_id = $1", orderID)
+
+	tx, err := dbPool.BeginTx(ctx, nil)
+	assert.NoError(t, err, "Expected no error starting transaction")
+	for _, status := range []types.OrderStatus{types.OrderPaid, types.OrderShipped} {
+		change := types.OrderStatusChange{OrderID: orderID, Status: status}
+		err = insertEvent(ctx, tx, "order", orderID, types.EventTypeOrderStatusChanged, change)
+		assert.NoError(t, err, "Expected no error inserting event")
+	}
+	assert.NoError(t, tx.Commit(), "Expected no error committing transaction")
+
+	// only the first event of the order is claimed while it is pending
+	events, err := repo.ClaimEvents(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming events")
+	claimed := eventsOf(events, orderID)
+	assert.Len(t, claimed, 1, "Expected a single event of the order to be claimed")
+	assert.Contains(t, string(claimed[0].Payload), string(types.OrderPaid))
+
+	// claimed events are leased
+	events, err = repo.ClaimEvents(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming events")
+	assert.Empty(t, eventsOf(events, orderID), "Expected leased event to be skipped")
+
+	now := time.Now().UTC()
+	claimed[0].Status = types.DomainEventProcessed
+	claimed[0].Attempts = 1
+	claimed[0].Handled = []string{"notifications"}
+	claimed[0].ProcessedAt = &now
+	err = repo.UpdateEvent(ctx, &claimed[0])
+	assert.NoError(t, err, "Expected no error updating event")
+
+	events, err = repo.ClaimEvents(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming events")
+	claimed = eventsOf(events, orderID)
+	assert.Len(t, claimed, 1, "Expected the next event of the order to be claimed")
+	assert.Contains(t, string(claimed[0].Payload), string(types.OrderShipped))
+}
+
+func eventsOf(events []types.DomainEvent, aggregateID string) []types.DomainEvent {
+	var matching []types.DomainEvent
+	for _, event := range events {
+		if event.AggregateID == aggregateID {
+			matching = append(matching, event)
+		}
+	}
+	return matching
+}
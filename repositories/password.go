@@ -101,12 +101,18 @@ func (r *passwordRepository) MarkResetCodeUsed(ctx context.Context, email string
 	return nil
 }
 
-// UpdatePassword updates a user's password
+// UpdatePassword updates a user's password and revokes their refresh tokens,
+// so sessions started with the previous password cannot be renewed
 func (r *passwordRepository) UpdatePassword(ctx context.Context, email, password string) error {
 	query := `
-		UPDATE users
-		SET password_hash = $1, updated_at = NOW()
-		WHERE email = $2
+		WITH usr AS (
+			UPDATE users
+			SET password_hash = $1, updated_at = NOW()
+			WHERE email = $2
+			RETURNING id
+		)
+		UPDATE refresh_tokens SET revoked = true
+		WHERE user_id IN (SELECT id FROM usr)
 	`
 	_, err := r.db.ExecContext(ctx, query, string(password), email)
 	return err
@@ -0,0 +1,80 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type PermissionRepository interface {
+	GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error)
+	SetRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error
+}
+
+type permissionRepository struct {
+	db *sql.DB
+}
+
+func NewPermissionRepository(db *sql.DB) PermissionRepository {
+	return &permissionRepository{db: db}
+}
+
+func (r *permissionRepository) GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error) {
+	query := `
+		SELECT role, permission
+		FROM role_permissions
+		ORDER BY role, permission
+	`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rolePerms := []types.RolePermissions{}
+	for rows.Next() {
+		var role types.Role
+		var perm types.Permission
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		if len(rolePerms) == 0 || rolePerms[len(rolePerms)-1].Role != role {
+			rolePerms = append(rolePerms, types.RolePermissions{Role: role})
+		}
+		last := &rolePerms[len(rolePerms)-1]
+		last.Permissions = append(last.Permissions, perm)
+	}
+
+	// Check for errors from iterating over rows.
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rolePerms, nil
+}
+
+// SetRolePermissions replaces the permissions granted to a role
+func (r *permissionRepository) SetRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role = $1`, role); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO role_permissions (role, permission)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+	for _, perm := range permissions {
+		if _, err := tx.ExecContext(ctx, query, role, perm); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
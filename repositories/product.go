@@ -239,6 +239,23 @@ func (r *productRepository) UpdateProduct(ctx context.Context, product types.Pro
 	if product.Category != nil {
 		categoryID = sql.NullString{String: product.Category.ID, Valid: true}
 	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock product row to compare inventory
+	var inventory int
+	err = tx.QueryRowContext(ctx, `SELECT inventory FROM products WHERE id = $1 FOR UPDATE`, product.ID).Scan(&inventory)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
 	query := `UPDATE products SET
 		name = $1,
 		price = $2,
@@ -257,7 +274,7 @@ func (r *productRepository) UpdateProduct(ctx context.Context, product types.Pro
 		updated_at = NOW()
 		WHERE id = $15
 	`
-	res, err := r.db.ExecContext(ctx, query,
+	_, err = tx.ExecContext(ctx, query,
 		product.Name,
 		product.Price,
 		product.Summary,
@@ -277,12 +294,18 @@ func (r *productRepository) UpdateProduct(ctx context.Context, product types.Pro
 	if err != nil {
 		return err
 	}
-	// lib/pq always returns nil error for RowsAffected()
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		return types.ErrNotFound
+
+	if inventory != product.Inventory {
+		err = insertEvent(ctx, tx, "product", product.ID, types.EventTypeInventoryChanged, types.InventoryUpdate{
+			ProductID: product.ID,
+			Inventory: product.Inventory,
+		})
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+
+	return tx.Commit()
 }
 
 func (r *productRepository) RemoveProduct(ctx context.Context, id string) error {
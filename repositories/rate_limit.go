@@ -10,6 +10,7 @@ import (
 type RateLimitRepository interface {
 	GetHitCount(ctx context.Context, rl *types.RateLimit) error
 	RecordHit(ctx context.Context, rl *types.RateLimit) error
+	RecordKeyHit(ctx context.Context, rl *types.RateLimit) error
 }
 
 type rateLimitRepository struct {
@@ -34,6 +35,20 @@ func (r *rateLimitRepository) RecordHit(ctx context.Context, rl *types.RateLimit
 	return r.db.QueryRowContext(ctx, query, rl.IPAddress, rl.Path, rl.ExpiresAt).Scan(&rl.HitCount)
 }
 
+// RecordKeyHit counts a hit against rl.Path in a fixed window, regardless of IP address.
+// rl.ExpiresAt sets the end of the window when a new one starts, and is ignored otherwise.
+func (r *rateLimitRepository) RecordKeyHit(ctx context.Context, rl *types.RateLimit) error {
+	query := `
+		INSERT INTO key_rate_limits (key, expires_at, hit_count)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (key) DO UPDATE
+		SET hit_count = CASE WHEN key_rate_limits.expires_at <= NOW() THEN 1 ELSE key_rate_limits.hit_count + 1 END,
+		expires_at = CASE WHEN key_rate_limits.expires_at <= NOW() THEN $2 ELSE key_rate_limits.expires_at END
+		RETURNING hit_count, expires_at
+	`
+	return r.db.QueryRowContext(ctx, query, rl.Path, rl.ExpiresAt).Scan(&rl.HitCount, &rl.ExpiresAt)
+}
+
 func (r *rateLimitRepository) GetHitCount(ctx context.Context, rl *types.RateLimit) error {
 	query := `
 		SELECT hit_count
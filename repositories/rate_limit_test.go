@@ -152,6 +152,39 @@ func TestGetHitCount_ExceedLimit(t *testing.T) {
 	assert.Equal(t, 4, rl.HitCount, "Expected hit count to be 4")
 }
 
+func TestRecordKeyHit_FixedWindow(t *testing.T) {
+	repo := NewRateLimitRepository(dbPool)
+	ctx := context.Background()
+
+	key := generateTestEndpoint("api_key")
+	defer func() {
+		_, err := dbPool.ExecContext(ctx, "DELETE FROM key_rate_limits WHERE key = $1", key)
+		assert.NoError(t, err, "Expected no error cleaning up key rate limit")
+	}()
+
+	windowEnd := time.Now().UTC().Add(time.Hour).Truncate(time.Microsecond)
+	rl := &types.RateLimit{Path: key, ExpiresAt: windowEnd}
+	err := repo.RecordKeyHit(ctx, rl)
+	assert.NoError(t, err, "Expected no error on first hit")
+	assert.Equal(t, 1, rl.HitCount, "Expected hit count to be 1")
+
+	// Later hits count towards the same window, without extending it
+	rl = &types.RateLimit{Path: key, ExpiresAt: windowEnd.Add(time.Minute)}
+	err = repo.RecordKeyHit(ctx, rl)
+	assert.NoError(t, err, "Expected no error on second hit")
+	assert.Equal(t, 2, rl.HitCount, "Expected hit count to be 2")
+	assert.True(t, windowEnd.Equal(rl.ExpiresAt), "Expected window end to be unchanged")
+
+	// Once the window has passed, counting starts over
+	_, err = dbPool.ExecContext(ctx, "UPDATE key_rate_limits SET expires_at = NOW() - INTERVAL '1 second' WHERE key = $1", key)
+	assert.NoError(t, err, "Expected no error expiring window")
+	rl = &types.RateLimit{Path: key, ExpiresAt: windowEnd.Add(time.Hour)}
+	err = repo.RecordKeyHit(ctx, rl)
+	assert.NoError(t, err, "Expected no error on hit in new window")
+	assert.Equal(t, 1, rl.HitCount, "Expected hit count to start over")
+	assert.True(t, windowEnd.Add(time.Hour).Equal(rl.ExpiresAt), "Expected a new window")
+}
+
 // Helper function to generate unique test IP addresses
 func generateTestIP() string {
 	return fmt.Sprintf("192.168.%d.%d",
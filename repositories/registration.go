@@ -10,7 +10,8 @@ import (
 
 type RegistrationRepository interface {
 	CreateCode(ctx context.Context, userID, code string, expires time.Time) error
-	VerifyCode(ctx context.Context, code string) (*types.User, error)
+	VerifyCode(ctx context.Context, email, code string) (*types.User, error)
+	RemoveCodes(ctx context.Context, email string) (*types.User, error)
 }
 
 type registrationRepository struct {
@@ -30,7 +31,8 @@ func (r *registrationRepository) CreateCode(ctx context.Context, userID, code st
 	return err
 }
 
-func (r *registrationRepository) VerifyCode(ctx context.Context, code string) (*types.User, error) {
+// VerifyCode verifies the account with the email, when the code was issued to it
+func (r *registrationRepository) VerifyCode(ctx context.Context, email, code string) (*types.User, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
@@ -42,14 +44,14 @@ func (r *registrationRepository) VerifyCode(ctx context.Context, code string) (*
 	query := `
 		UPDATE users
 		SET verified = true, updated_at = NOW()
-		WHERE id = (
+		WHERE email = $1 AND id = (
 			SELECT user_id
 			FROM registration_codes
-			WHERE code = $1 AND expires_at > NOW()
+			WHERE code = $2 AND expires_at > NOW()
 		)
 		RETURNING id, email, role
 	`
-	err = tx.QueryRowContext(ctx, query, code).Scan(&usr.ID, &usr.Email, &usr.Role)
+	err = tx.QueryRowContext(ctx, query, email, code).Scan(&usr.ID, &usr.Email, &usr.Role)
 	if err == sql.ErrNoRows {
 		return nil, types.ErrNotFound
 	}
@@ -72,3 +74,28 @@ func (r *registrationRepository) VerifyCode(ctx context.Context, code string) (*
 
 	return &usr, nil
 }
+
+// RemoveCodes removes the registration codes of the unverified account with the email,
+// and returns the account
+func (r *registrationRepository) RemoveCodes(ctx context.Context, email string) (*types.User, error) {
+	var usr types.User
+	query := `
+		WITH usr AS (
+			SELECT id, email, role
+			FROM users
+			WHERE email = $1 AND verified = false
+		), removed AS (
+			DELETE FROM registration_codes
+			WHERE user_id IN (SELECT id FROM usr)
+		)
+		SELECT id, email, role FROM usr
+	`
+	err := r.db.QueryRowContext(ctx, query, email).Scan(&usr.ID, &usr.Email, &usr.Role)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &usr, nil
+}
@@ -0,0 +1,62 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type RevocationRepository interface {
+	RevokeTokens(ctx context.Context, userID string) (time.Time, error)
+	GetRevocations(ctx context.Context, window time.Duration) (map[string]time.Time, error)
+}
+
+type revocationRepository struct {
+	db *sql.DB
+}
+
+func NewRevocationRepository(db *sql.DB) RevocationRepository {
+	return &revocationRepository{db: db}
+}
+
+// RevokeTokens invalidates all access tokens issued to the user before now
+func (r *revocationRepository) RevokeTokens(ctx context.Context, userID string) (time.Time, error) {
+	query := `
+		INSERT INTO token_revocations (user_id, revoked_at)
+		VALUES ($1, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at
+		RETURNING revoked_at
+	`
+	var revokedAt time.Time
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&revokedAt)
+	return revokedAt, err
+}
+
+// GetRevocations returns revocations made within window, keyed by user ID.
+// Older revocations only affect tokens which have already expired.
+func (r *revocationRepository) GetRevocations(ctx context.Context, window time.Duration) (map[string]time.Time, error) {
+	query := `
+		SELECT user_id, revoked_at
+		FROM token_revocations
+		WHERE revoked_at > NOW() - make_interval(secs => $1)
+	`
+	rows, err := r.db.QueryContext(ctx, query, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := make(map[string]time.Time)
+	for rows.Next() {
+		var userID string
+		var revokedAt time.Time
+		if err := rows.Scan(&userID, &revokedAt); err != nil {
+			return nil, err
+		}
+		revocations[userID] = revokedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
@@ -0,0 +1,132 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
+)
+
+// streamChannel is the channel new stream events are announced on, with "<user_id>:<event_id>" as payload
+const streamChannel = "stream_events"
+
+type StreamRepository interface {
+	CreateEvent(ctx context.Context, event *types.StreamEvent) error
+	GetEvents(ctx context.Context, userID, afterID string, limit int) ([]types.StreamEvent, error)
+	GetLatestEventID(ctx context.Context, userID string) (string, error)
+	Listen(ctx context.Context, notify func(payload string)) error
+}
+
+type streamRepository struct {
+	db             *sql.DB
+	dataSourceName string // for the dedicated LISTEN connection
+}
+
+func NewStreamRepository(db *sql.DB, dataSourceName string) StreamRepository {
+	return &streamRepository{db: db, dataSourceName: dataSourceName}
+}
+
+// CreateEvent stores the event and announces it to listeners once committed.
+// Events are numbered per user, and the user's sequence row stays locked until the event commits,
+// so their events commit in ID order and streams reading after an ID never skip one.
+func (r *streamRepository) CreateEvent(ctx context.Context, event *types.StreamEvent) error {
+	query := `
+		WITH seq AS (
+			INSERT INTO stream_sequences (user_id, seq)
+			VALUES ($1, 1)
+			ON CONFLICT (user_id) DO UPDATE SET seq = stream_sequences.seq + 1
+			RETURNING seq
+		), event AS (
+			INSERT INTO stream_events (user_id, seq, type, data)
+			SELECT $1, seq, $2, $3 FROM seq
+			RETURNING seq, created_at
+		)
+		SELECT seq, created_at, pg_notify($4, $1 || ':' || seq)
+		FROM event
+	`
+	var notified string
+	return r.db.QueryRowContext(ctx, query,
+		event.UserID,
+		event.Type,
+		event.Data,
+		streamChannel,
+	).Scan(&event.ID, &event.CreatedAt, &notified)
+}
+
+// GetEvents returns the user's events after the given event ID, oldest first
+func (r *streamRepository) GetEvents(ctx context.Context, userID, afterID string, limit int) ([]types.StreamEvent, error) {
+	query := `
+		SELECT seq, user_id, type, data, created_at
+		FROM stream_events
+		WHERE user_id = $1 AND seq > $2
+		ORDER BY seq
+		LIMIT $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []types.StreamEvent{}
+	for rows.Next() {
+		var event types.StreamEvent
+		if err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Type,
+			&event.Data,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// GetLatestEventID returns the ID of the user's latest event, "0" when there are none
+func (r *streamRepository) GetLatestEventID(ctx context.Context, userID string) (string, error) {
+	query := `SELECT COALESCE((SELECT seq FROM stream_sequences WHERE user_id = $1), 0)`
+	var id string
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&id)
+	return id, err
+}
+
+// Listen calls notify with the payload of each announced event until ctx is canceled.
+// notify is called with an empty payload after reconnecting, as events may have been missed.
+func (r *streamRepository) Listen(ctx context.Context, notify func(payload string)) error {
+	listener := pq.NewListener(r.dataSourceName, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				slog.WarnContext(ctx, "Stream listener connection error", "error", err)
+			}
+		})
+	defer listener.Close()
+
+	if err := listener.Listen(streamChannel); err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(time.Minute)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			if n == nil {
+				// the connection was re-established
+				notify("")
+				continue
+			}
+			notify(n.Extra)
+		case <-ping.C:
+			// detects a lost connection when no notifications arrive
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEvents(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewStreamRepository(dbPool, "")
+	ctx := context.Background()
+	user := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, user.ID)
+
+	latestID, err := repo.GetLatestEventID(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error fetching latest event ID")
+	assert.Equal(t, "0", latestID, "Expected no events for a new user")
+
+	data, _ := json.Marshal(types.InboxUnread{Count: 1})
+	first := types.StreamEvent{UserID: user.ID, Type: types.StreamUnread, Data: data}
+	second := types.StreamEvent{UserID: user.ID, Type: types.StreamUnread, Data: data}
+	assert.NoError(t, repo.CreateEvent(ctx, &first), "Expected no error creating event")
+	assert.NoError(t, repo.CreateEvent(ctx, &second), "Expected no error creating event")
+	assert.Equal(t, "1", first.ID, "Expected events to be numbered per user")
+	assert.Equal(t, "2", second.ID, "Expected events to be numbered per user")
+	assert.False(t, first.CreatedAt.IsZero(), "Expected created at to be set")
+
+	latestID, err = repo.GetLatestEventID(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error fetching latest event ID")
+	assert.Equal(t, second.ID, latestID)
+
+	events, err := repo.GetEvents(ctx, user.ID, first.ID, 10)
+	assert.NoError(t, err, "Expected no error fetching events")
+	assert.Len(t, events, 1, "Expected only events after the given ID")
+	assert.Equal(t, second.ID, events[0].ID)
+	assert.Equal(t, types.StreamUnread, events[0].Type)
+	assert.JSONEq(t, `{"count":1}`, string(events[0].Data))
+
+	events, err = repo.GetEvents(ctx, user.ID, "0", 1)
+	assert.NoError(t, err, "Expected no error fetching events")
+	assert.Len(t, events, 1, "Expected no more events than the limit")
+	assert.Equal(t, first.ID, events[0].ID)
+}
@@ -0,0 +1,99 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+type TemplateRepository interface {
+	CreateVersion(ctx context.Context, version *types.TemplateVersion) error
+	GetVersions(ctx context.Context, name, language string) ([]types.TemplateVersion, error)
+	GetLatestVersions(ctx context.Context, language string) ([]types.TemplateVersion, error)
+}
+
+type templateRepository struct {
+	db *sql.DB
+}
+
+func NewTemplateRepository(db *sql.DB) TemplateRepository {
+	return &templateRepository{db: db}
+}
+
+// CreateVersion saves the next version of a template.
+// Returns ErrUniqueConstraintViolation when another version was saved concurrently.
+func (r *templateRepository) CreateVersion(ctx context.Context, version *types.TemplateVersion) error {
+	query := `
+		INSERT INTO template_versions (id, name, language, version, body, created_by)
+		SELECT $1, $2, $3, COALESCE(MAX(version), 0) + 1, $4, NULLIF($5, '')::BIGINT
+		FROM template_versions
+		WHERE name = $2 AND language = $3
+		RETURNING version, created_at
+	`
+	err := r.db.QueryRowContext(ctx, query,
+		version.ID,
+		version.Name,
+		version.Language,
+		version.Body,
+		version.CreatedBy,
+	).Scan(&version.Version, &version.CreatedAt)
+	if isUniqueViolation(err) {
+		return types.ErrUniqueConstraintViolation
+	}
+	return err
+}
+
+const templateVersionColumns = `id, name, language, version, body, COALESCE(created_by::TEXT, ''), created_at`
+
+func scanTemplateVersion(row rowScanner, version *types.TemplateVersion) error {
+	return row.Scan(
+		&version.ID,
+		&version.Name,
+		&version.Language,
+		&version.Version,
+		&version.Body,
+		&version.CreatedBy,
+		&version.CreatedAt,
+	)
+}
+
+// GetVersions returns the versions of a template, newest first
+func (r *templateRepository) GetVersions(ctx context.Context, name, language string) ([]types.TemplateVersion, error) {
+	query := `
+		SELECT ` + templateVersionColumns + `
+		FROM template_versions
+		WHERE name = $1 AND language = $2
+		ORDER BY version DESC
+	`
+	return r.queryVersions(ctx, query, name, language)
+}
+
+// GetLatestVersions returns the latest version of each edited template, including reverted ones
+func (r *templateRepository) GetLatestVersions(ctx context.Context, language string) ([]types.TemplateVersion, error) {
+	query := `
+		SELECT DISTINCT ON (name) ` + templateVersionColumns + `
+		FROM template_versions
+		WHERE language = $1
+		ORDER BY name, version DESC
+	`
+	return r.queryVersions(ctx, query, language)
+}
+
+func (r *templateRepository) queryVersions(ctx context.Context, query string, args ...interface{}) ([]types.TemplateVersion, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []types.TemplateVersion{}
+	for rows.Next() {
+		var version types.TemplateVersion
+		if err := scanTemplateVersion(rows, &version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,51 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateVersions(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewTemplateRepository(dbPool)
+	ctx := context.Background()
+	user := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, user.ID)
+
+	// unique language, so versions of previous runs are not counted
+	language := "x-" + utilities.MustGenerateIDString()
+	defer dbPool.ExecContext(ctx, "DELETE FROM template_versions WHERE language = $1", language)
+
+	first, second := "<p>first</p>", "<p>second</p>"
+	versions := []*types.TemplateVersion{
+		{ID: utilities.MustGenerateIDString(), Name: "email_order_shipped.html", Language: language, Body: &first, CreatedBy: user.ID},
+		{ID: utilities.MustGenerateIDString(), Name: "email_order_shipped.html", Language: language, Body: &second, CreatedBy: user.ID},
+		{ID: utilities.MustGenerateIDString(), Name: "email_order_delivered.html", Language: language, Body: &first},
+		{ID: utilities.MustGenerateIDString(), Name: "email_order_delivered.html", Language: language, Body: nil},
+	}
+	for _, version := range versions {
+		assert.NoError(t, repo.CreateVersion(ctx, version), "Expected no error creating version")
+	}
+	assert.Equal(t, 1, versions[0].Version)
+	assert.Equal(t, 2, versions[1].Version)
+	assert.Equal(t, 1, versions[2].Version)
+
+	history, err := repo.GetVersions(ctx, "email_order_shipped.html", language)
+	assert.NoError(t, err, "Expected no error fetching versions")
+	assert.Len(t, history, 2)
+	assert.Equal(t, 2, history[0].Version, "Expected newest version first")
+	assert.Equal(t, second, *history[0].Body)
+	assert.Equal(t, user.ID, history[0].CreatedBy)
+
+	latest, err := repo.GetLatestVersions(ctx, language)
+	assert.NoError(t, err, "Expected no error fetching latest versions")
+	assert.Len(t, latest, 2)
+	assert.Equal(t, "email_order_delivered.html", latest[0].Name)
+	assert.Nil(t, latest[0].Body, "Expected reverted template without body")
+	assert.Equal(t, "email_order_shipped.html", latest[1].Name)
+	assert.Equal(t, second, *latest[1].Body)
+}
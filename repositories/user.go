@@ -3,6 +3,7 @@ package repositories
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/dgyurics/marketplace/types"
 	"github.com/lib/pq"
@@ -14,6 +15,14 @@ type UserRepository interface {
 	// update
 	UpdateEmail(ctx context.Context, userID, newEmail string) (*types.User, error)
 	UpdatePassword(ctx context.Context, userID, newPasswordHash string) (*types.User, error)
+	UpdateRole(ctx context.Context, userID string, role types.Role) (*types.User, error)
+	UpdateProfile(ctx context.Context, userID string, name, phone *string) (*types.User, error)
+	CreateEmailChange(ctx context.Context, userID, newEmail, code string, expiresAt time.Time) error
+	ConfirmEmailChange(ctx context.Context, userID, code string) (*types.User, error)
+	AnonymizeUser(ctx context.Context, userID string) ([]string, error)
+	ExportUser(ctx context.Context, userID string) (*types.UserExport, error)
+	UpgradeGuest(ctx context.Context, userID, email, passwordHash string) (*types.User, error)
+	MergeUsers(ctx context.Context, sourceID, targetID string) error
 	// get
 	GetUserByEmail(ctx context.Context, email string) (*types.User, error)
 	GetUserByID(ctx context.Context, userID string) (*types.User, error)
@@ -112,18 +121,503 @@ func (r *userRepository) UpdatePassword(ctx context.Context, userID, newPassword
 	return &user, nil
 }
 
+func (r *userRepository) UpdateRole(ctx context.Context, userID string, role types.Role) (*types.User, error) {
+	updateQuery := `
+		UPDATE users
+		SET role = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING id, email, role, verified, created_at, updated_at
+	`
+	var user types.User
+	err := r.db.QueryRowContext(ctx, updateQuery, role, userID).
+		Scan(
+			&user.ID,
+			&user.Email,
+			&user.Role,
+			&user.Verified,
+			&user.CreatedAt,
+			&user.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *userRepository) UpdateProfile(ctx context.Context, userID string, name, phone *string) (*types.User, error) {
+	updateQuery := `
+		UPDATE users
+		SET name = $1, phone = $2, updated_at = NOW()
+		WHERE id = $3
+		RETURNING id, email, name, phone, role, verified, created_at, updated_at
+	`
+	var user types.User
+	err := r.db.QueryRowContext(ctx, updateQuery, name, phone, userID).
+		Scan(
+			&user.ID,
+			&user.Email,
+			&user.Name,
+			&user.Phone,
+			&user.Role,
+			&user.Verified,
+			&user.CreatedAt,
+			&user.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// CreateEmailChange stores a pending email change, replacing any previous request
+func (r *userRepository) CreateEmailChange(ctx context.Context, userID, newEmail, code string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO email_change_codes (user_id, new_email, code, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET new_email = EXCLUDED.new_email,
+				code = EXCLUDED.code,
+				expires_at = EXCLUDED.expires_at,
+				created_at = NOW()
+	`
+	_, err := r.db.ExecContext(ctx, query, userID, newEmail, code, expiresAt)
+	return err
+}
+
+// ConfirmEmailChange applies a pending email change if the code matches and has not expired
+func (r *userRepository) ConfirmEmailChange(ctx context.Context, userID, code string) (*types.User, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var newEmail string
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM email_change_codes
+		WHERE user_id = $1 AND code = $2 AND expires_at > NOW()
+		RETURNING new_email`,
+		userID, code).Scan(&newEmail)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user types.User
+	err = tx.QueryRowContext(ctx, `
+		UPDATE users
+		SET email = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING id, email, name, phone, role, verified, created_at, updated_at`,
+		newEmail, userID).
+		Scan(
+			&user.ID,
+			&user.Email,
+			&user.Name,
+			&user.Phone,
+			&user.Role,
+			&user.Verified,
+			&user.CreatedAt,
+			&user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return nil, types.ErrUniqueConstraintViolation
+	}
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AnonymizeUser removes personal data while keeping the user row, so that orders
+// and their shipping addresses are retained for accounting. Returns the IDs of the
+// deleted conversations, whose attachment files are removed by the caller.
+func (r *userRepository) AnonymizeUser(ctx context.Context, userID string) ([]string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Cancel any pending order and restore its inventory,
+	// unless held by an accepted offer
+	_, err = tx.ExecContext(ctx, `
+		WITH canceled AS (
+			UPDATE orders SET status = 'canceled', updated_at = NOW()
+			WHERE user_id = $1 AND status = 'pending'
+			RETURNING id, offer_id
+		), restored AS (
+			DELETE FROM order_items oi
+			USING canceled c
+			WHERE oi.order_id = c.id
+			RETURNING oi.product_id, oi.quantity, c.offer_id
+		)
+		UPDATE products
+		SET inventory = inventory + restored.quantity
+		FROM restored
+		WHERE products.id = restored.product_id
+		AND NOT EXISTS (SELECT 1 FROM offers WHERE id = restored.offer_id AND status = 'accepted')`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Release the units reserved by accepted offers before deleting them
+	offerRows, err := tx.QueryContext(ctx, `
+		SELECT id, product_id FROM offers
+		WHERE user_id = $1 AND status = 'accepted'
+		FOR UPDATE`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	var accepted []types.OfferStatusChange
+	for offerRows.Next() {
+		var change types.OfferStatusChange
+		if err := offerRows.Scan(&change.OfferID, &change.ProductID); err != nil {
+			offerRows.Close()
+			return nil, err
+		}
+		accepted = append(accepted, change)
+	}
+	offerRows.Close()
+	if err := offerRows.Err(); err != nil {
+		return nil, err
+	}
+	for _, change := range accepted {
+		if err := releaseOffer(ctx, tx, change); err != nil {
+			return nil, err
+		}
+	}
+
+	// Attachment files are kept per conversation
+	convRows, err := tx.QueryContext(ctx, `
+		DELETE FROM conversations WHERE recipient_id = $1
+		RETURNING id::TEXT`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	var conversationIDs []string
+	for convRows.Next() {
+		var id string
+		if err := convRows.Scan(&id); err != nil {
+			convRows.Close()
+			return nil, err
+		}
+		conversationIDs = append(conversationIDs, id)
+	}
+	convRows.Close()
+	if err := convRows.Err(); err != nil {
+		return nil, err
+	}
+
+	queries := []string{
+		`DELETE FROM cart_items WHERE user_id = $1`,
+		`DELETE FROM offers WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM password_reset_codes WHERE user_id = $1`,
+		`DELETE FROM registration_codes WHERE user_id = $1`,
+		`DELETE FROM email_change_codes WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM notification_preferences WHERE user_id = $1`,
+		`DELETE FROM webhooks WHERE user_id = $1`,
+		`DELETE FROM emails WHERE (SELECT email FROM users WHERE id = $1) = ANY(recipients)`,
+		// addresses not referenced by a completed order
+		`DELETE FROM addresses a
+		WHERE a.user_id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM orders o
+			WHERE o.address_id = a.id AND o.status != 'canceled'
+		)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET email = NULL,
+				name = NULL,
+				phone = NULL,
+				password_hash = NULL,
+				role = 'guest',
+				verified = false,
+				deleted_at = NOW(),
+				updated_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return nil, types.ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return conversationIDs, nil
+}
+
+// ExportUser collects the personal data held for a user.
+// IDs are exported as strings, matching the API.
+func (r *userRepository) ExportUser(ctx context.Context, userID string) (*types.UserExport, error) {
+	user, err := r.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT
+			COALESCE((
+				SELECT json_agg(a ORDER BY a.created_at)
+				FROM (
+					SELECT id::TEXT, name, line1, line2, city, state, postal_code, country, email, created_at
+					FROM addresses
+					WHERE user_id = $1
+				) a
+			), '[]'),
+			COALESCE((
+				SELECT json_agg(c ORDER BY c.created_at)
+				FROM (
+					SELECT ci.product_id::TEXT, p.name, ci.quantity, ci.unit_price, ci.created_at
+					FROM cart_items ci
+					JOIN products p ON p.id = ci.product_id
+					WHERE ci.user_id = $1
+				) c
+			), '[]'),
+			COALESCE((
+				SELECT json_agg(o ORDER BY o.created_at)
+				FROM (
+					SELECT
+						o.id::TEXT, o.status, o.amount, o.tax_amount, o.shipping_amount, o.total_amount,
+						o.address_id::TEXT, o.created_at,
+						COALESCE((
+							SELECT json_agg(json_build_object(
+								'product_id', oi.product_id::TEXT,
+								'name', p.name,
+								'quantity', oi.quantity,
+								'unit_price', oi.unit_price))
+							FROM order_items oi
+							JOIN products p ON p.id = oi.product_id
+							WHERE oi.order_id = o.id
+						), '[]') AS items
+					FROM orders o
+					WHERE o.user_id = $1
+				) o
+			), '[]'),
+			COALESCE((
+				SELECT json_agg(f ORDER BY f.created_at)
+				FROM (
+					SELECT id::TEXT, product_id::TEXT, amount, status, comment, created_at
+					FROM offers
+					WHERE user_id = $1
+				) f
+			), '[]'),
+			COALESCE((
+				SELECT json_agg(c ORDER BY c.created_at)
+				FROM (
+					SELECT
+						c.id::TEXT, c.type, c.subject, c.created_at,
+						COALESCE((
+							SELECT json_agg(json_build_object(
+								'id', m.id::TEXT,
+								'sender_id', m.sender_id::TEXT,
+								'body', m.body,
+								'attachments', COALESCE((
+									SELECT json_agg(json_build_object(
+										'id', a.id::TEXT,
+										'filename', a.filename,
+										'content_type', a.content_type,
+										'size', a.size,
+										'created_at', a.created_at) ORDER BY a.created_at)
+									FROM attachments a
+									WHERE a.message_id = m.id
+								), '[]'),
+								'created_at', m.created_at) ORDER BY m.created_at)
+							FROM messages m
+							WHERE m.conversation_id = c.id
+						), '[]') AS messages
+					FROM conversations c
+					WHERE c.recipient_id = $1 AND NOT c.is_deleted
+				) c
+			), '[]')
+	`
+	var addresses, cartItems, orders, offers, conversations []byte
+	err = r.db.QueryRowContext(ctx, query, userID).Scan(
+		&addresses,
+		&cartItems,
+		&orders,
+		&offers,
+		&conversations,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserExport{
+		User:          *user,
+		Addresses:     addresses,
+		CartItems:     cartItems,
+		Orders:        orders,
+		Offers:        offers,
+		Conversations: conversations,
+		ExportedAt:    time.Now().UTC(),
+	}, nil
+}
+
+// UpgradeGuest converts a guest user into a regular (unverified) user in place,
+// preserving the user ID and everything attached to it.
+// Returns ErrUniqueConstraintViolation when the email belongs to a verified account,
+// which the guest can merge into, and ErrConstraintViolation when it belongs to an
+// unverified account.
+func (r *userRepository) UpgradeGuest(ctx context.Context, userID, email, passwordHash string) (*types.User, error) {
+	query := `
+		UPDATE users
+		SET email = $1, password_hash = $2, role = 'user', verified = false, updated_at = NOW()
+		WHERE id = $3 AND role = 'guest'
+		RETURNING id, email, role, verified, updated_at
+	`
+	var user types.User
+	err := r.db.QueryRowContext(ctx, query, email, passwordHash, userID).
+		Scan(
+			&user.ID,
+			&user.Email,
+			&user.Role,
+			&user.Verified,
+			&user.UpdatedAt)
+	if isUniqueViolation(err) {
+		var verified bool
+		if err := r.db.QueryRowContext(ctx, `SELECT verified FROM users WHERE email = $1`, email).Scan(&verified); err != nil {
+			return nil, err
+		}
+		if !verified {
+			return nil, types.ErrConstraintViolation
+		}
+		return nil, types.ErrUniqueConstraintViolation
+	}
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// MergeUsers moves cart items, orders, addresses, offers and conversations
+// from a guest user to an existing user, then removes the guest.
+func (r *userRepository) MergeUsers(ctx context.Context, sourceID, targetID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Cancel the guest's pending order and restore its inventory, unless
+	// held by an accepted offer, which moves to the user with the unit
+	// still reserved. Only one pending order is allowed per user, and checkout
+	// recreates it from the merged cart.
+	_, err = tx.ExecContext(ctx, `
+		WITH canceled AS (
+			UPDATE orders SET status = 'canceled', updated_at = NOW()
+			WHERE user_id = $1 AND status = 'pending'
+			RETURNING id, offer_id
+		), restored AS (
+			DELETE FROM order_items oi
+			USING canceled c
+			WHERE oi.order_id = c.id
+			RETURNING oi.product_id, oi.quantity, c.offer_id
+		)
+		UPDATE products
+		SET inventory = inventory + restored.quantity
+		FROM restored
+		WHERE products.id = restored.product_id
+		AND NOT EXISTS (SELECT 1 FROM offers WHERE id = restored.offer_id AND status = 'accepted')`,
+		sourceID)
+	if err != nil {
+		return err
+	}
+
+	// Merge cart items, combining quantities for products in both carts
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO cart_items (user_id, product_id, quantity, unit_price)
+		SELECT $2, product_id, quantity, unit_price
+		FROM cart_items
+		WHERE user_id = $1
+		ON CONFLICT (user_id, product_id) DO UPDATE
+		SET quantity = cart_items.quantity + EXCLUDED.quantity,
+				unit_price = EXCLUDED.unit_price,
+				updated_at = NOW()`,
+		sourceID, targetID)
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`UPDATE orders SET user_id = $2, updated_at = NOW() WHERE user_id = $1`,
+		`UPDATE addresses SET user_id = $2, updated_at = NOW() WHERE user_id = $1`,
+		`UPDATE offers SET user_id = $2, updated_at = NOW() WHERE user_id = $1`,
+		`UPDATE conversations SET recipient_id = $2 WHERE recipient_id = $1`,
+		`UPDATE messages SET sender_id = $2 WHERE sender_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, sourceID, targetID); err != nil {
+			return err
+		}
+	}
+
+	// Remove the guest (cascades to remaining cart items and refresh tokens)
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1 AND role = 'guest'`, sourceID)
+	if err != nil {
+		return err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+
+	return tx.Commit()
+}
+
 func (r *userRepository) GetUserByID(ctx context.Context, userID string) (*types.User, error) {
 	var user types.User
 	query := `
-		SELECT id, email, password_hash, role
+		SELECT id, email, name, phone, password_hash, role, verified, created_at, updated_at
 		FROM users WHERE id = $1
 	`
 	err := r.db.QueryRowContext(ctx, query, userID).
 		Scan(
 			&user.ID,
 			&user.Email,
+			&user.Name,
+			&user.Phone,
 			&user.PasswordHash,
-			&user.Role)
+			&user.Role,
+			&user.Verified,
+			&user.CreatedAt,
+			&user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, types.ErrNotFound
@@ -2,7 +2,11 @@ package repositories
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
 	"testing"
+	"time"
 
 	"github.com/dgyurics/marketplace/types"
 	"github.com/dgyurics/marketplace/utilities"
@@ -98,3 +102,323 @@ func TestCreateGuest(t *testing.T) {
 	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", guestUser.ID)
 	assert.NoError(t, err, "Expected no error on guest user deletion")
 }
+
+func TestUpgradeGuest(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	guest := createUniqueGuestUser(t, repo)
+	email := fmt.Sprintf("upgraded%d@example.com", mathrand.Intn(1000000))
+
+	// Upgrade the guest in place
+	user, err := repo.UpgradeGuest(ctx, guest.ID, email, "hashedpassword")
+	assert.NoError(t, err, "Expected no error on guest upgrade")
+	assert.Equal(t, guest.ID, user.ID, "Expected user ID to be preserved")
+	assert.Equal(t, email, *user.Email, "Expected email to be set")
+	assert.Equal(t, types.RoleUser, user.Role, "Expected role to be 'user'")
+	assert.False(t, user.Verified, "Expected upgraded user to be unverified")
+
+	// A registered user cannot be upgraded again
+	_, err = repo.UpgradeGuest(ctx, guest.ID, email, "hashedpassword")
+	assert.Equal(t, types.ErrNotFound, err, "Expected ErrNotFound for non-guest user")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", guest.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+}
+
+func TestUpgradeGuest_EmailTaken(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+	guest := createUniqueGuestUser(t, repo)
+
+	_, err := repo.UpgradeGuest(ctx, guest.ID, *user.Email, "hashedpassword")
+	assert.Equal(t, types.ErrUniqueConstraintViolation, err, "Expected unique constraint violation")
+
+	// an unverified account cannot be merged into
+	_, err = dbPool.ExecContext(ctx, "UPDATE users SET verified = false WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error unverifying user")
+	_, err = repo.UpgradeGuest(ctx, guest.ID, *user.Email, "hashedpassword")
+	assert.Equal(t, types.ErrConstraintViolation, err, "Expected constraint violation for unverified account")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1 OR id = $2", user.ID, guest.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+}
+
+func TestMergeUsers(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	cartRepo := NewCartRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+	guest := createUniqueGuestUser(t, repo)
+
+	// Create products
+	productA := types.Product{ID: utilities.MustGenerateIDString()}
+	productB := types.Product{ID: utilities.MustGenerateIDString()}
+	for _, id := range []string{productA.ID, productB.ID} {
+		_, err := dbPool.ExecContext(ctx, `
+			INSERT INTO products (id, name, price, summary, inventory)
+			VALUES ($1, 'Test Product', 1000, 'Test product summary', 10)`,
+			id)
+		assert.NoError(t, err, "Expected no error on inserting test product")
+	}
+
+	// Both carts contain product A, only the guest cart contains product B
+	assert.NoError(t, cartRepo.AddItem(ctx, user.ID, &types.CartItem{Product: productA, Quantity: 1}))
+	assert.NoError(t, cartRepo.AddItem(ctx, guest.ID, &types.CartItem{Product: productA, Quantity: 2}))
+	assert.NoError(t, cartRepo.AddItem(ctx, guest.ID, &types.CartItem{Product: productB, Quantity: 1}))
+
+	// Guest has an address and a completed order
+	addressID := createTestAddress(t, dbPool, guest.ID)
+	orderID := utilities.MustGenerateIDString()
+	_, err := dbPool.ExecContext(ctx, `
+		INSERT INTO orders (id, user_id, address_id, status)
+		VALUES ($1, $2, $3, 'paid')`,
+		orderID, guest.ID, addressID)
+	assert.NoError(t, err, "Expected no error on inserting test order")
+
+	err = repo.MergeUsers(ctx, guest.ID, user.ID)
+	assert.NoError(t, err, "Expected no error on merge")
+
+	// Cart quantities are combined
+	cart, err := cartRepo.GetItems(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error on fetching cart")
+	quantities := map[string]int{}
+	for _, item := range cart {
+		quantities[item.Product.ID] = item.Quantity
+	}
+	assert.Equal(t, 3, quantities[productA.ID], "Expected combined quantity for product A")
+	assert.Equal(t, 1, quantities[productB.ID], "Expected product B to be moved")
+
+	// Order and address belong to the existing user
+	var owner string
+	err = dbPool.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE id = $1", orderID).Scan(&owner)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, owner, "Expected order to be moved")
+	err = dbPool.QueryRowContext(ctx, "SELECT user_id FROM addresses WHERE id = $1", addressID).Scan(&owner)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, owner, "Expected address to be moved")
+
+	// Guest is removed
+	_, err = repo.GetUserByID(ctx, guest.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected guest to be removed")
+
+	// Merging a non-guest into an existing guest fails, leaving both users in place
+	other := createUniqueGuestUser(t, repo)
+	err = repo.MergeUsers(ctx, user.ID, other.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected ErrNotFound when source is not a guest")
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.NoError(t, err, "Expected non-guest source to remain")
+	otherCart, err := cartRepo.GetItems(ctx, other.ID)
+	assert.NoError(t, err, "Expected no error on fetching cart")
+	assert.Empty(t, otherCart, "Expected failed merge to be rolled back")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1 OR id = $2", user.ID, other.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM products WHERE id = $1 OR id = $2", productA.ID, productB.ID)
+	assert.NoError(t, err, "Expected no error on deleting products")
+}
+
+func TestMergeUsers_OfferOrder(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+	guest := createUniqueGuestUser(t, repo)
+
+	// Guest checked out an accepted offer, its unit is reserved by the offer
+	productID := utilities.MustGenerateIDString()
+	_, err := dbPool.ExecContext(ctx, `
+		INSERT INTO products (id, name, price, summary, inventory)
+		VALUES ($1, 'Test Product', 1000, 'Test product summary', 10)`,
+		productID)
+	assert.NoError(t, err, "Expected no error on inserting test product")
+	offerID := utilities.MustGenerateIDString()
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO offers (id, user_id, product_id, amount, status)
+		VALUES ($1, $2, $3, 800, 'accepted')`,
+		offerID, guest.ID, productID)
+	assert.NoError(t, err, "Expected no error on inserting test offer")
+	addressID := createTestAddress(t, dbPool, guest.ID)
+	orderID := utilities.MustGenerateIDString()
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO orders (id, user_id, address_id, status, offer_id)
+		VALUES ($1, $2, $3, 'pending', $4)`,
+		orderID, guest.ID, addressID, offerID)
+	assert.NoError(t, err, "Expected no error on inserting test order")
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO order_items (order_id, product_id, quantity, unit_price)
+		VALUES ($1, $2, 1, 800)`,
+		orderID, productID)
+	assert.NoError(t, err, "Expected no error on inserting test order item")
+
+	err = repo.MergeUsers(ctx, guest.ID, user.ID)
+	assert.NoError(t, err, "Expected no error on merge")
+
+	// Order is canceled, the unit stays reserved by the offer now owned by the user
+	var status string
+	err = dbPool.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1", orderID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "canceled", status, "Expected pending order to be canceled")
+	var inventory int
+	err = dbPool.QueryRowContext(ctx, "SELECT inventory FROM products WHERE id = $1", productID).Scan(&inventory)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, inventory, "Expected inventory of the accepted offer not to be restored")
+	var owner string
+	err = dbPool.QueryRowContext(ctx, "SELECT user_id, status FROM offers WHERE id = $1", offerID).Scan(&owner, &status)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, owner, "Expected offer to be moved")
+	assert.Equal(t, "accepted", status, "Expected offer to remain accepted")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM orders WHERE id = $1", orderID)
+	assert.NoError(t, err, "Expected no error on order deletion")
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM products WHERE id = $1", productID)
+	assert.NoError(t, err, "Expected no error on deleting product")
+}
+
+func TestUpdateProfile(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+
+	updated, err := repo.UpdateProfile(ctx, user.ID, utilities.StringPtr("Jane Doe"), utilities.StringPtr("+1 555 0100"))
+	assert.NoError(t, err, "Expected no error on profile update")
+	assert.Equal(t, "Jane Doe", *updated.Name, "Expected name to be updated")
+	assert.Equal(t, "+1 555 0100", *updated.Phone, "Expected phone to be updated")
+
+	retrieved, err := repo.GetUserByID(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error on getting user by ID")
+	assert.Equal(t, updated.Name, retrieved.Name, "Expected name to be persisted")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+	newEmail := fmt.Sprintf("changed%d@example.com", mathrand.Intn(1000000))
+
+	err := repo.CreateEmailChange(ctx, user.ID, newEmail, "ABC123", time.Now().UTC().Add(time.Hour))
+	assert.NoError(t, err, "Expected no error on creating email change")
+
+	// Wrong code
+	_, err = repo.ConfirmEmailChange(ctx, user.ID, "XXXXXX")
+	assert.Equal(t, types.ErrNotFound, err, "Expected ErrNotFound for wrong code")
+
+	updated, err := repo.ConfirmEmailChange(ctx, user.ID, "ABC123")
+	assert.NoError(t, err, "Expected no error on confirming email change")
+	assert.Equal(t, newEmail, *updated.Email, "Expected email to be changed")
+
+	// Code is single use
+	_, err = repo.ConfirmEmailChange(ctx, user.ID, "ABC123")
+	assert.Equal(t, types.ErrNotFound, err, "Expected code to be consumed")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+}
+
+func TestAnonymizeUser(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+
+	// Address used by a paid order is kept, unused address is removed
+	orderAddressID := createTestAddress(t, dbPool, user.ID)
+	unusedAddressID := createTestAddress(t, dbPool, user.ID)
+	orderID := utilities.MustGenerateIDString()
+	_, err := dbPool.ExecContext(ctx, `
+		INSERT INTO orders (id, user_id, address_id, status)
+		VALUES ($1, $2, $3, 'paid')`,
+		orderID, user.ID, orderAddressID)
+	assert.NoError(t, err, "Expected no error on inserting test order")
+
+	// Accepted offer reserves a unit of the product
+	productID := utilities.MustGenerateIDString()
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO products (id, name, price, summary, inventory)
+		VALUES ($1, 'Test Product', 1000, 'Test product summary', 4)`,
+		productID)
+	assert.NoError(t, err, "Expected no error on inserting test product")
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO offers (id, user_id, product_id, amount, status)
+		VALUES ($1, $2, $3, 800, 'accepted')`,
+		utilities.MustGenerateIDString(), user.ID, productID)
+	assert.NoError(t, err, "Expected no error on inserting test offer")
+
+	// Conversations are deleted, returning their IDs
+	conversationID := utilities.MustGenerateIDString()
+	_, err = dbPool.ExecContext(ctx, `
+		INSERT INTO conversations (id, type, subject, recipient_id)
+		VALUES ($1, 'notification', 'Test subject', $2)`,
+		conversationID, user.ID)
+	assert.NoError(t, err, "Expected no error on inserting test conversation")
+
+	conversationIDs, err := repo.AnonymizeUser(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error on anonymizing user")
+	assert.Equal(t, []string{conversationID}, conversationIDs, "Expected deleted conversation IDs")
+
+	var inventory int
+	err = dbPool.QueryRowContext(ctx, "SELECT inventory FROM products WHERE id = $1", productID).Scan(&inventory)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, inventory, "Expected unit of the accepted offer to be restocked")
+
+	anonymized, err := repo.GetUserByID(ctx, user.ID)
+	assert.NoError(t, err, "Expected user row to be kept")
+	assert.Nil(t, anonymized.Email, "Expected email to be removed")
+	assert.Nil(t, anonymized.PasswordHash, "Expected password to be removed")
+
+	var count int
+	err = dbPool.QueryRowContext(ctx, "SELECT COUNT(*) FROM orders WHERE id = $1", orderID).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "Expected order to be kept")
+	err = dbPool.QueryRowContext(ctx, "SELECT COUNT(*) FROM addresses WHERE id = $1", unusedAddressID).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "Expected unused address to be removed")
+
+	// Anonymizing twice fails
+	_, err = repo.AnonymizeUser(ctx, user.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected ErrNotFound for deleted account")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM products WHERE id = $1", productID)
+	assert.NoError(t, err, "Expected no error on deleting product")
+}
+
+func TestExportUser(t *testing.T) {
+	repo := NewUserRepository(dbPool)
+	ctx := context.Background()
+
+	user := createUniqueTestUser(t, repo)
+	addressID := createTestAddress(t, dbPool, user.ID)
+
+	export, err := repo.ExportUser(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error on export")
+	assert.Equal(t, user.ID, export.User.ID, "Expected user to be exported")
+
+	var addresses []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(export.Addresses, &addresses))
+	assert.Len(t, addresses, 1, "Expected one address")
+	assert.Equal(t, addressID, addresses[0]["id"], "Expected address ID as string")
+	assert.JSONEq(t, "[]", string(export.Orders), "Expected no orders")
+
+	// Clean up
+	_, err = dbPool.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	assert.NoError(t, err, "Expected no error on user deletion")
+}
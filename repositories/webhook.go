@@ -0,0 +1,319 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/lib/pq"
+)
+
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, webhook *types.Webhook) error
+	GetWebhooks(ctx context.Context) ([]types.Webhook, error)
+	UpdateWebhook(ctx context.Context, webhook *types.Webhook) error
+	RemoveWebhook(ctx context.Context, id string) error
+	GetUserWebhook(ctx context.Context, userID string) (types.Webhook, error)
+	RemoveUserWebhook(ctx context.Context, userID string) error
+	GetSubscribers(ctx context.Context, event types.WebhookEvent) ([]types.Webhook, error)
+	CreateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error
+	GetDelivery(ctx context.Context, id string) (types.WebhookDelivery, error)
+	GetDeliveries(ctx context.Context, webhookID string, page, limit int) ([]types.WebhookDelivery, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]types.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error
+}
+
+type webhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) WebhookRepository {
+	return &webhookRepository{db: db}
+}
+
+func (r *webhookRepository) CreateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	query := `
+		INSERT INTO webhooks (id, url, secret, events, enabled, user_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::BIGINT)
+		RETURNING created_at, updated_at
+	`
+	return r.db.QueryRowContext(ctx, query,
+		webhook.ID,
+		webhook.URL,
+		webhook.Secret,
+		pq.Array(fromEvents(webhook.Events)),
+		webhook.Enabled,
+		webhook.UserID,
+	).Scan(&webhook.CreatedAt, &webhook.UpdatedAt)
+}
+
+// GetWebhooks returns every webhook not owned by a user, without signing secrets
+func (r *webhookRepository) GetWebhooks(ctx context.Context) ([]types.Webhook, error) {
+	query := `
+		SELECT id, url, events, enabled, created_at, updated_at
+		FROM webhooks
+		WHERE user_id IS NULL
+		ORDER BY id
+	`
+	return r.queryWebhooks(ctx, query)
+}
+
+// UpdateWebhook updates the url, events and enabled state of a webhook.
+// The signing secret cannot be changed.
+func (r *webhookRepository) UpdateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $2, events = $3, enabled = $4, updated_at = NOW()
+		WHERE id = $1 AND user_id IS NULL
+		RETURNING created_at, updated_at
+	`
+	err := r.db.QueryRowContext(ctx, query,
+		webhook.ID,
+		webhook.URL,
+		pq.Array(fromEvents(webhook.Events)),
+		webhook.Enabled,
+	).Scan(&webhook.CreatedAt, &webhook.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	return err
+}
+
+// RemoveWebhook removes a webhook not owned by a user
+func (r *webhookRepository) RemoveWebhook(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1 AND user_id IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	// lib/pq always returns nil error for RowsAffected()
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+// GetUserWebhook returns the webhook owned by a user, without its signing secret
+func (r *webhookRepository) GetUserWebhook(ctx context.Context, userID string) (types.Webhook, error) {
+	query := `
+		SELECT id, url, events, enabled, created_at, updated_at
+		FROM webhooks
+		WHERE user_id = $1
+	`
+	webhooks, err := r.queryWebhooks(ctx, query, userID)
+	if err != nil {
+		return types.Webhook{}, err
+	}
+	if len(webhooks) == 0 {
+		return types.Webhook{}, types.ErrNotFound
+	}
+	webhooks[0].UserID = userID
+	return webhooks[0], nil
+}
+
+// RemoveUserWebhook removes the webhook owned by a user, if any
+func (r *webhookRepository) RemoveUserWebhook(ctx context.Context, userID string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM webhooks WHERE user_id = $1`, userID)
+	return err
+}
+
+// GetSubscribers returns the enabled webhooks subscribed to the event.
+// Webhooks owned by users only receive their own notifications, so are excluded.
+func (r *webhookRepository) GetSubscribers(ctx context.Context, event types.WebhookEvent) ([]types.Webhook, error) {
+	query := `
+		SELECT id, url, events, enabled, created_at, updated_at
+		FROM webhooks
+		WHERE enabled AND $1 = ANY(events) AND user_id IS NULL
+	`
+	return r.queryWebhooks(ctx, query, event)
+}
+
+func (r *webhookRepository) queryWebhooks(ctx context.Context, query string, args ...interface{}) ([]types.Webhook, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []types.Webhook{}
+	for rows.Next() {
+		var webhook types.Webhook
+		var events []string
+		if err := rows.Scan(
+			&webhook.ID,
+			&webhook.URL,
+			pq.Array(&events),
+			&webhook.Enabled,
+			&webhook.CreatedAt,
+			&webhook.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		webhook.Events = toEvents(events)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (r *webhookRepository) CreateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at
+	`
+	return r.db.QueryRowContext(ctx, query,
+		delivery.ID,
+		delivery.WebhookID,
+		delivery.Event,
+		[]byte(delivery.Payload),
+		delivery.Status,
+		delivery.NextAttemptAt,
+	).Scan(&delivery.CreatedAt, &delivery.UpdatedAt)
+}
+
+const deliveryColumns = `
+	d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.response_status,
+	d.error, d.next_attempt_at, d.delivered_at, d.created_at, d.updated_at`
+
+func (r *webhookRepository) GetDelivery(ctx context.Context, id string) (types.WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries d WHERE d.id = $1`
+	delivery, err := scanDelivery(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return delivery, types.ErrNotFound
+	}
+	return delivery, err
+}
+
+// GetDeliveries returns the delivery log of a webhook, newest first
+func (r *webhookRepository) GetDeliveries(ctx context.Context, webhookID string, page, limit int) ([]types.WebhookDelivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries d
+		WHERE d.webhook_id = $1
+		ORDER BY d.id DESC
+		LIMIT $2 OFFSET $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, webhookID, limit, (page-1)*limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []types.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// ClaimDeliveries returns pending deliveries which are due, along with their webhook.
+// Claimed deliveries are pushed back by lease, so other instances skip them while
+// they are being delivered, and they are retried should this instance fail.
+func (r *webhookRepository) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]types.WebhookDelivery, error) {
+	query := `
+		WITH due AS (
+			SELECT d.id
+			FROM webhook_deliveries d
+			JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= NOW() AND w.enabled
+			ORDER BY d.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING ` + deliveryColumns + `, w.url, w.secret, COALESCE(w.user_id::TEXT, '')
+	`
+	rows, err := r.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []types.WebhookDelivery{}
+	for rows.Next() {
+		webhook := &types.Webhook{}
+		delivery, err := scanDelivery(rows, &webhook.URL, &webhook.Secret, &webhook.UserID)
+		if err != nil {
+			return nil, err
+		}
+		webhook.ID = delivery.WebhookID
+		delivery.Webhook = webhook
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery records the outcome of a delivery attempt
+func (r *webhookRepository) UpdateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_status = $4, error = $5,
+			next_attempt_at = $6, delivered_at = $7, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`
+	err := r.db.QueryRowContext(ctx, query,
+		delivery.ID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.Error,
+		delivery.NextAttemptAt,
+		delivery.DeliveredAt,
+	).Scan(&delivery.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDelivery scans the delivery columns, followed by any extra columns
+func scanDelivery(row rowScanner, extra ...interface{}) (types.WebhookDelivery, error) {
+	var delivery types.WebhookDelivery
+	var payload []byte
+	dest := []interface{}{
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.Error,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	delivery.Payload = payload
+	return delivery, err
+}
+
+func fromEvents(events []types.WebhookEvent) []string {
+	values := make([]string, len(events))
+	for i, event := range events {
+		values[i] = string(event)
+	}
+	return values
+}
+
+func toEvents(values []string) []types.WebhookEvent {
+	events := make([]types.WebhookEvent, len(values))
+	for i, v := range values {
+		events[i] = types.WebhookEvent(v)
+	}
+	return events
+}
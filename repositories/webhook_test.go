@@ -0,0 +1,179 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSubscribers(t *testing.T) {
+	repo := NewWebhookRepository(dbPool)
+	ctx := context.Background()
+
+	webhook := &types.Webhook{
+		ID:      utilities.MustGenerateIDString(),
+		URL:     "https://example.com/hook",
+		Secret:  "whsec_test",
+		Events:  []types.WebhookEvent{types.EventOrderPaid, types.EventOfferAccepted},
+		Enabled: true,
+	}
+	err := repo.CreateWebhook(ctx, webhook)
+	assert.NoError(t, err, "Expected no error creating webhook")
+	defer repo.RemoveWebhook(ctx, webhook.ID)
+
+	subscribers, err := repo.GetSubscribers(ctx, types.EventOfferAccepted)
+	assert.NoError(t, err, "Expected no error fetching subscribers")
+	assert.True(t, containsWebhook(subscribers, webhook.ID), "Expected webhook to be subscribed")
+	for _, subscriber := range subscribers {
+		assert.Empty(t, subscriber.Secret, "Expected secret to be omitted")
+	}
+
+	subscribers, err = repo.GetSubscribers(ctx, types.EventOrderShipped)
+	assert.NoError(t, err, "Expected no error fetching subscribers")
+	assert.False(t, containsWebhook(subscribers, webhook.ID), "Expected webhook not to be subscribed")
+
+	webhook.Enabled = false
+	err = repo.UpdateWebhook(ctx, webhook)
+	assert.NoError(t, err, "Expected no error disabling webhook")
+
+	subscribers, err = repo.GetSubscribers(ctx, types.EventOfferAccepted)
+	assert.NoError(t, err, "Expected no error fetching subscribers")
+	assert.False(t, containsWebhook(subscribers, webhook.ID), "Expected disabled webhook to be skipped")
+}
+
+func TestUserWebhook(t *testing.T) {
+	userRepo := NewUserRepository(dbPool)
+	repo := NewWebhookRepository(dbPool)
+	ctx := context.Background()
+	user := createUniqueTestUser(t, userRepo)
+	defer userRepo.RemoveUser(ctx, user.ID)
+
+	webhook := &types.Webhook{
+		ID:      utilities.MustGenerateIDString(),
+		URL:     "https://example.com/hook",
+		Secret:  "whsec_test",
+		Events:  []types.WebhookEvent{types.EventNotification},
+		Enabled: true,
+		UserID:  user.ID,
+	}
+	err := repo.CreateWebhook(ctx, webhook)
+	assert.NoError(t, err, "Expected no error creating webhook")
+
+	found, err := repo.GetUserWebhook(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error fetching user webhook")
+	assert.Equal(t, webhook.ID, found.ID)
+
+	// user webhooks only receive the user's notifications
+	subscribers, err := repo.GetSubscribers(ctx, types.EventNotification)
+	assert.NoError(t, err, "Expected no error fetching subscribers")
+	assert.False(t, containsWebhook(subscribers, webhook.ID), "Expected user webhook not to be subscribed")
+	webhooks, err := repo.GetWebhooks(ctx)
+	assert.NoError(t, err, "Expected no error fetching webhooks")
+	assert.False(t, containsWebhook(webhooks, webhook.ID), "Expected user webhook to be hidden")
+
+	// admins cannot remove user webhooks
+	err = repo.RemoveWebhook(ctx, webhook.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected user webhook not to be removed as an admin webhook")
+
+	err = repo.RemoveUserWebhook(ctx, user.ID)
+	assert.NoError(t, err, "Expected no error removing user webhook")
+	_, err = repo.GetUserWebhook(ctx, user.ID)
+	assert.Equal(t, types.ErrNotFound, err, "Expected user webhook to be removed")
+}
+
+func TestClaimDeliveries(t *testing.T) {
+	repo := NewWebhookRepository(dbPool)
+	ctx := context.Background()
+
+	webhook := &types.Webhook{
+		ID:      utilities.MustGenerateIDString(),
+		URL:     "https://example.com/hook",
+		Secret:  "whsec_test",
+		Events:  []types.WebhookEvent{types.EventOrderPaid},
+		Enabled: true,
+	}
+	err := repo.CreateWebhook(ctx, webhook)
+	assert.NoError(t, err, "Expected no error creating webhook")
+	defer repo.RemoveWebhook(ctx, webhook.ID)
+
+	now := time.Now().UTC()
+	delivery := &types.WebhookDelivery{
+		ID:            utilities.MustGenerateIDString(),
+		WebhookID:     webhook.ID,
+		Event:         types.EventOrderPaid,
+		Payload:       json.RawMessage(`{"id": "1"}`),
+		Status:        types.DeliveryPending,
+		NextAttemptAt: &now,
+	}
+	err = repo.CreateDelivery(ctx, delivery)
+	assert.NoError(t, err, "Expected no error creating delivery")
+
+	claimed, err := repo.ClaimDeliveries(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming deliveries")
+	var found *types.WebhookDelivery
+	for i := range claimed {
+		if claimed[i].ID == delivery.ID {
+			found = &claimed[i]
+		}
+	}
+	if assert.NotNil(t, found, "Expected delivery to be claimed") {
+		assert.Equal(t, "whsec_test", found.Webhook.Secret)
+		assert.JSONEq(t, `{"id": "1"}`, string(found.Payload))
+	}
+
+	// claimed deliveries are leased
+	claimed, err = repo.ClaimDeliveries(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming deliveries")
+	for _, d := range claimed {
+		assert.NotEqual(t, delivery.ID, d.ID, "Expected leased delivery not to be claimed again")
+	}
+
+	status := 200
+	delivery.Status = types.DeliverySucceeded
+	delivery.Attempts = 1
+	delivery.ResponseStatus = &status
+	delivery.NextAttemptAt = nil
+	delivery.DeliveredAt = &now
+	err = repo.UpdateDelivery(ctx, delivery)
+	assert.NoError(t, err, "Expected no error updating delivery")
+
+	deliveries, err := repo.GetDeliveries(ctx, webhook.ID, 1, 10)
+	assert.NoError(t, err, "Expected no error fetching deliveries")
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, types.DeliverySucceeded, deliveries[0].Status)
+	assert.Equal(t, 200, *deliveries[0].ResponseStatus)
+
+	// deliveries of disabled webhooks are not sent
+	webhook.Enabled = false
+	err = repo.UpdateWebhook(ctx, webhook)
+	assert.NoError(t, err, "Expected no error disabling webhook")
+	disabled := &types.WebhookDelivery{
+		ID:            utilities.MustGenerateIDString(),
+		WebhookID:     webhook.ID,
+		Event:         types.EventOrderPaid,
+		Payload:       json.RawMessage(`{"id": "2"}`),
+		Status:        types.DeliveryPending,
+		NextAttemptAt: &now,
+	}
+	err = repo.CreateDelivery(ctx, disabled)
+	assert.NoError(t, err, "Expected no error creating delivery")
+	claimed, err = repo.ClaimDeliveries(ctx, 1000, time.Minute)
+	assert.NoError(t, err, "Expected no error claiming deliveries")
+	for _, d := range claimed {
+		assert.NotEqual(t, disabled.ID, d.ID, "Expected delivery of disabled webhook not to be claimed")
+	}
+}
+
+func containsWebhook(webhooks []types.Webhook, id string) bool {
+	for _, webhook := range webhooks {
+		if webhook.ID == id {
+			return true
+		}
+	}
+	return false
+}
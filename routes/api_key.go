@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type APIKeyRoutes struct {
+	router
+	apiKeyService services.APIKeyService
+}
+
+func NewAPIKeyRoutes(apiKeyService services.APIKeyService, router router) *APIKeyRoutes {
+	return &APIKeyRoutes{
+		router:        router,
+		apiKeyService: apiKeyService,
+	}
+}
+
+func (h *APIKeyRoutes) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var key types.APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	plain, err := h.apiKeyService.CreateKey(r.Context(), &key)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid name, role, permission or expiry")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusForbidden, "api keys cannot create api keys")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the key is only ever returned here
+	u.RespondWithJSON(w, http.StatusCreated, struct {
+		types.APIKey
+		Key string `json:"key"`
+	}{key, plain})
+}
+
+func (h *APIKeyRoutes) GetKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.apiKeyService.GetKeys(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, keys)
+}
+
+func (h *APIKeyRoutes) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	err := h.apiKeyService.RevokeKey(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "api key not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keySnapshot loads a key for the audit log, the key itself is never available
+func (h *APIKeyRoutes) keySnapshot(ctx context.Context, id string) (interface{}, error) {
+	keys, err := h.apiKeyService.GetKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (h *APIKeyRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/api-keys", h.secure(types.RoleStaff)(h.audit("api_key.create", "api_key", h.keySnapshot)(h.limit(h.CreateKey, 10, time.Hour)))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/api-keys", h.secure(types.RoleStaff)(h.GetKeys)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/api-keys/{id}", h.secure(types.RoleStaff)(h.audit("api_key.revoke", "api_key", h.keySnapshot)(h.RevokeKey))).Methods(http.MethodDelete)
+}
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+)
+
+type AuditRoutes struct {
+	router
+	auditService services.AuditService
+}
+
+func NewAuditRoutes(auditService services.AuditService, router router) *AuditRoutes {
+	return &AuditRoutes{
+		router:       router,
+		auditService: auditService,
+	}
+}
+
+func (h *AuditRoutes) GetEntries(w http.ResponseWriter, r *http.Request) {
+	params := u.ParsePaginationParams(r, 1, 50)
+	query := r.URL.Query()
+	filter := types.AuditFilter{
+		ActorID:    query.Get("actor_id"),
+		Action:     query.Get("action"),
+		EntityType: query.Get("entity_type"),
+		EntityID:   query.Get("entity_id"),
+		Page:       params.Page,
+		Limit:      params.Limit,
+	}
+
+	since, err := parseTimeParam(r, "since")
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+		return
+	}
+	until, err := parseTimeParam(r, "until")
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "until must be an RFC 3339 timestamp")
+		return
+	}
+	filter.Since = since
+	filter.Until = until
+
+	entries, err := h.auditService.GetEntries(r.Context(), filter)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusOK, entries)
+}
+
+// parseTimeParam parses an optional RFC 3339 query parameter
+func parseTimeParam(r *http.Request, key string) (*time.Time, error) {
+	val := r.URL.Query().Get(key)
+	if val == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (h *AuditRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/admin/audit", h.permit(types.PermAuditRead)(h.GetEntries)).Methods(http.MethodGet)
+}
@@ -19,13 +19,15 @@ type router struct {
 	muxRouter           *mux.Router
 	authMiddleware      middleware.Authorizer
 	rateLimitMiddleware middleware.RateLimit
+	auditMiddleware     middleware.Audit
 }
 
-func NewRouter(muxRouter *mux.Router, authMiddleware middleware.Authorizer, rateLimitMiddleware middleware.RateLimit) router {
+func NewRouter(muxRouter *mux.Router, authMiddleware middleware.Authorizer, rateLimitMiddleware middleware.RateLimit, auditMiddleware middleware.Audit) router {
 	return router{
 		muxRouter:           muxRouter,
 		authMiddleware:      authMiddleware,
 		rateLimitMiddleware: rateLimitMiddleware,
+		auditMiddleware:     auditMiddleware,
 	}
 }
 
@@ -34,6 +36,30 @@ func (h *router) secure(role types.Role) func(next http.HandlerFunc) http.Handle
 	return h.authMiddleware.RequireRole(role)
 }
 
+// permit restricts endpoint access to users whose role grants the specified permission
+func (h *router) permit(perm types.Permission) func(next http.HandlerFunc) http.HandlerFunc {
+	return h.authMiddleware.RequirePermission(perm)
+}
+
+// permitted checks if the authenticated user has the specified permission
+func (h *router) permitted(r *http.Request, perm types.Permission) bool {
+	return h.authMiddleware.Permitted(r.Context(), perm)
+}
+
+// maxAuditBodyBytes limits the request body buffered by the audit middleware
+const maxAuditBodyBytes = 1 << 20
+
+// audit records successful mutations to the audit log.
+// snapshot is optional and loads the entity state used for the before/after diff.
+func (h *router) audit(action, entityType string, snapshot middleware.SnapshotFunc) func(next http.HandlerFunc) http.HandlerFunc {
+	return h.auditMiddleware.Record(action, entityType, snapshot, maxAuditBodyBytes)
+}
+
+// auditUpload is audit for routes accepting request bodies up to maxBytes, such as file uploads
+func (h *router) auditUpload(action, entityType string, snapshot middleware.SnapshotFunc, maxBytes int64) func(next http.HandlerFunc) http.HandlerFunc {
+	return h.auditMiddleware.Record(action, entityType, snapshot, maxBytes)
+}
+
 // Most common case - tracks automatically and enforces limit
 func (h *router) limit(next http.HandlerFunc, limit int, expiry time.Duration) http.HandlerFunc {
 	return h.rateLimitMiddleware.LimitAndRecordHit(next, limit, expiry)
@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type BroadcastRoutes struct {
+	router
+	broadcastService services.BroadcastService
+}
+
+func NewBroadcastRoutes(broadcastService services.BroadcastService, router router) *BroadcastRoutes {
+	return &BroadcastRoutes{
+		router:           router,
+		broadcastService: broadcastService,
+	}
+}
+
+// CreateBroadcast schedules an announcement to a segment of users, sent immediately without a send_at
+func (h *BroadcastRoutes) CreateBroadcast(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Subject    string                 `json:"subject"`
+		Body       string                 `json:"body"`
+		Segment    types.BroadcastSegment `json:"segment"`
+		Role       types.Role             `json:"role"`
+		CategoryID string                 `json:"category_id"`
+		Email      bool                   `json:"email"`
+		SendAt     *time.Time             `json:"send_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	broadcast := types.Broadcast{
+		Subject:    reqBody.Subject,
+		Body:       reqBody.Body,
+		Segment:    reqBody.Segment,
+		Role:       reqBody.Role,
+		CategoryID: reqBody.CategoryID,
+		Email:      reqBody.Email,
+	}
+	if reqBody.SendAt != nil {
+		broadcast.SendAt = reqBody.SendAt.UTC()
+	}
+	err := h.broadcastService.CreateBroadcast(r.Context(), &broadcast)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "subject, body and a valid segment are required")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusCreated, broadcast)
+}
+
+// GetBroadcasts returns broadcasts newest first, with their progress
+func (h *BroadcastRoutes) GetBroadcasts(w http.ResponseWriter, r *http.Request) {
+	params := u.ParsePaginationParams(r, 1, 25)
+	broadcasts, err := h.broadcastService.GetBroadcasts(r.Context(), params.Page, params.Limit)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, broadcasts)
+}
+
+func (h *BroadcastRoutes) GetBroadcast(w http.ResponseWriter, r *http.Request) {
+	broadcast, err := h.broadcastService.GetBroadcast(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "broadcast not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, broadcast)
+}
+
+// CancelBroadcast stops a scheduled or sending broadcast
+func (h *BroadcastRoutes) CancelBroadcast(w http.ResponseWriter, r *http.Request) {
+	broadcast, err := h.broadcastService.CancelBroadcast(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "broadcast not found")
+		return
+	}
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusConflict, "broadcast already completed or canceled")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, broadcast)
+}
+
+func (h *BroadcastRoutes) broadcastSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.broadcastService.GetBroadcast(ctx, id)
+}
+
+func (h *BroadcastRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/broadcasts", h.permit(types.PermBroadcastsWrite)(h.GetBroadcasts)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/broadcasts", h.permit(types.PermBroadcastsWrite)(h.audit("broadcast.create", "broadcast", h.broadcastSnapshot)(h.CreateBroadcast))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/broadcasts/{id}", h.permit(types.PermBroadcastsWrite)(h.GetBroadcast)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/broadcasts/{id}/cancel", h.permit(types.PermBroadcastsWrite)(h.audit("broadcast.cancel", "broadcast", h.broadcastSnapshot)(h.CancelBroadcast))).Methods(http.MethodPost)
+}
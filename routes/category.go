@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -92,10 +93,15 @@ func (h *CategoryRoutes) DeleteCategory(w http.ResponseWriter, r *http.Request)
 	u.RespondSuccess(w)
 }
 
+// categorySnapshot loads a category for the audit log
+func (h *CategoryRoutes) categorySnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.categoryService.GetCategoryByID(ctx, id)
+}
+
 func (h *CategoryRoutes) RegisterRoutes() {
 	h.muxRouter.HandleFunc("/categories", h.GetCategories).Methods(http.MethodGet)
 	h.muxRouter.HandleFunc("/categories/{id}", h.GetCategory).Methods(http.MethodGet)
-	h.muxRouter.Handle("/categories/{id}", h.secure(types.RoleAdmin)(h.DeleteCategory)).Methods(http.MethodDelete)
-	h.muxRouter.Handle("/categories", h.secure(types.RoleAdmin)(h.CreateCategory)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/categories", h.secure(types.RoleAdmin)(h.UpdateCategory)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/categories/{id}", h.permit(types.PermCategoriesWrite)(h.audit("category.remove", "category", h.categorySnapshot)(h.DeleteCategory))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/categories", h.permit(types.PermCategoriesWrite)(h.audit("category.create", "category", h.categorySnapshot)(h.CreateCategory))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/categories", h.permit(types.PermCategoriesWrite)(h.audit("category.update", "category", h.categorySnapshot)(h.UpdateCategory))).Methods(http.MethodPut)
 }
@@ -2,7 +2,14 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/dgyurics/marketplace/services"
 	"github.com/dgyurics/marketplace/types"
@@ -12,13 +19,21 @@ import (
 
 type ConversationRoutes struct {
 	router
-	service services.ConversationService
+	service           services.ConversationService
+	attachmentService services.AttachmentService
+	config            types.AttachmentConfig
 }
 
-func NewConversationRoutes(service services.ConversationService, router router) *ConversationRoutes {
+func NewConversationRoutes(
+	service services.ConversationService,
+	attachmentService services.AttachmentService,
+	config types.AttachmentConfig,
+	router router) *ConversationRoutes {
 	return &ConversationRoutes{
-		router:  router,
-		service: service,
+		router:            router,
+		service:           service,
+		attachmentService: attachmentService,
+		config:            config,
 	}
 }
 
@@ -50,17 +65,36 @@ func (h *ConversationRoutes) CreateConversation(w http.ResponseWriter, r *http.R
 	u.RespondWithJSON(w, http.StatusCreated, conversation)
 }
 
+// nextCursorHeader holds the cursor of the next page of cursor paginated lists, when there may be one
+const nextCursorHeader = "X-Next-Cursor"
+
+// GetConversations returns the user's conversations, most recently updated first.
+// The next page is requested with the cursor query parameter, set to the X-Next-Cursor header.
 func (h *ConversationRoutes) GetConversations(w http.ResponseWriter, r *http.Request) {
-	conversations, err := h.service.GetConversations(r.Context())
+	params, err := u.ParseCursorParams(r, 25)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	conversations, err := h.service.GetConversations(r.Context(), params.Cursor, params.Limit)
 	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if len(conversations) == params.Limit {
+		last := conversations[len(conversations)-1]
+		w.Header().Set(nextCursorHeader, types.Cursor{Time: last.UpdatedAt, ID: last.ID}.String())
+	}
 	u.RespondWithJSON(w, http.StatusOK, conversations)
 }
 
 func (h *ConversationRoutes) GetConversationAdmin(w http.ResponseWriter, r *http.Request) {
-	conversation, err := h.service.GetConversationByID(r.Context(), mux.Vars(r)["id"])
+	params, err := u.ParseCursorParams(r, 50)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	conversation, err := h.service.GetConversationByID(r.Context(), mux.Vars(r)["id"], params.Cursor, params.Limit)
 	if err == types.ErrNotFound {
 		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
 		return
@@ -69,9 +103,18 @@ func (h *ConversationRoutes) GetConversationAdmin(w http.ResponseWriter, r *http
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	setMessagesCursor(w, conversation.Messages, params.Limit)
 	u.RespondWithJSON(w, http.StatusOK, conversation)
 }
 
+// setMessagesCursor sets the cursor of the page of older messages, when there may be one
+func setMessagesCursor(w http.ResponseWriter, messages []types.Message, limit int) {
+	if len(messages) == limit {
+		oldest := messages[0]
+		w.Header().Set(nextCursorHeader, types.Cursor{Time: oldest.CreatedAt, ID: oldest.ID}.String())
+	}
+}
+
 func (h *ConversationRoutes) RemoveConversation(w http.ResponseWriter, r *http.Request) {
 	conversationID := mux.Vars(r)["id"]
 	err := h.service.RemoveConversation(r.Context(), conversationID)
@@ -87,8 +130,15 @@ func (h *ConversationRoutes) RemoveConversation(w http.ResponseWriter, r *http.R
 	u.RespondSuccess(w)
 }
 
+// GetConversation returns a conversation of the user with its latest messages, oldest first.
+// Older messages are requested with the cursor query parameter, set to the X-Next-Cursor header.
 func (h *ConversationRoutes) GetConversation(w http.ResponseWriter, r *http.Request) {
-	conversation, err := h.service.GetConversationByIDAndUser(r.Context(), mux.Vars(r)["id"])
+	params, err := u.ParseCursorParams(r, 50)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	conversation, err := h.service.GetConversationByIDAndUser(r.Context(), mux.Vars(r)["id"], params.Cursor, params.Limit)
 	if err == types.ErrNotFound {
 		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
 		return
@@ -97,9 +147,71 @@ func (h *ConversationRoutes) GetConversation(w http.ResponseWriter, r *http.Requ
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	setMessagesCursor(w, conversation.Messages, params.Limit)
 	u.RespondWithJSON(w, http.StatusOK, conversation)
 }
 
+// CountUnread returns the number of the user's conversations with unread messages, for inbox badges
+func (h *ConversationRoutes) CountUnread(w http.ResponseWriter, r *http.Request) {
+	count, err := h.service.CountUnread(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, types.InboxUnread{Count: count})
+}
+
+// maxBulkConversations is the number of conversations which may be marked read or archived at once
+const maxBulkConversations = 100
+
+// decodeConversationIDs decodes the conversation IDs of bulk requests, responding with an error when invalid
+func decodeConversationIDs(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var reqBody struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return nil, false
+	}
+	if len(reqBody.IDs) == 0 || len(reqBody.IDs) > maxBulkConversations {
+		u.RespondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("between 1 and %d ids required", maxBulkConversations))
+		return nil, false
+	}
+	for _, id := range reqBody.IDs {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			u.RespondWithError(w, r, http.StatusBadRequest, "invalid id")
+			return nil, false
+		}
+	}
+	return reqBody.IDs, true
+}
+
+// MarkRead marks conversations of the user read
+func (h *ConversationRoutes) MarkRead(w http.ResponseWriter, r *http.Request) {
+	ids, ok := decodeConversationIDs(w, r)
+	if !ok {
+		return
+	}
+	if err := h.service.MarkRead(r.Context(), ids); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondSuccess(w)
+}
+
+// ArchiveConversations removes conversations from the user's inbox, as RemoveConversation does for one
+func (h *ConversationRoutes) ArchiveConversations(w http.ResponseWriter, r *http.Request) {
+	ids, ok := decodeConversationIDs(w, r)
+	if !ok {
+		return
+	}
+	if err := h.service.ArchiveConversations(r.Context(), ids); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondSuccess(w)
+}
+
 func (h *ConversationRoutes) CreateMessage(w http.ResponseWriter, r *http.Request) {
 	var message types.Message
 	message.ConversationID = mux.Vars(r)["id"]
@@ -109,22 +221,319 @@ func (h *ConversationRoutes) CreateMessage(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	message.Attachments = nil // uploaded through UploadAttachment
+	if message.Body == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "body required")
+		return
+	}
+
+	err := h.service.CreateMessage(r.Context(), &message)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// OpenTicket opens a support conversation of the authenticated user,
+// optionally about one of their orders or a product
+func (h *ConversationRoutes) OpenTicket(w http.ResponseWriter, r *http.Request) {
+	var ticket types.Ticket
+	if err := json.NewDecoder(r.Body).Decode(&ticket); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	if ticket.Subject == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "subject required")
+		return
+	}
+	if ticket.Body == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "body required")
+		return
+	}
+
+	conversation, err := h.service.OpenTicket(r.Context(), ticket)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "order or product not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusCreated, conversation)
+}
+
+// Reply adds a message of the authenticated user to their own support conversation
+func (h *ConversationRoutes) Reply(w http.ResponseWriter, r *http.Request) {
+	var message types.Message
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	message.ConversationID = mux.Vars(r)["id"]
+	message.Attachments = nil // uploaded through UploadAttachment
+
 	if message.Body == "" {
 		u.RespondWithError(w, r, http.StatusBadRequest, "body required")
 		return
 	}
 
-	if err := h.service.CreateMessage(r.Context(), &message); err != nil {
+	err := h.service.Reply(r.Context(), &message)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusCreated, message)
+}
+
+// GetTickets returns the staff queue of support conversations, longest waiting first,
+// optionally filtered by status, assignee (a user ID, "me" or "none") and unread=true
+func (h *ConversationRoutes) GetTickets(w http.ResponseWriter, r *http.Request) {
+	params := u.ParsePaginationParams(r, 1, 50)
+	query := r.URL.Query()
+	filter := types.TicketFilter{
+		Status:   types.TicketStatus(query.Get("status")),
+		Assignee: query.Get("assignee"),
+		Unread:   query.Get("unread") == "true",
+		Page:     params.Page,
+		Limit:    params.Limit,
+	}
+	if filter.Status != "" && !filter.Status.IsValid() {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid status")
+		return
+	}
+
+	tickets, err := h.service.GetTickets(r.Context(), filter)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, tickets)
+}
+
+func (h *ConversationRoutes) UpdateTicketStatus(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Status types.TicketStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	err := h.service.UpdateTicketStatus(r.Context(), mux.Vars(r)["id"], reqBody.Status)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid status")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
+// AssignTicket assigns a support conversation to a staff member, or unassigns it without assignee_id
+func (h *ConversationRoutes) AssignTicket(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		AssigneeID string `json:"assignee_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	err := h.service.AssignTicket(r.Context(), mux.Vars(r)["id"], reqBody.AssigneeID)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "assignee must be staff")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
+const (
+	formKeyFile = "file" // Form key for attachment file
+	formKeyBody = "body" // Form key for message body, optional with attachments
+)
+
+// UploadAttachment adds a message with an attached file to a conversation.
+// Staff may attach files to any conversation, customers only to their own support conversations.
+//
+// Request:
+//
+//	Form: multipart/form-data with "file" field, and optional "body" field
+//
+// Response: 201 Created with the message
+func (h *ConversationRoutes) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadBytes())
+	if err := r.ParseMultipartForm(int64(h.config.MaxFileSizeBytes)); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			u.RespondWithError(w, r, http.StatusRequestEntityTooLarge, "file too large")
+			return
+		}
+		u.RespondWithError(w, r, http.StatusBadRequest, "error parsing multipart form")
+		return
+	}
+	file, fileHeader, err := r.FormFile(formKeyFile)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error retrieving file from form data")
+		return
+	}
+	defer file.Close()
+
+	// checked before storing, so files are never written for conversations the user cannot reply to
+	conversationID := mux.Vars(r)["id"]
+	staff := h.permitted(r, types.PermConversationsWrite)
+	if !staff {
+		conversation, err := h.service.GetConversationByIDAndUser(r.Context(), conversationID, nil, 1)
+		if err == nil && conversation.Type != types.Support {
+			err = types.ErrNotFound
+		}
+		if err == types.ErrNotFound {
+			u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	attachment, err := h.attachmentService.Store(r.Context(), conversationID, fileHeader.Filename, file)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusRequestEntityTooLarge, "file empty or too large")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == services.ErrUnsupportedAttachment {
+		u.RespondWithError(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	if err == services.ErrMalware {
+		u.RespondWithError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	message := types.Message{
+		ConversationID: conversationID,
+		Body:           r.FormValue(formKeyBody),
+		Attachments:    []types.Attachment{attachment},
+	}
+	if staff {
+		err = h.service.CreateMessage(r.Context(), &message)
+	} else {
+		err = h.service.Reply(r.Context(), &message)
+	}
+	if err != nil {
+		if removeErr := h.attachmentService.Remove(attachment); removeErr != nil {
+			slog.ErrorContext(r.Context(), "Error removing attachment", "attachment_id", attachment.ID, "error", removeErr)
+		}
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusCreated, message)
+}
+
+// maxUploadBytes limits the size of attachment uploads, allowing for the form's other fields
+func (h *ConversationRoutes) maxUploadBytes() int64 {
+	return int64(h.config.MaxFileSizeBytes) + 1<<20
+}
+
+// uploadAttachment is UploadAttachment, with uploads by staff recorded to the audit log
+func (h *ConversationRoutes) uploadAttachment() http.HandlerFunc {
+	audited := h.auditUpload("conversation.attachment", "conversation", nil, h.maxUploadBytes())(h.UploadAttachment)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.permitted(r, types.PermConversationsWrite) {
+			audited(w, r)
+			return
+		}
+		h.UploadAttachment(w, r)
+	}
+}
+
+// DownloadAttachment serves an attached file to the conversation's participants
+func (h *ConversationRoutes) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	conversationID, attachmentID := mux.Vars(r)["id"], mux.Vars(r)["attachment"]
+
+	var attachment types.Attachment
+	var file *os.File
+	var err error
+	if h.permitted(r, types.PermConversationsRead) {
+		attachment, file, err = h.attachmentService.Open(r.Context(), conversationID, attachmentID)
+	} else {
+		attachment, file, err = h.attachmentService.OpenByUser(r.Context(), conversationID, attachmentID)
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", attachment.CreatedAt, file)
 }
 
 func (h *ConversationRoutes) RegisterRoutes() {
-	h.muxRouter.Handle("/conversations", h.secure(types.RoleStaff)(h.CreateConversation)).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/tickets", h.secure(types.RoleGuest)(h.limit(h.OpenTicket, 5, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/tickets", h.permit(types.PermConversationsRead)(h.GetTickets)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/conversations/unread-count", h.secure(types.RoleGuest)(h.CountUnread)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/conversations/read", h.secure(types.RoleGuest)(h.MarkRead)).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/archive", h.secure(types.RoleGuest)(h.ArchiveConversations)).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations", h.permit(types.PermConversationsWrite)(h.audit("conversation.create", "conversation", nil)(h.CreateConversation))).Methods(http.MethodPost)
 	h.muxRouter.Handle("/conversations/{id}", h.secure(types.RoleGuest)(h.GetConversation)).Methods(http.MethodGet)
 	h.muxRouter.Handle("/conversations/{id}", h.secure(types.RoleGuest)(h.RemoveConversation)).Methods(http.MethodDelete)
-	h.muxRouter.Handle("/conversations/{id}/admin", h.secure(types.RoleStaff)(h.GetConversationAdmin)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/conversations/{id}/message", h.secure(types.RoleStaff)(h.CreateMessage)).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/{id}/admin", h.permit(types.PermConversationsRead)(h.GetConversationAdmin)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/conversations/{id}/message", h.permit(types.PermConversationsWrite)(h.audit("conversation.message", "conversation", nil)(h.CreateMessage))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/{id}/attachments", h.secure(types.RoleGuest)(h.limit(h.uploadAttachment(), 20, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/{id}/attachments/{attachment}", h.secure(types.RoleGuest)(h.DownloadAttachment)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/conversations/{id}/reply", h.secure(types.RoleGuest)(h.limit(h.Reply, 30, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/conversations/{id}/status", h.permit(types.PermConversationsWrite)(h.audit("conversation.status", "conversation", nil)(h.UpdateTicketStatus))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/conversations/{id}/assignee", h.permit(types.PermConversationsWrite)(h.audit("conversation.assign", "conversation", nil)(h.AssignTicket))).Methods(http.MethodPut)
 	h.muxRouter.Handle("/conversations", h.secure(types.RoleGuest)(h.GetConversations)).Methods(http.MethodGet)
 }
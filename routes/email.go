@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type EmailRoutes struct {
+	router
+	emailService services.EmailService
+}
+
+func NewEmailRoutes(emailService services.EmailService, router router) *EmailRoutes {
+	return &EmailRoutes{
+		router:       router,
+		emailService: emailService,
+	}
+}
+
+// GetEmails returns the delivery log, optionally filtered by status and recipient
+func (h *EmailRoutes) GetEmails(w http.ResponseWriter, r *http.Request) {
+	params := u.ParsePaginationParams(r, 1, 50)
+	status := types.EmailStatus(r.URL.Query().Get("status"))
+	recipient := r.URL.Query().Get("recipient")
+	emails, err := h.emailService.GetEmails(r.Context(), status, recipient, params.Page, params.Limit)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, emails)
+}
+
+func (h *EmailRoutes) GetEmail(w http.ResponseWriter, r *http.Request) {
+	email, err := h.emailService.GetEmail(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "email not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, email)
+}
+
+func (h *EmailRoutes) Resend(w http.ResponseWriter, r *http.Request) {
+	email, err := h.emailService.Resend(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "email not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	email.Body = ""
+	u.RespondWithJSON(w, http.StatusAccepted, email)
+}
+
+// emailSnapshot loads an email for the audit log, without its body,
+// which may hold links such as password reset codes
+func (h *EmailRoutes) emailSnapshot(ctx context.Context, id string) (interface{}, error) {
+	email, err := h.emailService.GetEmail(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	email.Body = ""
+	return email, nil
+}
+
+func (h *EmailRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/emails", h.permit(types.PermEmailsAdmin)(h.GetEmails)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/emails/{id}", h.permit(types.PermEmailsAdmin)(h.GetEmail)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/emails/{id}/resend", h.permit(types.PermEmailsAdmin)(h.audit("email.resend", "email", h.emailSnapshot)(h.Resend))).Methods(http.MethodPost)
+}
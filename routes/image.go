@@ -269,6 +269,6 @@ func isSupportedFormat(format string) bool {
 }
 
 func (h *ImageRoutes) RegisterRoutes() {
-	h.muxRouter.Handle("/images/products/{id}", h.secure(types.RoleAdmin)(h.UploadImage)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/images/{image}", h.secure(types.RoleAdmin)(h.RemoveImage)).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/images/products/{id}", h.permit(types.PermProductsWrite)(h.auditUpload("image.upload", "product", nil, int64(h.config.MaxFileSizeBytes)+1<<20)(h.UploadImage))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/images/{image}", h.permit(types.PermProductsWrite)(h.audit("image.remove", "image", nil)(h.RemoveImage))).Methods(http.MethodDelete)
 }
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	u "github.com/dgyurics/marketplace/utilities"
+)
+
+type JWKSRoutes struct {
+	router
+	jwtService services.JWTService
+}
+
+func NewJWKSRoutes(jwtService services.JWTService, router router) *JWKSRoutes {
+	return &JWKSRoutes{
+		router:     router,
+		jwtService: jwtService,
+	}
+}
+
+// GetJWKS publishes the public keys used to verify access tokens
+func (h *JWKSRoutes) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := h.jwtService.JWKS()
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// short lived, so verifiers pick up rotated keys quickly
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	u.RespondWithJSON(w, http.StatusOK, jwks)
+}
+
+func (h *JWKSRoutes) RegisterRoutes() {
+	h.muxRouter.HandleFunc("/.well-known/jwks.json", h.GetJWKS).Methods(http.MethodGet)
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+)
+
+type NotificationRoutes struct {
+	router
+	notificationService services.NotificationService
+	templateService     services.TemplateService
+}
+
+func NewNotificationRoutes(
+	notificationService services.NotificationService,
+	templateService services.TemplateService,
+	router router) *NotificationRoutes {
+	return &NotificationRoutes{
+		router:              router,
+		notificationService: notificationService,
+		templateService:     templateService,
+	}
+}
+
+// GetPreferences returns the authenticated user's notification preferences and webhook
+func (h *NotificationRoutes) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.notificationService.GetPreferences(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, settings)
+}
+
+// UpdatePreferences enables or disables channels for events, e.g. [{"event": "order_updates", "channel": "email", "enabled": false}]
+func (h *NotificationRoutes) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	var prefs []types.NotificationPreference
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	settings, err := h.notificationService.UpdatePreferences(r.Context(), prefs)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid event or channel")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, settings)
+}
+
+// SetWebhook replaces the authenticated user's notification webhook.
+// The signing secret is only returned in this response.
+func (h *NotificationRoutes) SetWebhook(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	webhook, err := h.notificationService.SetWebhook(r.Context(), reqBody.URL)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid url")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, webhook)
+}
+
+func (h *NotificationRoutes) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.notificationService.RemoveWebhook(r.Context()); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnsubscribePage asks to confirm unsubscribing, so that link scanners following
+// the link in an email do not unsubscribe.
+func (h *NotificationRoutes) UnsubscribePage(w http.ResponseWriter, r *http.Request) {
+	h.respondWithPage(w, r, services.PageUnsubscribe, map[string]string{
+		"Token": r.URL.Query().Get("token"),
+	})
+}
+
+// Unsubscribe disables the event and channel of a signed token, without logging in.
+// Mail clients post here directly for one-click unsubscribe (RFC 8058).
+func (h *NotificationRoutes) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	err := h.notificationService.Unsubscribe(r.Context(), r.URL.Query().Get("token"))
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid token")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondWithPage(w, r, services.PageUnsubscribed, map[string]string{
+		"PreferencesLink": h.notificationService.BaseURL() + "/profile",
+	})
+}
+
+func (h *NotificationRoutes) respondWithPage(w http.ResponseWriter, r *http.Request, page services.HtmlTemplate, data interface{}) {
+	body, err := h.templateService.RenderHtmlToString(r.Context(), page, data)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
+
+func (h *NotificationRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/users/me/notification-preferences", h.secure(types.RoleGuest)(h.GetPreferences)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users/me/notification-preferences", h.secure(types.RoleGuest)(h.UpdatePreferences)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/users/me/notification-webhook", h.secure(types.RoleUser)(h.limit(h.SetWebhook, 10, time.Hour))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/users/me/notification-webhook", h.secure(types.RoleUser)(h.RemoveWebhook)).Methods(http.MethodDelete)
+	h.muxRouter.HandleFunc("/notifications/unsubscribe", h.UnsubscribePage).Methods(http.MethodGet)
+	h.muxRouter.HandleFunc("/notifications/unsubscribe", h.Unsubscribe).Methods(http.MethodPost)
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -38,6 +39,10 @@ func (h *OfferRoutes) CreateOffer(w http.ResponseWriter, r *http.Request) {
 
 	// Create offer
 	err := h.service.CreateOffer(r.Context(), &offer)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "amount must be positive")
+		return
+	}
 	if err == types.ErrNotFound {
 		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
 		return
@@ -70,8 +75,8 @@ func (h *OfferRoutes) UpdateOffer(w http.ResponseWriter, r *http.Request) {
 		offer.Status = types.OfferRejected
 	case "canceled":
 		offer.Status = types.OfferCanceled
-	case "completed":
-		offer.Status = types.OfferCompleted
+	case "expired":
+		offer.Status = types.OfferExpired
 	default:
 		u.RespondWithError(w, r, http.StatusBadRequest, "invalid action")
 		return
@@ -79,14 +84,137 @@ func (h *OfferRoutes) UpdateOffer(w http.ResponseWriter, r *http.Request) {
 
 	// Update offer status
 	err := h.service.UpdateOffer(r.Context(), &offer)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid action")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "offer cannot be "+string(offer.Status)+", or product out of stock")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// counterRequest is the body of a counter-offer, by either party
+type counterRequest struct {
+	Amount  int64   `json:"amount"`
+	Comment *string `json:"comment"`
+}
+
+// CounterOffer answers a pending offer with a different amount
+func (h *OfferRoutes) CounterOffer(w http.ResponseWriter, r *http.Request) {
+	var reqBody counterRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request body")
+		return
+	}
+	offer := types.Offer{
+		ID:      mux.Vars(r)["id"],
+		Amount:  reqBody.Amount,
+		Comment: reqBody.Comment,
+	}
+	err := h.service.CounterOffer(r.Context(), &offer)
+	h.respondRevised(w, r, offer.ID, err, "only pending offers can be countered")
+}
+
+// CounterOfferOwner answers a counter-offer with a different amount, on behalf of the buyer
+func (h *OfferRoutes) CounterOfferOwner(w http.ResponseWriter, r *http.Request) {
+	var reqBody counterRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request body")
+		return
+	}
+	offer := types.Offer{
+		ID:      mux.Vars(r)["id"],
+		Amount:  reqBody.Amount,
+		Comment: reqBody.Comment,
+	}
+	err := h.service.CounterOfferOwner(r.Context(), &offer)
+	h.respondRevised(w, r, offer.ID, err, "only countered offers can be countered")
+}
+
+// RespondToOffer accepts a counter-offer, or cancels an open offer, on behalf of the buyer
+func (h *OfferRoutes) RespondToOffer(w http.ResponseWriter, r *http.Request) {
+	offer := types.Offer{
+		ID:     mux.Vars(r)["id"],
+		Status: types.OfferStatus(mux.Vars(r)["status"]),
+	}
+	err := h.service.RespondToOffer(r.Context(), &offer)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid action")
+		return
+	}
+	h.respondRevised(w, r, offer.ID, err, "offer cannot be "+string(offer.Status))
+}
+
+// respondRevised responds with a revised offer, or the error revising it
+func (h *OfferRoutes) respondRevised(w http.ResponseWriter, r *http.Request, id string, err error, conflict string) {
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "amount must be positive")
+		return
+	}
 	if err == types.ErrNotFound {
 		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
 		return
 	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, conflict)
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	offer, err := h.service.GetOfferByID(r.Context(), id)
 	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	u.RespondWithJSON(w, http.StatusOK, offer)
+}
+
+func (h *OfferRoutes) GetOfferFloor(w http.ResponseWriter, r *http.Request) {
+	floor, err := h.service.GetOfferFloor(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "product not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, floor)
+}
+
+// SetOfferFloor sets the lowest amount a product accepts offers for, a null floor removes it
+func (h *OfferRoutes) SetOfferFloor(w http.ResponseWriter, r *http.Request) {
+	var floor types.OfferFloor
+	if err := json.NewDecoder(r.Body).Decode(&floor); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request body")
+		return
+	}
+	floor.ProductID = mux.Vars(r)["id"]
+	err := h.service.SetOfferFloor(r.Context(), &floor)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "floor cannot be negative")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "product not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, floor)
 }
 
 func (h *OfferRoutes) GetOfferOwner(w http.ResponseWriter, r *http.Request) {
@@ -133,11 +261,26 @@ func (h *OfferRoutes) GetOffers(w http.ResponseWriter, r *http.Request) {
 	u.RespondWithJSON(w, http.StatusOK, offers)
 }
 
+// offerSnapshot loads an offer for the audit log
+func (h *OfferRoutes) offerSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.service.GetOfferByID(ctx, id)
+}
+
+// floorSnapshot loads a product's offer floor for the audit log
+func (h *OfferRoutes) floorSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.service.GetOfferFloor(ctx, id)
+}
+
 func (h *OfferRoutes) RegisterRoutes() {
-	h.muxRouter.Handle("/offers/items/{id}", h.secure(types.RoleMember)(h.limit(h.CreateOffer, 5, time.Hour))).Methods(http.MethodPost)
-	h.muxRouter.Handle("/offers/{id}/{status}", h.secure(types.RoleAdmin)(h.UpdateOffer)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/offers/items/{id}", h.permit(types.PermOffersCreate)(h.limit(h.CreateOffer, 5, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/offers/{id}/{status}", h.permit(types.PermOffersWrite)(h.audit("offer.update_status", "offer", h.offerSnapshot)(h.UpdateOffer))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/offers/{id}/counter", h.permit(types.PermOffersWrite)(h.audit("offer.counter", "offer", h.offerSnapshot)(h.CounterOffer))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/offers/{id}/owner/counter", h.permit(types.PermOffersCreate)(h.limit(h.CounterOfferOwner, 5, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/offers/{id}/owner/{status}", h.permit(types.PermOffersCreate)(h.RespondToOffer)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/offers/items/{id}/floor", h.permit(types.PermOffersRead)(h.GetOfferFloor)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/offers/items/{id}/floor", h.permit(types.PermOffersWrite)(h.audit("offer.update_floor", "product", h.floorSnapshot)(h.SetOfferFloor))).Methods(http.MethodPut)
 	h.muxRouter.Handle("/offers/{id}/owner", h.secure(types.RoleGuest)(h.GetOfferOwner)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/offers/{id}/admin", h.secure(types.RoleAdmin)(h.GetOfferAdmin)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/offers/items/{id}", h.secure(types.RoleMember)(h.GetOfferByProductID)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/offers", h.secure(types.RoleAdmin)(h.GetOffers)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/offers/{id}/admin", h.permit(types.PermOffersRead)(h.GetOfferAdmin)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/offers/items/{id}", h.permit(types.PermOffersCreate)(h.GetOfferByProductID)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/offers", h.permit(types.PermOffersRead)(h.GetOffers)).Methods(http.MethodGet)
 }
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+// oidcStateCookie binds a sign in to the browser that started it
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateMaxAge = 10 * time.Minute
+)
+
+type OIDCRoutes struct {
+	router
+	oidcService    services.OIDCService
+	jwtService     services.JWTService
+	refreshService services.RefreshService
+	environment    types.Environment
+}
+
+func NewOIDCRoutes(
+	oidcService services.OIDCService,
+	jwtService services.JWTService,
+	refreshService services.RefreshService,
+	environment types.Environment,
+	router router) *OIDCRoutes {
+	return &OIDCRoutes{
+		router:         router,
+		oidcService:    oidcService,
+		jwtService:     jwtService,
+		refreshService: refreshService,
+		environment:    environment,
+	}
+}
+
+// GetProviders lists the configured identity providers
+func (h *OIDCRoutes) GetProviders(w http.ResponseWriter, r *http.Request) {
+	u.RespondWithJSON(w, http.StatusOK, h.oidcService.Providers())
+}
+
+// Authorize redirects the user to the identity provider to sign in
+func (h *OIDCRoutes) Authorize(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := h.oidcService.AuthorizationURL(r.Context(), mux.Vars(r)["provider"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "unknown provider")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	h.setStateCookie(w, state, oidcStateMaxAge)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setStateCookie stores the sign in state in the browser. Lax allows the cookie
+// on the top-level navigation back from the provider, but not on cross-site requests.
+func (h *OIDCRoutes) setStateCookie(w http.ResponseWriter, state string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   h.environment == types.Production,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Callback completes the sign in using the code and state the provider
+// passed to the frontend redirect URL, and issues our own tokens
+func (h *OIDCRoutes) Callback(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	if reqBody.Code == "" || reqBody.State == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "code and state are required")
+		return
+	}
+
+	var boundState string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		boundState = cookie.Value
+	}
+	h.setStateCookie(w, "", -time.Second) // single use, expire immediately
+
+	usr, err := h.oidcService.Authenticate(r.Context(), mux.Vars(r)["provider"], reqBody.Code, reqBody.State, boundState)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "unknown provider")
+		return
+	}
+	if err == types.ErrInvalidInput {
+		h.recordHit(r, time.Hour)
+		u.RespondWithError(w, r, http.StatusUnauthorized, "sign in failed")
+		return
+	}
+	if err == types.ErrUniqueConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "email already registered")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Generate new access token
+	accessToken, err := h.jwtService.GenerateToken(*usr)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Generate new refresh refreshToken
+	refreshToken, err := h.refreshService.GenerateToken()
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Store refresh token
+	if err := h.refreshService.StoreToken(r.Context(), usr.ID, refreshToken); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusOK, types.TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+func (h *OIDCRoutes) RegisterRoutes() {
+	h.muxRouter.HandleFunc("/auth/oidc", h.GetProviders).Methods(http.MethodGet)
+	h.muxRouter.Handle("/auth/oidc/{provider}/authorize", h.limit(h.Authorize, 20, time.Hour)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/auth/oidc/{provider}/callback", h.guardLimit(h.Callback, 10)).Methods(http.MethodPost)
+}
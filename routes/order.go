@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -20,6 +21,7 @@ type OrderRoutes struct {
 	paymentService services.PaymentService
 	cartService    services.CartService
 	addressService services.AddressService
+	offerService   services.OfferService
 }
 
 func NewOrderRoutes(
@@ -28,6 +30,7 @@ func NewOrderRoutes(
 	paymentService services.PaymentService,
 	cartService services.CartService,
 	addressService services.AddressService,
+	offerService services.OfferService,
 	router router) *OrderRoutes {
 	return &OrderRoutes{
 		router:         router,
@@ -36,6 +39,7 @@ func NewOrderRoutes(
 		paymentService: paymentService,
 		cartService:    cartService,
 		addressService: addressService,
+		offerService:   offerService,
 	}
 }
 
@@ -101,7 +105,17 @@ func (h *OrderRoutes) UpdateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.orderService.UpdateOrder(r.Context(), &order); err != nil {
+	if order.Status == types.OrderRefunded && !h.permitted(r, types.PermRefundsCreate) {
+		u.RespondWithError(w, r, http.StatusForbidden, "missing permission "+string(types.PermRefundsCreate))
+		return
+	}
+
+	err := h.orderService.UpdateOrder(r.Context(), &order)
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "only pending orders with an open offer can be paid")
+		return
+	}
+	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -110,42 +124,87 @@ func (h *OrderRoutes) UpdateOrder(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *OrderRoutes) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := h.newOrder(w, r)
+	if !ok {
+		return
+	}
+
+	// Fetch user cart
+	cart, err := h.cartService.GetItems(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(cart) == 0 {
+		u.RespondWithError(w, r, http.StatusBadRequest, "cart is empty")
+		return
+	}
+
+	h.checkout(w, r, order, cart)
+}
+
+// CreateOfferOrder checks out an accepted offer of the buyer, a unit of its product at the offer's amount.
+// The unit is reserved by the offer until paid, or the offer expires.
+func (h *OrderRoutes) CreateOfferOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := h.newOrder(w, r)
+	if !ok {
+		return
+	}
+
+	item, err := h.offerService.GetCheckoutItem(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "offer not found")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "offer must be accepted")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	order.OfferID = mux.Vars(r)["id"]
+	h.checkout(w, r, order, []types.CartItem{item})
+}
+
+// newOrder starts an order from the Idempotency-Key header and shipping_id parameter,
+// responding with an error when either is invalid
+func (h *OrderRoutes) newOrder(w http.ResponseWriter, r *http.Request) (*types.Order, bool) {
 	idempotencyKey := r.Header.Get("Idempotency-Key")
 	if idempotencyKey == "" {
 		u.RespondWithError(w, r, http.StatusBadRequest, "Idempotency-Key header is required")
-		return
+		return nil, false
 	}
 
 	shippingID := r.URL.Query().Get("shipping_id")
 	if shippingID == "" {
 		u.RespondWithError(w, r, http.StatusBadRequest, "shipping_id is required")
-		return
+		return nil, false
 	}
 
 	// Fetch shipping address
 	addr, err := h.addressService.GetAddress(r.Context(), shippingID)
 	if err == types.ErrNotFound {
 		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
-		return
+		return nil, false
 	}
 	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
-		return
+		return nil, false
 	}
 
-	// Fetch user cart
-	cart, err := h.cartService.GetItems(r.Context())
-	if err != nil {
-		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if len(cart) == 0 {
-		u.RespondWithError(w, r, http.StatusBadRequest, "cart is empty")
-		return
-	}
+	return &types.Order{
+		IdempotencyKey: &idempotencyKey,
+		Address:        addr,
+	}, true
+}
 
+// checkout creates an order of the items, taxed to its address, and a payment intent for its total
+func (h *OrderRoutes) checkout(w http.ResponseWriter, r *http.Request, order *types.Order, items []types.CartItem) {
 	// Calculate tax
-	tax, err := h.taxService.CalculateTax(r.Context(), "", addr, cart)
+	tax, err := h.taxService.CalculateTax(r.Context(), "", order.Address, items)
 	if err == types.ErrInvalidInput {
 		u.RespondWithError(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -156,12 +215,8 @@ func (h *OrderRoutes) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create order
-	order := &types.Order{
-		IdempotencyKey: &idempotencyKey,
-		Address:        addr,
-		TaxAmount:      tax,
-	}
-	calculateOrderFromCart(order, cart)
+	order.TaxAmount = tax
+	calculateOrderFromCart(order, items)
 	err = h.orderService.CreateOrder(r.Context(), order)
 
 	var stockErr *types.InsufficientStockError
@@ -169,6 +224,10 @@ func (h *OrderRoutes) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		u.RespondWithJSON(w, http.StatusConflict, stockErr.Items)
 		return
 	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
 	if err == types.ErrConstraintViolation {
 		u.RespondWithError(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -202,11 +261,17 @@ func calculateOrderFromCart(order *types.Order, cart []types.CartItem) {
 	order.TotalAmount = order.Amount + order.TaxAmount + order.ShippingAmount
 }
 
+// orderSnapshot loads an order for the audit log
+func (h *OrderRoutes) orderSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.orderService.GetOrderByID(ctx, id)
+}
+
 func (h *OrderRoutes) RegisterRoutes() {
 	h.muxRouter.Handle("/orders", h.secure(types.RoleGuest)(h.limit(h.CreateOrder, 5, time.Hour))).Methods(http.MethodPost)
-	h.muxRouter.Handle("/orders", h.secure(types.RoleAdmin)(h.UpdateOrder)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/orders/offers/{id}", h.permit(types.PermOffersCreate)(h.limit(h.CreateOfferOrder, 5, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/orders", h.permit(types.PermOrdersFulfill)(h.audit("order.update", "order", h.orderSnapshot)(h.UpdateOrder))).Methods(http.MethodPut)
 	h.muxRouter.HandleFunc("/orders/{id}/public", h.GetOrderPublic).Methods(http.MethodGet)
 	h.muxRouter.Handle("/orders/{id}/owner", h.secure(types.RoleGuest)(h.GetOrderOwner)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/orders/{id}/admin", h.secure(types.RoleStaff)(h.GetOrderAdmin)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/orders", h.secure(types.RoleStaff)(h.GetOrders)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/orders/{id}/admin", h.permit(types.PermOrdersRead)(h.GetOrderAdmin)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/orders", h.permit(types.PermOrdersRead)(h.GetOrders)).Methods(http.MethodGet)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgyurics/marketplace/services"
@@ -17,12 +18,16 @@ type PasswordRoutes struct {
 	passwordService     services.PasswordService
 	userService         services.UserService
 	notificationService services.NotificationService
+	lockoutService      services.LockoutService
+	revocationService   services.TokenRevocationService
 }
 
 func NewPasswordRoutes(
 	passwordService services.PasswordService,
 	userService services.UserService,
 	notificationService services.NotificationService,
+	lockoutService services.LockoutService,
+	revocationService services.TokenRevocationService,
 	router router,
 ) *PasswordRoutes {
 	return &PasswordRoutes{
@@ -30,6 +35,8 @@ func NewPasswordRoutes(
 		passwordService:     passwordService,
 		userService:         userService,
 		notificationService: notificationService,
+		lockoutService:      lockoutService,
+		revocationService:   revocationService,
 	}
 }
 
@@ -107,9 +114,22 @@ func (h *PasswordRoutes) ResetPasswordConfirm(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Reject attempts against a locked email
+	email := strings.ToLower(credentials.Email)
+	remaining, err := h.lockoutService.Check(r.Context(), types.LockoutPasswordReset, email)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if remaining > 0 {
+		respondLocked(w, r, remaining)
+		return
+	}
+
 	// Validate the reset code
-	err := h.passwordService.ValidateResetCode(r.Context(), credentials.ResetCode, credentials.Email)
+	err = h.passwordService.ValidateResetCode(r.Context(), credentials.ResetCode, credentials.Email)
 	if err == types.ErrConstraintViolation {
+		h.recordResetFailure(r, email)
 		u.RespondWithError(w, r, http.StatusBadRequest, "invalid or expired reset code")
 		return
 	}
@@ -129,9 +149,42 @@ func (h *PasswordRoutes) ResetPasswordConfirm(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutPasswordReset, email); err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting password reset lockout", "error", err)
+	}
+
+	// Refresh tokens were revoked with the password, also reject access tokens
+	// already issued, the account may have been compromised
+	usr, err := h.userService.GetUserByEmail(r.Context(), credentials.Email)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := h.revocationService.RevokeTokens(r.Context(), usr.ID); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	u.RespondSuccess(w)
 }
 
+// recordResetFailure tracks a failed reset code attempt.
+// Once locked, the outstanding reset code is invalidated so it cannot be guessed later.
+func (h *PasswordRoutes) recordResetFailure(r *http.Request, email string) {
+	lockout, err := h.lockoutService.RecordFailure(r.Context(), types.LockoutPasswordReset, email)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error recording failed password reset", "error", err)
+		return
+	}
+	if lockout.LockedUntil == nil {
+		return
+	}
+	slog.WarnContext(r.Context(), "Password reset locked after failed attempts", "email", email, "failures", lockout.Failures)
+	if err := h.passwordService.InvalidateResetCode(r.Context(), email); err != nil {
+		slog.ErrorContext(r.Context(), "Error invalidating reset code", "error", err)
+	}
+}
+
 func (h *PasswordRoutes) RegisterRoutes() {
 	h.muxRouter.Handle("/users/password-reset", h.limit(h.ResetPassword, 1, time.Hour*6)).Methods(http.MethodPost)
 	h.muxRouter.Handle("/users/password-reset/confirm", h.limit(h.ResetPasswordConfirm, 1, time.Hour*6)).Methods(http.MethodPost)
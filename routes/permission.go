@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type PermissionRoutes struct {
+	router
+	permissionService services.PermissionService
+}
+
+func NewPermissionRoutes(permissionService services.PermissionService, router router) *PermissionRoutes {
+	return &PermissionRoutes{
+		router:            router,
+		permissionService: permissionService,
+	}
+}
+
+func (h *PermissionRoutes) GetRolePermissions(w http.ResponseWriter, r *http.Request) {
+	rolePerms, err := h.permissionService.GetRolePermissions(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"roles":       rolePerms,
+		"permissions": types.Permissions,
+	})
+}
+
+func (h *PermissionRoutes) UpdateRolePermissions(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Permissions []types.Permission `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	role := types.Role(mux.Vars(r)["role"])
+	err := h.permissionService.UpdateRolePermissions(r.Context(), role, reqBody.Permissions)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid role or permission")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusOK, types.RolePermissions{
+		Role:        role,
+		Permissions: reqBody.Permissions,
+	})
+}
+
+func (h *PermissionRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/permissions", h.permit(types.PermUsersAdmin)(h.GetRolePermissions)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/permissions/{role}", h.permit(types.PermUsersAdmin)(h.audit("permissions.update", "role", nil)(h.UpdateRolePermissions))).Methods(http.MethodPut)
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -115,10 +116,15 @@ func (h *ProductRoutes) RemoveProduct(w http.ResponseWriter, r *http.Request) {
 	u.RespondSuccess(w)
 }
 
+// productSnapshot loads a product for the audit log
+func (h *ProductRoutes) productSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.productService.GetProductByID(ctx, id)
+}
+
 func (h *ProductRoutes) RegisterRoutes() {
 	h.muxRouter.HandleFunc("/products", h.GetProducts).Methods(http.MethodGet)
 	h.muxRouter.HandleFunc("/products/{id}", h.GetProduct).Methods(http.MethodGet)
-	h.muxRouter.Handle("/products", h.secure(types.RoleAdmin)(h.CreateProduct)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/products/{id}", h.secure(types.RoleAdmin)(h.RemoveProduct)).Methods(http.MethodDelete)
-	h.muxRouter.Handle("/products", h.secure(types.RoleAdmin)(h.UpdateProduct)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/products", h.permit(types.PermProductsWrite)(h.audit("product.create", "product", h.productSnapshot)(h.CreateProduct))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/products/{id}", h.permit(types.PermProductsWrite)(h.audit("product.remove", "product", h.productSnapshot)(h.RemoveProduct))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/products", h.permit(types.PermProductsWrite)(h.audit("product.update", "product", h.productSnapshot)(h.UpdateProduct))).Methods(http.MethodPut)
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/dgyurics/marketplace/middleware"
 	"github.com/dgyurics/marketplace/types"
 	util "github.com/dgyurics/marketplace/utilities"
 	"github.com/gorilla/mux"
@@ -29,6 +30,24 @@ func (d dummyAuth) RequireRole(role types.Role) func(next http.HandlerFunc) http
 	}
 }
 
+func (d dummyAuth) RequirePermission(perm types.Permission) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return next
+	}
+}
+
+func (d dummyAuth) Permitted(ctx context.Context, perm types.Permission) bool {
+	return true
+}
+
+type dummyAudit struct{}
+
+func (d dummyAudit) Record(action, entityType string, snapshot middleware.SnapshotFunc, maxBytes int64) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return next
+	}
+}
+
 // Mocking the ProductService
 type MockProductService struct {
 	mock.Mock
@@ -67,8 +86,9 @@ func TestGetProductByID(t *testing.T) {
 	routes := &ProductRoutes{
 		productService: mockService,
 		router: router{
-			muxRouter:      mux.NewRouter(),
-			authMiddleware: &dummyAuth{},
+			muxRouter:       mux.NewRouter(),
+			authMiddleware:  &dummyAuth{},
+			auditMiddleware: &dummyAudit{},
 		},
 	}
 
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -22,6 +23,7 @@ type RegistrationRoutes struct {
 	jwtService          services.JWTService
 	refreshService      services.RefreshService
 	notificationService services.NotificationService
+	lockoutService      services.LockoutService
 }
 
 func NewRegistrationRoutes(
@@ -30,6 +32,7 @@ func NewRegistrationRoutes(
 	jwtService services.JWTService,
 	refreshService services.RefreshService,
 	notificationService services.NotificationService,
+	lockoutService services.LockoutService,
 	router router) *RegistrationRoutes {
 	return &RegistrationRoutes{
 		router:              router,
@@ -38,6 +41,7 @@ func NewRegistrationRoutes(
 		jwtService:          jwtService,
 		refreshService:      refreshService,
 		notificationService: notificationService,
+		lockoutService:      lockoutService,
 	}
 }
 
@@ -73,16 +77,146 @@ func (h *RegistrationRoutes) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// create registration code
-	code, err := h.registrationService.CreateCode(r.Context(), usr.ID, time.Now().UTC().Add(24*time.Hour))
+	if err := h.sendVerification(r, &usr); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
+// RegisterGuest upgrades the authenticated guest to a registered user in place.
+// The user ID is kept, so cart, orders, addresses and inbox carry over.
+func (h *RegistrationRoutes) RegisterGuest(w http.ResponseWriter, r *http.Request) {
+	var reqBody types.Credential
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	if reqBody.Email == "" || !isValidEmail(reqBody.Email) {
+		u.RespondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	if reqBody.Password == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "password is required")
+		return
+	}
+	reqBody.Email = strings.ToLower(reqBody.Email)
+
+	usr, err := h.userService.UpgradeGuest(r.Context(), &reqBody)
+	if err == types.ErrUniqueConstraintViolation {
+		// client should prompt for login and use /register/guest/merge
+		u.RespondWithError(w, r, http.StatusConflict, "email already registered")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		// merging requires a verified account, so the client cannot merge either
+		u.RespondWithError(w, r, http.StatusUnprocessableEntity, "email registered but not verified")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusBadRequest, "only guest accounts can be upgraded")
+		return
+	}
 	if err != nil {
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// email customer email verification link
+	if err := h.sendVerification(r, usr); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
+// MergeGuest moves the authenticated guest's cart, orders, addresses and
+// conversations into an existing account, then signs in as that account.
+func (h *RegistrationRoutes) MergeGuest(w http.ResponseWriter, r *http.Request) {
+	var reqBody types.Credential
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	if reqBody.Email == "" || !isValidEmail(reqBody.Email) {
+		u.RespondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	if reqBody.Password == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "password is required")
+		return
+	}
+	reqBody.Email = strings.ToLower(reqBody.Email)
+
+	// Merging verifies the account password, so it shares the login lockout
+	remaining, err := h.lockoutService.Check(r.Context(), types.LockoutLogin, reqBody.Email)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if remaining > 0 {
+		h.recordHit(r, time.Hour*6)
+		respondLocked(w, r, remaining)
+		return
+	}
+
+	usr, err := h.userService.MergeGuest(r.Context(), &reqBody)
+	if err == types.ErrNotFound {
+		h.recordHit(r, time.Hour*6) // record failed login attempt for rate limiting
+		recordLoginFailure(r, h.lockoutService, h.userService, h.notificationService, reqBody.Email)
+		u.RespondWithError(w, r, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusBadRequest, "only guest accounts can be merged")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Successful login clears previous failures
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutLogin, reqBody.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting login lockout", "error", err)
+	}
+
+	// Generate access token
+	accessToken, err := h.jwtService.GenerateToken(*usr)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Generate refresh token
+	refreshToken, err := h.refreshService.GenerateToken()
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Store refresh token
+	if err := h.refreshService.StoreToken(r.Context(), usr.ID, refreshToken); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusCreated, types.TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// sendVerification creates a registration code and emails the verification link
+func (h *RegistrationRoutes) sendVerification(r *http.Request, usr *types.User) error {
+	code, err := h.registrationService.CreateCode(r.Context(), usr.ID, time.Now().UTC().Add(24*time.Hour))
+	if err != nil {
+		return err
+	}
+
 	go func(email, code string) {
-		detailsLink := fmt.Sprintf("%s?registration-code=%s", h.notificationService.BaseURL(), url.QueryEscape(code))
+		detailsLink := fmt.Sprintf("%s?registration-code=%s&email=%s", h.notificationService.BaseURL(), url.QueryEscape(code), url.QueryEscape(email))
 		data := map[string]string{
 			"DetailsLink": detailsLink,
 		}
@@ -91,21 +225,43 @@ func (h *RegistrationRoutes) Register(w http.ResponseWriter, r *http.Request) {
 		}
 	}(*usr.Email, code)
 
-	u.RespondSuccess(w)
+	return nil
 }
 
 func (h *RegistrationRoutes) RegisterConfirm(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
+		Email            string `json:"email"`
 		RegistrationCode string `json:"registration_code"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
 		return
 	}
+	if reqBody.Email == "" || !isValidEmail(reqBody.Email) {
+		u.RespondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	if reqBody.RegistrationCode == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "registration code is required")
+		return
+	}
+	email := strings.ToLower(reqBody.Email)
+
+	// Failures are tracked per account, so guessing from rotating IPs is bounded too
+	remaining, err := h.lockoutService.Check(r.Context(), types.LockoutRegistration, email)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if remaining > 0 {
+		respondLocked(w, r, remaining)
+		return
+	}
 
 	// verify registration code
-	usr, err := h.registrationService.VerifyCode(r.Context(), reqBody.RegistrationCode)
+	usr, err := h.registrationService.VerifyCode(r.Context(), email, reqBody.RegistrationCode)
 	if err == types.ErrNotFound {
+		h.recordRegistrationFailure(r, email)
 		u.RespondWithError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -113,6 +269,9 @@ func (h *RegistrationRoutes) RegisterConfirm(w http.ResponseWriter, r *http.Requ
 		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutRegistration, email); err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting registration lockout", "error", err)
+	}
 
 	// Generate new access token
 	accessToken, err := h.jwtService.GenerateToken(*usr)
@@ -140,6 +299,33 @@ func (h *RegistrationRoutes) RegisterConfirm(w http.ResponseWriter, r *http.Requ
 	})
 }
 
+// recordRegistrationFailure tracks a failed confirmation against the account.
+// Once the account is locked, its pending codes are invalidated and a new
+// verification link is emailed to the account owner.
+func (h *RegistrationRoutes) recordRegistrationFailure(r *http.Request, email string) {
+	lockout, err := h.lockoutService.RecordFailure(r.Context(), types.LockoutRegistration, email)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error recording failed registration confirmation", "error", err)
+		return
+	}
+	if lockout.LockedUntil == nil {
+		return
+	}
+
+	usr, err := h.registrationService.RemoveCodes(r.Context(), email)
+	if err == types.ErrNotFound {
+		return // no pending registration
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error invalidating registration codes", "error", err)
+		return
+	}
+	slog.WarnContext(r.Context(), "Registration codes invalidated after failed confirmations", "user_id", usr.ID, "failures", lockout.Failures)
+	if err := h.sendVerification(r, usr); err != nil {
+		slog.ErrorContext(r.Context(), "Error sending new registration code", "user_id", usr.ID, "error", err)
+	}
+}
+
 func (h *RegistrationRoutes) CreateCodeForUser(w http.ResponseWriter, r *http.Request) {
 	code, err := h.registrationService.CreateCode(r.Context(), mux.Vars(r)["id"], time.Now().UTC().Add(24*time.Hour))
 	if err != nil {
@@ -152,8 +338,15 @@ func (h *RegistrationRoutes) CreateCodeForUser(w http.ResponseWriter, r *http.Re
 	})
 }
 
+// userSnapshot loads a user for the audit log
+func (h *RegistrationRoutes) userSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.userService.GetUserByID(ctx, id)
+}
+
 func (h *RegistrationRoutes) RegisterRoutes() {
 	h.muxRouter.Handle("/register", h.limit(h.Register, 2, time.Hour*6)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/register/{id}/admin", h.secure(types.RoleAdmin)(h.CreateCodeForUser)).Methods(http.MethodPost)
+	h.muxRouter.Handle("/register/guest", h.secure(types.RoleGuest)(h.limit(h.RegisterGuest, 2, time.Hour*6))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/register/guest/merge", h.secure(types.RoleGuest)(h.guardLimit(h.MergeGuest, 5))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/register/{id}/admin", h.permit(types.PermUsersAdmin)(h.audit("user.registration_code", "user", h.userSnapshot)(h.CreateCodeForUser))).Methods(http.MethodPost)
 	h.muxRouter.Handle("/register/confirm", h.limit(h.RegisterConfirm, 2, time.Hour*6)).Methods(http.MethodPost)
 }
@@ -152,11 +152,11 @@ func validateExcludedShippingZone(zone types.ExcludedShippingZone) error {
 }
 
 func (h *ShippingZoneRoutes) RegisterRoutes() {
-	h.muxRouter.Handle("/shipping-zones", h.secure(types.RoleAdmin)(h.CreateShippingZone)).Methods("POST")
-	h.muxRouter.Handle("/shipping-zones", h.secure(types.RoleStaff)(h.ListShippingZones)).Methods("GET")
-	h.muxRouter.Handle("/shipping-zones/{id}", h.secure(types.RoleAdmin)(h.RemoveShippingZone)).Methods("DELETE")
+	h.muxRouter.Handle("/shipping-zones", h.permit(types.PermShippingWrite)(h.audit("shipping_zone.create", "shipping_zone", nil)(h.CreateShippingZone))).Methods("POST")
+	h.muxRouter.Handle("/shipping-zones", h.permit(types.PermShippingRead)(h.ListShippingZones)).Methods("GET")
+	h.muxRouter.Handle("/shipping-zones/{id}", h.permit(types.PermShippingWrite)(h.audit("shipping_zone.remove", "shipping_zone", nil)(h.RemoveShippingZone))).Methods("DELETE")
 
-	h.muxRouter.Handle("/shipping-zones/excluded", h.secure(types.RoleAdmin)(h.CreateExcludedShippingZone)).Methods("POST")
-	h.muxRouter.Handle("/shipping-zones/excluded", h.secure(types.RoleStaff)(h.ListExcludedShippingZones)).Methods("GET")
-	h.muxRouter.Handle("/shipping-zones/excluded/{id}", h.secure(types.RoleAdmin)(h.RemoveExcludedShippingZone)).Methods("DELETE")
+	h.muxRouter.Handle("/shipping-zones/excluded", h.permit(types.PermShippingWrite)(h.audit("shipping_exclusion.create", "shipping_exclusion", nil)(h.CreateExcludedShippingZone))).Methods("POST")
+	h.muxRouter.Handle("/shipping-zones/excluded", h.permit(types.PermShippingRead)(h.ListExcludedShippingZones)).Methods("GET")
+	h.muxRouter.Handle("/shipping-zones/excluded/{id}", h.permit(types.PermShippingWrite)(h.audit("shipping_exclusion.remove", "shipping_exclusion", nil)(h.RemoveExcludedShippingZone))).Methods("DELETE")
 }
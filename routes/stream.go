@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+)
+
+const (
+	streamHeartbeat   = 25 * time.Second // comment sent when idle, so proxies keep the connection open
+	streamMaxDuration = 30 * time.Minute // streams end after this, so clients reconnect with a current access token
+	streamRetry       = 5 * time.Second  // delay before EventSource clients reconnect
+)
+
+type StreamRoutes struct {
+	router
+	streamService services.StreamService
+	writeTimeout  time.Duration
+}
+
+func NewStreamRoutes(streamService services.StreamService, config types.ServerConfig, router router) *StreamRoutes {
+	return &StreamRoutes{
+		router:        router,
+		streamService: streamService,
+		writeTimeout:  config.WriteTimeout,
+	}
+}
+
+// Stream sends the authenticated user's events as Server-Sent Events: new messages, unread
+// conversation counts, and order and offer status changes. Clients reconnecting with the
+// Last-Event-ID header (or last_event_id parameter) receive the events they missed.
+// EventSource clients authenticate with the token parameter, see StreamToken.
+//
+// The server's WriteTimeout applies to each write rather than to the whole stream.
+func (h *StreamRoutes) Stream(w http.ResponseWriter, r *http.Request) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), streamMaxDuration)
+	defer cancel()
+
+	events, err := h.streamService.Subscribe(ctx, lastEventID)
+	if err == services.ErrTooManyStreams {
+		u.RespondWithError(w, r, http.StatusTooManyRequests, "too many open streams")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // disables response buffering in nginx
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...interface{}) error {
+		var deadline time.Time // none without a WriteTimeout
+		if h.writeTimeout > 0 {
+			deadline = time.Now().Add(h.writeTimeout)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := write("retry: %d\n\n", streamRetry.Milliseconds()); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return // ctx ended, or the server is shutting down
+			}
+			if err := write("id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// StreamToken returns a short-lived token for opening a stream as the authenticated user.
+// Browsers' EventSource cannot send an Authorization header, so it opens
+// /users/me/events?token=<token> instead, and requests a new token to reconnect.
+func (h *StreamRoutes) StreamToken(w http.ResponseWriter, r *http.Request) {
+	token, err := h.streamService.CreateToken(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusCreated, map[string]string{
+		"token":      token,
+		"expires_in": "1m",
+	})
+}
+
+// streamAuth authenticates with the stream token parameter when given, and with the Authorization header otherwise
+func (h *StreamRoutes) streamAuth(next http.HandlerFunc) http.HandlerFunc {
+	secured := h.secure(types.RoleGuest)(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			secured(w, r)
+			return
+		}
+		user, err := h.streamService.ParseToken(token)
+		if err != nil || !user.HasMinimumRole(types.RoleGuest) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), services.UserKey, user)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func (h *StreamRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/users/me/events", h.streamAuth(h.Stream)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users/me/events/token", h.secure(types.RoleGuest)(h.limit(h.StreamToken, 60, time.Hour))).Methods(http.MethodPost)
+}
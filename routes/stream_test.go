@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockStreamService struct {
+	mock.Mock
+	services.StreamService
+}
+
+func (m *MockStreamService) Subscribe(ctx context.Context, lastEventID string) (<-chan types.StreamEvent, error) {
+	args := m.Called(ctx, lastEventID)
+	events, _ := args.Get(0).(chan types.StreamEvent)
+	return events, args.Error(1)
+}
+
+func newStreamServer(t *testing.T, mockService *MockStreamService) *httptest.Server {
+	routes := &StreamRoutes{
+		streamService: mockService,
+		writeTimeout:  time.Second,
+		router: router{
+			muxRouter: mux.NewRouter(),
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(routes.Stream))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStream(t *testing.T) {
+	mockService := new(MockStreamService)
+	events := make(chan types.StreamEvent)
+	mockService.On("Subscribe", mock.Anything, "41").Return(events, nil)
+	server := newStreamServer(t, mockService)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "41")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	go func() {
+		data, _ := json.Marshal(types.InboxUnread{Count: 3})
+		events <- types.StreamEvent{ID: "42", Type: types.StreamUnread, Data: data}
+		close(events)
+	}()
+
+	reader := bufio.NewReader(resp.Body)
+	var received []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		received = append(received, strings.TrimRight(line, "\n"))
+	}
+	require.Equal(t, []string{
+		"retry: 5000",
+		"",
+		"id: 42",
+		"event: unread",
+		`data: {"count":3}`,
+		"",
+	}, received)
+}
+
+func TestStream_TooManyStreams(t *testing.T) {
+	mockService := new(MockStreamService)
+	mockService.On("Subscribe", mock.Anything, "").Return(nil, services.ErrTooManyStreams)
+	server := newStreamServer(t, mockService)
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func (m *MockStreamService) ParseToken(token string) (*types.User, error) {
+	args := m.Called(token)
+	user, _ := args.Get(0).(*types.User)
+	return user, args.Error(1)
+}
+
+func TestStream_Token(t *testing.T) {
+	mockService := new(MockStreamService)
+	routes := &StreamRoutes{
+		streamService: mockService,
+		writeTimeout:  time.Second,
+		router: router{
+			muxRouter:      mux.NewRouter(),
+			authMiddleware: &dummyAuth{},
+		},
+	}
+	server := httptest.NewServer(routes.streamAuth(routes.Stream))
+	t.Cleanup(server.Close)
+
+	mockService.On("ParseToken", "invalid").Return(nil, types.ErrInvalidInput)
+	resp, err := http.Get(server.URL + "?token=invalid")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// EventSource clients authenticate with the token parameter
+	mockService.On("ParseToken", "valid").Return(&types.User{ID: "7", Role: types.RoleUser}, nil)
+	mockService.On("Subscribe", mock.MatchedBy(func(ctx context.Context) bool {
+		user, ok := ctx.Value(services.UserKey).(*types.User)
+		return ok && user.ID == "7"
+	}), "").Return(nil, services.ErrTooManyStreams)
+	resp, err = http.Get(server.URL + "?token=valid")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	mockService.AssertExpectations(t)
+}
@@ -0,0 +1,160 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type TemplateRoutes struct {
+	router
+	templateService services.TemplateService
+}
+
+func NewTemplateRoutes(templateService services.TemplateService, router router) *TemplateRoutes {
+	return &TemplateRoutes{
+		router:          router,
+		templateService: templateService,
+	}
+}
+
+func (h *TemplateRoutes) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.templateService.GetTemplates(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, templates)
+}
+
+func (h *TemplateRoutes) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := h.templateService.GetTemplate(r.Context(), templateName(r))
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, tmpl)
+}
+
+func (h *TemplateRoutes) GetVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.templateService.GetTemplateVersions(r.Context(), templateName(r))
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, versions)
+}
+
+// SaveTemplate saves a new version of a template, e.g. {"body": "<html>...</html>"},
+// which is rendered instead of the file from then on
+func (h *TemplateRoutes) SaveTemplate(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	version, err := h.templateService.SaveTemplate(r.Context(), templateName(r), reqBody.Body)
+	var invalidErr *types.InvalidTemplateError
+	if errors.As(err, &invalidErr) {
+		u.RespondWithError(w, r, http.StatusBadRequest, invalidErr.Error())
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "template not found")
+		return
+	}
+	if err == types.ErrUniqueConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "template was saved concurrently, try again")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusCreated, version)
+}
+
+// RevertTemplate reverts a template to its file, keeping the saved versions
+func (h *TemplateRoutes) RevertTemplate(w http.ResponseWriter, r *http.Request) {
+	version, err := h.templateService.RevertTemplate(r.Context(), templateName(r))
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "template not found")
+		return
+	}
+	if err == types.ErrUniqueConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "template was saved concurrently, try again")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusCreated, version)
+}
+
+// PreviewTemplate renders a template with sample data, as HTML.
+// An optional body, e.g. {"body": "<html>...</html>"}, is previewed without being saved.
+func (h *TemplateRoutes) PreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Body *string `json:"body"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+			return
+		}
+	}
+
+	body, err := h.templateService.PreviewTemplate(r.Context(), templateName(r), reqBody.Body)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
+
+// templateName returns the template named in the path, e.g. "email_order_confirmation.html"
+func templateName(r *http.Request) services.HtmlTemplate {
+	return services.HtmlTemplate(mux.Vars(r)["id"])
+}
+
+// templateSnapshot loads a template for the audit log, with its latest version
+func (h *TemplateRoutes) templateSnapshot(ctx context.Context, name string) (interface{}, error) {
+	tmpl, err := h.templateService.GetTemplate(ctx, services.HtmlTemplate(name))
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Override, nil
+}
+
+func (h *TemplateRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/templates", h.permit(types.PermTemplatesWrite)(h.GetTemplates)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/templates/{id}", h.permit(types.PermTemplatesWrite)(h.GetTemplate)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/templates/{id}", h.permit(types.PermTemplatesWrite)(h.audit("template.update", "template", h.templateSnapshot)(h.SaveTemplate))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/templates/{id}", h.permit(types.PermTemplatesWrite)(h.audit("template.revert", "template", h.templateSnapshot)(h.RevertTemplate))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/templates/{id}/versions", h.permit(types.PermTemplatesWrite)(h.GetVersions)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/templates/{id}/preview", h.permit(types.PermTemplatesWrite)(h.PreviewTemplate)).Methods(http.MethodPost)
+}
@@ -1,10 +1,16 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,21 +22,27 @@ import (
 
 type UserRoutes struct {
 	router
-	userService    services.UserService
-	jwtService     services.JWTService
-	refreshService services.RefreshService
+	userService         services.UserService
+	jwtService          services.JWTService
+	refreshService      services.RefreshService
+	lockoutService      services.LockoutService
+	notificationService services.NotificationService
 }
 
 func NewUserRoutes(
 	userService services.UserService,
 	jwtService services.JWTService,
 	refreshService services.RefreshService,
+	lockoutService services.LockoutService,
+	notificationService services.NotificationService,
 	router router) *UserRoutes {
 	return &UserRoutes{
-		router:         router,
-		userService:    userService,
-		jwtService:     jwtService,
-		refreshService: refreshService,
+		router:              router,
+		userService:         userService,
+		jwtService:          jwtService,
+		refreshService:      refreshService,
+		lockoutService:      lockoutService,
+		notificationService: notificationService,
 	}
 }
 
@@ -51,6 +63,12 @@ func isValidEmail(email string) bool {
 	return err == nil
 }
 
+// respondLocked responds with 429 Too Many Requests and a Retry-After header
+func respondLocked(w http.ResponseWriter, r *http.Request, remaining time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	u.RespondWithError(w, r, http.StatusTooManyRequests, "too many failed attempts, try again later")
+}
+
 func (h *UserRoutes) Login(w http.ResponseWriter, r *http.Request) {
 	var credentials types.Credential
 	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
@@ -68,10 +86,24 @@ func (h *UserRoutes) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reject attempts against a locked account, regardless of client IP
+	email := strings.ToLower(credentials.Email)
+	remaining, err := h.lockoutService.Check(r.Context(), types.LockoutLogin, email)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if remaining > 0 {
+		h.recordHit(r, time.Hour*6)
+		respondLocked(w, r, remaining)
+		return
+	}
+
 	// Verify user credentials
 	usr, err := h.userService.Login(r.Context(), &credentials)
 	if err == types.ErrNotFound {
 		h.recordHit(r, time.Hour*6) // record failed login attempt for rate limiting
+		recordLoginFailure(r, h.lockoutService, h.userService, h.notificationService, email)
 		u.RespondWithError(w, r, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
@@ -80,6 +112,11 @@ func (h *UserRoutes) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Successful login clears previous failures
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutLogin, email); err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting login lockout", "error", err)
+	}
+
 	// Generate access token
 	accessToken, err := h.jwtService.GenerateToken(*usr)
 	if err != nil {
@@ -106,6 +143,36 @@ func (h *UserRoutes) Login(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// recordLoginFailure tracks a failed login against the account,
+// and emails the account owner when the account becomes locked.
+// Shared by every route verifying an account password.
+func recordLoginFailure(r *http.Request, lockoutService services.LockoutService, userService services.UserService,
+	notificationService services.NotificationService, email string) {
+	lockout, err := lockoutService.RecordFailure(r.Context(), types.LockoutLogin, email)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error recording failed login", "error", err)
+		return
+	}
+	if lockout.LockedUntil == nil {
+		return
+	}
+
+	slog.WarnContext(r.Context(), "Account locked after failed logins", "email", email, "failures", lockout.Failures)
+	go func(email string, lockedUntil time.Time) {
+		// only notify existing accounts
+		if _, err := userService.GetUserByEmail(context.Background(), email); err != nil {
+			return
+		}
+		data := map[string]interface{}{
+			"LockedUntil": lockedUntil,
+			"ResetLink":   fmt.Sprintf("%s/auth/email/%s/password-reset", notificationService.BaseURL(), url.PathEscape(email)),
+		}
+		if err := notificationService.SendEmail(email, services.SubjectAccountLocked, services.EmailAccountLocked, data); err != nil {
+			slog.Error("Error sending account locked email: ", "email", email, "error", err)
+		}
+	}(email, *lockout.LockedUntil)
+}
+
 // RefreshToken generates a new access token using a valid refresh token
 func (h *UserRoutes) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	var requestBody struct {
@@ -402,6 +469,200 @@ func (h *UserRoutes) ChangeEmail(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetProfile returns the authenticated user's profile
+func (h *UserRoutes) GetProfile(w http.ResponseWriter, r *http.Request) {
+	usr, err := h.userService.GetProfile(r.Context())
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, usr)
+}
+
+// UpdateProfile updates the authenticated user's name and phone number
+func (h *UserRoutes) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Name  *string `json:"name"`
+		Phone *string `json:"phone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	usr, err := h.userService.UpdateProfile(r.Context(), reqBody.Name, reqBody.Phone)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid name or phone")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, usr)
+}
+
+// RequestEmailChange sends a confirmation code to the new email address
+func (h *UserRoutes) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	var credentials types.Credential
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	if credentials.Email == "" || !isValidEmail(credentials.Email) {
+		u.RespondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	if credentials.Password == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "password is required")
+		return
+	}
+
+	code, err := h.userService.RequestEmailChange(r.Context(), &credentials)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	if err == types.ErrUniqueConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "email already in use")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusBadRequest, "password must be set before changing email")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Send confirmation code to the new address
+	go func(recEmail, code string) {
+		data := map[string]string{
+			"Code":        code,
+			"ConfirmLink": fmt.Sprintf("%s?email-change-code=%s", h.notificationService.BaseURL(), url.QueryEscape(code)),
+		}
+		if err := h.notificationService.SendEmail(recEmail, services.SubjectEmailChange, services.EmailChange, data); err != nil {
+			slog.Error("Error sending email change confirmation: ", "email", recEmail, "error", err)
+		}
+	}(credentials.Email, code)
+
+	u.RespondSuccess(w)
+}
+
+// ConfirmEmailChange applies a pending email change and issues new tokens
+func (h *UserRoutes) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	if reqBody.Code == "" {
+		u.RespondWithError(w, r, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	usr, err := h.userService.ConfirmEmailChange(r.Context(), reqBody.Code)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid or expired code")
+		return
+	}
+	if err == types.ErrUniqueConstraintViolation {
+		u.RespondWithError(w, r, http.StatusConflict, "email already in use")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Revoke existing refresh tokens
+	if err := h.refreshService.RevokeTokens(r.Context()); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Generate new access token
+	accessToken, err := h.jwtService.GenerateToken(*usr)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Generate new refresh refreshToken
+	refreshToken, err := h.refreshService.GenerateToken()
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Store refresh token
+	if err := h.refreshService.StoreToken(r.Context(), usr.ID, refreshToken); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusOK, types.TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// ExportData returns a JSON archive of the authenticated user's data
+func (h *UserRoutes) ExportData(w http.ResponseWriter, r *http.Request) {
+	export, err := h.userService.ExportData(r.Context())
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="account-export.json"`)
+	u.RespondWithJSON(w, http.StatusOK, export)
+}
+
+// DeleteAccount anonymizes the authenticated user's account.
+// Orders are kept for accounting, all other personal data is removed.
+func (h *UserRoutes) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+			return
+		}
+	}
+
+	err := h.userService.DeleteAccount(r.Context(), reqBody.Password)
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusBadRequest, "admin accounts cannot be deleted")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
 func (h *UserRoutes) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	params := u.ParsePaginationParams(r, 1, 100)
 	users, err := h.userService.GetAllUsers(r.Context(), params.Page, params.Limit)
@@ -424,9 +685,84 @@ func (h *UserRoutes) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Include login lockout status
+	if usr.Email != nil {
+		lockout, err := h.lockoutService.GetLockout(r.Context(), types.LockoutLogin, strings.ToLower(*usr.Email))
+		if err != nil && err != types.ErrNotFound {
+			u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if lockout != nil {
+			usr.FailedLogins = lockout.Failures
+			if lockout.LockedUntil != nil && lockout.LockedUntil.After(time.Now()) {
+				usr.LockedUntil = lockout.LockedUntil
+			}
+		}
+	}
+
 	u.RespondWithJSON(w, http.StatusOK, usr)
 }
 
+// UpdateRole changes the role of a user
+func (h *UserRoutes) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Role types.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	usr, err := h.userService.UpdateRole(r.Context(), mux.Vars(r)["id"], reqBody.Role)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid role")
+		return
+	}
+	if err == types.ErrConstraintViolation {
+		u.RespondWithError(w, r, http.StatusBadRequest, "cannot change own role")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondWithJSON(w, http.StatusOK, usr)
+}
+
+// UnlockUser clears the login lockout for a user
+func (h *UserRoutes) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	usr, err := h.userService.GetUserByID(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if usr.Email == nil {
+		u.RespondSuccess(w)
+		return
+	}
+
+	email := strings.ToLower(*usr.Email)
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutLogin, email); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := h.lockoutService.Reset(r.Context(), types.LockoutPasswordReset, email); err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.RespondSuccess(w)
+}
+
 func (h *UserRoutes) RemoveUser(w http.ResponseWriter, r *http.Request) {
 	err := h.userService.RemoveUser(r.Context(), mux.Vars(r)["id"])
 	if err == types.ErrNotFound {
@@ -441,16 +777,29 @@ func (h *UserRoutes) RemoveUser(w http.ResponseWriter, r *http.Request) {
 	u.RespondSuccess(w)
 }
 
+// userSnapshot loads a user for the audit log
+func (h *UserRoutes) userSnapshot(ctx context.Context, id string) (interface{}, error) {
+	return h.userService.GetUserByID(ctx, id)
+}
+
 func (h *UserRoutes) RegisterRoutes() {
 	h.muxRouter.Handle("/users/login", h.guardLimit(h.Login, 5)).Methods(http.MethodPost)
 	h.muxRouter.Handle("/users/refresh-token", h.limit(h.RefreshToken, 5, time.Hour)).Methods(http.MethodPost)
 	h.muxRouter.Handle("/users/guest", h.limit(h.CreateGuestUser, 3, time.Hour)).Methods(http.MethodPost)
 	h.muxRouter.Handle("/users/change-password", h.secure(types.RoleUser)(h.limit(h.ChangePassword, 5, time.Hour))).Methods(http.MethodPut)
 	h.muxRouter.Handle("/users/set-password", h.secure(types.RoleUser)(h.limit(h.SetPassword, 5, time.Hour))).Methods(http.MethodPost)
-	h.muxRouter.Handle("/users/change-email", h.secure(types.RoleAdmin)(h.limit(h.ChangeEmail, 5, time.Hour))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/users/change-email", h.permit(types.PermUsersAdmin)(h.audit("user.change_email", "user", nil)(h.limit(h.ChangeEmail, 5, time.Hour)))).Methods(http.MethodPut)
 	h.muxRouter.Handle("/users/logout", h.secure(types.RoleGuest)(h.Logout)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/users", h.secure(types.RoleStaff)(h.GetAllUsers)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/users", h.secure(types.RoleAdmin)(h.CreateUser)).Methods(http.MethodPost)
-	h.muxRouter.Handle("/users/{id}", h.secure(types.RoleAdmin)(h.GetUser)).Methods(http.MethodGet)
-	h.muxRouter.Handle("/users/{id}", h.secure(types.RoleAdmin)(h.RemoveUser)).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/users/me", h.secure(types.RoleUser)(h.GetProfile)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users/me", h.secure(types.RoleUser)(h.UpdateProfile)).Methods(http.MethodPut)
+	h.muxRouter.Handle("/users/me", h.secure(types.RoleGuest)(h.limit(h.DeleteAccount, 5, time.Hour))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/users/me/email", h.secure(types.RoleUser)(h.limit(h.RequestEmailChange, 3, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/users/me/email/confirm", h.secure(types.RoleUser)(h.limit(h.ConfirmEmailChange, 5, time.Hour))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/users/me/export", h.secure(types.RoleGuest)(h.limit(h.ExportData, 5, time.Hour))).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users", h.permit(types.PermUsersRead)(h.GetAllUsers)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users", h.permit(types.PermUsersAdmin)(h.audit("user.create", "user", h.userSnapshot)(h.CreateUser))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/users/{id}", h.permit(types.PermUsersAdmin)(h.GetUser)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/users/{id}", h.permit(types.PermUsersAdmin)(h.audit("user.remove", "user", h.userSnapshot)(h.RemoveUser))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/users/{id}/role", h.permit(types.PermUsersAdmin)(h.audit("user.update_role", "user", h.userSnapshot)(h.UpdateRole))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/users/{id}/lockout", h.permit(types.PermUsersAdmin)(h.audit("user.unlock", "user", nil)(h.UnlockUser))).Methods(http.MethodDelete)
 }
@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgyurics/marketplace/services"
+	"github.com/dgyurics/marketplace/types"
+	u "github.com/dgyurics/marketplace/utilities"
+	"github.com/gorilla/mux"
+)
+
+type WebhookRoutes struct {
+	router
+	webhookService services.WebhookService
+}
+
+func NewWebhookRoutes(webhookService services.WebhookService, router router) *WebhookRoutes {
+	return &WebhookRoutes{
+		router:         router,
+		webhookService: webhookService,
+	}
+}
+
+func (h *WebhookRoutes) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.webhookService.GetWebhooks(r.Context())
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"webhooks": webhooks,
+		"events":   types.WebhookEvents,
+	})
+}
+
+func (h *WebhookRoutes) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook types.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+
+	err := h.webhookService.CreateWebhook(r.Context(), &webhook)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid url or events")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the signing secret is only ever returned here
+	u.RespondWithJSON(w, http.StatusCreated, webhook)
+}
+
+func (h *WebhookRoutes) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook types.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		u.RespondWithError(w, r, http.StatusBadRequest, "error decoding request payload")
+		return
+	}
+	webhook.ID = mux.Vars(r)["id"]
+
+	err := h.webhookService.UpdateWebhook(r.Context(), &webhook)
+	if err == types.ErrInvalidInput {
+		u.RespondWithError(w, r, http.StatusBadRequest, "invalid url or events")
+		return
+	}
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, webhook)
+}
+
+func (h *WebhookRoutes) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	err := h.webhookService.RemoveWebhook(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebhookRoutes) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	params := u.ParsePaginationParams(r, 1, 50)
+	deliveries, err := h.webhookService.GetDeliveries(r.Context(), mux.Vars(r)["id"], params.Page, params.Limit)
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusOK, deliveries)
+}
+
+func (h *WebhookRoutes) Redeliver(w http.ResponseWriter, r *http.Request) {
+	delivery, err := h.webhookService.Redeliver(r.Context(), mux.Vars(r)["id"])
+	if err == types.ErrNotFound {
+		u.RespondWithError(w, r, http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err != nil {
+		u.RespondWithError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	u.RespondWithJSON(w, http.StatusAccepted, delivery)
+}
+
+// webhookSnapshot loads a webhook for the audit log, without its signing secret
+func (h *WebhookRoutes) webhookSnapshot(ctx context.Context, id string) (interface{}, error) {
+	webhooks, err := h.webhookService.GetWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range webhooks {
+		if webhook.ID == id {
+			return webhook, nil
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (h *WebhookRoutes) RegisterRoutes() {
+	h.muxRouter.Handle("/webhooks", h.permit(types.PermWebhooksAdmin)(h.GetWebhooks)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/webhooks", h.permit(types.PermWebhooksAdmin)(h.audit("webhook.create", "webhook", h.webhookSnapshot)(h.CreateWebhook))).Methods(http.MethodPost)
+	h.muxRouter.Handle("/webhooks/{id}", h.permit(types.PermWebhooksAdmin)(h.audit("webhook.update", "webhook", h.webhookSnapshot)(h.UpdateWebhook))).Methods(http.MethodPut)
+	h.muxRouter.Handle("/webhooks/{id}", h.permit(types.PermWebhooksAdmin)(h.audit("webhook.remove", "webhook", h.webhookSnapshot)(h.RemoveWebhook))).Methods(http.MethodDelete)
+	h.muxRouter.Handle("/webhooks/{id}/deliveries", h.permit(types.PermWebhooksAdmin)(h.GetDeliveries)).Methods(http.MethodGet)
+	h.muxRouter.Handle("/webhooks/deliveries/{id}/redeliver", h.permit(types.PermWebhooksAdmin)(h.audit("webhook.redeliver", "webhook_delivery", nil)(h.Redeliver))).Methods(http.MethodPost)
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+const (
+	apiKeyPrefix        = "mk_"
+	apiKeyDefaultExpiry = 90 * 24 * time.Hour
+	apiKeyMaxExpiry     = 365 * 24 * time.Hour
+)
+
+// APIKeyService manages personal API keys, used by scripts in place of a password
+type APIKeyService interface {
+	CreateKey(ctx context.Context, key *types.APIKey) (string, error)
+	GetKeys(ctx context.Context) ([]types.APIKey, error)
+	RevokeKey(ctx context.Context, keyID string) error
+	Authenticate(ctx context.Context, key string) (*types.User, error)
+}
+
+type apiKeyService struct {
+	repo   repositories.APIKeyRepository
+	secret []byte
+}
+
+func NewAPIKeyService(repo repositories.APIKeyRepository, secret []byte) APIKeyService {
+	return &apiKeyService{
+		repo:   repo,
+		secret: secret,
+	}
+}
+
+// CreateKey creates a key for the current user and returns it.
+// The key cannot be retrieved again, only its hash is stored.
+func (s *apiKeyService) CreateKey(ctx context.Context, key *types.APIKey) (string, error) {
+	user, ok := ctx.Value(UserKey).(*types.User)
+	if !ok || user == nil {
+		return "", types.ErrNotFound
+	}
+	// keys must not be able to mint other keys
+	if user.APIKeyID != "" {
+		return "", types.ErrConstraintViolation
+	}
+
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" || len(key.Name) > 100 {
+		return "", types.ErrInvalidInput
+	}
+	if key.Role == "" {
+		key.Role = user.Role
+	}
+	if !key.Role.IsValid() || !user.HasMinimumRole(key.Role) {
+		return "", types.ErrInvalidInput
+	}
+	for _, perm := range key.Permissions {
+		if !perm.IsValid() {
+			return "", types.ErrInvalidInput
+		}
+	}
+	now := time.Now().UTC()
+	if key.ExpiresAt.IsZero() {
+		key.ExpiresAt = now.Add(apiKeyDefaultExpiry)
+	}
+	if !key.ExpiresAt.After(now) || key.ExpiresAt.After(now.Add(apiKeyMaxExpiry)) {
+		return "", types.ErrInvalidInput
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	plain := apiKeyPrefix + hex.EncodeToString(secret)
+
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return "", err
+	}
+	key.ID = id
+	key.UserID = user.ID
+	key.Prefix = plain[:len(apiKeyPrefix)+8]
+	key.KeyHash = hashString(plain, s.secret)
+	key.Revoked = false
+	key.LastUsedAt = nil
+	if err := s.repo.CreateKey(ctx, key); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+func (s *apiKeyService) GetKeys(ctx context.Context) ([]types.APIKey, error) {
+	return s.repo.GetKeys(ctx, getUserID(ctx))
+}
+
+func (s *apiKeyService) RevokeKey(ctx context.Context, keyID string) error {
+	return s.repo.RevokeKey(ctx, getUserID(ctx), keyID)
+}
+
+// Authenticate resolves a key to the user it acts as.
+// The role is capped at the owner's current role, so demoting a user also demotes their keys.
+func (s *apiKeyService) Authenticate(ctx context.Context, key string) (*types.User, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, types.ErrNotFound
+	}
+	apiKey, owner, err := s.repo.UseKey(ctx, hashString(key, s.secret))
+	if err != nil {
+		return nil, err
+	}
+
+	role := apiKey.Role
+	if !owner.HasMinimumRole(role) {
+		role = owner.Role
+	}
+	return &types.User{
+		ID:       owner.ID,
+		Email:    owner.Email,
+		Role:     role,
+		APIKeyID: apiKey.ID,
+		Scopes:   apiKey.Permissions,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockAPIKeyRepo struct {
+	mock.Mock
+}
+
+func (m *mockAPIKeyRepo) CreateKey(ctx context.Context, key *types.APIKey) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+func (m *mockAPIKeyRepo) GetKeys(ctx context.Context, userID string) ([]types.APIKey, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).([]types.APIKey), args.Error(1)
+}
+
+func (m *mockAPIKeyRepo) RevokeKey(ctx context.Context, userID, keyID string) error {
+	args := m.Called(ctx, userID, keyID)
+	return args.Error(0)
+}
+
+func (m *mockAPIKeyRepo) UseKey(ctx context.Context, keyHash string) (*types.APIKey, *types.User, error) {
+	args := m.Called(ctx, keyHash)
+	if v := args.Get(0); v != nil {
+		return v.(*types.APIKey), args.Get(1).(*types.User), args.Error(2)
+	}
+	return nil, nil, args.Error(2)
+}
+
+func TestCreateKey_StoresHash(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockAPIKeyRepo)
+	svc := NewAPIKeyService(repo, []byte("secret"))
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleStaff})
+
+	repo.On("CreateKey", ctx, mock.Anything).Return(nil).Once()
+
+	key := &types.APIKey{Name: " inventory sync ", Permissions: []types.Permission{types.PermProductsWrite}}
+	plain, err := svc.CreateKey(ctx, key)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(plain, key.Prefix), "expected prefix to identify the key")
+	assert.Equal(t, hashString(plain, []byte("secret")), key.KeyHash)
+	assert.NotContains(t, key.KeyHash, plain)
+	assert.Equal(t, "inventory sync", key.Name)
+	assert.Equal(t, types.RoleStaff, key.Role, "expected role to default to the owner's role")
+	assert.Equal(t, "1", key.UserID)
+	assert.WithinDuration(t, time.Now().Add(apiKeyDefaultExpiry), key.ExpiresAt, time.Minute)
+	repo.AssertExpectations(t)
+}
+
+func TestCreateKey_Invalid(t *testing.T) {
+	repo := new(mockAPIKeyRepo)
+	svc := NewAPIKeyService(repo, []byte("secret"))
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleStaff})
+
+	_, err := svc.CreateKey(ctx, &types.APIKey{Name: "escalate", Role: types.RoleAdmin})
+	assert.Equal(t, types.ErrInvalidInput, err, "expected role above the owner's to be rejected")
+
+	_, err = svc.CreateKey(ctx, &types.APIKey{Name: "unknown", Permissions: []types.Permission{"everything"}})
+	assert.Equal(t, types.ErrInvalidInput, err, "expected unknown permission to be rejected")
+
+	_, err = svc.CreateKey(ctx, &types.APIKey{Name: "forever", ExpiresAt: time.Now().Add(2 * apiKeyMaxExpiry)})
+	assert.Equal(t, types.ErrInvalidInput, err, "expected expiry beyond the maximum to be rejected")
+
+	keyCtx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleStaff, APIKeyID: "2"})
+	_, err = svc.CreateKey(keyCtx, &types.APIKey{Name: "minted"})
+	assert.Equal(t, types.ErrConstraintViolation, err, "expected api keys to be unable to create keys")
+
+	repo.AssertNotCalled(t, "CreateKey", mock.Anything, mock.Anything)
+}
+
+func TestAuthenticate_CapsRoleAtOwner(t *testing.T) {
+	repo := new(mockAPIKeyRepo)
+	svc := NewAPIKeyService(repo, []byte("secret"))
+	ctx := context.Background()
+
+	plain := apiKeyPrefix + "abc"
+	key := &types.APIKey{ID: "2", UserID: "1", Role: types.RoleAdmin, Permissions: []types.Permission{types.PermOrdersRead}}
+	owner := &types.User{ID: "1", Role: types.RoleStaff} // demoted since the key was created
+	repo.On("UseKey", ctx, hashString(plain, []byte("secret"))).Return(key, owner, nil).Once()
+
+	user, err := svc.Authenticate(ctx, plain)
+	assert.NoError(t, err)
+	assert.Equal(t, types.RoleStaff, user.Role)
+	assert.Equal(t, "2", user.APIKeyID)
+	assert.Equal(t, []types.Permission{types.PermOrdersRead}, user.Scopes)
+
+	_, err = svc.Authenticate(ctx, "not-a-key")
+	assert.Equal(t, types.ErrNotFound, err)
+}
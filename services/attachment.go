@@ -0,0 +1,315 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+var (
+	// ErrUnsupportedAttachment is returned for files whose content is not of an allowed type
+	ErrUnsupportedAttachment = errors.New("unsupported attachment type")
+	// ErrMalware is returned for files rejected by the attachment scanner
+	ErrMalware = errors.New("attachment rejected by scanner")
+)
+
+// attachmentTypes are the allowed content types, detected from the content rather than trusting the client
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// AttachmentScanner scans uploaded files for malware, returning ErrMalware for infected files
+type AttachmentScanner interface {
+	Scan(ctx context.Context, file io.Reader) error
+}
+
+type localScanner struct{}
+
+// NewLocalScanner returns a stand-in scanner for local development, which accepts every file.
+// Production deployments should use NewClamAVScanner.
+func NewLocalScanner() AttachmentScanner {
+	return localScanner{}
+}
+
+func (localScanner) Scan(ctx context.Context, file io.Reader) error {
+	slog.DebugContext(ctx, "Attachment not scanned, using local scanner")
+	return nil
+}
+
+// clamAVChunkSize is the size of the chunks streamed to clamd, well below its default StreamMaxLength
+const clamAVChunkSize = 64 * 1024
+
+type clamAVScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+// NewClamAVScanner returns a scanner streaming files to the clamd daemon at addr, e.g. clamav:3310
+func NewClamAVScanner(addr string, timeout time.Duration) AttachmentScanner {
+	return &clamAVScanner{addr: addr, timeout: timeout}
+}
+
+// Scan sends the file to clamd with the INSTREAM command, which replies
+// "stream: OK" for clean files and "stream: <signature> FOUND" for infected ones.
+func (s *clamAVScanner) Scan(ctx context.Context, file io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	// each chunk is prefixed with its length, a zero length chunk ends the stream
+	chunk := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, err := file.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	switch {
+	case reply == "stream: OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		slog.WarnContext(ctx, "Attachment rejected by scanner", "result", reply)
+		return ErrMalware
+	default:
+		return fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// AttachmentService stores files attached to messages. Files are kept under their own root,
+// apart from product images, and are only served to the conversation's participants.
+type AttachmentService interface {
+	Store(ctx context.Context, conversationID, filename string, file io.ReadSeeker) (types.Attachment, error)
+	Remove(attachment types.Attachment) error
+	RemoveConversation(conversationID string) error
+	Open(ctx context.Context, conversationID, id string) (types.Attachment, *os.File, error)
+	OpenByUser(ctx context.Context, conversationID, id string) (types.Attachment, *os.File, error)
+	URL(conversationID, id string) string
+}
+
+type attachmentService struct {
+	repo        repositories.AttachmentRepository
+	scanner     AttachmentScanner
+	dir         string
+	maxFileSize int64
+	baseURL     string
+}
+
+func NewAttachmentService(repo repositories.AttachmentRepository, scanner AttachmentScanner, config types.AttachmentConfig, baseURL string) AttachmentService {
+	return &attachmentService{
+		repo:        repo,
+		scanner:     scanner,
+		dir:         config.UploadPath,
+		maxFileSize: int64(config.MaxFileSizeBytes),
+		baseURL:     baseURL,
+	}
+}
+
+// path returns the file path of an attachment. IDs must be numeric, so paths never leave the root.
+func (s *attachmentService) path(conversationID, id string) (string, error) {
+	for _, n := range []string{conversationID, id} {
+		if _, err := strconv.ParseInt(n, 10, 64); err != nil {
+			return "", types.ErrNotFound
+		}
+	}
+	return filepath.Join(s.dir, conversationID, id), nil
+}
+
+// Store validates, scans and saves a file for a message of the conversation, returning its attachment.
+// The attachment is saved with the message; should that fail, the file must be removed.
+// Returns ErrInvalidInput for empty files and files over the size limit, ErrUnsupportedAttachment and ErrMalware.
+func (s *attachmentService) Store(ctx context.Context, conversationID, filename string, file io.ReadSeeker) (types.Attachment, error) {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return types.Attachment{}, err
+	}
+	filePath, err := s.path(conversationID, id)
+	if err != nil {
+		return types.Attachment{}, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return types.Attachment{}, err
+	}
+	if size == 0 || size > s.maxFileSize {
+		return types.Attachment{}, types.ErrInvalidInput
+	}
+
+	// detect the content type from the first 512 bytes
+	head := make([]byte, 512)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return types.Attachment{}, err
+	}
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return types.Attachment{}, err
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil || !attachmentTypes[contentType] {
+		return types.Attachment{}, ErrUnsupportedAttachment
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return types.Attachment{}, err
+	}
+	if err := s.scanner.Scan(ctx, file); err != nil {
+		return types.Attachment{}, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return types.Attachment{}, err
+	}
+	dst, err := createFile(filePath)
+	if err != nil {
+		os.Remove(filepath.Dir(filePath)) // fails unless empty
+		return types.Attachment{}, err
+	}
+	if _, err := io.Copy(dst, file); err != nil {
+		dst.Close()
+		removeFile(filePath)
+		return types.Attachment{}, err
+	}
+	if err := dst.Close(); err != nil {
+		removeFile(filePath)
+		return types.Attachment{}, err
+	}
+
+	return types.Attachment{
+		ID:             id,
+		ConversationID: conversationID,
+		Filename:       filepath.Base(filename),
+		ContentType:    contentType,
+		Size:           size,
+		URL:            s.URL(conversationID, id),
+	}, nil
+}
+
+// createFile creates the file with its directory. Another upload may remove the directory
+// once empty, in which case it is created again.
+func createFile(filePath string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create directory for attachment: %w", err)
+		}
+		dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+		if os.IsNotExist(err) && attempt < 2 {
+			continue
+		}
+		return dst, err
+	}
+}
+
+// removeFile deletes a file, and its directory when no other files are left in it
+func removeFile(filePath string) error {
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(filePath)) // fails unless empty
+	return nil
+}
+
+// Remove deletes the file of an attachment which was not saved,
+// along with the conversation's directory when it holds no other attachments
+func (s *attachmentService) Remove(attachment types.Attachment) error {
+	filePath, err := s.path(attachment.ConversationID, attachment.ID)
+	if err != nil {
+		return err
+	}
+	return removeFile(filePath)
+}
+
+// RemoveConversation deletes the files of all attachments of a deleted conversation
+func (s *attachmentService) RemoveConversation(conversationID string) error {
+	if _, err := strconv.ParseInt(conversationID, 10, 64); err != nil {
+		return types.ErrNotFound
+	}
+	return os.RemoveAll(filepath.Join(s.dir, conversationID))
+}
+
+// Open returns an attachment of any conversation with its file, which the caller must close
+func (s *attachmentService) Open(ctx context.Context, conversationID, id string) (types.Attachment, *os.File, error) {
+	attachment, err := s.repo.GetAttachment(ctx, conversationID, id)
+	if err != nil {
+		return attachment, nil, err
+	}
+	return s.open(attachment)
+}
+
+// OpenByUser returns an attachment of a conversation of the authenticated user with its file,
+// which the caller must close
+func (s *attachmentService) OpenByUser(ctx context.Context, conversationID, id string) (types.Attachment, *os.File, error) {
+	attachment, err := s.repo.GetAttachmentByUser(ctx, conversationID, id, getUserID(ctx))
+	if err != nil {
+		return attachment, nil, err
+	}
+	return s.open(attachment)
+}
+
+func (s *attachmentService) open(attachment types.Attachment) (types.Attachment, *os.File, error) {
+	filePath, err := s.path(attachment.ConversationID, attachment.ID)
+	if err != nil {
+		return attachment, nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return attachment, nil, types.ErrNotFound
+	}
+	attachment.URL = s.URL(attachment.ConversationID, attachment.ID)
+	return attachment, file, err
+}
+
+// URL returns the authenticated download URL of an attachment
+func (s *attachmentService) URL(conversationID, id string) string {
+	return fmt.Sprintf("%s/api/conversations/%s/attachments/%s", s.baseURL, conversationID, id)
+}
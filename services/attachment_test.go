@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockAttachmentRepo struct {
+	mock.Mock
+}
+
+func (m *mockAttachmentRepo) GetAttachment(ctx context.Context, conversationID, id string) (types.Attachment, error) {
+	args := m.Called(ctx, conversationID, id)
+	return args.Get(0).(types.Attachment), args.Error(1)
+}
+
+func (m *mockAttachmentRepo) GetAttachmentByUser(ctx context.Context, conversationID, id, userID string) (types.Attachment, error) {
+	args := m.Called(ctx, conversationID, id, userID)
+	return args.Get(0).(types.Attachment), args.Error(1)
+}
+
+type mockScanner struct {
+	mock.Mock
+}
+
+func (m *mockScanner) Scan(ctx context.Context, file io.Reader) error {
+	content, _ := io.ReadAll(file)
+	args := m.Called(ctx, string(content))
+	return args.Error(0)
+}
+
+// pngHeader is enough of a PNG for its content type to be detected
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func newTestAttachmentService(t *testing.T) (*attachmentService, *mockAttachmentRepo, *mockScanner) {
+	repo := new(mockAttachmentRepo)
+	scanner := new(mockScanner)
+	config := types.AttachmentConfig{UploadPath: t.TempDir(), MaxFileSizeBytes: 64}
+	svc := NewAttachmentService(repo, scanner, config, "https://example.com")
+	return svc.(*attachmentService), repo, scanner
+}
+
+func TestStoreAttachment(t *testing.T) {
+	svc, _, scanner := newTestAttachmentService(t)
+	scanner.On("Scan", mock.Anything, string(pngHeader)).Return(nil).Once()
+
+	attachment, err := svc.Store(context.Background(), "1", "../../damage.png", bytes.NewReader(pngHeader))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "damage.png", attachment.Filename, "Expected the directory to be stripped")
+	assert.Equal(t, "image/png", attachment.ContentType)
+	assert.Equal(t, int64(len(pngHeader)), attachment.Size)
+	assert.Equal(t, "https://example.com/api/conversations/1/attachments/"+attachment.ID, attachment.URL)
+
+	stored, err := os.ReadFile(filepath.Join(svc.dir, "1", attachment.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, pngHeader, stored)
+
+	assert.NoError(t, svc.Remove(attachment))
+	_, err = os.Stat(filepath.Join(svc.dir, "1", attachment.ID))
+	assert.True(t, os.IsNotExist(err), "Expected the file to be removed")
+	_, err = os.Stat(filepath.Join(svc.dir, "1"))
+	assert.True(t, os.IsNotExist(err), "Expected the empty directory to be removed")
+}
+
+func TestStoreAttachment_Rejected(t *testing.T) {
+	svc, _, scanner := newTestAttachmentService(t)
+	scanner.On("Scan", mock.Anything, string(pngHeader)).Return(ErrMalware).Once()
+
+	tests := []struct {
+		name           string
+		conversationID string
+		content        []byte
+		err            error
+	}{
+		{"empty", "1", []byte{}, types.ErrInvalidInput},
+		{"too large", "1", bytes.Repeat([]byte("a"), 65), types.ErrInvalidInput},
+		{"unsupported type", "1", []byte("<html><script>alert(1)</script></html>"), ErrUnsupportedAttachment},
+		{"infected", "1", pngHeader, ErrMalware},
+		{"path outside root", "..", []byte("hello"), types.ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, err := svc.Store(context.Background(), tt.conversationID, "file", bytes.NewReader(tt.content))
+		assert.Equal(t, tt.err, err, tt.name)
+	}
+
+	entries, err := os.ReadDir(svc.dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "Expected no rejected file to be stored")
+	scanner.AssertExpectations(t)
+}
+
+func TestOpenAttachmentByUser(t *testing.T) {
+	svc, repo, scanner := newTestAttachmentService(t)
+	scanner.On("Scan", mock.Anything, mock.Anything).Return(nil)
+	stored, err := svc.Store(context.Background(), "1", "notes.txt", strings.NewReader("tracking number"))
+	assert.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+	repo.On("GetAttachmentByUser", mock.Anything, "1", stored.ID, "7").Return(stored, nil).Once()
+	repo.On("GetAttachmentByUser", mock.Anything, "1", "2", "7").Return(types.Attachment{}, types.ErrNotFound).Once()
+
+	attachment, file, err := svc.OpenByUser(ctx, "1", stored.ID)
+	assert.NoError(t, err)
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	assert.Equal(t, "tracking number", string(content))
+	assert.Equal(t, "text/plain", attachment.ContentType)
+
+	_, _, err = svc.OpenByUser(ctx, "1", "2")
+	assert.Equal(t, types.ErrNotFound, err)
+	repo.AssertExpectations(t)
+}
+
+func TestRemoveConversationAttachments(t *testing.T) {
+	svc, _, scanner := newTestAttachmentService(t)
+	scanner.On("Scan", mock.Anything, mock.Anything).Return(nil)
+	for _, conversationID := range []string{"1", "1", "2"} {
+		_, err := svc.Store(context.Background(), conversationID, "notes.txt", strings.NewReader("tracking number"))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, svc.RemoveConversation("1"))
+	_, err := os.Stat(filepath.Join(svc.dir, "1"))
+	assert.True(t, os.IsNotExist(err), "Expected the conversation's directory to be removed")
+	_, err = os.Stat(filepath.Join(svc.dir, "2"))
+	assert.NoError(t, err, "Expected other conversations to be kept")
+
+	assert.NoError(t, svc.RemoveConversation("3"), "Expected no error for a conversation without attachments")
+	assert.Equal(t, types.ErrNotFound, svc.RemoveConversation(".."))
+	_, err = os.Stat(svc.dir)
+	assert.NoError(t, err, "Expected the root to be kept")
+}
+
+// fakeClamd accepts one INSTREAM connection and replies with the result for the streamed content
+func fakeClamd(t *testing.T, result func(content string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+			return
+		}
+		var content bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&content, reader, int64(size)); err != nil {
+				return
+			}
+		}
+		conn.Write([]byte(result(content.String()) + "\x00"))
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamAVScanner(t *testing.T) {
+	result := func(content string) string {
+		if strings.Contains(content, "EICAR") {
+			return "stream: Eicar-Test-Signature FOUND"
+		}
+		return "stream: OK"
+	}
+
+	scanner := NewClamAVScanner(fakeClamd(t, result), time.Second)
+	err := scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("clean ", 20000)))
+	assert.NoError(t, err, "Expected clean file to pass")
+
+	scanner = NewClamAVScanner(fakeClamd(t, result), time.Second)
+	err = scanner.Scan(context.Background(), strings.NewReader("EICAR-STANDARD-ANTIVIRUS-TEST-FILE"))
+	assert.Equal(t, ErrMalware, err, "Expected infected file to be rejected")
+
+	scanner = NewClamAVScanner(fakeClamd(t, func(string) string { return "INSTREAM size limit exceeded. ERROR" }), time.Second)
+	err = scanner.Scan(context.Background(), strings.NewReader("content"))
+	assert.Error(t, err, "Expected clamd errors to fail the scan")
+	assert.NotEqual(t, ErrMalware, err)
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+type AuditService interface {
+	Record(ctx context.Context, entry *types.AuditEntry, before, after []byte) error
+	GetEntries(ctx context.Context, filter types.AuditFilter) ([]types.AuditEntry, error)
+}
+
+type auditService struct {
+	repo repositories.AuditRepository
+}
+
+func NewAuditService(repo repositories.AuditRepository) AuditService {
+	return &auditService{repo: repo}
+}
+
+// Record stores an audit entry for the given before/after JSON snapshots.
+// Only the top-level fields which differ are kept.
+func (s *auditService) Record(ctx context.Context, entry *types.AuditEntry, before, after []byte) error {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	entry.Before, entry.After = diffJSON(before, after)
+	return s.repo.CreateEntry(ctx, entry)
+}
+
+func (s *auditService) GetEntries(ctx context.Context, filter types.AuditFilter) ([]types.AuditEntry, error) {
+	return s.repo.GetEntries(ctx, filter)
+}
+
+// diffJSON reduces two JSON documents to the top-level keys whose values differ.
+// Documents which are not JSON objects are returned unchanged.
+func diffJSON(before, after []byte) (json.RawMessage, json.RawMessage) {
+	var beforeObj, afterObj map[string]interface{}
+	beforeErr := json.Unmarshal(before, &beforeObj)
+	afterErr := json.Unmarshal(after, &afterObj)
+
+	switch {
+	case len(before) == 0 && afterErr == nil:
+		return nil, after
+	case len(after) == 0 && beforeErr == nil:
+		return before, nil
+	case beforeErr != nil || afterErr != nil:
+		return validJSON(before), validJSON(after)
+	}
+
+	beforeDiff := map[string]interface{}{}
+	afterDiff := map[string]interface{}{}
+	for key, val := range beforeObj {
+		if afterVal, ok := afterObj[key]; !ok || !reflect.DeepEqual(val, afterVal) {
+			beforeDiff[key] = val
+		}
+	}
+	for key, val := range afterObj {
+		if beforeVal, ok := beforeObj[key]; !ok || !reflect.DeepEqual(val, beforeVal) {
+			afterDiff[key] = val
+		}
+	}
+
+	beforeJSON, _ := json.Marshal(beforeDiff)
+	afterJSON, _ := json.Marshal(afterDiff)
+	return beforeJSON, afterJSON
+}
+
+// validJSON returns data if it is valid JSON, otherwise nil
+func validJSON(data []byte) json.RawMessage {
+	if len(data) == 0 || !json.Valid(data) {
+		return nil
+	}
+	return data
+}
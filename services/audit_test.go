@@ -0,0 +1,41 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffJSON_ChangedKeysOnly(t *testing.T) {
+	before := []byte(`{"id":"1","name":"Lamp","price":1000,"tags":["a"]}`)
+	after := []byte(`{"id":"1","name":"Lamp","price":1200,"tags":["a","b"]}`)
+
+	beforeDiff, afterDiff := diffJSON(before, after)
+	assert.JSONEq(t, `{"price":1000,"tags":["a"]}`, string(beforeDiff))
+	assert.JSONEq(t, `{"price":1200,"tags":["a","b"]}`, string(afterDiff))
+}
+
+func TestDiffJSON_AddedAndRemovedKeys(t *testing.T) {
+	before := []byte(`{"id":"1","summary":"old"}`)
+	after := []byte(`{"id":"1","description":"new"}`)
+
+	beforeDiff, afterDiff := diffJSON(before, after)
+	assert.JSONEq(t, `{"summary":"old"}`, string(beforeDiff))
+	assert.JSONEq(t, `{"description":"new"}`, string(afterDiff))
+}
+
+func TestDiffJSON_CreateAndRemove(t *testing.T) {
+	beforeDiff, afterDiff := diffJSON(nil, []byte(`{"id":"1"}`))
+	assert.Nil(t, beforeDiff)
+	assert.JSONEq(t, `{"id":"1"}`, string(afterDiff))
+
+	beforeDiff, afterDiff = diffJSON([]byte(`{"id":"1"}`), nil)
+	assert.JSONEq(t, `{"id":"1"}`, string(beforeDiff))
+	assert.Nil(t, afterDiff)
+}
+
+func TestDiffJSON_InvalidJSON(t *testing.T) {
+	beforeDiff, afterDiff := diffJSON([]byte(`not json`), []byte(`[1,2]`))
+	assert.Nil(t, beforeDiff)
+	assert.JSONEq(t, `[1,2]`, string(afterDiff))
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+const (
+	broadcastBatchSize    = 100                // recipients sent to between progress updates
+	broadcastLease        = 2 * time.Minute    // time a claimed broadcast is hidden from other instances, extended each batch
+	broadcastRenewAfter   = broadcastLease / 4 // time after which the lease is renewed while sending a batch
+	broadcastPollInterval = 30 * time.Second   // how often scheduled broadcasts are checked for
+)
+
+// BroadcastService sends announcements to the inbox of every user in a segment, and optionally by email,
+// through NotificationService so users' preferences apply. Broadcasts are sent by a worker in batches,
+// at their send time, and may be canceled until they complete.
+type BroadcastService interface {
+	CreateBroadcast(ctx context.Context, broadcast *types.Broadcast) error
+	GetBroadcast(ctx context.Context, id string) (types.Broadcast, error)
+	GetBroadcasts(ctx context.Context, page, limit int) ([]types.Broadcast, error)
+	CancelBroadcast(ctx context.Context, id string) (types.Broadcast, error)
+	SendDue(ctx context.Context)
+	Start(ctx context.Context)
+}
+
+type broadcastService struct {
+	repo          repositories.BroadcastRepository
+	notifications NotificationService
+	wake          chan struct{}
+}
+
+func NewBroadcastService(repo repositories.BroadcastRepository, notifications NotificationService) BroadcastService {
+	return &broadcastService{
+		repo:          repo,
+		notifications: notifications,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// announcement is the data rendered by the announcement templates
+type announcement struct {
+	Paragraphs []string
+}
+
+// CreateBroadcast schedules a broadcast by the authenticated user, sent immediately when SendAt is unset.
+// Returns ErrInvalidInput for a missing subject or body, or a segment without its role or category.
+func (s *broadcastService) CreateBroadcast(ctx context.Context, broadcast *types.Broadcast) error {
+	broadcast.Subject = strings.TrimSpace(broadcast.Subject)
+	broadcast.Body = strings.TrimSpace(broadcast.Body)
+	if broadcast.Subject == "" || broadcast.Body == "" || !broadcast.Segment.IsValid() {
+		return types.ErrInvalidInput
+	}
+	if broadcast.Segment != types.SegmentRole {
+		broadcast.Role = ""
+	} else if !broadcast.Role.IsValid() {
+		return types.ErrInvalidInput
+	}
+	if broadcast.Segment != types.SegmentCategory {
+		broadcast.CategoryID = ""
+	} else if broadcast.CategoryID == "" {
+		return types.ErrInvalidInput
+	}
+	if broadcast.SendAt.IsZero() {
+		broadcast.SendAt = time.Now().UTC()
+	}
+
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	broadcast.ID = id
+	broadcast.CreatedBy = getUserID(ctx)
+	if err := s.repo.CreateBroadcast(ctx, broadcast); err != nil {
+		return err
+	}
+	if !broadcast.SendAt.After(time.Now()) {
+		s.notify()
+	}
+	return nil
+}
+
+func (s *broadcastService) GetBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	return s.repo.GetBroadcast(ctx, id)
+}
+
+func (s *broadcastService) GetBroadcasts(ctx context.Context, page, limit int) ([]types.Broadcast, error) {
+	return s.repo.GetBroadcasts(ctx, page, limit)
+}
+
+// CancelBroadcast stops a broadcast. Recipients of the batch being sent may still receive it.
+// Returns ErrInvalidInput for completed and canceled broadcasts.
+func (s *broadcastService) CancelBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	return s.repo.CancelBroadcast(ctx, id)
+}
+
+// Start sends broadcasts as they become due, until ctx is canceled.
+// Pass it root context to allow for clean shutdown.
+func (s *broadcastService) Start(ctx context.Context) {
+	ticker := time.NewTicker(broadcastPollInterval)
+	defer ticker.Stop()
+
+	slog.Info("Broadcast delivery started")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Broadcast delivery stopped")
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.SendDue(ctx)
+	}
+}
+
+// SendDue sends broadcasts which are due, until none remain
+func (s *broadcastService) SendDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		broadcast, err := s.repo.ClaimBroadcast(ctx, broadcastLease)
+		if err == types.ErrNotFound {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming broadcast", "error", err)
+			return
+		}
+		s.send(ctx, &broadcast)
+	}
+}
+
+// send dispatches a claimed broadcast to its recipients in batches, recording progress after each,
+// until every recipient is sent to or the broadcast is canceled. The lease is renewed during slow
+// batches, and sending stops once the claim is lost, e.g. when canceled.
+// A broadcast resumed by another instance after a failure may resend the batch in progress.
+func (s *broadcastService) send(ctx context.Context, broadcast *types.Broadcast) {
+	renewedAt := time.Now()
+	if broadcast.LastRecipientID == "0" {
+		count, err := s.repo.CountRecipients(ctx, *broadcast)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error counting broadcast recipients", "broadcast_id", broadcast.ID, "error", err)
+			return
+		}
+		broadcast.RecipientCount = count
+	}
+
+	templates := map[types.NotificationChannel]HtmlTemplate{
+		types.ChannelInbox:   NotifyAnnouncement,
+		types.ChannelWebhook: NotifyAnnouncement,
+	}
+	if broadcast.Email {
+		templates[types.ChannelEmail] = EmailAnnouncement
+	}
+	data := announcement{Paragraphs: paragraphs(broadcast.Body)}
+
+	for ctx.Err() == nil {
+		recipients, err := s.repo.GetRecipients(ctx, *broadcast, broadcastBatchSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error fetching broadcast recipients", "broadcast_id", broadcast.ID, "error", err)
+			return
+		}
+		interrupted := false
+		for _, userID := range recipients {
+			if ctx.Err() != nil {
+				interrupted = true // shutting down, the rest of the batch is sent on resuming
+				break
+			}
+			if time.Since(renewedAt) >= broadcastRenewAfter {
+				err := s.repo.RenewClaim(ctx, *broadcast, broadcastLease)
+				if err == types.ErrNotFound {
+					slog.InfoContext(ctx, "Broadcast canceled or resumed elsewhere while sending", "broadcast_id", broadcast.ID)
+					return
+				}
+				if err != nil {
+					// progress is checked against the claim at the end of the batch
+					slog.ErrorContext(ctx, "Error renewing broadcast claim", "broadcast_id", broadcast.ID, "error", err)
+				}
+				renewedAt = time.Now()
+			}
+			err := s.notifications.Dispatch(ctx, Notification{
+				UserID:    userID,
+				Event:     types.NotificationAnnouncement,
+				Subject:   broadcast.Subject,
+				Templates: templates,
+				Data:      data,
+			})
+			if err != nil {
+				broadcast.FailedCount++
+				slog.ErrorContext(ctx, "Error sending broadcast", "broadcast_id", broadcast.ID, "user_id", userID, "error", err)
+			} else {
+				broadcast.SentCount++
+			}
+			broadcast.LastRecipientID = userID
+		}
+		if !interrupted && len(recipients) < broadcastBatchSize {
+			broadcast.Status = types.BroadcastCompleted
+		}
+		// members joining the segment while sending are sent to as well
+		if sent := broadcast.SentCount + broadcast.FailedCount; sent > broadcast.RecipientCount {
+			broadcast.RecipientCount = sent
+		}
+
+		err = s.repo.UpdateProgress(context.WithoutCancel(ctx), broadcast, broadcastLease)
+		if err == types.ErrNotFound {
+			slog.InfoContext(ctx, "Broadcast canceled or resumed elsewhere while sending", "broadcast_id", broadcast.ID)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error recording broadcast progress", "broadcast_id", broadcast.ID, "error", err)
+			return
+		}
+		if broadcast.Status == types.BroadcastCompleted {
+			slog.InfoContext(ctx, "Broadcast completed", "broadcast_id", broadcast.ID,
+				"sent", broadcast.SentCount, "failed", broadcast.FailedCount)
+			return
+		}
+		renewedAt = time.Now()
+	}
+}
+
+// paragraphs splits a plain text body on blank lines
+func paragraphs(body string) []string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	result := []string{}
+	for _, p := range strings.Split(body, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// notify wakes the delivery loop, without blocking if it is already awake
+func (s *broadcastService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockBroadcastRepo struct {
+	mock.Mock
+}
+
+func (m *mockBroadcastRepo) CreateBroadcast(ctx context.Context, broadcast *types.Broadcast) error {
+	args := m.Called(ctx, broadcast)
+	return args.Error(0)
+}
+
+func (m *mockBroadcastRepo) GetBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.Broadcast), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) GetBroadcasts(ctx context.Context, page, limit int) ([]types.Broadcast, error) {
+	args := m.Called(ctx, page, limit)
+	return args.Get(0).([]types.Broadcast), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) CancelBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.Broadcast), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) ClaimBroadcast(ctx context.Context, lease time.Duration) (types.Broadcast, error) {
+	args := m.Called(ctx, lease)
+	return args.Get(0).(types.Broadcast), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) CountRecipients(ctx context.Context, broadcast types.Broadcast) (int, error) {
+	args := m.Called(ctx, broadcast)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) GetRecipients(ctx context.Context, broadcast types.Broadcast, limit int) ([]string, error) {
+	args := m.Called(ctx, broadcast, limit)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockBroadcastRepo) RenewClaim(ctx context.Context, broadcast types.Broadcast, lease time.Duration) error {
+	args := m.Called(ctx, broadcast, lease)
+	return args.Error(0)
+}
+
+func (m *mockBroadcastRepo) UpdateProgress(ctx context.Context, broadcast *types.Broadcast, lease time.Duration) error {
+	args := m.Called(ctx, broadcast, lease)
+	return args.Error(0)
+}
+
+// recipientIDs returns n user IDs starting at first
+func recipientIDs(first, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint(first + i)
+	}
+	return ids
+}
+
+func TestCreateBroadcast_Invalid(t *testing.T) {
+	svc := NewBroadcastService(new(mockBroadcastRepo), new(mockNotificationService))
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleAdmin})
+
+	tests := []types.Broadcast{
+		{Subject: " ", Body: "Sale", Segment: types.SegmentAll},
+		{Subject: "Sale", Body: "Sale", Segment: "everyone"},
+		{Subject: "Sale", Body: "Sale", Segment: types.SegmentRole, Role: "system"},
+		{Subject: "Sale", Body: "Sale", Segment: types.SegmentCategory},
+	}
+	for _, broadcast := range tests {
+		err := svc.CreateBroadcast(ctx, &broadcast)
+		assert.Equal(t, types.ErrInvalidInput, err, "Expected %+v to be rejected", broadcast)
+	}
+}
+
+func TestSendDue_SendsInBatches(t *testing.T) {
+	repo := new(mockBroadcastRepo)
+	notifications := new(mockNotificationService)
+	svc := NewBroadcastService(repo, notifications)
+
+	broadcast := types.Broadcast{
+		ID:              "5",
+		Subject:         "Spring sale",
+		Body:            "New arrivals.\n\nFree shipping this week.",
+		Segment:         types.SegmentAll,
+		Email:           true,
+		Status:          types.BroadcastSending,
+		LastRecipientID: "0",
+	}
+	repo.On("ClaimBroadcast", mock.Anything, broadcastLease).Return(broadcast, nil).Once()
+	repo.On("ClaimBroadcast", mock.Anything, broadcastLease).Return(types.Broadcast{}, types.ErrNotFound).Once()
+	repo.On("CountRecipients", mock.Anything, broadcast).Return(broadcastBatchSize+1, nil).Once()
+	repo.On("GetRecipients", mock.Anything, mock.MatchedBy(func(b types.Broadcast) bool {
+		return b.LastRecipientID == "0"
+	}), broadcastBatchSize).Return(recipientIDs(1000, broadcastBatchSize), nil).Once()
+	repo.On("GetRecipients", mock.Anything, mock.MatchedBy(func(b types.Broadcast) bool {
+		return b.LastRecipientID == "1099"
+	}), broadcastBatchSize).Return([]string{"2000"}, nil).Once()
+
+	var progress []types.Broadcast
+	repo.On("UpdateProgress", mock.Anything, mock.Anything, broadcastLease).Run(func(args mock.Arguments) {
+		progress = append(progress, *args.Get(1).(*types.Broadcast))
+	}).Return(nil).Twice()
+
+	notifications.On("Dispatch", mock.Anything, mock.MatchedBy(func(n Notification) bool {
+		return n.UserID == "1000"
+	})).Return(errors.New("smtp down")).Once()
+	notifications.On("Dispatch", mock.Anything, mock.MatchedBy(func(n Notification) bool {
+		data, ok := n.Data.(announcement)
+		return n.Event == types.NotificationAnnouncement && n.Subject == "Spring sale" &&
+			n.Templates[types.ChannelInbox] == NotifyAnnouncement && n.Templates[types.ChannelEmail] == EmailAnnouncement &&
+			ok && len(data.Paragraphs) == 2
+	})).Return(nil)
+
+	svc.SendDue(context.Background())
+
+	repo.AssertExpectations(t)
+	assert.Len(t, progress, 2)
+	assert.Equal(t, types.BroadcastSending, progress[0].Status)
+	assert.Equal(t, "1099", progress[0].LastRecipientID)
+	assert.Equal(t, types.BroadcastCompleted, progress[1].Status)
+	assert.Equal(t, broadcastBatchSize+1, progress[1].RecipientCount)
+	assert.Equal(t, broadcastBatchSize, progress[1].SentCount)
+	assert.Equal(t, 1, progress[1].FailedCount)
+}
+
+func TestSendDue_StopsWhenCanceled(t *testing.T) {
+	repo := new(mockBroadcastRepo)
+	notifications := new(mockNotificationService)
+	svc := NewBroadcastService(repo, notifications)
+
+	broadcast := types.Broadcast{ID: "5", Subject: "Sale", Body: "Sale", Segment: types.SegmentPendingOffer,
+		Status: types.BroadcastSending, LastRecipientID: "1099", RecipientCount: 300, SentCount: 100}
+	repo.On("ClaimBroadcast", mock.Anything, broadcastLease).Return(broadcast, nil).Once()
+	repo.On("ClaimBroadcast", mock.Anything, broadcastLease).Return(types.Broadcast{}, types.ErrNotFound).Once()
+	repo.On("GetRecipients", mock.Anything, mock.Anything, broadcastBatchSize).Return(recipientIDs(2000, broadcastBatchSize), nil).Once()
+	repo.On("UpdateProgress", mock.Anything, mock.Anything, broadcastLease).Return(types.ErrNotFound).Once()
+	notifications.On("Dispatch", mock.Anything, mock.Anything).Return(nil)
+
+	svc.SendDue(context.Background())
+
+	repo.AssertExpectations(t)
+	repo.AssertNotCalled(t, "CountRecipients", mock.Anything, mock.Anything)
+	notifications.AssertNumberOfCalls(t, "Dispatch", broadcastBatchSize)
+	notifications.AssertNotCalled(t, "Dispatch", mock.Anything, mock.MatchedBy(func(n Notification) bool {
+		_, ok := n.Templates[types.ChannelEmail]
+		return ok
+	}))
+}
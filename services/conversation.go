@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"log/slog"
 
 	"github.com/dgyurics/marketplace/repositories"
 	"github.com/dgyurics/marketplace/types"
@@ -11,18 +12,28 @@ import (
 type ConversationService interface {
 	CreateConversation(ctx context.Context, conversation *types.Conversation) error
 	CreateMessage(ctx context.Context, message *types.Message) error
-	GetConversationByID(ctx context.Context, conversationID string) (types.Conversation, error)
-	GetConversationByIDAndUser(ctx context.Context, conversationID string) (types.Conversation, error)
-	GetConversations(ctx context.Context) ([]types.Conversation, error)
+	GetConversationByID(ctx context.Context, conversationID string, before *types.Cursor, limit int) (types.Conversation, error)
+	GetConversationByIDAndUser(ctx context.Context, conversationID string, before *types.Cursor, limit int) (types.Conversation, error)
+	GetConversations(ctx context.Context, before *types.Cursor, limit int) ([]types.Conversation, error)
 	RemoveConversation(ctx context.Context, conversationID string) error
+	ArchiveConversations(ctx context.Context, conversationIDs []string) error
+	MarkRead(ctx context.Context, conversationIDs []string) error
+	CountUnread(ctx context.Context) (int, error)
+	OpenTicket(ctx context.Context, ticket types.Ticket) (types.Conversation, error)
+	Reply(ctx context.Context, message *types.Message) error
+	GetTickets(ctx context.Context, filter types.TicketFilter) ([]types.Conversation, error)
+	UpdateTicketStatus(ctx context.Context, conversationID string, status types.TicketStatus) error
+	AssignTicket(ctx context.Context, conversationID, assigneeID string) error
 }
 
 type conversationService struct {
-	repo repositories.ConversationRepository
+	repo        repositories.ConversationRepository
+	stream      StreamService
+	attachments AttachmentService
 }
 
-func NewConversationService(repo repositories.ConversationRepository) ConversationService {
-	return &conversationService{repo: repo}
+func NewConversationService(repo repositories.ConversationRepository, stream StreamService, attachments AttachmentService) ConversationService {
+	return &conversationService{repo: repo, stream: stream, attachments: attachments}
 }
 
 func (s *conversationService) CreateConversation(ctx context.Context, conversation *types.Conversation) error {
@@ -31,6 +42,10 @@ func (s *conversationService) CreateConversation(ctx context.Context, conversati
 		return err
 	}
 	conversation.ID = convID
+	conversation.Status = "" // only support conversations have a status
+	if conversation.Type == types.Support {
+		conversation.Status = types.TicketAwaitingCustomer // started by staff
+	}
 	return s.repo.CreateConversation(ctx, conversation)
 }
 
@@ -41,21 +56,171 @@ func (s *conversationService) CreateMessage(ctx context.Context, message *types.
 		return err
 	}
 	message.ID = messageID
-	return s.repo.CreateMessage(ctx, message)
+	if err := s.repo.CreateMessage(ctx, message); err != nil {
+		return err
+	}
+
+	// the recipient's own replies are already read
+	if message.RecipientID != message.SenderID {
+		err = s.stream.Publish(ctx, message.RecipientID, types.StreamMessage, types.InboxMessage{
+			ConversationID: message.ConversationID,
+			MessageID:      message.ID,
+			SenderID:       message.SenderID,
+			CreatedAt:      message.CreatedAt,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error publishing message event", "message_id", message.ID, "error", err)
+		}
+		s.publishUnread(ctx, message.RecipientID)
+	}
+	return nil
 }
 
 func (s *conversationService) RemoveConversation(ctx context.Context, conversationID string) error {
-	return s.repo.RemoveConversation(ctx, conversationID, getUserID(ctx))
+	userID := getUserID(ctx)
+	if err := s.repo.RemoveConversation(ctx, conversationID, userID); err != nil {
+		return err
+	}
+	s.publishUnread(ctx, userID)
+	return nil
+}
+
+// ArchiveConversations removes conversations of the authenticated user from their inbox
+func (s *conversationService) ArchiveConversations(ctx context.Context, conversationIDs []string) error {
+	userID := getUserID(ctx)
+	if err := s.repo.ArchiveConversations(ctx, conversationIDs, userID); err != nil {
+		return err
+	}
+	s.publishUnread(ctx, userID)
+	return nil
+}
+
+// MarkRead marks conversations of the authenticated user read
+func (s *conversationService) MarkRead(ctx context.Context, conversationIDs []string) error {
+	userID := getUserID(ctx)
+	if err := s.repo.MarkRead(ctx, conversationIDs, userID); err != nil {
+		return err
+	}
+	s.publishUnread(ctx, userID)
+	return nil
 }
 
-func (s *conversationService) GetConversationByID(ctx context.Context, conversationID string) (types.Conversation, error) {
-	return s.repo.GetConversationByID(ctx, conversationID)
+// CountUnread returns the number of conversations of the authenticated user with unread messages
+func (s *conversationService) CountUnread(ctx context.Context) (int, error) {
+	return s.repo.CountUnread(ctx, getUserID(ctx))
+}
+
+// publishUnread streams the user's unread conversation count, for badges in other tabs and devices.
+// The change it reflects is already saved, so errors are only logged.
+func (s *conversationService) publishUnread(ctx context.Context, userID string) {
+	count, err := s.repo.CountUnread(ctx, userID)
+	if err == nil {
+		err = s.stream.Publish(ctx, userID, types.StreamUnread, types.InboxUnread{Count: count})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error publishing unread event", "user_id", userID, "error", err)
+	}
+}
+
+// GetConversationByID returns any conversation with its latest messages before the cursor,
+// marking it read by staff
+func (s *conversationService) GetConversationByID(ctx context.Context, conversationID string, before *types.Cursor, limit int) (types.Conversation, error) {
+	conversation, err := s.repo.GetConversationByID(ctx, conversationID, before, limit)
+	if err != nil {
+		return conversation, err
+	}
+	s.setAttachmentURLs(conversation.Messages)
+	return conversation, s.repo.MarkReadByStaff(ctx, conversationID)
+}
+
+// GetConversationByIDAndUser returns a conversation of the authenticated user with its latest messages
+// before the cursor, marking it read
+func (s *conversationService) GetConversationByIDAndUser(ctx context.Context, conversationID string, before *types.Cursor, limit int) (types.Conversation, error) {
+	userID := getUserID(ctx)
+	conversation, err := s.repo.GetConversationByIDAndUser(ctx, conversationID, userID, before, limit)
+	if err != nil {
+		return conversation, err
+	}
+	s.setAttachmentURLs(conversation.Messages)
+	if conversation.UnreadCount > 0 {
+		// reading it changed the unread count
+		s.publishUnread(ctx, userID)
+	}
+	return conversation, nil
 }
 
-func (s *conversationService) GetConversationByIDAndUser(ctx context.Context, conversationID string) (types.Conversation, error) {
-	return s.repo.GetConversationByIDAndUser(ctx, conversationID, getUserID(ctx))
+func (s *conversationService) setAttachmentURLs(messages []types.Message) {
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			attachment := &messages[i].Attachments[j]
+			attachment.URL = s.attachments.URL(attachment.ConversationID, attachment.ID)
+		}
+	}
+}
+
+// GetConversations returns conversations of the authenticated user before the cursor, most recently updated first
+func (s *conversationService) GetConversations(ctx context.Context, before *types.Cursor, limit int) ([]types.Conversation, error) {
+	return s.repo.GetConversations(ctx, getUserID(ctx), before, limit)
+}
+
+// OpenTicket opens a support conversation of the authenticated user with their first message
+func (s *conversationService) OpenTicket(ctx context.Context, ticket types.Ticket) (types.Conversation, error) {
+	userID := getUserID(ctx)
+	convID, err := utilities.GenerateIDString()
+	if err != nil {
+		return types.Conversation{}, err
+	}
+	messageID, err := utilities.GenerateIDString()
+	if err != nil {
+		return types.Conversation{}, err
+	}
+
+	conversation := types.Conversation{
+		ID:          convID,
+		Type:        types.Support,
+		Subject:     ticket.Subject,
+		RecipientID: userID,
+		OrderID:     ticket.OrderID,
+		ProductID:   ticket.ProductID,
+	}
+	message := types.Message{
+		ID:             messageID,
+		SenderID:       userID,
+		ConversationID: convID,
+		Body:           ticket.Body,
+	}
+	err = s.repo.CreateTicket(ctx, &conversation, &message)
+	return conversation, err
+}
+
+// Reply adds a message of the authenticated user to their own support conversation,
+// reopening it for staff. Returns ErrNotFound for any other conversation.
+func (s *conversationService) Reply(ctx context.Context, message *types.Message) error {
+	message.SenderID = getUserID(ctx)
+	messageID, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	message.ID = messageID
+	return s.repo.CreateReply(ctx, message)
+}
+
+// GetTickets returns the staff queue of support conversations
+func (s *conversationService) GetTickets(ctx context.Context, filter types.TicketFilter) ([]types.Conversation, error) {
+	if filter.Assignee == "me" {
+		filter.Assignee = getUserID(ctx)
+	}
+	return s.repo.GetTickets(ctx, filter)
+}
+
+func (s *conversationService) UpdateTicketStatus(ctx context.Context, conversationID string, status types.TicketStatus) error {
+	if !status.IsValid() {
+		return types.ErrInvalidInput
+	}
+	return s.repo.UpdateTicketStatus(ctx, conversationID, status)
 }
 
-func (s *conversationService) GetConversations(ctx context.Context) ([]types.Conversation, error) {
-	return s.repo.GetConversations(ctx, getUserID(ctx))
+// AssignTicket assigns the ticket to a staff member, or unassigns it when assigneeID is empty
+func (s *conversationService) AssignTicket(ctx context.Context, conversationID, assigneeID string) error {
+	return s.repo.AssignTicket(ctx, conversationID, assigneeID)
 }
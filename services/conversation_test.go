@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockConversationRepo struct {
+	mock.Mock
+	repositories.ConversationRepository
+}
+
+func (m *mockConversationRepo) CreateMessage(ctx context.Context, message *types.Message) error {
+	args := m.Called(ctx, message)
+	return args.Error(0)
+}
+
+func (m *mockConversationRepo) CreateTicket(ctx context.Context, conversation *types.Conversation, message *types.Message) error {
+	args := m.Called(ctx, conversation, message)
+	return args.Error(0)
+}
+
+func (m *mockConversationRepo) CreateReply(ctx context.Context, message *types.Message) error {
+	args := m.Called(ctx, message)
+	return args.Error(0)
+}
+
+func (m *mockConversationRepo) GetTickets(ctx context.Context, filter types.TicketFilter) ([]types.Conversation, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]types.Conversation), args.Error(1)
+}
+
+func (m *mockConversationRepo) UpdateTicketStatus(ctx context.Context, id string, status types.TicketStatus) error {
+	args := m.Called(ctx, id, status)
+	return args.Error(0)
+}
+
+func (m *mockConversationRepo) MarkRead(ctx context.Context, ids []string, userID string) error {
+	args := m.Called(ctx, ids, userID)
+	return args.Error(0)
+}
+
+func (m *mockConversationRepo) GetConversationByIDAndUser(ctx context.Context, conversationID, userID string, before *types.Cursor, limit int) (types.Conversation, error) {
+	args := m.Called(ctx, conversationID, userID, before, limit)
+	return args.Get(0).(types.Conversation), args.Error(1)
+}
+
+func (m *mockConversationRepo) CountUnread(ctx context.Context, userID string) (int, error) {
+	args := m.Called(ctx, userID)
+	return args.Int(0), args.Error(1)
+}
+
+func TestOpenTicket(t *testing.T) {
+	repo := new(mockConversationRepo)
+	svc := NewConversationService(repo, new(mockStreamService), nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7", Role: types.RoleUser})
+
+	repo.On("CreateTicket", mock.Anything, mock.MatchedBy(func(c *types.Conversation) bool {
+		return c.Type == types.Support && c.RecipientID == "7" && c.OrderID == "42" && c.Subject == "Damaged lamp"
+	}), mock.MatchedBy(func(m *types.Message) bool {
+		return m.SenderID == "7" && m.Body == "It arrived broken" && m.ConversationID != ""
+	})).Return(nil).Once()
+
+	conversation, err := svc.OpenTicket(ctx, types.Ticket{Subject: "Damaged lamp", Body: "It arrived broken", OrderID: "42"})
+
+	assert.NoError(t, err)
+	assert.NotEmpty(t, conversation.ID)
+	repo.AssertExpectations(t)
+}
+
+func TestReply_SetsSender(t *testing.T) {
+	repo := new(mockConversationRepo)
+	svc := NewConversationService(repo, new(mockStreamService), nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7", Role: types.RoleUser})
+
+	repo.On("CreateReply", mock.Anything, mock.MatchedBy(func(m *types.Message) bool {
+		return m.SenderID == "7" && m.ConversationID == "1" && m.ID != ""
+	})).Return(types.ErrNotFound).Once()
+
+	// the sender is always the authenticated user, whatever the payload says
+	err := svc.Reply(ctx, &types.Message{ConversationID: "1", SenderID: "8", Body: "Hello"})
+
+	assert.Equal(t, types.ErrNotFound, err)
+	repo.AssertExpectations(t)
+}
+
+func TestCreateMessage_PublishesToRecipient(t *testing.T) {
+	repo := new(mockConversationRepo)
+	streams := new(mockStreamService)
+	svc := NewConversationService(repo, streams, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleStaff})
+
+	repo.On("CreateMessage", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(1).(*types.Message).RecipientID = "7"
+	}).Return(nil).Once()
+	repo.On("CountUnread", mock.Anything, "7").Return(1, nil).Once()
+	streams.On("Publish", mock.Anything, "7", types.StreamMessage, mock.Anything).Return(nil).Once()
+	streams.On("Publish", mock.Anything, "7", types.StreamUnread, types.InboxUnread{Count: 1}).Return(nil).Once()
+
+	err := svc.CreateMessage(ctx, &types.Message{ConversationID: "1", Body: "Your order shipped"})
+
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+	streams.AssertExpectations(t)
+}
+
+func TestGetTickets_AssignedToMe(t *testing.T) {
+	repo := new(mockConversationRepo)
+	svc := NewConversationService(repo, new(mockStreamService), nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleStaff})
+
+	filter := types.TicketFilter{Status: types.TicketOpen, Assignee: "1", Page: 1, Limit: 50}
+	repo.On("GetTickets", mock.Anything, filter).Return([]types.Conversation{}, nil).Once()
+
+	_, err := svc.GetTickets(ctx, types.TicketFilter{Status: types.TicketOpen, Assignee: "me", Page: 1, Limit: 50})
+
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+}
+
+func TestUpdateTicketStatus_Invalid(t *testing.T) {
+	repo := new(mockConversationRepo)
+	svc := NewConversationService(repo, new(mockStreamService), nil)
+
+	err := svc.UpdateTicketStatus(context.Background(), "1", "pending")
+
+	assert.Equal(t, types.ErrInvalidInput, err)
+	repo.AssertNotCalled(t, "UpdateTicketStatus", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestMarkRead_PublishesUnread(t *testing.T) {
+	repo := new(mockConversationRepo)
+	streams := new(mockStreamService)
+	svc := NewConversationService(repo, streams, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7", Role: types.RoleUser})
+
+	repo.On("MarkRead", mock.Anything, []string{"1", "2"}, "7").Return(nil).Once()
+	repo.On("CountUnread", mock.Anything, "7").Return(0, nil).Once()
+	streams.On("Publish", mock.Anything, "7", types.StreamUnread, types.InboxUnread{Count: 0}).Return(nil).Once()
+
+	err := svc.MarkRead(ctx, []string{"1", "2"})
+
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+	streams.AssertExpectations(t)
+}
+
+func TestGetConversationByIDAndUser_PublishesUnreadOnlyWhenRead(t *testing.T) {
+	repo := new(mockConversationRepo)
+	streams := new(mockStreamService)
+	svc := NewConversationService(repo, streams, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7", Role: types.RoleUser})
+
+	// already read, the unread count is unchanged
+	repo.On("GetConversationByIDAndUser", mock.Anything, "1", "7", (*types.Cursor)(nil), 20).
+		Return(types.Conversation{ID: "1", UnreadCount: 0}, nil).Once()
+	_, err := svc.GetConversationByIDAndUser(ctx, "1", nil, 20)
+	assert.NoError(t, err)
+	streams.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	repo.On("GetConversationByIDAndUser", mock.Anything, "2", "7", (*types.Cursor)(nil), 20).
+		Return(types.Conversation{ID: "2", UnreadCount: 2}, nil).Once()
+	repo.On("CountUnread", mock.Anything, "7").Return(0, nil).Once()
+	streams.On("Publish", mock.Anything, "7", types.StreamUnread, types.InboxUnread{Count: 0}).Return(nil).Once()
+	_, err = svc.GetConversationByIDAndUser(ctx, "2", nil, 20)
+	assert.NoError(t, err)
+
+	repo.AssertExpectations(t)
+	streams.AssertExpectations(t)
+}
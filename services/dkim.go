@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dkimHeaders lists the headers signed when present, in signing order
+var dkimHeaders = []string{
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// dkimSigner signs messages with DKIM (RFC 6376), using relaxed canonicalization of headers and body.
+// RSA keys sign with rsa-sha256, Ed25519 keys with ed25519-sha256 (RFC 8463).
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+// newDKIMSigner parses a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key
+func newDKIMSigner(domain, selector string, pemKey []byte) (*dkimSigner, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM encoded key found")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &dkimSigner{domain, selector, k}, nil
+	case ed25519.PrivateKey:
+		return &dkimSigner{domain, selector, k}, nil
+	}
+	return nil, fmt.Errorf("dkim: unsupported key type %T", key)
+}
+
+// Sign prepends a DKIM-Signature header to msg
+func (d *dkimSigner) Sign(msg []byte, now time.Time) ([]byte, error) {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, errors.New("dkim: message has no body")
+	}
+	fields := splitHeaderFields(string(msg[:end+2]))
+	body := msg[end+4:]
+
+	var names []string
+	var signed []string
+	for _, name := range dkimHeaders {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), name) {
+				names = append(names, strings.ToLower(name))
+				signed = append(signed, field)
+				break
+			}
+		}
+	}
+
+	algorithm := "rsa-sha256"
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, d.domain, d.selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// the signature covers the signed headers, followed by the DKIM-Signature header with an empty b= tag
+	h := sha256.New()
+	for _, field := range signed {
+		h.Write([]byte(relaxedHeader(field)))
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+value), "\r\n")))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch key := d.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, digest)
+	default:
+		signature, err = d.key.Sign(nil, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: " + value)
+	// fold the signature, whitespace within the b= tag is ignored
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 72 {
+		out.WriteString(b[:72] + "\r\n\t")
+		b = b[72:]
+	}
+	out.WriteString(b + "\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// splitHeaderFields splits a header block into fields, keeping folded continuation lines with their field
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm (RFC 6376 section 3.4.2)
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes a body with the "relaxed" algorithm (RFC 6376 section 3.4.4)
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRightFunc(line, isWSP)
+		var b strings.Builder
+		wsp := false
+		for _, r := range line {
+			if isWSP(r) {
+				wsp = true
+				continue
+			}
+			if wsp {
+				b.WriteByte(' ')
+				wsp = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyDKIM verifies the DKIM-Signature of msg with relaxed/relaxed canonicalization,
+// independently of the signer, the way a receiving server would
+func verifyDKIM(msg []byte, publicKey crypto.PublicKey) error {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	raw := m.Header.Get("DKIM-Signature")
+	if raw == "" {
+		return errors.New("no signature")
+	}
+	tags := map[string]string{}
+	for _, tag := range strings.Split(raw, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = regexp.MustCompile(`\s+`).ReplaceAllString(v, "")
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected tags %v", tags)
+	}
+
+	// body hash
+	body, _ := io.ReadAll(m.Body)
+	lines := strings.Split(string(body), "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(regexp.MustCompile(`[ \t]+`).ReplaceAllString(lines[i], " "), " ")
+	}
+	canonical := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if canonical != "" {
+		canonical += "\r\n"
+	}
+	bh := sha256.Sum256([]byte(canonical))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	// header hash, mail.Header has already unfolded the values
+	h := sha256.New()
+	canon := func(name, value string) string {
+		return strings.ToLower(name) + ":" + strings.TrimSpace(regexp.MustCompile(`[ \t]+`).ReplaceAllString(value, " "))
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		h.Write([]byte(canon(name, m.Header.Get(name)) + "\r\n"))
+	}
+	unsigned := regexp.MustCompile(`(^|;)(\s*b=)[^;]*`).ReplaceAllString(raw, "$1$2")
+	h.Write([]byte(canon("dkim-signature", unsigned)))
+	digest := h.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		return rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest, signature)
+	case "ed25519-sha256":
+		if !ed25519.Verify(publicKey.(ed25519.PublicKey), digest, signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", tags["a"])
+}
+
+func dkimEmailService(t *testing.T, key crypto.Signer, pemType string) *emailService {
+	var der []byte
+	var err error
+	if pemType == "RSA PRIVATE KEY" {
+		der = x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+	}
+	svc := goldenEmailService()
+	svc.dkim, err = newDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}))
+	assert.NoError(t, err)
+	return svc
+}
+
+func dkimTestEmail() *types.Email {
+	return &types.Email{
+		ID:              "2001",
+		To:              []string{"user@example.com"},
+		Subject:         "Ünïcödé   subject",
+		Body:            "<p>Your   order\t has shipped.</p>\n\n\n",
+		IsHTML:          true,
+		ListUnsubscribe: "https://example.com/unsubscribe/abc",
+		Attachments: []types.EmailAttachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")},
+		},
+		CreatedAt: goldenDate,
+	}
+}
+
+func TestDKIM_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	for _, pemType := range []string{"RSA PRIVATE KEY", "PRIVATE KEY"} {
+		svc := dkimEmailService(t, key, pemType)
+		msg, err := svc.message(dkimTestEmail())
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(msg, []byte("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=mail;")))
+		assert.NoError(t, verifyDKIM(msg, &key.PublicKey), "Expected %s key signature to verify", pemType)
+	}
+}
+
+func TestDKIM_Ed25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	svc := dkimEmailService(t, private, "PRIVATE KEY")
+	msg, err := svc.message(dkimTestEmail())
+	assert.NoError(t, err)
+	assert.Contains(t, string(msg), "a=ed25519-sha256;")
+	assert.NoError(t, verifyDKIM(msg, public))
+}
+
+func TestDKIM_SignedHeaders(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	svc := dkimEmailService(t, private, "PRIVATE KEY")
+	msg, err := svc.message(dkimTestEmail())
+	assert.NoError(t, err)
+	assert.Contains(t, string(msg), "h=from:to:subject:date:message-id:list-unsubscribe:list-unsubscribe-post:mime-version:content-type;")
+}
+
+func TestDKIM_DetectsTampering(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	svc := dkimEmailService(t, private, "PRIVATE KEY")
+	msg, err := svc.message(dkimTestEmail())
+	assert.NoError(t, err)
+
+	tamperedHeader := bytes.Replace(msg, []byte("To: user@example.com"), []byte("To: other@example.com"), 1)
+	assert.Error(t, verifyDKIM(tamperedHeader, public), "Expected modified header to fail verification")
+
+	tamperedBody := bytes.Replace(msg, []byte("%PDF-1.4"), []byte("%PDF-1.5"), 1)
+	tamperedBody = bytes.Replace(tamperedBody, []byte("JVBERi0xLjQ="), []byte("JVBERi0xLjU="), 1)
+	assert.Error(t, verifyDKIM(tamperedBody, public), "Expected modified body to fail verification")
+
+	// relaxed canonicalization tolerates whitespace changes made in transit
+	refolded := bytes.Replace(msg, []byte("Subject: "), []byte("Subject:  \t"), 1)
+	assert.NoError(t, verifyDKIM(refolded, public))
+}
+
+func TestDKIM_Disabled(t *testing.T) {
+	svc := goldenEmailService()
+	msg, err := svc.message(dkimTestEmail())
+	assert.NoError(t, err)
+	assert.False(t, bytes.HasPrefix(msg, []byte("DKIM-Signature")))
+}
+
+func TestDKIM_InvalidKey(t *testing.T) {
+	_, err := newDKIMSigner("example.com", "mail", []byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestRelaxedBody(t *testing.T) {
+	assert.Equal(t, " C\r\nD E\r\n", string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))))
+	assert.Empty(t, relaxedBody([]byte("\r\n\r\n")))
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	// example from RFC 6376 section 3.4.5
+	assert.Equal(t, "a:X\r\n", relaxedHeader("A: X\r\n"))
+	assert.Equal(t, "b:Y Z\r\n", relaxedHeader("B : Y\t\r\n\tZ  \r\n"))
+}
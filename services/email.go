@@ -1,15 +1,22 @@
 package services
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/dgyurics/marketplace/repositories"
 	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
 )
 
 // TODO: Refactor email architecture into two layers:
@@ -32,11 +39,31 @@ import (
 //     SendPaymentSuccess(recipientEmail, orderID string) error
 // }
 
+const (
+	emailMaxAttempts    = 8                // attempts before an email is marked failed, spanning roughly 4 hours
+	emailRetryBase      = time.Minute      // delay before the first retry, doubled on each further retry
+	emailTimeout        = 30 * time.Second // maximum time allowed for a single SMTP conversation
+	emailLease          = 2 * time.Minute  // time a claimed email is hidden from other instances
+	emailBatchSize      = 10
+	emailPollInterval   = 30 * time.Second
+	emailRecipientLimit = 10        // emails a recipient may be sent per emailThrottleWindow
+	emailThrottleWindow = time.Hour // window of the per-recipient throttle
+	emailQueueTimeout   = 5 * time.Second
+)
+
+// EmailService queues outgoing emails, and sends them from a worker.
+// Emails are stored before being sent, and retried with exponential backoff until they succeed.
 type EmailService interface {
 	Send(email *types.Email) error
+	GetEmails(ctx context.Context, status types.EmailStatus, recipient string, page, limit int) ([]types.Email, error)
+	GetEmail(ctx context.Context, id string) (types.Email, error)
+	Resend(ctx context.Context, id string) (types.Email, error)
+	DeliverPending(ctx context.Context)
+	Start(ctx context.Context)
 }
 
 type emailService struct {
+	repo     repositories.EmailRepository
 	enabled  bool
 	host     string
 	port     int
@@ -45,10 +72,25 @@ type emailService struct {
 	useTLS   bool
 	from     string
 	fromName string
+	replyTo  string
+	wake     chan struct{}
+
+	dkim *dkimSigner // nil when DKIM signing is not configured
 }
 
-func NewEmailService(config types.EmailConfig) EmailService {
+// NewEmailService creates the email service. A DKIM key which cannot be parsed fails startup.
+func NewEmailService(repo repositories.EmailRepository, config types.EmailConfig) EmailService {
+	var dkim *dkimSigner
+	if config.DKIMDomain != "" {
+		var err error
+		dkim, err = newDKIMSigner(config.DKIMDomain, config.DKIMSelector, config.DKIMPrivateKey)
+		if err != nil {
+			slog.Error("Failed to load DKIM key", "error", err, "domain", config.DKIMDomain)
+			os.Exit(1)
+		}
+	}
 	return &emailService{
+		repo:     repo,
 		enabled:  config.Enabled,
 		host:     config.Host,
 		port:     config.Port,
@@ -57,52 +99,225 @@ func NewEmailService(config types.EmailConfig) EmailService {
 		useTLS:   config.UseTLS,
 		from:     config.From,
 		fromName: config.FromName,
+		replyTo:  config.ReplyTo,
+		wake:     make(chan struct{}, 1),
+		dkim:     dkim,
 	}
 }
 
+// Send queues an email for delivery.
+// Emails to a recipient which has exceeded the send limit are recorded as throttled, and not sent.
+// Account emails, such as password resets, are exempt from the limit.
 func (s *emailService) Send(email *types.Email) error {
 	if !s.enabled {
 		slog.Warn("Email service is disabled; skipping email send", "to", email.To, "subject", email.Subject)
 		return nil
 	}
-	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	if len(email.To) == 0 {
+		return types.ErrInvalidInput
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), emailQueueTimeout)
+	defer cancel()
 
-	slog.Debug("Sending email", "to", email.To, "subject", email.Subject, "from", s.from, "host", s.host, "port", s.port, "useTLS", s.useTLS)
-	if s.useTLS {
-		return s.sendWithTLS(addr, email)
+	if email.Event == types.NotificationAccount {
+		return s.queue(ctx, email)
 	}
 
-	// Plain SMTP (for local docker containers)
-	return s.sendPlain(addr, email)
+	if err := prepareEmail(email); err != nil {
+		return err
+	}
+	since := time.Now().UTC().Add(-emailThrottleWindow)
+	if err := s.repo.CreateEmailThrottled(ctx, email, emailRecipientLimit, since); err != nil {
+		return err
+	}
+	if email.Status == types.EmailThrottled {
+		slog.Warn("Recipient exceeded email limit; email not sent", "to", email.To, "subject", email.Subject)
+		return nil
+	}
+	s.notify()
+	return nil
 }
 
-func (s *emailService) sendPlain(addr string, email *types.Email) error {
-	var a smtp.Auth
-	if s.username != "" {
-		a = smtp.PlainAuth("", s.username, s.password, s.host) // PORT NOT NEEDED??
+// queue stores the email for delivery, without applying the recipient throttle
+func (s *emailService) queue(ctx context.Context, email *types.Email) error {
+	if err := prepareEmail(email); err != nil {
+		return err
+	}
+	if err := s.repo.CreateEmail(ctx, email); err != nil {
+		return err
 	}
+	s.notify()
+	return nil
+}
 
-	msg := s.buildMessage(email)
-	return smtp.SendMail(addr, a, s.from, email.To, []byte(msg))
+// prepareEmail assigns a new ID and resets the delivery state, so the email is sent right away
+func prepareEmail(email *types.Email) error {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	email.ID = id
+	email.Status = types.EmailQueued
+	email.Attempts = 0
+	email.Response = nil
+	email.Error = nil
+	email.SentAt = nil
+	email.NextAttemptAt = &now
+	return nil
+}
+
+func (s *emailService) GetEmails(ctx context.Context, status types.EmailStatus, recipient string, page, limit int) ([]types.Email, error) {
+	return s.repo.GetEmails(ctx, status, recipient, page, limit)
+}
+
+func (s *emailService) GetEmail(ctx context.Context, id string) (types.Email, error) {
+	return s.repo.GetEmail(ctx, id)
+}
+
+// Resend queues a copy of a previous email.
+// The recipient throttle does not apply, resending is an admin action.
+func (s *emailService) Resend(ctx context.Context, id string) (types.Email, error) {
+	prev, err := s.repo.GetEmail(ctx, id)
+	if err != nil {
+		return types.Email{}, err
+	}
+	email := types.Email{
+		To:              prev.To,
+		Subject:         prev.Subject,
+		Body:            prev.Body,
+		TextBody:        prev.TextBody,
+		IsHTML:          prev.IsHTML,
+		Template:        prev.Template,
+		ReplyTo:         prev.ReplyTo,
+		ListUnsubscribe: prev.ListUnsubscribe,
+		Attachments:     prev.Attachments,
+	}
+	if err := s.queue(ctx, &email); err != nil {
+		return types.Email{}, err
+	}
+	return email, nil
+}
+
+// Start sends queued emails until ctx is canceled.
+// Pass it root context to allow for clean shutdown.
+func (s *emailService) Start(ctx context.Context) {
+	ticker := time.NewTicker(emailPollInterval)
+	defer ticker.Stop()
+
+	slog.Info("Email delivery started")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Email delivery stopped")
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.DeliverPending(ctx)
+	}
+}
+
+// DeliverPending sends emails which are due, until none remain
+func (s *emailService) DeliverPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		emails, err := s.repo.ClaimEmails(ctx, emailBatchSize, emailLease)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming emails", "error", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := range emails {
+			wg.Add(1)
+			go func(email *types.Email) {
+				defer wg.Done()
+				s.deliver(ctx, email)
+			}(&emails[i])
+		}
+		wg.Wait()
+
+		if len(emails) < emailBatchSize {
+			return
+		}
+	}
+}
+
+// deliver attempts to send an email and records the outcome, scheduling a retry on failure.
+// Permanent rejections (5xx replies) are not retried.
+func (s *emailService) deliver(ctx context.Context, email *types.Email) {
+	response, err := s.send(email)
+
+	now := time.Now().UTC()
+	email.Attempts++
+	email.Response = nil
+	if response != "" {
+		email.Response = &response
+	}
+	var reply *textproto.Error
+	switch {
+	case err == nil:
+		email.Status = types.EmailSent
+		email.Error = nil
+		email.NextAttemptAt = nil
+		email.SentAt = &now
+	case email.Attempts >= emailMaxAttempts, errors.As(err, &reply) && reply.Code >= 500:
+		email.Status = types.EmailFailed
+		email.Error = utilities.StringPtr(err.Error())
+		email.NextAttemptAt = nil
+		slog.ErrorContext(ctx, "Email failed", "email_id", email.ID, "to", email.To, "error", err)
+	default:
+		next := now.Add(emailRetryBase << (email.Attempts - 1))
+		email.Error = utilities.StringPtr(err.Error())
+		email.NextAttemptAt = &next
+	}
+
+	if err := s.repo.UpdateEmail(context.WithoutCancel(ctx), email); err != nil {
+		slog.ErrorContext(ctx, "Error recording email", "email_id", email.ID, "error", err)
+	}
 }
 
-func (s *emailService) sendWithTLS(addr string, email *types.Email) error {
-	// Connect to SMTP server
-	client, err := smtp.Dial(addr)
+// notify wakes the delivery loop, without blocking if it is already awake
+func (s *emailService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send delivers an email over SMTP, returning the server's reply to the message.
+// TLS is negotiated with STARTTLS when enabled, plain SMTP is meant for local docker containers.
+func (s *emailService) send(email *types.Email) (string, error) {
+	msg, err := s.message(email)
+	if err != nil {
+		return "", err
+	}
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	slog.Debug("Sending email", "to", email.To, "subject", email.Subject, "from", s.from, "host", s.host, "port", s.port, "useTLS", s.useTLS)
+
+	conn, err := net.DialTimeout("tcp", addr, emailTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+		return "", fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return smtpReply(err), fmt.Errorf("failed to connect to SMTP server: %w", err)
 	}
 	defer client.Close()
 
 	// Start TLS if supported
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		slog.Debug("Starting TLS")
-		config := &tls.Config{
-			ServerName: s.host,
-			// InsecureSkipVerify: true, // Only for testing!
-		}
-		if err = client.StartTLS(config); err != nil {
-			return fmt.Errorf("failed to start TLS: %w", err)
+	if s.useTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			slog.Debug("Starting TLS")
+			config := &tls.Config{
+				ServerName: s.host,
+			}
+			if err = client.StartTLS(config); err != nil {
+				return smtpReply(err), fmt.Errorf("failed to start TLS: %w", err)
+			}
 		}
 	}
 
@@ -111,70 +326,77 @@ func (s *emailService) sendWithTLS(addr string, email *types.Email) error {
 		slog.Debug("Authenticating", "username", s.username)
 		auth := smtp.PlainAuth("", s.username, s.password, s.host)
 		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("authentication failed: %w", err)
+			return smtpReply(err), fmt.Errorf("authentication failed: %w", err)
 		}
-		slog.Debug("Authentication successful")
 	}
 
 	// Set sender
-	slog.Debug("Setting sender", "from", s.from)
 	if err = client.Mail(s.from); err != nil {
-		return fmt.Errorf("failed to set sender: %w", err)
+		return smtpReply(err), fmt.Errorf("failed to set sender: %w", err)
 	}
 
 	// Set recipients
 	for _, addr := range email.To {
-		slog.Debug("Adding recipient", "to", addr)
 		if err = client.Rcpt(addr); err != nil {
-			return fmt.Errorf("failed to set recipient %s: %w", addr, err)
+			return smtpReply(err), fmt.Errorf("failed to set recipient %s: %w", addr, err)
 		}
 	}
 
 	// Send message
-	slog.Debug("Sending message data")
-	w, err := client.Data()
+	reply, err := sendData(client, msg)
 	if err != nil {
-		return fmt.Errorf("failed to send DATA command: %w", err)
+		return reply, fmt.Errorf("failed to send message: %w", err)
 	}
 
-	message := s.buildMessage(email)
-	if _, err = w.Write([]byte(message)); err != nil {
-		return fmt.Errorf("failed to write message: %w", err)
-	}
+	slog.Debug("Email sent successfully", "reply", reply)
+	client.Quit()
+	return reply, nil
+}
 
-	if err = w.Close(); err != nil {
-		return fmt.Errorf("failed to close message: %w", err)
+// message builds the message of an email, signed with DKIM when configured
+func (s *emailService) message(email *types.Email) ([]byte, error) {
+	msg := s.buildMessage(email)
+	if s.dkim == nil {
+		return msg, nil
 	}
-
-	slog.Debug("Email sent successfully")
-	return client.Quit()
+	return s.dkim.Sign(msg, time.Now())
 }
 
-func (s *emailService) buildMessage(email *types.Email) string {
-	var msg strings.Builder
-
-	// Headers
-	if s.fromName == "" {
-		msg.WriteString(fmt.Sprintf("From: %s\r\n", s.from))
-	} else {
-		msg.WriteString(fmt.Sprintf("From: %s <%s>\r\n", s.fromName, s.from)) // WHAT'S <%s> DO??
+// sendData sends the message with the DATA command, returning the server's reply.
+// smtp.Client.Data discards the reply, which usually holds the server's queue ID.
+func sendData(client *smtp.Client, msg []byte) (string, error) {
+	text := client.Text
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return "", err
 	}
-
-	msg.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(email.To, ", ")))
-	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", email.Subject))
-
-	// Content-Type based on whether it's HTML
-	if email.IsHTML {
-		msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-	} else {
-		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(354)
+	text.EndResponse(id)
+	if err != nil {
+		return smtpReply(err), err
 	}
 
-	// Empty line before body
-	msg.WriteString("\r\n")
-
-	// Body
-	msg.WriteString(email.Body)
+	w := text.DotWriter()
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	code, reply, err := text.ReadResponse(250)
+	if err != nil {
+		return smtpReply(err), err
+	}
+	return fmt.Sprintf("%d %s", code, reply), nil
+}
 
-	return msg.String()
+// smtpReply returns the server's reply held by err, if any
+func smtpReply(err error) string {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return fmt.Sprintf("%d %s", reply.Code, reply.Msg)
+	}
+	return ""
 }
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+// mimePart is a node of a message body, either a leaf holding an encoded body, or a multipart container
+type mimePart struct {
+	contentType string            // e.g. "text/plain; charset=UTF-8" or "multipart/alternative"
+	header      map[string]string // headers other than Content-Type
+	body        []byte
+	parts       []mimePart
+	boundary    string
+}
+
+// buildMessage renders an email as an RFC 5322 message.
+//
+// HTML emails are sent as multipart/alternative, with a plain-text part generated from the HTML
+// when the email has no text body. Inline images are wrapped with the HTML part in multipart/related,
+// and attachments are added in a multipart/mixed container.
+// The output only depends on the email, boundaries are derived from its ID.
+func (s *emailService) buildMessage(email *types.Email) []byte {
+	var msg bytes.Buffer
+
+	date := email.CreatedAt
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	writeHeader(&msg, "From", formatAddress(s.fromName, s.from))
+	replyTo := email.ReplyTo
+	if replyTo == "" {
+		replyTo = s.replyTo
+	}
+	if addr, err := mail.ParseAddress(replyTo); err == nil {
+		writeHeader(&msg, "Reply-To", addr.String())
+	}
+	writeHeader(&msg, "To", strings.Join(email.To, ", "))
+	writeHeader(&msg, "Subject", mime.QEncoding.Encode("UTF-8", email.Subject))
+	writeHeader(&msg, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&msg, "Message-ID", fmt.Sprintf("<%s@%s>", email.ID, domainOf(s.from)))
+	if email.ListUnsubscribe != "" {
+		writeHeader(&msg, "List-Unsubscribe", "<"+stripLineBreaks(email.ListUnsubscribe)+">")
+		if strings.HasPrefix(email.ListUnsubscribe, "https://") {
+			// RFC 8058 one-click unsubscribe
+			writeHeader(&msg, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+	}
+	writeHeader(&msg, "MIME-Version", "1.0")
+	writePart(&msg, messageBody(email))
+	return msg.Bytes()
+}
+
+// messageBody arranges the body and attachments of an email into MIME parts
+func messageBody(email *types.Email) mimePart {
+	var content mimePart
+	if email.IsHTML {
+		text := email.TextBody
+		if text == "" {
+			text = htmlToText(email.Body)
+		}
+		htmlPart := textPart("html", email.Body)
+
+		var inline, attached []types.EmailAttachment
+		for _, a := range email.Attachments {
+			if a.ContentID != "" {
+				inline = append(inline, a)
+			} else {
+				attached = append(attached, a)
+			}
+		}
+		if len(inline) > 0 {
+			related := mimePart{contentType: `multipart/related; type="text/html"`, boundary: "=_related_" + email.ID}
+			related.parts = append(related.parts, htmlPart)
+			for _, a := range inline {
+				related.parts = append(related.parts, attachmentPart(a))
+			}
+			htmlPart = related
+		}
+		content = mimePart{
+			contentType: "multipart/alternative",
+			boundary:    "=_alternative_" + email.ID,
+			parts:       []mimePart{textPart("plain", text), htmlPart},
+		}
+		return mixed(email.ID, content, attached)
+	}
+
+	content = textPart("plain", email.Body)
+	return mixed(email.ID, content, email.Attachments)
+}
+
+// mixed adds attachments to content, if any
+func mixed(id string, content mimePart, attachments []types.EmailAttachment) mimePart {
+	if len(attachments) == 0 {
+		return content
+	}
+	container := mimePart{contentType: "multipart/mixed", boundary: "=_mixed_" + id}
+	container.parts = append(container.parts, content)
+	for _, a := range attachments {
+		container.parts = append(container.parts, attachmentPart(a))
+	}
+	return container
+}
+
+// textPart returns a quoted-printable encoded text part of the given subtype, e.g. "plain" or "html"
+func textPart(subtype, text string) mimePart {
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	w.Write([]byte(text))
+	w.Close()
+	return mimePart{
+		contentType: "text/" + subtype + "; charset=UTF-8",
+		header:      map[string]string{"Content-Transfer-Encoding": "quoted-printable"},
+		body:        body.Bytes(),
+	}
+}
+
+// attachmentPart returns a base64 encoded attachment.
+// Attachments with a content ID are inline, and referenced from the HTML body as cid:<ContentID>.
+func attachmentPart(a types.EmailAttachment) mimePart {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	header := map[string]string{"Content-Transfer-Encoding": "base64"}
+	if a.ContentID != "" {
+		disposition = "inline"
+		header["Content-ID"] = "<" + stripLineBreaks(a.ContentID) + ">"
+	}
+	if a.Filename != "" {
+		contentType = mime.FormatMediaType(contentType, map[string]string{"name": a.Filename})
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})
+	}
+	header["Content-Disposition"] = disposition
+
+	// base64 lines are limited to 76 characters
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	var body bytes.Buffer
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded)
+	return mimePart{contentType: contentType, header: header, body: body.Bytes()}
+}
+
+// writePart writes the headers and body of a part, and its children if it is a multipart container
+func writePart(buf *bytes.Buffer, p mimePart) {
+	contentType := p.contentType
+	if p.boundary != "" {
+		contentType += `; boundary="` + p.boundary + `"`
+	}
+	writeHeader(buf, "Content-Type", contentType)
+	keys := make([]string, 0, len(p.header))
+	for k := range p.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader(buf, k, p.header[k])
+	}
+	buf.WriteString("\r\n")
+
+	if p.boundary == "" {
+		buf.Write(p.body)
+		return
+	}
+	for i, child := range p.parts {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("--" + p.boundary + "\r\n")
+		writePart(buf, child)
+	}
+	buf.WriteString("\r\n--" + p.boundary + "--\r\n")
+}
+
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key + ": " + value + "\r\n")
+}
+
+// formatAddress formats a mailbox, encoding a non-ASCII display name
+func formatAddress(name, address string) string {
+	if name == "" {
+		return address
+	}
+	return (&mail.Address{Name: name, Address: address}).String()
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
+
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+var (
+	hrefPattern       = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// htmlToText renders an HTML body as plain text, for the text alternative of HTML emails.
+// Block elements end lines, links keep their target, and the contents of head, style and script are dropped.
+func htmlToText(s string) string {
+	var out strings.Builder
+	skip := 0      // depth within elements whose content is dropped
+	linkStart := 0 // position of the current link's text
+	href := ""
+
+	for len(s) > 0 {
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			i = len(s)
+		}
+		if skip == 0 && i > 0 {
+			out.WriteString(whitespacePattern.ReplaceAllString(html.UnescapeString(s[:i]), " "))
+		}
+		if i == len(s) {
+			break
+		}
+		end := strings.IndexByte(s[i:], '>')
+		if end < 0 {
+			break
+		}
+		tag := s[i+1 : i+end]
+		s = s[i+end+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if j := strings.IndexAny(name, " \t\r\n/"); j >= 0 {
+			name = name[:j]
+		}
+
+		switch name {
+		case "head", "style", "script", "title":
+			if closing {
+				skip = max(skip-1, 0)
+			} else {
+				skip++
+			}
+		case "br":
+			out.WriteString("\n")
+		case "p", "div", "table", "tr", "ul", "ol", "h1", "h2", "h3", "h4", "h5", "h6":
+			out.WriteString("\n\n")
+		case "li":
+			if !closing {
+				out.WriteString("\n- ")
+			}
+		case "td", "th":
+			if closing {
+				out.WriteString(" ")
+			}
+		case "a":
+			if !closing {
+				href = ""
+				if m := hrefPattern.FindStringSubmatch(tag); m != nil {
+					href = html.UnescapeString(m[1] + m[2] + m[3])
+				}
+				linkStart = out.Len()
+			} else if href != "" {
+				text := strings.TrimSpace(out.String()[linkStart:])
+				if text != href && !strings.HasPrefix(href, "#") {
+					out.WriteString(" (" + href + ")")
+				}
+				href = ""
+			}
+		}
+	}
+
+	// trim lines, and collapse runs of blank lines
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
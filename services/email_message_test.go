@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// assertGolden compares output with testdata/email/<name>.eml, rewriting the file when -update is set
+func assertGolden(t *testing.T, name string, output []byte) {
+	path := filepath.Join("testdata", "email", name+".eml")
+	if *updateGolden {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, output, 0o644))
+	}
+	expected, err := os.ReadFile(path)
+	assert.NoError(t, err, "Expected golden file %s, run with -update to create it", path)
+	assert.Equal(t, string(expected), string(output))
+}
+
+func goldenEmailService() *emailService {
+	return &emailService{
+		from:     "noreply@example.com",
+		fromName: "Marketplace",
+	}
+}
+
+var goldenDate = time.Date(2026, time.March, 14, 9, 26, 53, 0, time.UTC)
+
+func TestBuildMessage_HTMLAlternative(t *testing.T) {
+	svc := goldenEmailService()
+	email := &types.Email{
+		ID:        "1001",
+		To:        []string{"user@example.com"},
+		Subject:   "Réinitialisation du mot de passe",
+		Body:      "<!-- Password reset email template -->\n<html>\n<body>\n    <p>To reset your password, follow the link below:</p>\n    <p><a href=\"https://example.com/reset/1234\">https://example.com/reset/1234</a></p>\n    <p>If you did not request a password reset, disregard this email.</p>\n</body>\n</html>\n",
+		IsHTML:    true,
+		CreatedAt: goldenDate,
+	}
+	assertGolden(t, "html_alternative", svc.buildMessage(email))
+}
+
+func TestBuildMessage_PlainText(t *testing.T) {
+	svc := goldenEmailService()
+	svc.fromName = "Marktplatz Größe"
+	email := &types.Email{
+		ID:        "1002",
+		To:        []string{"one@example.com", "two@example.com"},
+		Subject:   "Plain text",
+		Body:      "A plain text message.\nWith a line that is long enough to be wrapped by the quoted-printable encoder, which limits lines to 76 characters.\n",
+		CreatedAt: goldenDate,
+	}
+	assertGolden(t, "plain_text", svc.buildMessage(email))
+}
+
+func TestBuildMessage_Attachments(t *testing.T) {
+	svc := goldenEmailService()
+	svc.replyTo = "support@example.com"
+	email := &types.Email{
+		ID:              "1003",
+		To:              []string{"user@example.com"},
+		Subject:         "Your invoice",
+		Body:            `<html><head><style>p { color: red; }</style></head><body><img src="cid:logo" alt="Logo"><p>Your invoice is attached.</p><ul><li>Order 42</li><li>Total &euro;10.00</li></ul></body></html>`,
+		IsHTML:          true,
+		ListUnsubscribe: "https://example.com/unsubscribe/abc",
+		Attachments: []types.EmailAttachment{
+			{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Data: []byte("\x89PNG\r\n\x1a\n")},
+			{Filename: "invoice 42.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4\n% a minimal document, long enough to span more than one line of base64 output\n%%EOF\n")},
+		},
+		CreatedAt: goldenDate,
+	}
+	assertGolden(t, "attachments", svc.buildMessage(email))
+}
+
+// TestBuildMessage_Parses reads the message back with the standard library, the way a mail client would
+func TestBuildMessage_Parses(t *testing.T) {
+	svc := goldenEmailService()
+	email := &types.Email{
+		ID:      "1006",
+		To:      []string{"user@example.com"},
+		Subject: "Ünïcödé",
+		Body:    `<p>Hello <img src="cid:logo"></p>`,
+		IsHTML:  true,
+		Attachments: []types.EmailAttachment{
+			{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Data: []byte("image")},
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("document")},
+		},
+		CreatedAt: goldenDate,
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(svc.buildMessage(email)))
+	assert.NoError(t, err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	assert.NoError(t, err)
+	assert.Equal(t, email.Subject, subject)
+
+	// collect the leaf parts, in order
+	var leaves []string
+	var contents [][]byte
+	var walk func(r io.Reader, header textproto.MIMEHeader)
+	walk = func(r io.Reader, header textproto.MIMEHeader) {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		assert.NoError(t, err)
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			// multipart.Reader only decodes quoted-printable
+			if header.Get("Content-Transfer-Encoding") == "base64" {
+				r = base64.NewDecoder(base64.StdEncoding, r)
+			}
+			leaves = append(leaves, mediaType)
+			body, _ := io.ReadAll(r)
+			contents = append(contents, body)
+			return
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			}
+			assert.NoError(t, err)
+			walk(part, part.Header)
+		}
+	}
+	walk(msg.Body, textproto.MIMEHeader(msg.Header))
+
+	assert.Equal(t, []string{"text/plain", "text/html", "image/png", "application/pdf"}, leaves)
+	assert.Equal(t, "Hello", string(contents[0]))
+	assert.Equal(t, "document", string(contents[3]), "Expected base64 to be decoded")
+}
+
+func TestBuildMessage_ReplyToOverride(t *testing.T) {
+	svc := goldenEmailService()
+	svc.replyTo = "support@example.com"
+	email := &types.Email{
+		ID:        "1004",
+		To:        []string{"user@example.com"},
+		Subject:   "Re: your question",
+		Body:      "Hello",
+		ReplyTo:   "Sales <sales@example.com>",
+		CreatedAt: goldenDate,
+	}
+	msg := string(svc.buildMessage(email))
+	assert.Contains(t, msg, "Reply-To: \"Sales\" <sales@example.com>\r\n")
+	assert.NotContains(t, msg, "support@example.com")
+}
+
+func TestBuildMessage_SubjectHeaderInjection(t *testing.T) {
+	svc := goldenEmailService()
+	email := &types.Email{
+		ID:        "1005",
+		To:        []string{"user@example.com"},
+		Subject:   "Hello\r\nBcc: victim@example.com",
+		Body:      "Hello",
+		CreatedAt: goldenDate,
+	}
+	msg := string(svc.buildMessage(email))
+	assert.NotContains(t, msg, "\r\nBcc:")
+}
+
+func TestHTMLToText(t *testing.T) {
+	html := `<html><head><title>Ignored</title></head><body>
+		<h1>Order   confirmed</h1>
+		<p>Details can be found here: <a href="https://example.com/orders/1">view order</a></p>
+		<p>Or visit <a href="https://example.com">https://example.com</a>.<br>Thanks &amp; regards</p>
+		<table><tr><td>Item</td><td>Qty</td></tr></table>
+	</body></html>`
+	expected := "Order confirmed\n\n" +
+		"Details can be found here: view order (https://example.com/orders/1)\n\n" +
+		"Or visit https://example.com.\n" +
+		"Thanks & regards\n\n" +
+		"Item Qty"
+	assert.Equal(t, expected, htmlToText(html))
+}
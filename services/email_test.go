@@ -0,0 +1,280 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockEmailRepo struct {
+	mock.Mock
+}
+
+func (m *mockEmailRepo) CreateEmail(ctx context.Context, email *types.Email) error {
+	args := m.Called(ctx, email)
+	return args.Error(0)
+}
+
+func (m *mockEmailRepo) GetEmail(ctx context.Context, id string) (types.Email, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.Email), args.Error(1)
+}
+
+func (m *mockEmailRepo) GetEmails(ctx context.Context, status types.EmailStatus, recipient string, page, limit int) ([]types.Email, error) {
+	args := m.Called(ctx, status, recipient, page, limit)
+	return args.Get(0).([]types.Email), args.Error(1)
+}
+
+func (m *mockEmailRepo) CreateEmailThrottled(ctx context.Context, email *types.Email, limit int, since time.Time) error {
+	args := m.Called(ctx, email, limit, since)
+	return args.Error(0)
+}
+
+func (m *mockEmailRepo) CountRecent(ctx context.Context, recipient string, since time.Time) (int, error) {
+	args := m.Called(ctx, recipient, since)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockEmailRepo) ClaimEmails(ctx context.Context, limit int, lease time.Duration) ([]types.Email, error) {
+	args := m.Called(ctx, limit, lease)
+	return args.Get(0).([]types.Email), args.Error(1)
+}
+
+func (m *mockEmailRepo) UpdateEmail(ctx context.Context, email *types.Email) error {
+	args := m.Called(ctx, email)
+	return args.Error(0)
+}
+
+// startSMTPServer runs a minimal SMTP server, replying to the message with dataReply.
+// Received messages are sent on the returned channel.
+func startSMTPServer(t *testing.T, dataReply string) (types.EmailConfig, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost ESMTP test")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					msg.WriteString(l)
+				}
+				received <- msg.String()
+				reply(dataReply)
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	config := types.EmailConfig{
+		Enabled: true,
+		Host:    host,
+		From:    "noreply@example.com",
+	}
+	config.Port, _ = net.LookupPort("tcp", port)
+	return config, received
+}
+
+func queuedEmail() types.Email {
+	now := time.Now().UTC()
+	return types.Email{
+		ID:            "1",
+		To:            []string{"user@example.com"},
+		Subject:       "Hello",
+		Body:          "<p>Hello</p>",
+		IsHTML:        true,
+		Status:        types.EmailQueued,
+		NextAttemptAt: &now,
+	}
+}
+
+// deliverOnce runs a single delivery of email, returning the recorded outcome
+func deliverOnce(t *testing.T, svc EmailService, repo *mockEmailRepo, email types.Email) *types.Email {
+	var updated *types.Email
+	repo.On("ClaimEmails", mock.Anything, emailBatchSize, emailLease).Return([]types.Email{email}, nil).Once()
+	repo.On("UpdateEmail", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.Email)
+	}).Return(nil).Once()
+
+	svc.DeliverPending(context.Background())
+
+	repo.AssertExpectations(t)
+	return updated
+}
+
+func TestDeliverPendingEmails_RecordsReply(t *testing.T) {
+	config, received := startSMTPServer(t, "250 2.0.0 Ok: queued as 1A2B3C")
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, config)
+
+	updated := deliverOnce(t, svc, repo, queuedEmail())
+
+	assert.Equal(t, types.EmailSent, updated.Status)
+	assert.Equal(t, 1, updated.Attempts)
+	assert.Equal(t, "250 2.0.0 Ok: queued as 1A2B3C", *updated.Response)
+	assert.NotNil(t, updated.SentAt)
+	assert.Nil(t, updated.NextAttemptAt)
+	assert.Contains(t, <-received, "Subject: Hello")
+}
+
+func TestDeliverPendingEmails_RetriesTemporaryFailure(t *testing.T) {
+	config, _ := startSMTPServer(t, "451 4.3.0 Try again later")
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, config)
+
+	email := queuedEmail()
+	email.Attempts = 2
+	updated := deliverOnce(t, svc, repo, email)
+
+	assert.Equal(t, types.EmailQueued, updated.Status)
+	assert.Equal(t, 3, updated.Attempts)
+	assert.Equal(t, "451 4.3.0 Try again later", *updated.Response)
+	assert.NotNil(t, updated.Error)
+	// third attempt failed, the next retry waits 2^2 minutes
+	assert.WithinDuration(t, time.Now().Add(4*time.Minute), *updated.NextAttemptAt, 5*time.Second)
+}
+
+func TestDeliverPendingEmails_PermanentFailure(t *testing.T) {
+	config, _ := startSMTPServer(t, "554 5.7.1 Message rejected")
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, config)
+
+	updated := deliverOnce(t, svc, repo, queuedEmail())
+
+	assert.Equal(t, types.EmailFailed, updated.Status, "Expected permanent rejection not to be retried")
+	assert.Equal(t, 1, updated.Attempts)
+	assert.Nil(t, updated.NextAttemptAt)
+}
+
+func TestDeliverPendingEmails_GivesUpAfterMaxAttempts(t *testing.T) {
+	// nothing is listening on this server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, types.EmailConfig{Enabled: true, Host: "127.0.0.1", Port: addr.Port})
+
+	email := queuedEmail()
+	email.Attempts = emailMaxAttempts - 1
+	updated := deliverOnce(t, svc, repo, email)
+
+	assert.Equal(t, types.EmailFailed, updated.Status)
+	assert.Nil(t, updated.Response)
+	assert.NotNil(t, updated.Error)
+}
+
+func TestSendEmail_Queues(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, types.EmailConfig{Enabled: true})
+
+	email := &types.Email{To: []string{"user@example.com"}, Subject: "Hello", Body: "Hello"}
+	repo.On("CreateEmailThrottled", mock.Anything, email, emailRecipientLimit, mock.Anything).Return(nil).Once()
+
+	err := svc.Send(email)
+
+	assert.NoError(t, err)
+	assert.NotEmpty(t, email.ID)
+	assert.Equal(t, types.EmailQueued, email.Status)
+	assert.NotNil(t, email.NextAttemptAt)
+	repo.AssertExpectations(t)
+}
+
+func TestSendEmail_ThrottlesRecipient(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, types.EmailConfig{Enabled: true})
+
+	email := &types.Email{To: []string{"user@example.com"}, Subject: "Hello", Body: "Hello"}
+	repo.On("CreateEmailThrottled", mock.Anything, email, emailRecipientLimit, mock.Anything).Run(func(args mock.Arguments) {
+		// recipient has reached the limit
+		e := args.Get(1).(*types.Email)
+		e.Status = types.EmailThrottled
+		e.NextAttemptAt = nil
+	}).Return(nil).Once()
+
+	err := svc.Send(email)
+
+	assert.NoError(t, err)
+	assert.Equal(t, types.EmailThrottled, email.Status)
+	assert.Nil(t, email.NextAttemptAt, "Expected throttled email not to be sent")
+	repo.AssertExpectations(t)
+}
+
+func TestSendEmail_AccountEmailNotThrottled(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, types.EmailConfig{Enabled: true})
+
+	email := &types.Email{To: []string{"user@example.com"}, Subject: "Reset", Body: "Reset", Event: types.NotificationAccount}
+	repo.On("CreateEmail", mock.Anything, email).Return(nil).Once()
+
+	err := svc.Send(email)
+
+	assert.NoError(t, err)
+	assert.Equal(t, types.EmailQueued, email.Status)
+	assert.NotNil(t, email.NextAttemptAt)
+	repo.AssertNotCalled(t, "CreateEmailThrottled", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	repo.AssertExpectations(t)
+}
+
+func TestResendEmail_CopiesMessage(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockEmailRepo)
+	svc := NewEmailService(repo, types.EmailConfig{Enabled: true})
+	ctx := context.Background()
+
+	prev := queuedEmail()
+	prev.Status = types.EmailFailed
+	prev.Attempts = emailMaxAttempts
+	repo.On("GetEmail", ctx, prev.ID).Return(prev, nil).Once()
+	repo.On("CreateEmail", ctx, mock.Anything).Return(nil).Once()
+
+	email, err := svc.Resend(ctx, prev.ID)
+
+	assert.NoError(t, err)
+	assert.NotEqual(t, prev.ID, email.ID)
+	assert.Equal(t, prev.To, email.To)
+	assert.Equal(t, prev.Body, email.Body)
+	assert.Equal(t, types.EmailQueued, email.Status)
+	assert.Equal(t, 0, email.Attempts)
+	repo.AssertExpectations(t)
+}
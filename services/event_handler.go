@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+)
+
+// Outbox handlers, registered with OutboxService in main.
+// Each handler performs a single side effect, so a failure only retries that side effect.
+
+// NewCustomerNotificationHandler notifies customers when their orders and offers change
+func NewCustomerNotificationHandler(notificationService NotificationService) EventHandler {
+	return func(ctx context.Context, event types.DomainEvent) error {
+		switch event.Type {
+		case types.EventTypeOrderStatusChanged:
+			var change types.OrderStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			order := types.Order{ID: change.OrderID, UserID: change.UserID, Status: change.Status}
+			if change.Status == types.OrderPaid {
+				return notificationService.NotifyOrder(ctx, order.UserID, types.NotificationOrderConf, SubjectOrderConf, NotifyOrderConf, order)
+			}
+			return notificationService.NotifyOrder(ctx, order.UserID, types.NotificationOrderUpdates, SubjectOrderUpdate, NotifyOrderUpdate, order)
+
+		case types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged:
+			var change types.OfferStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			offer := types.Offer{ID: change.OfferID, UserID: change.UserID, Status: change.Status}
+			// an offer rejected for being below the price floor is an update rather than a confirmation
+			if event.Type == types.EventTypeOfferCreated && change.UpdatedBy != "" {
+				return notificationService.NotifyOffer(ctx, offer.UserID, types.NotificationOfferUpdates, SubjectOfferConf, NotifyOfferConf, offer)
+			}
+			// the customer made this change themselves
+			if event.Type == types.EventTypeOfferStatusChanged && change.UpdatedBy == change.UserID {
+				return nil
+			}
+			return notificationService.NotifyOffer(ctx, offer.UserID, types.NotificationOfferUpdates, SubjectOfferUpdate, NotifyOfferUpdate, offer)
+		}
+		return nil
+	}
+}
+
+// orderStatusEmail identifies the email sent to a customer when their order reaches a status
+type orderStatusEmail struct {
+	event    types.NotificationEvent
+	subject  string
+	template HtmlTemplate
+}
+
+var orderStatusEmails = map[types.OrderStatus]orderStatusEmail{
+	types.OrderPaid:      {types.NotificationOrderConf, SubjectOrderConf, EmailOrderConf},
+	types.OrderShipped:   {types.NotificationOrderUpdates, SubjectOrderShipped, EmailOrderShipped},
+	types.OrderDelivered: {types.NotificationOrderUpdates, SubjectOrderDeliv, EmailOrderDeliv},
+	types.OrderRefunded:  {types.NotificationOrderUpdates, SubjectOrderRefund, EmailOrderRefund},
+	types.OrderCanceled:  {types.NotificationOrderUpdates, SubjectOrderCancel, EmailOrderCancel},
+}
+
+// NewOrderEmailHandler emails customers the details of their order when its status changes
+func NewOrderEmailHandler(notificationService NotificationService, orderRepo repositories.OrderRepository) EventHandler {
+	return func(ctx context.Context, event types.DomainEvent) error {
+		if event.Type != types.EventTypeOrderStatusChanged {
+			return nil
+		}
+		var change types.OrderStatusChange
+		if err := json.Unmarshal(event.Payload, &change); err != nil {
+			return err
+		}
+		email, ok := orderStatusEmails[change.Status]
+		if !ok {
+			return nil
+		}
+
+		order, err := orderRepo.GetOrderByID(ctx, change.OrderID)
+		if err != nil {
+			return err
+		}
+		if order.Address.Email == "" {
+			return nil
+		}
+		// refunded and canceled orders no longer hold their items
+		if len(order.Items) == 0 {
+			order.Items = change.Items
+		}
+		return notificationService.EmailOrder(ctx, order.Address.Email, email.event, email.subject, email.template, order)
+	}
+}
+
+// NewAdminNotificationHandler notifies admins of paid orders, new offers, and offers the customer
+// responded to or which expired
+func NewAdminNotificationHandler(notificationService NotificationService, userService UserService) EventHandler {
+	return func(ctx context.Context, event types.DomainEvent) error {
+		switch event.Type {
+		case types.EventTypeOrderStatusChanged:
+			var change types.OrderStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			if change.Status != types.OrderPaid {
+				return nil
+			}
+			admins, err := userService.GetAllAdmins(ctx)
+			if err != nil {
+				return err
+			}
+			order := types.Order{ID: change.OrderID, UserID: change.UserID, Status: change.Status}
+			for _, admin := range admins {
+				if err := notificationService.NotifyOrder(ctx, admin.ID, types.NotificationOrderRecv, SubjectOrderRecv, NotifyOrderRecv, order); err != nil {
+					return err
+				}
+			}
+
+		case types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged:
+			var change types.OfferStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			subject, template := SubjectOfferRecv, NotifyOfferRecv
+			if event.Type == types.EventTypeOfferStatusChanged {
+				subject, template = SubjectOfferStatus, NotifyOfferStatus
+			}
+			// offers rejected below the price floor never reach admins, nor do changes made by admins
+			if change.UpdatedBy != change.UserID && change.Status != types.OfferExpired {
+				return nil
+			}
+			admins, err := userService.GetAllAdmins(ctx)
+			if err != nil {
+				return err
+			}
+			offer := types.Offer{ID: change.OfferID, UserID: change.UserID, Status: change.Status}
+			for _, admin := range admins {
+				if err := notificationService.NotifyOffer(ctx, admin.ID, types.NotificationOfferRecv, subject, template, offer); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// NewWebhookHandler publishes domain events to webhook subscribers.
+// The outbox event ID is used as the webhook event ID, so retries can be recognized by receivers.
+func NewWebhookHandler(webhookService WebhookService, orderRepo repositories.OrderRepository, offerRepo repositories.OfferRepository) EventHandler {
+	return func(ctx context.Context, event types.DomainEvent) error {
+		switch event.Type {
+		case types.EventTypeOrderStatusChanged:
+			var change types.OrderStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			webhookEvent := types.WebhookEvent("order." + string(change.Status))
+			if !webhookEvent.IsValid() {
+				return nil
+			}
+			order, err := orderRepo.GetOrderByID(ctx, change.OrderID)
+			if err != nil {
+				return err
+			}
+			return webhookService.Publish(ctx, event.ID, webhookEvent, order)
+
+		case types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged:
+			var change types.OfferStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			webhookEvent := types.EventOfferCreated
+			if event.Type == types.EventTypeOfferStatusChanged {
+				webhookEvent = types.WebhookEvent("offer." + string(change.Status))
+			}
+			if !webhookEvent.IsValid() {
+				return nil
+			}
+			offer, err := offerRepo.GetOfferByID(ctx, change.OfferID)
+			if err != nil {
+				return err
+			}
+			return webhookService.Publish(ctx, event.ID, webhookEvent, offer)
+
+		case types.EventTypeInventoryChanged:
+			var update types.InventoryUpdate
+			if err := json.Unmarshal(event.Payload, &update); err != nil {
+				return err
+			}
+			return webhookService.Publish(ctx, event.ID, types.EventInventoryUpdated, update)
+		}
+		return nil
+	}
+}
+
+// NewStreamHandler streams order and offer status changes to the customer they belong to
+func NewStreamHandler(streamService StreamService) EventHandler {
+	return func(ctx context.Context, event types.DomainEvent) error {
+		switch event.Type {
+		case types.EventTypeOrderStatusChanged:
+			var change types.OrderStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			change.Items = nil // removed items are only needed by emails
+			return streamService.Publish(ctx, change.UserID, types.StreamOrder, change)
+
+		case types.EventTypeOfferCreated, types.EventTypeOfferStatusChanged:
+			var change types.OfferStatusChange
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return err
+			}
+			return streamService.Publish(ctx, change.UserID, types.StreamOffer, change)
+		}
+		return nil
+	}
+}
@@ -1,7 +1,14 @@
 package services
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/dgyurics/marketplace/types"
@@ -17,28 +24,85 @@ import (
 type JWTService interface {
 	GenerateToken(user types.User) (string, error)
 	ParseToken(token string) (*types.User, error)
+	JWKS() (*types.JWKS, error)
 }
 
 type jwtService struct {
-	privateKey []byte // PEM-encoded RSA private key used for signing
-	publicKey  []byte // PEM-encoded RSA public key used for verification
-	expiry     time.Duration
+	privateKey         []byte   // PEM-encoded RSA private key used for signing
+	publicKey          []byte   // PEM-encoded RSA public key used for verification
+	previousPublicKeys [][]byte // PEM-encoded RSA public keys of rotated out signing keys
+	expiry             time.Duration
+
+	// parsed keys, cached on first use
+	once       sync.Once
+	keyErr     error
+	signingKey *rsa.PrivateKey
+	activeKid  string
+	verifyKeys map[string]*rsa.PublicKey // kid -> public key
 }
 
 // NewJWTService returns an implementation of JWTService
 func NewJWTService(config types.JWTConfig) JWTService {
 	return &jwtService{
-		privateKey: config.PrivateKey,
-		publicKey:  config.PublicKey,
-		expiry:     config.Expiry,
+		privateKey:         config.PrivateKey,
+		publicKey:          config.PublicKey,
+		previousPublicKeys: config.PreviousPublicKeys,
+		expiry:             config.Expiry,
 	}
 }
 
+// loadKeys parses the PEM-encoded keys once and caches the result.
+// Each key is identified by its RFC 7638 thumbprint, so key IDs never need to be configured.
+func (j *jwtService) loadKeys() error {
+	j.once.Do(func() {
+		signingKey, err := jwt.ParseRSAPrivateKeyFromPEM(j.privateKey)
+		if err != nil {
+			j.keyErr = err
+			return
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(j.publicKey)
+		if err != nil {
+			j.keyErr = err
+			return
+		}
+		if !signingKey.PublicKey.Equal(publicKey) {
+			j.keyErr = errors.New("public key does not match private key")
+			return
+		}
+
+		j.signingKey = signingKey
+		j.activeKid = keyID(publicKey)
+		j.verifyKeys = map[string]*rsa.PublicKey{j.activeKid: publicKey}
+		for _, pem := range j.previousPublicKeys {
+			key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+			if err != nil {
+				j.keyErr = err
+				return
+			}
+			j.verifyKeys[keyID(key)] = key
+		}
+	})
+	return j.keyErr
+}
+
+// keyID returns the base64url encoded RFC 7638 JWK thumbprint of an RSA public key
+func keyID(key *rsa.PublicKey) string {
+	// members in lexicographic order, no whitespace
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
 // GenerateToken creates a signed JWT containing the user's ID, email, and role.
-// The token is signed with the RSA private key so that any holder of the
+// The token is signed with the active RSA private key so that any holder of the
 // corresponding public key can verify authenticity without being able to
-// mint new tokens.
+// mint new tokens. The kid header identifies which key was used.
 func (j *jwtService) GenerateToken(user types.User) (string, error) {
+	if err := j.loadKeys(); err != nil {
+		return "", err
+	}
 	now := time.Now()
 	claims := jwt.MapClaims{
 		"user_id": user.ID,
@@ -48,21 +112,30 @@ func (j *jwtService) GenerateToken(user types.User) (string, error) {
 		"iat":     now.Unix(),
 	}
 	tokenUnsigned := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signingKey, err := jwt.ParseRSAPrivateKeyFromPEM(j.privateKey)
-	if err != nil {
-		return "", err
-	}
-	return tokenUnsigned.SignedString(signingKey)
+	tokenUnsigned.Header["kid"] = j.activeKid
+	return tokenUnsigned.SignedString(j.signingKey)
 }
 
-// ParseToken verifies the token signature using the RSA public key, checks
-// expiration, and extracts the embedded user claims.
+// ParseToken verifies the token signature using the public key matching its kid
+// header, checks expiration, and extracts the embedded user claims.
+// Tokens without a kid were issued before key rotation and are verified with the active key.
 func (j *jwtService) ParseToken(token string) (*types.User, error) {
+	if err := j.loadKeys(); err != nil {
+		return nil, err
+	}
 	tokenParsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, errors.New("unexpected signing method")
 		}
-		return jwt.ParseRSAPublicKeyFromPEM(j.publicKey)
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return j.verifyKeys[j.activeKid], nil
+		}
+		key, ok := j.verifyKeys[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return key, nil
 	})
 	if err != nil {
 		return nil, err
@@ -86,6 +159,36 @@ func (j *jwtService) ParseToken(token string) (*types.User, error) {
 	if role, ok := claims["role"].(string); ok {
 		user.Role = types.Role(role)
 	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		user.IssuedAt = iat.Time
+	}
 
 	return &user, nil
 }
+
+// JWKS returns the public keys accepted for verification in JSON Web Key Set format,
+// so other services can verify access tokens without access to this one.
+func (j *jwtService) JWKS() (*types.JWKS, error) {
+	if err := j.loadKeys(); err != nil {
+		return nil, err
+	}
+	jwks := &types.JWKS{Keys: make([]types.JWK, 0, len(j.verifyKeys))}
+	for kid, key := range j.verifyKeys {
+		jwks.Keys = append(jwks.Keys, types.JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	// active key first, remaining keys in a stable order
+	sort.Slice(jwks.Keys, func(a, b int) bool {
+		if jwks.Keys[a].Kid == j.activeKid || jwks.Keys[b].Kid == j.activeKid {
+			return jwks.Keys[a].Kid == j.activeKid
+		}
+		return jwks.Keys[a].Kid < jwks.Keys[b].Kid
+	})
+	return jwks, nil
+}
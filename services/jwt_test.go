@@ -1,12 +1,17 @@
 package services_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
 	"time"
 
 	"github.com/dgyurics/marketplace/services"
 	"github.com/dgyurics/marketplace/types"
 	"github.com/dgyurics/marketplace/utilities"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -114,3 +119,90 @@ func TestParseToken_ExpiredToken(t *testing.T) {
 	assert.Error(t, err, "expected an error due to token expiration")
 	assert.Nil(t, parsedUser, "expected nil user for expired token")
 }
+
+// generateKeyPair creates a PEM-encoded RSA keypair for rotation tests
+func generateKeyPair(t *testing.T) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	priv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return priv, pub
+}
+
+func TestGenerateToken_KidHeader(t *testing.T) {
+	service := createJWTService()
+	user := types.User{ID: "123", Role: "user"}
+
+	token, err := service.GenerateToken(user)
+	assert.NoError(t, err)
+
+	jwks, err := service.JWKS()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 1)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, jwks.Keys[0].Kid, parsed.Header["kid"])
+}
+
+func TestParseToken_PreviousKey(t *testing.T) {
+	newPriv, newPub := generateKeyPair(t)
+	user := types.User{ID: "123", Role: "user"}
+
+	// token issued before rotation
+	oldService := createJWTService()
+	token, err := oldService.GenerateToken(user)
+	assert.NoError(t, err)
+
+	rotated := services.NewJWTService(types.JWTConfig{
+		PrivateKey:         newPriv,
+		PublicKey:          newPub,
+		PreviousPublicKeys: [][]byte{[]byte(publicKey)},
+		Expiry:             expiry,
+	})
+	parsedUser, err := rotated.ParseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, parsedUser.ID)
+
+	jwks, err := rotated.JWKS()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 2)
+}
+
+func TestParseToken_RetiredKey(t *testing.T) {
+	newPriv, newPub := generateKeyPair(t)
+	user := types.User{ID: "123", Role: "user"}
+
+	token, err := createJWTService().GenerateToken(user)
+	assert.NoError(t, err)
+
+	// previous key no longer configured
+	rotated := services.NewJWTService(types.JWTConfig{
+		PrivateKey: newPriv,
+		PublicKey:  newPub,
+		Expiry:     expiry,
+	})
+	parsedUser, err := rotated.ParseToken(token)
+	assert.Error(t, err)
+	assert.Nil(t, parsedUser)
+}
+
+func TestParseToken_WithoutKid(t *testing.T) {
+	service := createJWTService()
+
+	// tokens issued before kid headers were added
+	signingKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKey))
+	assert.NoError(t, err)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"user_id": "123",
+		"role":    "user",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString(signingKey)
+	assert.NoError(t, err)
+
+	parsedUser, err := service.ParseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "123", parsedUser.ID)
+}
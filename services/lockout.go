@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+)
+
+// lockoutPolicy controls when a subject is locked and for how long.
+// Once failures reach threshold, each further failure doubles the lock
+// duration, starting at base and capped at max.
+type lockoutPolicy struct {
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	window    time.Duration // failures older than window are forgotten
+}
+
+var lockoutPolicies = map[types.LockoutScope]lockoutPolicy{
+	types.LockoutLogin:         {threshold: 5, base: time.Minute, max: time.Hour, window: 24 * time.Hour},
+	types.LockoutPasswordReset: {threshold: 5, base: 15 * time.Minute, max: 6 * time.Hour, window: 24 * time.Hour},
+	types.LockoutRegistration:  {threshold: 5, base: 15 * time.Minute, max: 6 * time.Hour, window: 24 * time.Hour},
+}
+
+// LockoutService tracks failed attempts per subject (account, email or IP)
+// and temporarily locks the subject out after repeated failures.
+type LockoutService interface {
+	Check(ctx context.Context, scope types.LockoutScope, subject string) (time.Duration, error)
+	RecordFailure(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error)
+	Reset(ctx context.Context, scope types.LockoutScope, subject string) error
+	GetLockout(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error)
+}
+
+type lockoutService struct {
+	repo repositories.LockoutRepository
+}
+
+func NewLockoutService(repo repositories.LockoutRepository) LockoutService {
+	return &lockoutService{repo: repo}
+}
+
+// Check returns the remaining lock duration for the subject, or zero when not locked.
+func (s *lockoutService) Check(ctx context.Context, scope types.LockoutScope, subject string) (time.Duration, error) {
+	lockout, err := s.repo.GetLockout(ctx, scope, subject)
+	if err == types.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if lockout.LockedUntil == nil {
+		return 0, nil
+	}
+	if remaining := time.Until(*lockout.LockedUntil); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// RecordFailure records a failed attempt. When the failure locks the subject,
+// the returned Lockout has LockedUntil set to a time in the future.
+func (s *lockoutService) RecordFailure(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error) {
+	policy := lockoutPolicies[scope]
+	lockout, err := s.repo.RecordFailure(ctx, scope, subject, policy.window)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := lockDuration(policy, lockout.Failures)
+	if duration == 0 {
+		lockout.LockedUntil = nil
+		return lockout, nil
+	}
+
+	lockedUntil := time.Now().UTC().Add(duration)
+	if err := s.repo.SetLockedUntil(ctx, scope, subject, lockedUntil); err != nil {
+		return nil, err
+	}
+	lockout.LockedUntil = &lockedUntil
+	return lockout, nil
+}
+
+// Reset clears the failure count, e.g. after a successful attempt or admin unlock.
+func (s *lockoutService) Reset(ctx context.Context, scope types.LockoutScope, subject string) error {
+	return s.repo.RemoveLockout(ctx, scope, subject)
+}
+
+func (s *lockoutService) GetLockout(ctx context.Context, scope types.LockoutScope, subject string) (*types.Lockout, error) {
+	return s.repo.GetLockout(ctx, scope, subject)
+}
+
+// lockDuration computes the exponential backoff for the given failure count
+func lockDuration(policy lockoutPolicy, failures int) time.Duration {
+	if policy.threshold == 0 || failures < policy.threshold {
+		return 0
+	}
+	duration := policy.base
+	for i := policy.threshold; i < failures; i++ {
+		duration *= 2
+		if duration >= policy.max {
+			return policy.max
+		}
+	}
+	return duration
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockDuration(t *testing.T) {
+	policy := lockoutPolicy{threshold: 5, base: time.Minute, max: time.Hour}
+
+	assert.Equal(t, time.Duration(0), lockDuration(policy, 1))
+	assert.Equal(t, time.Duration(0), lockDuration(policy, 4))
+	assert.Equal(t, time.Minute, lockDuration(policy, 5))
+	assert.Equal(t, 2*time.Minute, lockDuration(policy, 6))
+	assert.Equal(t, 32*time.Minute, lockDuration(policy, 10))
+	assert.Equal(t, time.Hour, lockDuration(policy, 11))
+	assert.Equal(t, time.Hour, lockDuration(policy, 100))
+}
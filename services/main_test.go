@@ -10,6 +10,7 @@ import (
 func TestMain(m *testing.M) {
 	// Initialize ID generator
 	utilities.InitIDGenerator(99)
+	utilities.InitLocale("US")
 
 	// Run tests
 	code := m.Run()
@@ -2,33 +2,73 @@ package services
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
+	"strings"
 
+	"github.com/dgyurics/marketplace/repositories"
 	"github.com/dgyurics/marketplace/types"
 )
 
 type NotificationService interface {
 	BaseURL() string
-	Notify(to, subject string, template HtmlTemplate, data interface{}) error
-	NotifyOffer(to, subject string, template HtmlTemplate, offer types.Offer) error
-	NotifyOrder(to, subject string, template HtmlTemplate, order types.Order) error
+	Dispatch(ctx context.Context, n Notification) error
+	NotifyOffer(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, offer types.Offer) error
+	NotifyOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error
+	EmailOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error
 	SendEmail(to, subject string, template HtmlTemplate, data interface{}) error
+	// preferences
+	GetPreferences(ctx context.Context) (types.NotificationSettings, error)
+	UpdatePreferences(ctx context.Context, prefs []types.NotificationPreference) (types.NotificationSettings, error)
+	SetWebhook(ctx context.Context, url string) (types.Webhook, error)
+	RemoveWebhook(ctx context.Context) error
+	Unsubscribe(ctx context.Context, token string) error
+}
+
+// Notification is sent to a user on each channel offered which they have enabled for the event
+type Notification struct {
+	UserID    string // recipient, empty for emails to an address without an account
+	Email     string // recipient address, defaults to the user's email
+	Event     types.NotificationEvent
+	Subject   string
+	Templates map[types.NotificationChannel]HtmlTemplate // channels offered, and the template rendered for each
+	Data      interface{}
 }
 
 type notificationService struct {
 	emailService        EmailService
 	templateService     TemplateService
 	conversationService ConversationService
+	webhookService      WebhookService
+	notificationRepo    repositories.NotificationRepository
+	userRepo            repositories.UserRepository
 	baseURL             string
+	hmacSecret          []byte // signs unsubscribe links
 }
 
-func NewNotificationService(emailService EmailService, templateService TemplateService, conversationService ConversationService, baseURL string) NotificationService {
+func NewNotificationService(
+	emailService EmailService,
+	templateService TemplateService,
+	conversationService ConversationService,
+	webhookService WebhookService,
+	notificationRepo repositories.NotificationRepository,
+	userRepo repositories.UserRepository,
+	baseURL string,
+	hmacSecret []byte) NotificationService {
 	return &notificationService{
 		emailService:        emailService,
 		templateService:     templateService,
 		conversationService: conversationService,
+		webhookService:      webhookService,
+		notificationRepo:    notificationRepo,
+		userRepo:            userRepo,
 		baseURL:             baseURL,
+		hmacSecret:          hmacSecret,
 	}
 }
 
@@ -36,34 +76,78 @@ func (s *notificationService) BaseURL() string {
 	return s.baseURL
 }
 
-func (s *notificationService) SendEmail(to, subject string, template HtmlTemplate, data interface{}) error {
-	htmlBody, err := s.templateService.RenderHtmlToString(template, data)
+// Dispatch sends a notification on every channel it is offered on, which the user has enabled for its event.
+// Account notifications are always emailed. The subject is translated to the storefront language.
+func (s *notificationService) Dispatch(ctx context.Context, n Notification) error {
+	enabled, err := s.channels(ctx, n.UserID, n.Event)
 	if err != nil {
-		slog.Error("Error loading email template: ", "template", template, "error", err)
 		return err
 	}
-	email := &types.Email{
-		To:      []string{to},
-		Subject: subject,
-		Body:    htmlBody,
-		IsHTML:  true,
+	n.Subject = s.templateService.Translate(n.Subject)
+
+	var errs []error
+	for _, channel := range types.NotificationChannels {
+		template, ok := n.Templates[channel]
+		if !ok || !enabled[channel] {
+			continue
+		}
+		switch channel {
+		case types.ChannelInbox:
+			err = s.inbox(n, template)
+		case types.ChannelEmail:
+			err = s.email(ctx, n, template)
+		case types.ChannelWebhook:
+			err = s.webhook(ctx, n, template)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+		}
 	}
-	return s.emailService.Send(email)
+	return errors.Join(errs...)
+}
+
+// channels returns the channels enabled for the event, applying the user's preferences over the defaults
+func (s *notificationService) channels(ctx context.Context, userID string, event types.NotificationEvent) (map[types.NotificationChannel]bool, error) {
+	enabled := map[types.NotificationChannel]bool{}
+	if event == types.NotificationAccount {
+		enabled[types.ChannelEmail] = true
+		return enabled, nil
+	}
+	for _, channel := range types.DefaultNotificationChannels[event] {
+		enabled[channel] = true
+	}
+	if userID == "" {
+		return enabled, nil
+	}
+	prefs, err := s.notificationRepo.GetPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, pref := range prefs {
+		if pref.Event == event {
+			enabled[pref.Channel] = pref.Enabled
+		}
+	}
+	return enabled, nil
 }
 
-func (s *notificationService) Notify(to, subject string, template HtmlTemplate, data interface{}) error {
+// inbox creates a conversation in the user's inbox holding the notification
+func (s *notificationService) inbox(n Notification, template HtmlTemplate) error {
+	if n.UserID == "" {
+		return nil
+	}
 	ctx := systemContext()
 
 	conv := &types.Conversation{
-		RecipientID: to,
+		RecipientID: n.UserID,
 		Type:        types.Notification,
-		Subject:     subject,
+		Subject:     n.Subject,
 	}
 	if err := s.conversationService.CreateConversation(ctx, conv); err != nil {
 		return err
 	}
 
-	body, err := s.templateService.RenderHtmlToString(template, data)
+	body, err := s.templateService.RenderHtmlToString(ctx, template, n.Data)
 	if err != nil {
 		return err
 	}
@@ -76,15 +160,102 @@ func (s *notificationService) Notify(to, subject string, template HtmlTemplate,
 	return s.conversationService.CreateMessage(ctx, msg)
 }
 
+// email queues the notification for delivery by email.
+// Emails other than account emails link to unsubscribe without logging in.
+func (s *notificationService) email(ctx context.Context, n Notification, template HtmlTemplate) error {
+	to := n.Email
+	if to == "" && n.UserID != "" {
+		usr, err := s.userRepo.GetUserByID(ctx, n.UserID)
+		if err != nil {
+			return err
+		}
+		if usr.Email != nil {
+			to = *usr.Email
+		}
+	}
+	if to == "" {
+		return nil
+	}
+
+	body, err := s.templateService.RenderHtmlToString(ctx, template, n.Data)
+	if err != nil {
+		slog.Error("Error loading email template: ", "template", template, "error", err)
+		return err
+	}
+	email := &types.Email{
+		To:       []string{to},
+		Subject:  n.Subject,
+		Body:     body,
+		IsHTML:   true,
+		Template: string(template),
+		Event:    n.Event,
+	}
+	if n.Event != types.NotificationAccount && n.UserID != "" {
+		email.ListUnsubscribe = s.unsubscribeLink(n.UserID, n.Event, types.ChannelEmail)
+		footer, err := s.templateService.RenderHtmlToString(ctx, EmailFooter, map[string]string{
+			"UnsubscribeLink": email.ListUnsubscribe,
+			"PreferencesLink": s.baseURL + "/profile",
+		})
+		if err != nil {
+			return err
+		}
+		email.Body = appendFooter(email.Body, footer)
+	}
+	return s.emailService.Send(email)
+}
+
+// appendFooter places the footer at the end of the HTML body
+func appendFooter(body, footer string) string {
+	if i := strings.LastIndex(body, "</body>"); i >= 0 {
+		return body[:i] + footer + body[i:]
+	}
+	return body + footer
+}
+
+// webhook queues delivery of the notification to the user's webhook, rendered as in the inbox
+func (s *notificationService) webhook(ctx context.Context, n Notification, template HtmlTemplate) error {
+	if n.UserID == "" {
+		return nil
+	}
+	body, err := s.templateService.RenderHtmlToString(ctx, template, n.Data)
+	if err != nil {
+		return err
+	}
+	return s.webhookService.PublishToUser(ctx, n.UserID, types.NotificationPayload{
+		Event:   n.Event,
+		Subject: n.Subject,
+		Body:    body,
+	})
+}
+
+// SendEmail sends an account email, such as a password reset, which cannot be unsubscribed from
+func (s *notificationService) SendEmail(to, subject string, template HtmlTemplate, data interface{}) error {
+	return s.Dispatch(context.Background(), Notification{
+		Email:     to,
+		Event:     types.NotificationAccount,
+		Subject:   subject,
+		Templates: map[types.NotificationChannel]HtmlTemplate{types.ChannelEmail: template},
+		Data:      data,
+	})
+}
+
 const systemUserID = "1"
 
 func systemContext() context.Context {
 	return context.WithValue(context.Background(), UserKey, &types.User{ID: systemUserID, Role: "system"})
 }
 
-func (s *notificationService) NotifyOffer(to, subject string, template HtmlTemplate, offer types.Offer) error {
+// inboxTemplates offers a notification in the inbox, and to the user's webhook
+func inboxTemplates(template HtmlTemplate) map[types.NotificationChannel]HtmlTemplate {
+	return map[types.NotificationChannel]HtmlTemplate{
+		types.ChannelInbox:   template,
+		types.ChannelWebhook: template,
+	}
+}
+
+func (s *notificationService) NotifyOffer(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, offer types.Offer) error {
 	path := "offers"
-	if template == NotifyOfferRecv {
+	if template == NotifyOfferRecv || template == NotifyOfferStatus {
 		path = "admin/offers"
 	}
 	detailsLink := fmt.Sprintf("%s/%s/%s", s.baseURL, path, offer.ID)
@@ -94,7 +265,14 @@ func (s *notificationService) NotifyOffer(to, subject string, template HtmlTempl
 	}
 
 	// Send the actual notification out
-	if err := s.Notify(to, subject, template, data); err != nil {
+	err := s.Dispatch(ctx, Notification{
+		UserID:    to,
+		Event:     event,
+		Subject:   subject,
+		Templates: inboxTemplates(template),
+		Data:      data,
+	})
+	if err != nil {
 		slog.Error("Error sending offer notification: ", "offer_id", offer.ID, "user_id", offer.UserID, "error", err)
 		return err
 	}
@@ -102,7 +280,7 @@ func (s *notificationService) NotifyOffer(to, subject string, template HtmlTempl
 	return nil
 }
 
-func (s *notificationService) NotifyOrder(to, subject string, template HtmlTemplate, order types.Order) error {
+func (s *notificationService) NotifyOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error {
 	path := "orders"
 	if template == NotifyOrderRecv {
 		path = "admin/orders"
@@ -114,10 +292,181 @@ func (s *notificationService) NotifyOrder(to, subject string, template HtmlTempl
 	}
 
 	// Send the actual notification out
-	if err := s.Notify(to, subject, template, data); err != nil {
+	err := s.Dispatch(ctx, Notification{
+		UserID:    to,
+		Event:     event,
+		Subject:   subject,
+		Templates: inboxTemplates(template),
+		Data:      data,
+	})
+	if err != nil {
 		slog.Error("Error sending order notification: ", "order_id", order.ID, "user_id", order.UserID, "error", err)
 		return err
 	}
 
 	return nil
 }
+
+// orderEmail is the data rendered by the order email templates
+type orderEmail struct {
+	Order       types.Order
+	Items       []orderEmailItem
+	DetailsLink string
+}
+
+type orderEmailItem struct {
+	Name      string
+	Thumbnail string
+	AltText   string
+	Quantity  int
+	UnitPrice int64
+	Total     int64
+}
+
+// EmailOrder emails a customer the details of their order, if they have email enabled for the event
+func (s *notificationService) EmailOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error {
+	data := orderEmail{
+		Order:       order,
+		Items:       make([]orderEmailItem, 0, len(order.Items)),
+		DetailsLink: fmt.Sprintf("%s/orders/%s", s.baseURL, order.ID),
+	}
+	for _, item := range order.Items {
+		thumbnail := item.Thumbnail
+		if strings.HasPrefix(thumbnail, "/") {
+			thumbnail = s.baseURL + thumbnail
+		}
+		data.Items = append(data.Items, orderEmailItem{
+			Name:      item.Product.Name,
+			Thumbnail: thumbnail,
+			AltText:   item.AltText,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Total:     item.UnitPrice * int64(item.Quantity),
+		})
+	}
+
+	err := s.Dispatch(ctx, Notification{
+		UserID:    order.UserID,
+		Email:     to,
+		Event:     event,
+		Subject:   subject,
+		Templates: map[types.NotificationChannel]HtmlTemplate{types.ChannelEmail: template},
+		Data:      data,
+	})
+	if err != nil {
+		slog.Error("Error sending order email: ", "order_id", order.ID, "user_id", order.UserID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// GetPreferences returns the authenticated user's preference for every event and channel, and their webhook
+func (s *notificationService) GetPreferences(ctx context.Context) (types.NotificationSettings, error) {
+	userID := getUserID(ctx)
+	stored, err := s.notificationRepo.GetPreferences(ctx, userID)
+	if err != nil {
+		return types.NotificationSettings{}, err
+	}
+	settings := types.NotificationSettings{Preferences: mergePreferences(stored)}
+
+	webhook, err := s.webhookService.GetUserWebhook(ctx, userID)
+	if err == nil {
+		settings.Webhook = &webhook
+	} else if err != types.ErrNotFound {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// mergePreferences lists every event and channel, using the stored preference or the default
+func mergePreferences(stored []types.NotificationPreference) []types.NotificationPreference {
+	prefs := []types.NotificationPreference{}
+	for _, event := range types.NotificationEvents {
+		for _, channel := range types.NotificationChannels {
+			pref := types.NotificationPreference{Event: event, Channel: channel}
+			for _, c := range types.DefaultNotificationChannels[event] {
+				pref.Enabled = pref.Enabled || c == channel
+			}
+			for _, p := range stored {
+				if p.Event == event && p.Channel == channel {
+					pref.Enabled = p.Enabled
+				}
+			}
+			prefs = append(prefs, pref)
+		}
+	}
+	return prefs
+}
+
+// UpdatePreferences stores the authenticated user's preferences. Events and channels not given are unchanged.
+func (s *notificationService) UpdatePreferences(ctx context.Context, prefs []types.NotificationPreference) (types.NotificationSettings, error) {
+	for _, pref := range prefs {
+		if !pref.Event.IsValid() || !pref.Channel.IsValid() {
+			return types.NotificationSettings{}, types.ErrInvalidInput
+		}
+	}
+	if err := s.notificationRepo.SetPreferences(ctx, getUserID(ctx), prefs); err != nil {
+		return types.NotificationSettings{}, err
+	}
+	return s.GetPreferences(ctx)
+}
+
+// SetWebhook replaces the webhook the authenticated user receives notifications at
+func (s *notificationService) SetWebhook(ctx context.Context, url string) (types.Webhook, error) {
+	return s.webhookService.SetUserWebhook(ctx, getUserID(ctx), url)
+}
+
+func (s *notificationService) RemoveWebhook(ctx context.Context) error {
+	return s.webhookService.RemoveUserWebhook(ctx, getUserID(ctx))
+}
+
+// Unsubscribe disables the channel and event of a signed unsubscribe token, without logging in
+func (s *notificationService) Unsubscribe(ctx context.Context, token string) error {
+	userID, event, channel, err := s.parseUnsubscribeToken(token)
+	if err != nil {
+		return err
+	}
+	return s.notificationRepo.SetPreferences(ctx, userID, []types.NotificationPreference{
+		{Event: event, Channel: channel, Enabled: false},
+	})
+}
+
+// unsubscribeLink links to the API endpoint which unsubscribes without logging in
+func (s *notificationService) unsubscribeLink(userID string, event types.NotificationEvent, channel types.NotificationChannel) string {
+	return s.baseURL + "/api/notifications/unsubscribe?token=" + url.QueryEscape(s.unsubscribeToken(userID, event, channel))
+}
+
+// unsubscribeToken signs the user, event and channel to unsubscribe from.
+// Tokens do not expire, so links in old emails keep working.
+func (s *notificationService) unsubscribeToken(userID string, event types.NotificationEvent, channel types.NotificationChannel) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userID + ":" + string(event) + ":" + string(channel)))
+	return payload + "." + s.signUnsubscribe(payload)
+}
+
+func (s *notificationService) parseUnsubscribeToken(token string) (string, types.NotificationEvent, types.NotificationChannel, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signUnsubscribe(payload))) {
+		return "", "", "", types.ErrInvalidInput
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", "", types.ErrInvalidInput
+	}
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 3 {
+		return "", "", "", types.ErrInvalidInput
+	}
+	event, channel := types.NotificationEvent(parts[1]), types.NotificationChannel(parts[2])
+	if parts[0] == "" || !event.IsValid() || !channel.IsValid() {
+		return "", "", "", types.ErrInvalidInput
+	}
+	return parts[0], event, channel, nil
+}
+
+// signUnsubscribe returns the HMAC-SHA256 of the payload.
+// The secret is shared with other signatures, so the purpose is included in the signed data.
+func (s *notificationService) signUnsubscribe(payload string) string {
+	mac := hmac.New(sha256.New, s.hmacSecret)
+	mac.Write([]byte("unsubscribe:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
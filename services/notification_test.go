@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockNotificationRepo struct {
+	mock.Mock
+}
+
+func (m *mockNotificationRepo) GetPreferences(ctx context.Context, userID string) ([]types.NotificationPreference, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).([]types.NotificationPreference), args.Error(1)
+}
+
+func (m *mockNotificationRepo) SetPreferences(ctx context.Context, userID string, prefs []types.NotificationPreference) error {
+	args := m.Called(ctx, userID, prefs)
+	return args.Error(0)
+}
+
+type mockEmailSender struct {
+	mock.Mock
+	EmailService
+}
+
+func (m *mockEmailSender) Send(email *types.Email) error {
+	args := m.Called(email)
+	return args.Error(0)
+}
+
+type mockConversationService struct {
+	mock.Mock
+	ConversationService
+}
+
+func (m *mockConversationService) CreateConversation(ctx context.Context, conversation *types.Conversation) error {
+	args := m.Called(ctx, conversation)
+	return args.Error(0)
+}
+
+func (m *mockConversationService) CreateMessage(ctx context.Context, message *types.Message) error {
+	args := m.Called(ctx, message)
+	return args.Error(0)
+}
+
+type mockUserWebhookService struct {
+	mock.Mock
+	WebhookService
+}
+
+func (m *mockUserWebhookService) PublishToUser(ctx context.Context, userID string, data interface{}) error {
+	args := m.Called(ctx, userID, data)
+	return args.Error(0)
+}
+
+type notificationMocks struct {
+	repo          *mockNotificationRepo
+	emails        *mockEmailSender
+	conversations *mockConversationService
+	webhooks      *mockUserWebhookService
+}
+
+func newTestNotificationService(t *testing.T) (*notificationService, notificationMocks) {
+	templates, err := newTemplateService("../utilities/templates", "en-US")
+	assert.NoError(t, err, "Loading templates should not return an error")
+
+	mocks := notificationMocks{
+		repo:          new(mockNotificationRepo),
+		emails:        new(mockEmailSender),
+		conversations: new(mockConversationService),
+		webhooks:      new(mockUserWebhookService),
+	}
+	svc := NewNotificationService(mocks.emails, templates, mocks.conversations, mocks.webhooks,
+		mocks.repo, new(mockUserLookupRepo), "https://example.com", []byte("secret"))
+	return svc.(*notificationService), mocks
+}
+
+func TestDispatch_DefaultChannels(t *testing.T) {
+	svc, mocks := newTestNotificationService(t)
+	mocks.repo.On("GetPreferences", mock.Anything, "7").Return([]types.NotificationPreference{}, nil)
+	mocks.conversations.On("CreateConversation", mock.Anything, mock.Anything).Return(nil).Once()
+	mocks.conversations.On("CreateMessage", mock.Anything, mock.Anything).Return(nil).Once()
+	mocks.webhooks.On("PublishToUser", mock.Anything, "7", mock.Anything).Return(nil).Once()
+
+	order := types.Order{ID: "42", UserID: "7", Status: types.OrderShipped}
+	err := svc.NotifyOrder(context.Background(), "7", types.NotificationOrderUpdates, SubjectOrderUpdate, NotifyOrderUpdate, order)
+
+	assert.NoError(t, err)
+	mocks.conversations.AssertExpectations(t)
+	mocks.webhooks.AssertExpectations(t)
+}
+
+func TestDispatch_HonorsPreferences(t *testing.T) {
+	svc, mocks := newTestNotificationService(t)
+	mocks.repo.On("GetPreferences", mock.Anything, "7").Return([]types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelInbox, Enabled: false},
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelWebhook, Enabled: true},
+	}, nil)
+	mocks.webhooks.On("PublishToUser", mock.Anything, "7", mock.MatchedBy(func(p types.NotificationPayload) bool {
+		return p.Event == types.NotificationOrderUpdates && strings.Contains(p.Body, "shipped")
+	})).Return(nil).Once()
+
+	order := types.Order{ID: "42", UserID: "7", Status: types.OrderShipped}
+	err := svc.NotifyOrder(context.Background(), "7", types.NotificationOrderUpdates, SubjectOrderUpdate, NotifyOrderUpdate, order)
+
+	assert.NoError(t, err)
+	mocks.webhooks.AssertExpectations(t)
+	mocks.conversations.AssertNotCalled(t, "CreateConversation", mock.Anything, mock.Anything)
+}
+
+func TestDispatch_EmailDisabled(t *testing.T) {
+	svc, mocks := newTestNotificationService(t)
+	mocks.repo.On("GetPreferences", mock.Anything, "7").Return([]types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelEmail, Enabled: false},
+	}, nil)
+
+	order := types.Order{ID: "42", UserID: "7", Status: types.OrderShipped}
+	err := svc.EmailOrder(context.Background(), "customer@example.com", types.NotificationOrderUpdates, SubjectOrderShipped, EmailOrderShipped, order)
+
+	assert.NoError(t, err)
+	mocks.emails.AssertNotCalled(t, "Send", mock.Anything)
+}
+
+func TestDispatch_EmailUnsubscribeLink(t *testing.T) {
+	svc, mocks := newTestNotificationService(t)
+	mocks.repo.On("GetPreferences", mock.Anything, "7").Return([]types.NotificationPreference{}, nil)
+	var sent *types.Email
+	mocks.emails.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		sent = args.Get(0).(*types.Email)
+	}).Return(nil).Once()
+
+	order := types.Order{ID: "42", UserID: "7", Status: types.OrderShipped}
+	err := svc.EmailOrder(context.Background(), "customer@example.com", types.NotificationOrderUpdates, SubjectOrderShipped, EmailOrderShipped, order)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"customer@example.com"}, sent.To)
+	assert.True(t, strings.HasPrefix(sent.ListUnsubscribe, "https://example.com/api/notifications/unsubscribe?token="))
+	assert.Contains(t, sent.Body, "Unsubscribe")
+	assert.Less(t, strings.Index(sent.Body, "Unsubscribe"), strings.Index(sent.Body, "</body>"), "Expected footer inside the body")
+
+	// the link unsubscribes from order update emails only
+	link, err := url.Parse(sent.ListUnsubscribe)
+	assert.NoError(t, err)
+	mocks.repo.On("SetPreferences", mock.Anything, "7", []types.NotificationPreference{
+		{Event: types.NotificationOrderUpdates, Channel: types.ChannelEmail, Enabled: false},
+	}).Return(nil).Once()
+	assert.NoError(t, svc.Unsubscribe(context.Background(), link.Query().Get("token")))
+	mocks.repo.AssertExpectations(t)
+}
+
+func TestDispatch_AccountEmailAlwaysSent(t *testing.T) {
+	svc, mocks := newTestNotificationService(t)
+	var sent *types.Email
+	mocks.emails.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		sent = args.Get(0).(*types.Email)
+	}).Return(nil).Once()
+
+	err := svc.SendEmail("customer@example.com", SubjectPasswordReset, EmailPasswordReset, map[string]string{"ResetLink": "https://example.com/reset"})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sent.ListUnsubscribe, "Expected account emails not to be unsubscribable")
+	mocks.repo.AssertNotCalled(t, "GetPreferences", mock.Anything, mock.Anything)
+}
+
+func TestUnsubscribe_RejectsInvalidToken(t *testing.T) {
+	svc, _ := newTestNotificationService(t)
+	token := svc.unsubscribeToken("7", types.NotificationOrderUpdates, types.ChannelEmail)
+	payload, _, _ := strings.Cut(token, ".")
+
+	other := *svc
+	other.hmacSecret = []byte("other")
+	forged := other.unsubscribeToken("8", types.NotificationOrderUpdates, types.ChannelEmail)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []string{
+		"",
+		payload,
+		forged,
+		forgedPayload + "." + strings.TrimPrefix(token, payload+"."),
+		svc.unsubscribeToken("7", types.NotificationAccount, types.ChannelEmail),
+	}
+	for _, token := range tests {
+		_, _, _, err := svc.parseUnsubscribeToken(token)
+		assert.Equal(t, types.ErrInvalidInput, err, "Expected token %q to be rejected", token)
+	}
+}
+
+func TestMergePreferences(t *testing.T) {
+	prefs := mergePreferences([]types.NotificationPreference{
+		{Event: types.NotificationOrderConf, Channel: types.ChannelEmail, Enabled: false},
+		{Event: types.NotificationOfferUpdates, Channel: types.ChannelWebhook, Enabled: true},
+	})
+
+	assert.Len(t, prefs, len(types.NotificationEvents)*len(types.NotificationChannels))
+	enabled := map[types.NotificationPreference]bool{}
+	for _, pref := range prefs {
+		enabled[types.NotificationPreference{Event: pref.Event, Channel: pref.Channel}] = pref.Enabled
+	}
+	assert.True(t, enabled[types.NotificationPreference{Event: types.NotificationOrderConf, Channel: types.ChannelInbox}])
+	assert.False(t, enabled[types.NotificationPreference{Event: types.NotificationOrderConf, Channel: types.ChannelEmail}])
+	assert.True(t, enabled[types.NotificationPreference{Event: types.NotificationOfferUpdates, Channel: types.ChannelWebhook}])
+	assert.False(t, enabled[types.NotificationPreference{Event: types.NotificationOrderRecv, Channel: types.ChannelEmail}])
+	assert.True(t, enabled[types.NotificationPreference{Event: types.NotificationOrderRecv, Channel: types.ChannelWebhook}])
+}
@@ -2,15 +2,33 @@ package services
 
 import (
 	"context"
+	"time"
 
 	"github.com/dgyurics/marketplace/repositories"
 	"github.com/dgyurics/marketplace/types"
 	"github.com/dgyurics/marketplace/utilities"
 )
 
+const (
+	offerExpiry         = 72 * time.Hour // time an open offer awaits a response before expiring
+	offerCheckoutWindow = 48 * time.Hour // time an accepted offer awaits payment before expiring
+	offerExpiryBatch    = 100            // offers expired per transaction
+)
+
+// OfferService negotiates offers between buyers and admins. The buyer makes an offer, which an admin
+// accepts, rejects or counters, and the buyer then accepts, cancels or counters again.
+// Open offers expire when left unanswered, and offers below a product's floor are rejected automatically.
+// An accepted offer reserves a unit for the buyer to check out at its amount, until paid or expired.
 type OfferService interface {
 	CreateOffer(ctx context.Context, offer *types.Offer) error
 	UpdateOffer(ctx context.Context, offer *types.Offer) error
+	CounterOffer(ctx context.Context, offer *types.Offer) error
+	CounterOfferOwner(ctx context.Context, offer *types.Offer) error
+	RespondToOffer(ctx context.Context, offer *types.Offer) error
+	ExpireOffers(ctx context.Context) (int, error)
+	GetCheckoutItem(ctx context.Context, id string) (types.CartItem, error)
+	GetOfferFloor(ctx context.Context, productID string) (types.OfferFloor, error)
+	SetOfferFloor(ctx context.Context, floor *types.OfferFloor) error
 	GetOfferByID(ctx context.Context, id string) (types.Offer, error)
 	GetOfferByIDAndUser(ctx context.Context, id string) (types.Offer, error)
 	GetOffersByProductID(ctx context.Context, id string) ([]types.Offer, error)
@@ -20,59 +38,158 @@ type OfferService interface {
 func NewOfferService(
 	repoProduct repositories.ProductRepository,
 	repoOffer repositories.OfferRepository,
-	userService UserService,
 	productService ProductService,
-	notificationService NotificationService,
 ) OfferService {
 	return &offerService{
-		repoOffer:           repoOffer,
-		repoProduct:         repoProduct,
-		userService:         userService,
-		productService:      productService,
-		notificationService: notificationService,
+		repoOffer:      repoOffer,
+		repoProduct:    repoProduct,
+		productService: productService,
 	}
 }
 
 type offerService struct {
-	repoOffer           repositories.OfferRepository
-	repoProduct         repositories.ProductRepository
-	userService         UserService
-	productService      ProductService
-	notificationService NotificationService
+	repoOffer      repositories.OfferRepository
+	repoProduct    repositories.ProductRepository
+	productService ProductService
 }
 
+// CreateOffer makes an offer by the authenticated user, which is rejected when below the product's floor.
+// Returns ErrInvalidInput for an amount which is not positive.
 func (ps *offerService) CreateOffer(ctx context.Context, offer *types.Offer) (err error) {
+	if offer.Amount <= 0 {
+		return types.ErrInvalidInput
+	}
 	offer.UserID = getUserID(ctx)
 	offer.ID, err = utilities.GenerateIDString()
 	if err != nil {
 		return err
 	}
 	offer.Status = types.OfferPending
+	offer.ExpiresAt = offerExpiresAt(offer.Status)
 
-	if err := ps.repoOffer.CreateOffer(ctx, offer); err != nil {
-		return err
+	return ps.repoOffer.CreateOffer(ctx, offer)
+}
+
+// offerUpdateSources are the statuses an admin may move an offer to, from the statuses listed.
+// Offers are only completed by paying for them, and a counter-offer is accepted by the buyer.
+var offerUpdateSources = map[types.OfferStatus][]types.OfferStatus{
+	types.OfferPending:  {types.OfferCountered}, // withdraws the counter-offer
+	types.OfferAccepted: {types.OfferPending},
+	types.OfferRejected: {types.OfferPending},
+	types.OfferCanceled: {types.OfferPending, types.OfferCountered, types.OfferAccepted},
+	types.OfferExpired:  {types.OfferPending, types.OfferCountered, types.OfferAccepted},
+}
+
+// UpdateOffer sets the status of an offer on behalf of an admin. Reopened and accepted offers expire anew,
+// and closing an accepted offer returns its unit to stock.
+// Returns ErrInvalidInput for a status admins cannot set, and ErrConstraintViolation when the offer
+// cannot move to the status from its current one, or an accepted product is out of stock.
+func (ps *offerService) UpdateOffer(ctx context.Context, offer *types.Offer) error {
+	from, ok := offerUpdateSources[offer.Status]
+	if !ok {
+		return types.ErrInvalidInput
+	}
+	offer.Amount = 0
+	offer.ExpiresAt = offerExpiresAt(offer.Status)
+	return ps.repoOffer.ReviseOffer(ctx, offer, getUserID(ctx), from...)
+}
+
+// CounterOffer answers a pending offer with a different amount, awaiting the buyer's response.
+// Returns ErrInvalidInput for an amount which is not positive, and ErrConstraintViolation
+// when the offer is not pending.
+func (ps *offerService) CounterOffer(ctx context.Context, offer *types.Offer) error {
+	if offer.Amount <= 0 {
+		return types.ErrInvalidInput
 	}
+	offer.UserID = ""
+	offer.Status = types.OfferCountered
+	offer.ExpiresAt = offerExpiresAt(offer.Status)
+	return ps.repoOffer.ReviseOffer(ctx, offer, getUserID(ctx), types.OfferPending)
+}
+
+// CounterOfferOwner answers a counter-offer with a different amount by the authenticated buyer,
+// which is pending once again, or rejected when below the product's floor.
+// Returns ErrInvalidInput for an amount which is not positive, and ErrConstraintViolation
+// when the offer is not countered.
+func (ps *offerService) CounterOfferOwner(ctx context.Context, offer *types.Offer) error {
+	if offer.Amount <= 0 {
+		return types.ErrInvalidInput
+	}
+	offer.UserID = getUserID(ctx)
+	offer.Status = types.OfferPending
+	offer.ExpiresAt = offerExpiresAt(offer.Status)
+	return ps.repoOffer.ReviseOffer(ctx, offer, offer.UserID, types.OfferCountered)
+}
 
-	// notify user that offer has been received
-	go ps.notificationService.NotifyOffer(offer.UserID, SubjectOfferConf, NotifyOfferConf, *offer)
+// RespondToOffer accepts a counter-offer, or cancels an open offer, by the authenticated buyer.
+// Returns ErrInvalidInput for other statuses, and ErrConstraintViolation when the offer
+// cannot move to the status, e.g. accepting an offer which was not countered.
+func (ps *offerService) RespondToOffer(ctx context.Context, offer *types.Offer) error {
+	offer.UserID = getUserID(ctx)
+	offer.Amount = 0
+	offer.ExpiresAt = offerExpiresAt(offer.Status)
+	switch offer.Status {
+	case types.OfferAccepted:
+		return ps.repoOffer.ReviseOffer(ctx, offer, offer.UserID, types.OfferCountered)
+	case types.OfferCanceled:
+		return ps.repoOffer.ReviseOffer(ctx, offer, offer.UserID, types.OfferPending, types.OfferCountered)
+	}
+	return types.ErrInvalidInput
+}
 
-	// notify admin(s) that an offer has been received
-	admins, _ := ps.userService.GetAllAdmins(context.Background())
-	for _, admin := range admins {
-		go ps.notificationService.NotifyOffer(admin.ID, SubjectOfferRecv, NotifyOfferRecv, *offer)
+// ExpireOffers expires open offers left unanswered, and accepted offers left unpaid,
+// returning how many were expired
+func (ps *offerService) ExpireOffers(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		count, err := ps.repoOffer.ExpireOffers(ctx, offerExpiryBatch)
+		total += count
+		if err != nil || count < offerExpiryBatch {
+			return total, err
+		}
 	}
+}
 
-	return nil
+func (ps *offerService) GetOfferFloor(ctx context.Context, productID string) (types.OfferFloor, error) {
+	return ps.repoOffer.GetOfferFloor(ctx, productID)
 }
 
-func (ps *offerService) UpdateOffer(ctx context.Context, offer *types.Offer) error {
-	if err := ps.repoOffer.UpdateOffer(ctx, offer); err != nil {
-		return err
+// SetOfferFloor sets the lowest amount a product accepts offers for, a nil floor removes it.
+// Returns ErrInvalidInput for a negative floor.
+func (ps *offerService) SetOfferFloor(ctx context.Context, floor *types.OfferFloor) error {
+	if floor.Floor != nil && *floor.Floor < 0 {
+		return types.ErrInvalidInput
 	}
+	return ps.repoOffer.SetOfferFloor(ctx, floor)
+}
 
-	go ps.notificationService.NotifyOffer(offer.UserID, SubjectOfferUpdate, NotifyOfferUpdate, *offer)
+// GetCheckoutItem returns the item bought by checking out an accepted offer of the authenticated buyer,
+// a unit of the product at the offer's amount.
+// Returns ErrConstraintViolation when the offer is not accepted.
+func (ps *offerService) GetCheckoutItem(ctx context.Context, id string) (types.CartItem, error) {
+	offer, err := ps.repoOffer.GetOfferByIDAndUser(ctx, id, getUserID(ctx))
+	if err != nil {
+		return types.CartItem{}, err
+	}
+	if offer.Status != types.OfferAccepted {
+		return types.CartItem{}, types.ErrConstraintViolation
+	}
+	product, err := ps.productService.GetProductByID(ctx, offer.Product.ID)
+	if err != nil {
+		return types.CartItem{}, err
+	}
+	return types.CartItem{Product: product, Quantity: 1, UnitPrice: offer.Amount}, nil
+}
 
-	return nil
+// offerExpiresAt returns when an offer moving to status expires: open offers await a response,
+// and accepted offers payment
+func offerExpiresAt(status types.OfferStatus) *time.Time {
+	window := offerExpiry
+	if status == types.OfferAccepted {
+		window = offerCheckoutWindow
+	}
+	expiresAt := time.Now().UTC().Add(window)
+	return &expiresAt
 }
 
 func (ps *offerService) GetOffersByProductID(ctx context.Context, id string) ([]types.Offer, error) {
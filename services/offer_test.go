@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockOfferRepo struct {
+	mock.Mock
+}
+
+func (m *mockOfferRepo) CreateOffer(ctx context.Context, offer *types.Offer) error {
+	args := m.Called(ctx, offer)
+	return args.Error(0)
+}
+
+func (m *mockOfferRepo) ReviseOffer(ctx context.Context, offer *types.Offer, authorID string, from ...types.OfferStatus) error {
+	args := m.Called(ctx, offer, authorID, from)
+	return args.Error(0)
+}
+
+func (m *mockOfferRepo) ExpireOffers(ctx context.Context, limit int) (int, error) {
+	args := m.Called(ctx, limit)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockOfferRepo) GetOfferByID(ctx context.Context, id string) (types.Offer, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.Offer), args.Error(1)
+}
+
+func (m *mockOfferRepo) GetOfferByIDAndUser(ctx context.Context, id, userID string) (types.Offer, error) {
+	args := m.Called(ctx, id, userID)
+	return args.Get(0).(types.Offer), args.Error(1)
+}
+
+func (m *mockOfferRepo) GetOffersByProductIDAndUser(ctx context.Context, productID, userID string) ([]types.Offer, error) {
+	args := m.Called(ctx, productID, userID)
+	return args.Get(0).([]types.Offer), args.Error(1)
+}
+
+func (m *mockOfferRepo) GetOffers(ctx context.Context) ([]types.Offer, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]types.Offer), args.Error(1)
+}
+
+func (m *mockOfferRepo) GetOfferFloor(ctx context.Context, productID string) (types.OfferFloor, error) {
+	args := m.Called(ctx, productID)
+	return args.Get(0).(types.OfferFloor), args.Error(1)
+}
+
+func (m *mockOfferRepo) SetOfferFloor(ctx context.Context, floor *types.OfferFloor) error {
+	args := m.Called(ctx, floor)
+	return args.Error(0)
+}
+
+type mockProductService struct {
+	mock.Mock
+	ProductService
+}
+
+func (m *mockProductService) GetProductByID(ctx context.Context, id string) (types.Product, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.Product), args.Error(1)
+}
+
+func TestCreateOffer_InvalidAmount(t *testing.T) {
+	repo := new(mockOfferRepo)
+	svc := NewOfferService(nil, repo, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+
+	for _, amount := range []int64{0, -100} {
+		offer := types.Offer{Product: types.Product{ID: "1"}, Amount: amount}
+		assert.Equal(t, types.ErrInvalidInput, svc.CreateOffer(ctx, &offer))
+	}
+	repo.AssertNotCalled(t, "CreateOffer", mock.Anything, mock.Anything)
+}
+
+func TestCounterOffer(t *testing.T) {
+	repo := new(mockOfferRepo)
+	svc := NewOfferService(nil, repo, nil)
+	adminCtx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleAdmin})
+	buyerCtx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+
+	repo.On("ReviseOffer", adminCtx, mock.MatchedBy(func(o *types.Offer) bool {
+		return o.Status == types.OfferCountered && o.Amount == 900 && o.UserID == "" && o.ExpiresAt != nil
+	}), "1", []types.OfferStatus{types.OfferPending}).Return(nil).Once()
+	repo.On("ReviseOffer", buyerCtx, mock.MatchedBy(func(o *types.Offer) bool {
+		return o.Status == types.OfferPending && o.Amount == 800 && o.UserID == "7" && o.ExpiresAt != nil
+	}), "7", []types.OfferStatus{types.OfferCountered}).Return(nil).Once()
+
+	assert.NoError(t, svc.CounterOffer(adminCtx, &types.Offer{ID: "42", Amount: 900}))
+	assert.NoError(t, svc.CounterOfferOwner(buyerCtx, &types.Offer{ID: "42", Amount: 800}))
+	assert.Equal(t, types.ErrInvalidInput, svc.CounterOfferOwner(buyerCtx, &types.Offer{ID: "42"}))
+	repo.AssertExpectations(t)
+}
+
+func TestRespondToOffer(t *testing.T) {
+	repo := new(mockOfferRepo)
+	svc := NewOfferService(nil, repo, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+
+	repo.On("ReviseOffer", ctx, mock.MatchedBy(func(o *types.Offer) bool {
+		// accepted offers await payment until the checkout window closes
+		return o.Status == types.OfferAccepted && o.UserID == "7" &&
+			o.ExpiresAt != nil && o.ExpiresAt.After(time.Now().Add(offerCheckoutWindow-time.Minute))
+	}), "7", []types.OfferStatus{types.OfferCountered}).Return(nil).Once()
+	repo.On("ReviseOffer", ctx, mock.MatchedBy(func(o *types.Offer) bool {
+		return o.Status == types.OfferCanceled && o.UserID == "7"
+	}), "7", []types.OfferStatus{types.OfferPending, types.OfferCountered}).Return(nil).Once()
+
+	assert.NoError(t, svc.RespondToOffer(ctx, &types.Offer{ID: "42", Status: types.OfferAccepted}))
+	assert.NoError(t, svc.RespondToOffer(ctx, &types.Offer{ID: "42", Status: types.OfferCanceled}))
+	for _, status := range []types.OfferStatus{types.OfferCompleted, types.OfferCountered, types.OfferRejected} {
+		assert.Equal(t, types.ErrInvalidInput, svc.RespondToOffer(ctx, &types.Offer{ID: "42", Status: status}))
+	}
+	repo.AssertExpectations(t)
+}
+
+func TestUpdateOffer(t *testing.T) {
+	repo := new(mockOfferRepo)
+	svc := NewOfferService(nil, repo, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "1", Role: types.RoleAdmin})
+
+	// admins accept only pending offers, a counter-offer is accepted by the buyer
+	repo.On("ReviseOffer", ctx, mock.MatchedBy(func(o *types.Offer) bool {
+		return o.Status == types.OfferAccepted
+	}), "1", []types.OfferStatus{types.OfferPending}).Return(nil).Once()
+	repo.On("ReviseOffer", ctx, mock.MatchedBy(func(o *types.Offer) bool {
+		return o.Status == types.OfferCanceled
+	}), "1", []types.OfferStatus{types.OfferPending, types.OfferCountered, types.OfferAccepted}).Return(nil).Once()
+
+	assert.NoError(t, svc.UpdateOffer(ctx, &types.Offer{ID: "42", Status: types.OfferAccepted}))
+	assert.NoError(t, svc.UpdateOffer(ctx, &types.Offer{ID: "42", Status: types.OfferCanceled}))
+	for _, status := range []types.OfferStatus{types.OfferCompleted, types.OfferCountered, "sold"} {
+		assert.Equal(t, types.ErrInvalidInput, svc.UpdateOffer(ctx, &types.Offer{ID: "42", Status: status}))
+	}
+	repo.AssertExpectations(t)
+}
+
+func TestGetCheckoutItem(t *testing.T) {
+	repo := new(mockOfferRepo)
+	products := new(mockProductService)
+	svc := NewOfferService(nil, repo, products)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+
+	product := types.Product{ID: "3", Price: 10000}
+	repo.On("GetOfferByIDAndUser", ctx, "42", "7").
+		Return(types.Offer{ID: "42", UserID: "7", Product: types.Product{ID: "3"}, Amount: 7000, Status: types.OfferAccepted}, nil).Once()
+	repo.On("GetOfferByIDAndUser", ctx, "43", "7").
+		Return(types.Offer{ID: "43", UserID: "7", Product: types.Product{ID: "3"}, Amount: 7000, Status: types.OfferCountered}, nil).Once()
+	products.On("GetProductByID", ctx, "3").Return(product, nil).Once()
+
+	item, err := svc.GetCheckoutItem(ctx, "42")
+	assert.NoError(t, err)
+	assert.Equal(t, types.CartItem{Product: product, Quantity: 1, UnitPrice: 7000}, item, "Expected a unit at the offer's amount")
+
+	_, err = svc.GetCheckoutItem(ctx, "43")
+	assert.Equal(t, types.ErrConstraintViolation, err, "Expected error for an offer which is not accepted")
+	repo.AssertExpectations(t)
+	products.AssertExpectations(t)
+}
+
+func TestExpireOffers_Batches(t *testing.T) {
+	repo := new(mockOfferRepo)
+	svc := NewOfferService(nil, repo, nil)
+
+	repo.On("ExpireOffers", mock.Anything, offerExpiryBatch).Return(offerExpiryBatch, nil).Twice()
+	repo.On("ExpireOffers", mock.Anything, offerExpiryBatch).Return(3, nil).Once()
+
+	count, err := svc.ExpireOffers(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2*offerExpiryBatch+3, count)
+	repo.AssertExpectations(t)
+}
+
+func TestCustomerNotificationHandler_Offers(t *testing.T) {
+	notifications := new(mockNotificationService)
+	handler := NewCustomerNotificationHandler(notifications)
+	ctx := context.Background()
+
+	notifications.On("NotifyOffer", ctx, "7", types.NotificationOfferUpdates, SubjectOfferConf, NotifyOfferConf, mock.Anything).Return(nil).Once()
+	notifications.On("NotifyOffer", ctx, "7", types.NotificationOfferUpdates, SubjectOfferUpdate, NotifyOfferUpdate, mock.Anything).Return(nil).Times(3)
+
+	events := []types.DomainEvent{
+		// made by the buyer
+		pendingEvent(types.EventTypeOfferCreated, types.OfferStatusChange{OfferID: "42", UserID: "7", Status: types.OfferPending, UpdatedBy: "7"}),
+		// rejected below the price floor
+		pendingEvent(types.EventTypeOfferCreated, types.OfferStatusChange{OfferID: "43", UserID: "7", Status: types.OfferRejected}),
+		// countered by an admin
+		pendingEvent(types.EventTypeOfferStatusChanged, types.OfferStatusChange{OfferID: "42", UserID: "7", Status: types.OfferCountered, UpdatedBy: "1"}),
+		// countered again by the buyer, not notified
+		pendingEvent(types.EventTypeOfferStatusChanged, types.OfferStatusChange{OfferID: "42", UserID: "7", Status: types.OfferPending, UpdatedBy: "7"}),
+		// expired
+		pendingEvent(types.EventTypeOfferStatusChanged, types.OfferStatusChange{OfferID: "42", UserID: "7", Status: types.OfferExpired}),
+	}
+	for _, event := range events {
+		assert.NoError(t, handler(ctx, event))
+	}
+	notifications.AssertExpectations(t)
+}
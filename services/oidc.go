@@ -0,0 +1,485 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateExpiry     = 10 * time.Minute // time allowed to complete sign in at the provider
+	oidcKeyRefreshDelay = time.Minute      // minimum time between provider JWKS fetches
+)
+
+// OIDCService implements the OpenID Connect relying party flow:
+// discovery, authorization code with PKCE, and ID token validation.
+type OIDCService interface {
+	Providers() []string
+	AuthorizationURL(ctx context.Context, provider string) (authURL, state string, err error)
+	Authenticate(ctx context.Context, provider, code, state, boundState string) (*types.User, error)
+}
+
+type oidcService struct {
+	identityRepo repositories.IdentityRepository
+	userRepo     repositories.UserRepository
+	httpClient   utilities.HTTPClient
+	providers    map[string]*oidcProvider
+	names        []string
+}
+
+// oidcProvider caches the discovery document and signing keys of a provider
+type oidcProvider struct {
+	config types.OIDCProviderConfig
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{} // kid -> *rsa.PublicKey or *ecdsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string      `json:"nonce"`
+	AuthorizedBy  string      `json:"azp"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // some providers send a string
+	Name          string      `json:"name"`
+}
+
+func NewOIDCService(
+	identityRepo repositories.IdentityRepository,
+	userRepo repositories.UserRepository,
+	httpClient utilities.HTTPClient,
+	configs []types.OIDCProviderConfig) OIDCService {
+	providers := make(map[string]*oidcProvider, len(configs))
+	names := make([]string, 0, len(configs))
+	for _, config := range configs {
+		providers[config.Name] = &oidcProvider{config: config}
+		names = append(names, config.Name)
+	}
+	return &oidcService{
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		httpClient:   httpClient,
+		providers:    providers,
+		names:        names,
+	}
+}
+
+// Providers returns the names of the configured providers
+func (s *oidcService) Providers() []string {
+	return s.names
+}
+
+// AuthorizationURL starts a sign in, returning the provider URL to redirect the user to.
+// The returned state must be bound to the user's browser and passed back to Authenticate.
+func (s *oidcService) AuthorizationURL(ctx context.Context, provider string) (string, string, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return "", "", types.ErrNotFound
+	}
+	discovery, err := s.discover(ctx, p)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	err = s.identityRepo.CreateAuthState(ctx, &types.OIDCAuthState{
+		State:        state,
+		Provider:     provider,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().UTC().Add(oidcStateExpiry),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// Authenticate completes a sign in. The authorization code is exchanged for an ID token,
+// which is validated and resolved to a user, linking or creating the user as needed.
+// boundState is the state stored in the browser that started the sign in, and must match
+// state, so a callback cannot be replayed in another browser (login CSRF).
+// Invalid or expired requests return types.ErrInvalidInput.
+func (s *oidcService) Authenticate(ctx context.Context, provider, code, state, boundState string) (*types.User, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+	if boundState == "" || subtle.ConstantTimeCompare([]byte(state), []byte(boundState)) != 1 {
+		return nil, types.ErrInvalidInput
+	}
+
+	authState, err := s.identityRepo.ConsumeAuthState(ctx, state)
+	if err == types.ErrNotFound {
+		return nil, types.ErrInvalidInput
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authState.Provider != provider {
+		return nil, types.ErrInvalidInput
+	}
+
+	rawIDToken, err := s.exchangeCode(ctx, p, code, authState.CodeVerifier)
+	if err != nil {
+		slog.WarnContext(ctx, "OIDC code exchange failed", "provider", provider, "error", err)
+		return nil, types.ErrInvalidInput
+	}
+	claims, err := s.validateIDToken(ctx, p, rawIDToken, authState.Nonce)
+	if err != nil {
+		slog.WarnContext(ctx, "OIDC ID token rejected", "provider", provider, "error", err)
+		return nil, types.ErrInvalidInput
+	}
+
+	return s.resolveUser(ctx, provider, claims)
+}
+
+// resolveUser returns the user linked to the identity. Unlinked identities with a verified
+// email are linked to the account with that email, otherwise a new account is created.
+func (s *oidcService) resolveUser(ctx context.Context, provider string, claims *idTokenClaims) (*types.User, error) {
+	identity, err := s.identityRepo.GetIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		return s.userRepo.GetUserByID(ctx, identity.UserID)
+	}
+	if err != types.ErrNotFound {
+		return nil, err
+	}
+
+	identity = &types.UserIdentity{Provider: provider, Subject: claims.Subject}
+	var email *string
+	if claims.Email != "" && isTrue(claims.EmailVerified) {
+		email = utilities.StringPtr(strings.ToLower(claims.Email))
+		identity.Email = email
+
+		usr, err := s.userRepo.GetUserByEmail(ctx, *email)
+		if err == nil {
+			identity.UserID = usr.ID
+			if err := s.identityRepo.CreateIdentity(ctx, identity); err != nil {
+				return nil, err
+			}
+			return usr, nil
+		}
+		if err != types.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	userID, err := utilities.GenerateIDString()
+	if err != nil {
+		return nil, err
+	}
+	usr := &types.User{
+		ID:       userID,
+		Email:    email,
+		Role:     types.RoleUser,
+		Verified: email != nil,
+	}
+	if claims.Name != "" {
+		usr.Name = utilities.StringPtr(claims.Name)
+	}
+	// unique violation when an unverified account holds the email
+	if err := s.identityRepo.CreateUserWithIdentity(ctx, usr, identity); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// exchangeCode redeems the authorization code at the token endpoint, returning the raw ID token
+func (s *oidcService) exchangeCode(ctx context.Context, p *oidcProvider, code, verifier string) (string, error) {
+	discovery, err := s.discover(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID) // public client
+	}
+	req, err := s.httpClient.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.IDToken == "" {
+		return "", errors.New("token response missing id_token")
+	}
+	return tokenResp.IDToken, nil
+}
+
+// validateIDToken verifies the ID token signature against the provider JWKS,
+// along with the issuer, audience, expiry and nonce
+func (s *oidcService) validateIDToken(ctx context.Context, p *oidcProvider, rawIDToken, nonce string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	_, err := jwt.ParseWithClaims(rawIDToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.signingKey(ctx, p, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID {
+		return nil, errors.New("azp mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub claim")
+	}
+	return &claims, nil
+}
+
+// discover fetches and caches the provider's discovery document
+func (s *oidcService) discover(ctx context.Context, p *oidcProvider) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := s.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, p.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// signingKey returns the provider key matching kid. Keys are refetched when
+// an unknown kid is seen, so provider key rotation is picked up.
+func (s *oidcService) signingKey(ctx context.Context, p *oidcProvider, kid string) (interface{}, error) {
+	discovery, err := s.discover(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < oidcKeyRefreshDelay {
+		return nil, errors.New("unknown signing key")
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := s.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k.Kty, k.N, k.E, k.Crv, k.X, k.Y)
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping unsupported provider key", "provider", p.config.Name, "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+// lookupKey finds a cached key. Tokens without a kid are accepted when the provider has a single key.
+func (p *oidcProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// parseJWK converts an RSA or EC JSON Web Key into a public key
+func parseJWK(kty, n, e, crv, x, y string) (interface{}, error) {
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch kty {
+	case "RSA":
+		modulus, err := decode(n)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := decode(e)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+		xInt, err := decode(x)
+		if err != nil {
+			return nil, err
+		}
+		yInt, err := decode(y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: xInt, Y: yInt}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", kty)
+	}
+}
+
+func (s *oidcService) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := s.httpClient.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// randomString returns 32 random bytes, base64url encoded
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// isTrue interprets a boolean claim, which some providers encode as a string
+func isTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
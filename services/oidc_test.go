@@ -0,0 +1,273 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockIdentityRepo struct {
+	mock.Mock
+}
+
+func (m *mockIdentityRepo) CreateAuthState(ctx context.Context, state *types.OIDCAuthState) error {
+	args := m.Called(ctx, state)
+	return args.Error(0)
+}
+
+func (m *mockIdentityRepo) ConsumeAuthState(ctx context.Context, state string) (*types.OIDCAuthState, error) {
+	args := m.Called(ctx, state)
+	if v := args.Get(0); v != nil {
+		return v.(*types.OIDCAuthState), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockIdentityRepo) GetIdentity(ctx context.Context, provider, subject string) (*types.UserIdentity, error) {
+	args := m.Called(ctx, provider, subject)
+	if v := args.Get(0); v != nil {
+		return v.(*types.UserIdentity), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockIdentityRepo) CreateIdentity(ctx context.Context, identity *types.UserIdentity) error {
+	args := m.Called(ctx, identity)
+	return args.Error(0)
+}
+
+func (m *mockIdentityRepo) CreateUserWithIdentity(ctx context.Context, user *types.User, identity *types.UserIdentity) error {
+	args := m.Called(ctx, user, identity)
+	return args.Error(0)
+}
+
+// mockUserLookupRepo implements the user lookups used during sign in
+type mockUserLookupRepo struct {
+	repositories.UserRepository
+	mock.Mock
+}
+
+func (m *mockUserLookupRepo) GetUserByID(ctx context.Context, userID string) (*types.User, error) {
+	args := m.Called(ctx, userID)
+	if v := args.Get(0); v != nil {
+		return v.(*types.User), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockUserLookupRepo) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	args := m.Called(ctx, email)
+	if v := args.Get(0); v != nil {
+		return v.(*types.User), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+// mockOIDCProvider is a minimal OpenID Connect provider issuing ID tokens for a fixed subject
+type mockOIDCProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string // code_challenge from the authorization request
+	nonce     string // nonce placed in the ID token
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	p := &mockOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": "test-key",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "valid-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            p.URL,
+			"aud":            "marketplace",
+			"sub":            "subject-123",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          p.nonce,
+			"email":          "Social@Example.com",
+			"email_verified": true,
+			"name":           "Social User",
+		})
+		token.Header["kid"] = "test-key"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": "ignored"})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// startSignIn requests an authorization URL, capturing the stored state
+func startSignIn(t *testing.T, svc OIDCService, idRepo *mockIdentityRepo, provider *mockOIDCProvider) *types.OIDCAuthState {
+	ctx := context.Background()
+	var state *types.OIDCAuthState
+	idRepo.On("CreateAuthState", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		state = args.Get(1).(*types.OIDCAuthState)
+	}).Return(nil).Once()
+
+	authURL, boundState, err := svc.AuthorizationURL(ctx, "mock")
+	assert.NoError(t, err)
+	parsed, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "S256", parsed.Query().Get("code_challenge_method"))
+	assert.Equal(t, state.State, parsed.Query().Get("state"))
+	assert.Equal(t, state.State, boundState)
+
+	provider.challenge = parsed.Query().Get("code_challenge")
+	provider.nonce = parsed.Query().Get("nonce")
+	return state
+}
+
+func newTestOIDCService(provider *mockOIDCProvider) (OIDCService, *mockIdentityRepo, *mockUserLookupRepo) {
+	idRepo := new(mockIdentityRepo)
+	userRepo := new(mockUserLookupRepo)
+	svc := NewOIDCService(idRepo, userRepo, utilities.NewDefaultHTTPClient(5*time.Second), []types.OIDCProviderConfig{{
+		Name:        "mock",
+		Issuer:      provider.URL,
+		ClientID:    "marketplace",
+		RedirectURL: "http://localhost/auth/oidc/mock/callback",
+		Scopes:      []string{"openid", "email"},
+	}})
+	return svc, idRepo, userRepo
+}
+
+func TestOIDCAuthenticate_CreatesUser(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, userRepo := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	state := startSignIn(t, svc, idRepo, provider)
+	idRepo.On("ConsumeAuthState", ctx, state.State).Return(state, nil).Once()
+	idRepo.On("GetIdentity", ctx, "mock", "subject-123").Return(nil, types.ErrNotFound).Once()
+	userRepo.On("GetUserByEmail", ctx, "social@example.com").Return(nil, types.ErrNotFound).Once()
+	idRepo.On("CreateUserWithIdentity", ctx, mock.Anything, mock.Anything).Return(nil).Once()
+
+	usr, err := svc.Authenticate(ctx, "mock", "valid-code", state.State, state.State)
+	assert.NoError(t, err)
+	assert.Equal(t, "social@example.com", *usr.Email)
+	assert.Equal(t, types.RoleUser, usr.Role)
+	assert.True(t, usr.Verified, "expected provider verified email to be trusted")
+	idRepo.AssertExpectations(t)
+}
+
+func TestOIDCAuthenticate_LinksExistingUser(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, userRepo := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	existing := &types.User{ID: "42", Email: utilities.StringPtr("social@example.com"), Role: types.RoleUser}
+	state := startSignIn(t, svc, idRepo, provider)
+	idRepo.On("ConsumeAuthState", ctx, state.State).Return(state, nil).Once()
+	idRepo.On("GetIdentity", ctx, "mock", "subject-123").Return(nil, types.ErrNotFound).Once()
+	userRepo.On("GetUserByEmail", ctx, "social@example.com").Return(existing, nil).Once()
+	idRepo.On("CreateIdentity", ctx, mock.MatchedBy(func(identity *types.UserIdentity) bool {
+		return identity.UserID == "42" && identity.Subject == "subject-123"
+	})).Return(nil).Once()
+
+	usr, err := svc.Authenticate(ctx, "mock", "valid-code", state.State, state.State)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", usr.ID)
+	idRepo.AssertExpectations(t)
+}
+
+func TestOIDCAuthenticate_RejectsNonceMismatch(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, _ := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	state := startSignIn(t, svc, idRepo, provider)
+	provider.nonce = "replayed-nonce"
+	idRepo.On("ConsumeAuthState", ctx, state.State).Return(state, nil).Once()
+
+	_, err := svc.Authenticate(ctx, "mock", "valid-code", state.State, state.State)
+	assert.Equal(t, types.ErrInvalidInput, err)
+	idRepo.AssertNotCalled(t, "GetIdentity", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestOIDCAuthenticate_RejectsInvalidCode(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, _ := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	state := startSignIn(t, svc, idRepo, provider)
+	idRepo.On("ConsumeAuthState", ctx, state.State).Return(state, nil).Once()
+
+	_, err := svc.Authenticate(ctx, "mock", "stolen-code", state.State, state.State)
+	assert.Equal(t, types.ErrInvalidInput, err)
+}
+
+func TestOIDCAuthenticate_UnknownState(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, _ := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	idRepo.On("ConsumeAuthState", ctx, "forged").Return(nil, types.ErrNotFound).Once()
+
+	_, err := svc.Authenticate(ctx, "mock", "valid-code", "forged", "forged")
+	assert.Equal(t, types.ErrInvalidInput, err)
+
+	_, err = svc.Authenticate(ctx, "unknown", "valid-code", "forged", "forged")
+	assert.Equal(t, types.ErrNotFound, err)
+}
+
+func TestOIDCAuthenticate_StateNotBoundToBrowser(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+	svc, idRepo, _ := newTestOIDCService(provider)
+	ctx := context.Background()
+
+	// the state is not consumed, so the browser that started the sign in can still complete it
+	state := startSignIn(t, svc, idRepo, provider)
+	_, err := svc.Authenticate(ctx, "mock", "valid-code", state.State, "")
+	assert.Equal(t, types.ErrInvalidInput, err)
+	_, err = svc.Authenticate(ctx, "mock", "valid-code", state.State, "other-browser")
+	assert.Equal(t, types.ErrInvalidInput, err)
+	idRepo.AssertNotCalled(t, "ConsumeAuthState", ctx, state.State)
+}
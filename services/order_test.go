@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
 	"testing"
 
@@ -26,6 +27,10 @@ func (m *MockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	return resp, args.Error(1)
 }
 
+func (m *MockHTTPClient) NewRequestWithContext(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, url, body)
+}
+
 func contextWithUserID(ctx context.Context, userID string) context.Context {
 	return context.WithValue(ctx, UserKey, &types.User{ID: userID})
 }
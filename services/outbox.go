@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+const (
+	outboxMaxAttempts = 10               // attempts before an event is marked failed
+	outboxRetryBase   = 30 * time.Second // delay before the first retry, doubled on each further retry
+	outboxLease       = time.Minute      // time a claimed event is hidden from other instances
+	outboxBatchSize   = 50
+)
+
+// EventHandler reacts to a domain event.
+// Handlers may be called more than once for the same event, and should tolerate duplicates.
+type EventHandler func(ctx context.Context, event types.DomainEvent) error
+
+// OutboxService dispatches domain events recorded in the outbox to registered handlers.
+// Each handler is retried independently until it succeeds, handlers which have
+// completed are not called again when another handler fails.
+type OutboxService interface {
+	Register(name string, handler EventHandler, eventTypes ...types.DomainEventType)
+	Dispatch(ctx context.Context)
+}
+
+type namedHandler struct {
+	name    string
+	handler EventHandler
+}
+
+type outboxService struct {
+	repo     repositories.OutboxRepository
+	mu       sync.RWMutex
+	handlers map[types.DomainEventType][]namedHandler
+}
+
+func NewOutboxService(repo repositories.OutboxRepository) OutboxService {
+	return &outboxService{
+		repo:     repo,
+		handlers: make(map[types.DomainEventType][]namedHandler),
+	}
+}
+
+// Register subscribes a handler to the given event types.
+// name identifies the handler across retries, and must be unique.
+func (s *outboxService) Register(name string, handler EventHandler, eventTypes ...types.DomainEventType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, eventType := range eventTypes {
+		s.handlers[eventType] = append(s.handlers[eventType], namedHandler{name, handler})
+	}
+}
+
+// Dispatch handles due events until none remain, or ctx is canceled.
+// Events already claimed are handled to completion after ctx is canceled, so shutdown drains in-flight work.
+func (s *outboxService) Dispatch(ctx context.Context) {
+	handleCtx := context.WithoutCancel(ctx)
+	for ctx.Err() == nil {
+		events, err := s.repo.ClaimEvents(ctx, outboxBatchSize, outboxLease)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Error claiming outbox events", "error", err)
+			}
+			return
+		}
+
+		// events of an aggregate are never claimed together, so the batch can be handled concurrently
+		var wg sync.WaitGroup
+		for i := range events {
+			wg.Add(1)
+			go func(event *types.DomainEvent) {
+				defer wg.Done()
+				s.handle(handleCtx, event)
+			}(&events[i])
+		}
+		wg.Wait()
+
+		if len(events) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// handle calls the handlers which have not yet completed, and records the outcome
+func (s *outboxService) handle(ctx context.Context, event *types.DomainEvent) {
+	s.mu.RLock()
+	handlers := s.handlers[event.Type]
+	s.mu.RUnlock()
+
+	var errs []error
+	for _, h := range handlers {
+		if slices.Contains(event.Handled, h.name) {
+			continue
+		}
+		if err := callHandler(ctx, h.handler, *event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		event.Handled = append(event.Handled, h.name)
+	}
+
+	now := time.Now().UTC()
+	event.Attempts++
+	switch {
+	case len(errs) == 0:
+		event.Status = types.DomainEventProcessed
+		event.LastError = nil
+		event.ProcessedAt = &now
+	case event.Attempts >= outboxMaxAttempts:
+		event.Status = types.DomainEventFailed
+		event.LastError = utilities.StringPtr(errors.Join(errs...).Error())
+		slog.ErrorContext(ctx, "Outbox event failed", "event_id", event.ID, "type", event.Type, "error", *event.LastError)
+	default:
+		event.LastError = utilities.StringPtr(errors.Join(errs...).Error())
+		event.NextAttemptAt = now.Add(outboxRetryBase << (event.Attempts - 1))
+		slog.WarnContext(ctx, "Outbox event will be retried", "event_id", event.ID, "type", event.Type, "attempts", event.Attempts, "error", *event.LastError)
+	}
+
+	if err := s.repo.UpdateEvent(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Error recording outbox event", "event_id", event.ID, "error", err)
+	}
+}
+
+// callHandler calls handler, converting a panic into an error so it is retried
+func callHandler(ctx context.Context, handler EventHandler, event types.DomainEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, event)
+}
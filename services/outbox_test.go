@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockOutboxRepo struct {
+	mock.Mock
+}
+
+func (m *mockOutboxRepo) ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]types.DomainEvent, error) {
+	args := m.Called(ctx, limit, lease)
+	return args.Get(0).([]types.DomainEvent), args.Error(1)
+}
+
+func (m *mockOutboxRepo) UpdateEvent(ctx context.Context, event *types.DomainEvent) error {
+	args := m.Called(ctx, event)
+	return args.Error(0)
+}
+
+type mockNotificationService struct {
+	mock.Mock
+	NotificationService
+}
+
+func (m *mockNotificationService) NotifyOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error {
+	args := m.Called(ctx, to, event, subject, template, order)
+	return args.Error(0)
+}
+
+func (m *mockNotificationService) NotifyOffer(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, offer types.Offer) error {
+	args := m.Called(ctx, to, event, subject, template, offer)
+	return args.Error(0)
+}
+
+func (m *mockNotificationService) Dispatch(ctx context.Context, n Notification) error {
+	args := m.Called(ctx, n)
+	return args.Error(0)
+}
+
+func (m *mockNotificationService) EmailOrder(ctx context.Context, to string, event types.NotificationEvent, subject string, template HtmlTemplate, order types.Order) error {
+	args := m.Called(ctx, to, event, subject, template, order)
+	return args.Error(0)
+}
+
+func pendingEvent(eventType types.DomainEventType, payload interface{}) types.DomainEvent {
+	data, _ := json.Marshal(payload)
+	return types.DomainEvent{
+		ID:            "1",
+		AggregateType: "order",
+		AggregateID:   "42",
+		Type:          eventType,
+		Payload:       data,
+		Status:        types.DomainEventPending,
+		Handled:       []string{},
+	}
+}
+
+// dispatchOnce runs a single dispatch of event, returning the recorded outcome
+func dispatchOnce(t *testing.T, svc OutboxService, repo *mockOutboxRepo, event types.DomainEvent) *types.DomainEvent {
+	var updated *types.DomainEvent
+	repo.On("ClaimEvents", mock.Anything, outboxBatchSize, outboxLease).Return([]types.DomainEvent{event}, nil).Once()
+	repo.On("UpdateEvent", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.DomainEvent)
+	}).Return(nil).Once()
+
+	svc.Dispatch(context.Background())
+
+	repo.AssertExpectations(t)
+	return updated
+}
+
+func TestDispatch_MarksProcessed(t *testing.T) {
+	repo := new(mockOutboxRepo)
+	svc := NewOutboxService(repo)
+
+	var called []string
+	svc.Register("first", func(ctx context.Context, event types.DomainEvent) error {
+		called = append(called, "first")
+		return nil
+	}, types.EventTypeOrderStatusChanged)
+	svc.Register("other", func(ctx context.Context, event types.DomainEvent) error {
+		called = append(called, "other")
+		return nil
+	}, types.EventTypeOfferCreated)
+
+	updated := dispatchOnce(t, svc, repo, pendingEvent(types.EventTypeOrderStatusChanged, types.OrderStatusChange{}))
+
+	assert.Equal(t, []string{"first"}, called, "Expected only the subscribed handler to be called")
+	assert.Equal(t, types.DomainEventProcessed, updated.Status)
+	assert.Equal(t, 1, updated.Attempts)
+	assert.Equal(t, []string{"first"}, updated.Handled)
+	assert.NotNil(t, updated.ProcessedAt)
+	assert.Nil(t, updated.LastError)
+}
+
+func TestDispatch_RetriesFailedHandlerOnly(t *testing.T) {
+	repo := new(mockOutboxRepo)
+	svc := NewOutboxService(repo)
+
+	var succeeded, failed int
+	svc.Register("succeeds", func(ctx context.Context, event types.DomainEvent) error {
+		succeeded++
+		return nil
+	}, types.EventTypeOrderStatusChanged)
+	svc.Register("fails", func(ctx context.Context, event types.DomainEvent) error {
+		failed++
+		return errors.New("smtp unavailable")
+	}, types.EventTypeOrderStatusChanged)
+
+	event := pendingEvent(types.EventTypeOrderStatusChanged, types.OrderStatusChange{})
+	event.Attempts = 2
+	updated := dispatchOnce(t, svc, repo, event)
+
+	assert.Equal(t, types.DomainEventPending, updated.Status)
+	assert.Equal(t, 3, updated.Attempts)
+	assert.Equal(t, []string{"succeeds"}, updated.Handled)
+	assert.Contains(t, *updated.LastError, "fails: smtp unavailable")
+	// third attempt failed, the next retry waits 30s * 2^2
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), updated.NextAttemptAt, 5*time.Second)
+
+	// the retry skips the handler which already completed
+	dispatchOnce(t, svc, repo, *updated)
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, 2, failed)
+}
+
+func TestDispatch_RecoversPanic(t *testing.T) {
+	repo := new(mockOutboxRepo)
+	svc := NewOutboxService(repo)
+
+	svc.Register("panics", func(ctx context.Context, event types.DomainEvent) error {
+		panic("nil map")
+	}, types.EventTypeInventoryChanged)
+
+	updated := dispatchOnce(t, svc, repo, pendingEvent(types.EventTypeInventoryChanged, types.InventoryUpdate{}))
+
+	assert.Equal(t, types.DomainEventPending, updated.Status)
+	assert.Contains(t, *updated.LastError, "panic: nil map")
+	assert.Empty(t, updated.Handled)
+}
+
+func TestDispatch_FailsAfterMaxAttempts(t *testing.T) {
+	repo := new(mockOutboxRepo)
+	svc := NewOutboxService(repo)
+
+	svc.Register("fails", func(ctx context.Context, event types.DomainEvent) error {
+		return errors.New("receiver down")
+	}, types.EventTypeOfferCreated)
+
+	event := pendingEvent(types.EventTypeOfferCreated, types.OfferStatusChange{})
+	event.Attempts = outboxMaxAttempts - 1
+	updated := dispatchOnce(t, svc, repo, event)
+
+	assert.Equal(t, types.DomainEventFailed, updated.Status)
+	assert.Equal(t, outboxMaxAttempts, updated.Attempts)
+	assert.Nil(t, updated.ProcessedAt)
+}
+
+func TestCustomerNotificationHandler_OrderPaid(t *testing.T) {
+	notifications := new(mockNotificationService)
+	handler := NewCustomerNotificationHandler(notifications)
+
+	change := types.OrderStatusChange{OrderID: "42", UserID: "7", Status: types.OrderPaid}
+	order := types.Order{ID: "42", UserID: "7", Status: types.OrderPaid}
+	notifications.On("NotifyOrder", mock.Anything, "7", types.NotificationOrderConf, SubjectOrderConf, NotifyOrderConf, order).Return(nil).Once()
+
+	err := handler(context.Background(), pendingEvent(types.EventTypeOrderStatusChanged, change))
+
+	assert.NoError(t, err)
+	notifications.AssertExpectations(t)
+}
+
+func TestOrderEmailHandler_OrderPaid(t *testing.T) {
+	notifications := new(mockNotificationService)
+	orders := new(mockOrderRepo)
+	handler := NewOrderEmailHandler(notifications, orders)
+
+	order := types.Order{
+		ID:      "42",
+		UserID:  "7",
+		Status:  types.OrderPaid,
+		Address: types.Address{Email: "customer@example.com"},
+		Items:   []types.OrderItem{{Product: types.Product{Name: "Lamp"}, Quantity: 2, UnitPrice: 1999}},
+	}
+	orders.On("GetOrderByID", mock.Anything, "42").Return(order, nil).Once()
+	notifications.On("EmailOrder", mock.Anything, "customer@example.com", types.NotificationOrderConf, SubjectOrderConf, EmailOrderConf, order).Return(nil).Once()
+
+	change := types.OrderStatusChange{OrderID: "42", UserID: "7", Status: types.OrderPaid}
+	err := handler(context.Background(), pendingEvent(types.EventTypeOrderStatusChanged, change))
+
+	assert.NoError(t, err)
+	notifications.AssertExpectations(t)
+}
+
+func TestOrderEmailHandler_CanceledUsesEventItems(t *testing.T) {
+	notifications := new(mockNotificationService)
+	orders := new(mockOrderRepo)
+	handler := NewOrderEmailHandler(notifications, orders)
+
+	items := []types.OrderItem{{Product: types.Product{Name: "Lamp"}, Quantity: 1, UnitPrice: 1999}}
+	order := types.Order{
+		ID:      "42",
+		UserID:  "7",
+		Status:  types.OrderCanceled,
+		Address: types.Address{Email: "customer@example.com"},
+		Items:   []types.OrderItem{},
+	}
+	orders.On("GetOrderByID", mock.Anything, "42").Return(order, nil).Once()
+	notifications.On("EmailOrder", mock.Anything, "customer@example.com", types.NotificationOrderUpdates, SubjectOrderCancel, EmailOrderCancel, mock.MatchedBy(func(o types.Order) bool {
+		return len(o.Items) == 1 && o.Items[0].Product.Name == "Lamp" && o.Items[0].UnitPrice == 1999
+	})).Return(nil).Once()
+
+	change := types.OrderStatusChange{OrderID: "42", UserID: "7", Status: types.OrderCanceled, Items: items}
+	err := handler(context.Background(), pendingEvent(types.EventTypeOrderStatusChanged, change))
+
+	assert.NoError(t, err)
+	notifications.AssertExpectations(t)
+}
+
+type mockStreamService struct {
+	mock.Mock
+	StreamService
+}
+
+func (m *mockStreamService) Publish(ctx context.Context, userID string, eventType types.StreamEventType, data interface{}) error {
+	args := m.Called(ctx, userID, eventType, data)
+	return args.Error(0)
+}
+
+func TestStreamHandler_OrderStatusChanged(t *testing.T) {
+	streams := new(mockStreamService)
+	handler := NewStreamHandler(streams)
+
+	items := []types.OrderItem{{Product: types.Product{Name: "Lamp"}, Quantity: 1, UnitPrice: 1999}}
+	change := types.OrderStatusChange{OrderID: "42", UserID: "7", Status: types.OrderCanceled, Items: items}
+	streams.On("Publish", mock.Anything, "7", types.StreamOrder, types.OrderStatusChange{OrderID: "42", UserID: "7", Status: types.OrderCanceled}).Return(nil).Once()
+
+	err := handler(context.Background(), pendingEvent(types.EventTypeOrderStatusChanged, change))
+
+	assert.NoError(t, err)
+	streams.AssertExpectations(t)
+}
@@ -19,6 +19,7 @@ type PasswordService interface {
 	StoreResetCode(ctx context.Context, code string, email string) error
 	ValidateResetCode(ctx context.Context, code, email string) error
 	ResetPassword(ctx context.Context, code, email, password string) error
+	InvalidateResetCode(ctx context.Context, email string) error
 }
 
 type passwordService struct {
@@ -101,3 +102,12 @@ func (s *passwordService) ResetPassword(ctx context.Context, code, email, passwo
 	}
 	return s.repo.UpdatePassword(ctx, email, string(hashedPassword))
 }
+
+// InvalidateResetCode marks the active reset code as used, e.g. after too many failed attempts
+func (s *passwordService) InvalidateResetCode(ctx context.Context, email string) error {
+	err := s.repo.MarkResetCodeUsed(ctx, email)
+	if err == types.ErrNotFound {
+		return nil
+	}
+	return err
+}
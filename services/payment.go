@@ -33,25 +33,19 @@ type PaymentService interface {
 }
 
 type paymentService struct {
-	HttpClient          utilities.HTTPClient
-	config              types.PaymentConfig
-	notificationService NotificationService
-	userService         UserService
-	repo                repositories.OrderRepository
+	HttpClient utilities.HTTPClient
+	config     types.PaymentConfig
+	repo       repositories.OrderRepository
 }
 
 func NewPaymentService(
 	httpClient utilities.HTTPClient,
 	config types.PaymentConfig,
-	notificationService NotificationService,
-	userService UserService,
 	repo repositories.OrderRepository) PaymentService {
 	return &paymentService{
-		HttpClient:          httpClient,
-		config:              config,
-		notificationService: notificationService,
-		userService:         userService,
-		repo:                repo,
+		HttpClient: httpClient,
+		config:     config,
+		repo:       repo,
 	}
 }
 
@@ -263,7 +257,8 @@ func (s *paymentService) handlePaymentIntentCreated(ctx context.Context, pi *str
 // handlePaymentIntentSucceeded processes the PaymentIntentSucceeded event.
 // It verifies the payment intent against the order details.
 // If the order is pending and the amounts match, it marks the order as paid.
-// If the order is not pending or the amounts do not match, it returns an error.
+// If the order was canceled, or can no longer be paid, the payment is refunded.
+// If the amounts do not match, it returns an error.
 // This function is called when a PaymentIntentSucceeded event is received.
 func (s *paymentService) handlePaymentIntentSucceeded(ctx context.Context, pi *stripe.PaymentIntent) error {
 	orderID := pi.Metadata["order_id"]
@@ -276,6 +271,10 @@ func (s *paymentService) handlePaymentIntentSucceeded(ctx context.Context, pi *s
 	if err != nil {
 		return err
 	}
+	if order.Status == types.OrderCanceled {
+		// e.g. its offer expired while paying, which canceled the order
+		return s.refundPaymentIntent(ctx, pi, order.ID)
+	}
 	if order.Status != types.OrderPending {
 		slog.Error("Payment intent succeeded for non-pending order", "order_id", order.ID, "status", order.Status)
 		return nil
@@ -290,21 +289,57 @@ func (s *paymentService) handlePaymentIntentSucceeded(ctx context.Context, pi *s
 	// mark order as paid
 	order.Status = types.OrderPaid
 	err = s.repo.UpdateOrder(ctx, &order)
+	if err == types.ErrConstraintViolation {
+		// e.g. its offer expired while paying, the order is left unpaid
+		return s.refundPaymentIntent(ctx, pi, order.ID)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to mark order as paid: order_id=%s, error=%w", order.ID, err)
 	}
 
 	slog.Info("Order marked as paid", "order_id", order.ID, "payment_intent_id", pi.ID)
 
-	// notify user that order payment has been received
-	go s.notificationService.NotifyOrder(order.UserID, SubjectOrderConf, NotifyOrderConf, order)
+	return nil
+}
+
+// refundPaymentIntent refunds in full a payment received for an order which can no longer be paid.
+// The refund is idempotent per payment intent, so retried webhook events do not refund twice.
+func (s *paymentService) refundPaymentIntent(ctx context.Context, pi *stripe.PaymentIntent, orderID string) error {
+	slog.WarnContext(ctx, "Payment received for an order which can no longer be paid, refunding",
+		"order_id", orderID, "payment_intent_id", pi.ID)
 
-	// notify admin(s) that an order has been received
-	admins, _ := s.userService.GetAllAdmins(context.Background())
-	for _, admin := range admins {
-		go s.notificationService.NotifyOrder(admin.ID, SubjectOrderRecv, NotifyOrderRecv, order)
+	reqURL, err := url.JoinPath(s.config.Stripe.BaseURL, "refunds")
+	if err != nil {
+		return err
+	}
+	payload := url.Values{
+		"payment_intent":        {pi.ID},
+		"reason":                {"requested_by_customer"},
+		"metadata[order_id]":    {orderID},
+		"metadata[environment]": {string(s.config.Environment)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, strings.NewReader(payload.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.config.Stripe.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("refund-%s", pi.ID))
+	req.Header.Set("Stripe-Version", s.config.Stripe.Version)
+
+	res, err := s.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// an error has Stripe retry the event, and with it the refund
+	if res.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Stripe API returned non-OK status", "status", res.StatusCode, "url", s.config.Stripe.BaseURL)
+		return fmt.Errorf("failed to refund payment intent: order_id=%s, status=%s", orderID, res.Status)
 	}
 
+	slog.InfoContext(ctx, "Payment refunded", "order_id", orderID, "payment_intent_id", pi.ID)
 	return nil
 }
 
@@ -345,6 +380,12 @@ func (s *paymentService) handleRefund(ctx context.Context, charge *stripe.Charge
 		return nil
 	}
 
+	// Payments refunded as the order could no longer be paid, the order was never marked paid
+	if order.Status == types.OrderPending || order.Status == types.OrderCanceled {
+		slog.Debug("Charge refunded for an unpaid order", "id", charge.ID, "order_id", orderID, "status", order.Status)
+		return nil
+	}
+
 	// Check if the order is eligible for a refund
 	isEligible := order.Status == types.OrderPaid ||
 		order.Status == types.OrderShipped ||
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/types/stripe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPaymentIntentSucceeded_Refund(t *testing.T) {
+	config := types.PaymentConfig{Stripe: types.StripeConfig{BaseURL: "https://api.stripe.test/v1", SecretKey: "sk_test"}}
+	pi := &stripe.PaymentIntent{ID: "pi_1", Amount: 1000, Currency: "usd", Metadata: map[string]string{"order_id": "order1"}}
+	isRefund := mock.MatchedBy(func(req *http.Request) bool {
+		body, _ := io.ReadAll(req.Body)
+		return req.URL.String() == "https://api.stripe.test/v1/refunds" &&
+			req.Header.Get("Idempotency-Key") == "refund-pi_1" &&
+			strings.Contains(string(body), "payment_intent=pi_1")
+	})
+	ok := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}
+
+	t.Run("order can no longer be paid", func(t *testing.T) {
+		repo := new(mockOrderRepo)
+		client := new(MockHTTPClient)
+		repo.On("GetOrderByID", mock.Anything, "order1").Return(types.Order{ID: "order1", Status: types.OrderPending, TotalAmount: 1000}, nil)
+		repo.On("UpdateOrder", mock.Anything, mock.Anything).Return(types.ErrConstraintViolation)
+		client.On("Do", isRefund).Return(ok, nil).Once()
+
+		service := &paymentService{HttpClient: client, config: config, repo: repo}
+		assert.NoError(t, service.handlePaymentIntentSucceeded(context.Background(), pi))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("order canceled", func(t *testing.T) {
+		repo := new(mockOrderRepo)
+		client := new(MockHTTPClient)
+		repo.On("GetOrderByID", mock.Anything, "order1").Return(types.Order{ID: "order1", Status: types.OrderCanceled, TotalAmount: 1000}, nil)
+		client.On("Do", isRefund).Return(ok, nil).Once()
+
+		service := &paymentService{HttpClient: client, config: config, repo: repo}
+		assert.NoError(t, service.handlePaymentIntentSucceeded(context.Background(), pi))
+		repo.AssertNotCalled(t, "UpdateOrder", mock.Anything, mock.Anything)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("refund failed", func(t *testing.T) {
+		repo := new(mockOrderRepo)
+		client := new(MockHTTPClient)
+		repo.On("GetOrderByID", mock.Anything, "order1").Return(types.Order{ID: "order1", Status: types.OrderCanceled, TotalAmount: 1000}, nil)
+		client.On("Do", isRefund).Return(&http.Response{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway", Body: io.NopCloser(strings.NewReader(""))}, nil).Once()
+
+		service := &paymentService{HttpClient: client, config: config, repo: repo}
+		assert.Error(t, service.handlePaymentIntentSucceeded(context.Background(), pi))
+	})
+}
+
+func TestHandleRefund_UnpaidOrder(t *testing.T) {
+	repo := new(mockOrderRepo)
+	repo.On("GetOrderByID", mock.Anything, "order1").Return(types.Order{ID: "order1", Status: types.OrderCanceled}, nil)
+
+	service := &paymentService{repo: repo}
+	charge := &stripe.Charge{ID: "ch_1", Currency: "usd", Metadata: map[string]string{"order_id": "order1"}}
+	assert.NoError(t, service.handleRefund(context.Background(), charge))
+	repo.AssertNotCalled(t, "UpdateOrder", mock.Anything, mock.Anything)
+}
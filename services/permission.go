@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+)
+
+// permissionCacheTTL controls how long role permissions are cached before
+// being reloaded, so changes made on another instance propagate.
+const permissionCacheTTL = time.Minute
+
+type PermissionService interface {
+	HasPermission(ctx context.Context, role types.Role, perm types.Permission) bool
+	GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error)
+	UpdateRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error
+}
+
+type permissionService struct {
+	repo     repositories.PermissionRepository
+	mu       sync.RWMutex
+	cache    map[types.Role]map[types.Permission]bool
+	loadedAt time.Time
+}
+
+func NewPermissionService(repo repositories.PermissionRepository) PermissionService {
+	return &permissionService{repo: repo}
+}
+
+// HasPermission reports whether the role has been granted the permission
+func (s *permissionService) HasPermission(ctx context.Context, role types.Role, perm types.Permission) bool {
+	s.mu.RLock()
+	cache, loadedAt := s.cache, s.loadedAt
+	s.mu.RUnlock()
+
+	if cache == nil || time.Since(loadedAt) > permissionCacheTTL {
+		if err := s.reload(ctx); err != nil {
+			// fall back to stale cache, if any
+			slog.ErrorContext(ctx, "Error loading role permissions", "error", err)
+		}
+		s.mu.RLock()
+		cache = s.cache
+		s.mu.RUnlock()
+	}
+
+	return cache[role][perm]
+}
+
+func (s *permissionService) GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error) {
+	return s.repo.GetRolePermissions(ctx)
+}
+
+// UpdateRolePermissions replaces the permissions granted to a role.
+// The admin bundle is fixed to prevent locking every admin out.
+func (s *permissionService) UpdateRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error {
+	switch role {
+	case types.RoleGuest, types.RoleUser, types.RoleMember, types.RoleStaff:
+	default:
+		return types.ErrInvalidInput
+	}
+	for _, perm := range permissions {
+		if !perm.IsValid() {
+			return types.ErrInvalidInput
+		}
+	}
+
+	if err := s.repo.SetRolePermissions(ctx, role, permissions); err != nil {
+		return err
+	}
+	return s.reload(ctx)
+}
+
+func (s *permissionService) reload(ctx context.Context) error {
+	rolePerms, err := s.repo.GetRolePermissions(ctx)
+	if err != nil {
+		return err
+	}
+
+	cache := make(map[types.Role]map[types.Permission]bool, len(rolePerms))
+	for _, rp := range rolePerms {
+		perms := make(map[types.Permission]bool, len(rp.Permissions))
+		for _, perm := range rp.Permissions {
+			perms[perm] = true
+		}
+		cache[rp.Role] = perms
+	}
+
+	s.mu.Lock()
+	s.cache = cache
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
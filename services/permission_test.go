@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockPermissionRepo struct {
+	mock.Mock
+}
+
+func (m *mockPermissionRepo) GetRolePermissions(ctx context.Context) ([]types.RolePermissions, error) {
+	args := m.Called(ctx)
+	if v := args.Get(0); v != nil {
+		return v.([]types.RolePermissions), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockPermissionRepo) SetRolePermissions(ctx context.Context, role types.Role, permissions []types.Permission) error {
+	args := m.Called(ctx, role, permissions)
+	return args.Error(0)
+}
+
+func TestHasPermission_CachesRolePermissions(t *testing.T) {
+	repo := new(mockPermissionRepo)
+	svc := NewPermissionService(repo)
+	ctx := context.Background()
+
+	repo.On("GetRolePermissions", ctx).Return([]types.RolePermissions{
+		{Role: types.RoleStaff, Permissions: []types.Permission{types.PermOrdersRead, types.PermOrdersFulfill}},
+	}, nil).Once()
+
+	assert.True(t, svc.HasPermission(ctx, types.RoleStaff, types.PermOrdersFulfill))
+	assert.False(t, svc.HasPermission(ctx, types.RoleStaff, types.PermUsersRead))
+	assert.False(t, svc.HasPermission(ctx, types.RoleUser, types.PermOrdersRead))
+
+	// permissions are loaded once and served from cache afterwards
+	repo.AssertNumberOfCalls(t, "GetRolePermissions", 1)
+}
+
+func TestUpdateRolePermissions_Validation(t *testing.T) {
+	repo := new(mockPermissionRepo)
+	svc := NewPermissionService(repo)
+	ctx := context.Background()
+
+	err := svc.UpdateRolePermissions(ctx, types.RoleAdmin, []types.Permission{types.PermOrdersRead})
+	assert.Equal(t, types.ErrInvalidInput, err, "expected admin bundle to be fixed")
+
+	err = svc.UpdateRolePermissions(ctx, types.RoleStaff, []types.Permission{"orders:delete"})
+	assert.Equal(t, types.ErrInvalidInput, err, "expected unknown permission to be rejected")
+
+	repo.AssertNotCalled(t, "SetRolePermissions", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUpdateRolePermissions_ReloadsCache(t *testing.T) {
+	repo := new(mockPermissionRepo)
+	svc := NewPermissionService(repo)
+	ctx := context.Background()
+
+	perms := []types.Permission{types.PermOrdersRead, types.PermOrdersFulfill}
+	repo.On("SetRolePermissions", ctx, types.RoleStaff, perms).Return(nil)
+	repo.On("GetRolePermissions", ctx).Return([]types.RolePermissions{
+		{Role: types.RoleStaff, Permissions: perms},
+	}, nil).Once()
+
+	err := svc.UpdateRolePermissions(ctx, types.RoleStaff, perms)
+	assert.NoError(t, err)
+	assert.True(t, svc.HasPermission(ctx, types.RoleStaff, types.PermOrdersFulfill))
+
+	repo.AssertExpectations(t)
+}
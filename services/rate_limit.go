@@ -10,6 +10,7 @@ import (
 type RateLimitService interface {
 	GetHitCount(ctx context.Context, rl *types.RateLimit) error
 	RecordHit(ctx context.Context, rl *types.RateLimit) error
+	RecordKeyHit(ctx context.Context, rl *types.RateLimit) error
 }
 
 type rateLimitService struct {
@@ -29,3 +30,7 @@ func (s *rateLimitService) GetHitCount(ctx context.Context, rl *types.RateLimit)
 func (s *rateLimitService) RecordHit(ctx context.Context, rl *types.RateLimit) error {
 	return s.repo.RecordHit(ctx, rl)
 }
+
+func (s *rateLimitService) RecordKeyHit(ctx context.Context, rl *types.RateLimit) error {
+	return s.repo.RecordKeyHit(ctx, rl)
+}
@@ -26,6 +26,11 @@ func (m *MockRateLimitRepository) RecordHit(ctx context.Context, rl *types.RateL
 	return args.Error(0)
 }
 
+func (m *MockRateLimitRepository) RecordKeyHit(ctx context.Context, rl *types.RateLimit) error {
+	args := m.Called(ctx, rl)
+	return args.Error(0)
+}
+
 func TestRateLimitService_GetHitCount(t *testing.T) {
 	mockRepo := new(MockRateLimitRepository)
 	service := services.NewRateLimitService(mockRepo)
@@ -10,7 +10,8 @@ import (
 
 type RegistrationService interface {
 	CreateCode(ctx context.Context, userID string, expiry time.Time) (string, error)
-	VerifyCode(ctx context.Context, code string) (*types.User, error)
+	VerifyCode(ctx context.Context, email, code string) (*types.User, error)
+	RemoveCodes(ctx context.Context, email string) (*types.User, error)
 }
 
 type registrationService struct {
@@ -35,6 +36,11 @@ func (s *registrationService) CreateCode(ctx context.Context, userID string, exp
 	return code, nil
 }
 
-func (s *registrationService) VerifyCode(ctx context.Context, code string) (*types.User, error) {
-	return s.repo.VerifyCode(ctx, code)
+func (s *registrationService) VerifyCode(ctx context.Context, email, code string) (*types.User, error) {
+	return s.repo.VerifyCode(ctx, email, code)
+}
+
+// RemoveCodes invalidates the pending registration of the unverified account with the email
+func (s *registrationService) RemoveCodes(ctx context.Context, email string) (*types.User, error) {
+	return s.repo.RemoveCodes(ctx, email)
 }
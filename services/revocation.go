@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+)
+
+// revocationCacheTTL controls how long token revocations are cached before
+// being reloaded, so revocations made on another instance propagate within seconds.
+const revocationCacheTTL = 5 * time.Second
+
+// TokenRevocationService invalidates access tokens before they expire,
+// e.g. when a user is removed, demoted, or changes their credentials.
+type TokenRevocationService interface {
+	RevokeTokens(ctx context.Context, userID string) error
+	IsRevoked(ctx context.Context, userID string, issuedAt time.Time) bool
+}
+
+type revocationService struct {
+	repo     repositories.RevocationRepository
+	window   time.Duration // access token lifetime, older revocations are irrelevant
+	mu       sync.RWMutex
+	cache    map[string]time.Time
+	loadedAt time.Time
+}
+
+func NewTokenRevocationService(repo repositories.RevocationRepository, tokenExpiry time.Duration) TokenRevocationService {
+	return &revocationService{repo: repo, window: tokenExpiry}
+}
+
+// RevokeTokens rejects all access tokens issued to the user up until now
+func (s *revocationService) RevokeTokens(ctx context.Context, userID string) error {
+	revokedAt, err := s.repo.RevokeTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	// take effect on this instance immediately
+	s.mu.Lock()
+	if s.cache != nil {
+		s.cache[userID] = revokedAt
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// IsRevoked reports whether a token issued to the user at issuedAt has been revoked.
+// Token timestamps have second precision, so tokens issued within the same second
+// as the revocation remain valid. This allows reissuing tokens right after revoking.
+func (s *revocationService) IsRevoked(ctx context.Context, userID string, issuedAt time.Time) bool {
+	s.mu.RLock()
+	cache, loadedAt := s.cache, s.loadedAt
+	s.mu.RUnlock()
+
+	if cache == nil || time.Since(loadedAt) > revocationCacheTTL {
+		if err := s.reload(ctx); err != nil {
+			// fall back to stale cache, if any
+			slog.ErrorContext(ctx, "Error loading token revocations", "error", err)
+		}
+		s.mu.RLock()
+		cache = s.cache
+		s.mu.RUnlock()
+	}
+
+	s.mu.RLock()
+	revokedAt, ok := cache[userID]
+	s.mu.RUnlock()
+	return ok && issuedAt.Before(revokedAt.Truncate(time.Second))
+}
+
+func (s *revocationService) reload(ctx context.Context) error {
+	cache, err := s.repo.GetRevocations(ctx, s.window)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cache = cache
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
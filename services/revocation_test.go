@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockRevocationRepo struct {
+	mock.Mock
+}
+
+func (m *mockRevocationRepo) RevokeTokens(ctx context.Context, userID string) (time.Time, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *mockRevocationRepo) GetRevocations(ctx context.Context, window time.Duration) (map[string]time.Time, error) {
+	args := m.Called(ctx, window)
+	if v := args.Get(0); v != nil {
+		return v.(map[string]time.Time), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func TestIsRevoked(t *testing.T) {
+	repo := new(mockRevocationRepo)
+	svc := NewTokenRevocationService(repo, time.Hour)
+	ctx := context.Background()
+
+	revokedAt := time.Date(2025, 1, 1, 12, 0, 0, 500_000_000, time.UTC)
+	repo.On("GetRevocations", ctx, time.Hour).Return(map[string]time.Time{"1": revokedAt}, nil).Once()
+
+	assert.True(t, svc.IsRevoked(ctx, "1", revokedAt.Add(-time.Minute)), "expected earlier token to be revoked")
+	assert.False(t, svc.IsRevoked(ctx, "1", revokedAt.Truncate(time.Second)), "expected token issued in the same second to be valid")
+	assert.False(t, svc.IsRevoked(ctx, "1", revokedAt.Add(time.Minute)), "expected later token to be valid")
+	assert.False(t, svc.IsRevoked(ctx, "2", revokedAt.Add(-time.Minute)), "expected other users to be unaffected")
+
+	// revocations are loaded once and served from cache afterwards
+	repo.AssertNumberOfCalls(t, "GetRevocations", 1)
+}
+
+func TestRevokeTokens_UpdatesCache(t *testing.T) {
+	repo := new(mockRevocationRepo)
+	svc := NewTokenRevocationService(repo, time.Hour)
+	ctx := context.Background()
+
+	revokedAt := time.Now().UTC()
+	repo.On("GetRevocations", ctx, time.Hour).Return(map[string]time.Time{}, nil).Once()
+	repo.On("RevokeTokens", ctx, "1").Return(revokedAt, nil).Once()
+
+	issuedAt := revokedAt.Add(-time.Minute)
+	assert.False(t, svc.IsRevoked(ctx, "1", issuedAt))
+	assert.NoError(t, svc.RevokeTokens(ctx, "1"))
+	assert.True(t, svc.IsRevoked(ctx, "1", issuedAt), "expected revocation to take effect without reload")
+
+	repo.AssertNumberOfCalls(t, "GetRevocations", 1)
+}
@@ -4,13 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/dgyurics/marketplace/types"
 )
 
 type scheduleService struct {
-	db *sql.DB
+	db          *sql.DB
+	auditConfig types.AuditConfig
+	jwtConfig   types.JWTConfig
+	outbox      OutboxService
+	offers      OfferService
 }
 
 // ScheduleService is responsible for running tasks at intervals
@@ -18,22 +23,38 @@ type ScheduleService interface {
 	Start(ctx context.Context)
 }
 
-func NewScheduleService(db *sql.DB) ScheduleService {
+// outboxInterval is how often the outbox is checked for due events
+const outboxInterval = 2 * time.Second
+
+func NewScheduleService(db *sql.DB, auditConfig types.AuditConfig, jwtConfig types.JWTConfig, outbox OutboxService, offers OfferService) ScheduleService {
 	return &scheduleService{
-		db: db,
+		db:          db,
+		auditConfig: auditConfig,
+		jwtConfig:   jwtConfig,
+		outbox:      outbox,
+		offers:      offers,
 	}
 }
 
 // Start starts the scheduling service.
 // Pass it root context to allow for clean shutdown.
+// Start returns once in-flight outbox events have been handled.
 func (s *scheduleService) Start(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Minute)
 	defer ticker.Stop()
 
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.dispatchOutbox(ctx)
+	}()
+
 	slog.Info("Scheduling service started")
 	for {
 		select {
 		case <-ctx.Done():
+			wg.Wait()
 			slog.Info("Scheduling service stopped")
 			return
 		case <-ticker.C:
@@ -62,6 +83,56 @@ func (s *scheduleService) Start(ctx context.Context) {
 				s.removeExpiredPasswordResets(ctxTimeout)
 				cancel()
 			}
+			if s.shouldRunJob(ctx, types.ExpiredAuditEntries, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.removeExpiredAuditEntries(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredLockouts, time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+				s.removeExpiredLockouts(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredTokenRevocations, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+				s.removeExpiredTokenRevocations(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredEmailChanges, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+				s.removeExpiredEmailChanges(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredOIDCStates, time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+				s.removeExpiredOIDCStates(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredWebhookDeliveries, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.removeExpiredWebhookDeliveries(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredOutboxEvents, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.removeExpiredOutboxEvents(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredEmails, 24*time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.removeExpiredEmails(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredStreamEvents, time.Hour) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.removeExpiredStreamEvents(ctxTimeout)
+				cancel()
+			}
+			if s.shouldRunJob(ctx, types.ExpiredOffers, 10*time.Minute) {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+				s.expireOffers(ctxTimeout)
+				cancel()
+			}
 			// TODO ExpiredRegistrationCodes
 		}
 	}
@@ -73,19 +144,21 @@ func (s *scheduleService) removeStaleOrders(ctx context.Context) {
 			UPDATE orders
 			SET status = 'canceled', updated_at = NOW()
 			WHERE status = 'pending' AND updated_at < NOW() - INTERVAL '15 minutes'
-			RETURNING id, address_id
+			RETURNING id, address_id, offer_id
 		),
 		deleted_items AS (
 			DELETE FROM order_items oi
 			USING canceled_orders co
 			WHERE oi.order_id = co.id
-			RETURNING oi.product_id, oi.quantity
+			RETURNING oi.product_id, oi.quantity, co.offer_id
 		),
 		restored AS (
 			UPDATE products
 			SET inventory = inventory + di.quantity
 			FROM deleted_items di
 			WHERE products.id = di.product_id
+			-- accepted offers hold their unit until paid or expired
+			AND NOT EXISTS (SELECT 1 FROM offers WHERE id = di.offer_id AND status = 'accepted')
 		)
 		DELETE FROM addresses
 		WHERE id IN (SELECT address_id FROM canceled_orders)
@@ -102,6 +175,12 @@ func (s *scheduleService) removeStaleRateLimits(ctx context.Context) {
 	if err != nil {
 		slog.ErrorContext(ctx, "Error removing stale rate limits", "error", err)
 	}
+	_, err = s.db.ExecContext(ctx, `
+		DELETE FROM key_rate_limits
+		WHERE expires_at < NOW()`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing stale key rate limits", "error", err)
+	}
 }
 
 func (s *scheduleService) removeStaleCartItems(ctx context.Context) {
@@ -131,6 +210,122 @@ func (s *scheduleService) removeExpiredPasswordResets(ctx context.Context) {
 	}
 }
 
+func (s *scheduleService) removeExpiredAuditEntries(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM audit_log
+		WHERE created_at < NOW() - make_interval(secs => $1)`,
+		s.auditConfig.Retention.Seconds())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired audit entries", "error", err)
+	}
+}
+
+func (s *scheduleService) removeExpiredLockouts(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM lockouts
+		WHERE updated_at < NOW() - INTERVAL '1 day'
+		AND (locked_until IS NULL OR locked_until < NOW())`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired lockouts", "error", err)
+	}
+}
+
+// removeExpiredTokenRevocations removes revocations older than the access token lifetime,
+// every token they apply to has expired
+func (s *scheduleService) removeExpiredTokenRevocations(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM token_revocations
+		WHERE revoked_at < NOW() - make_interval(secs => $1)`,
+		s.jwtConfig.Expiry.Seconds())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired token revocations", "error", err)
+	}
+}
+
+func (s *scheduleService) removeExpiredEmailChanges(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM email_change_codes
+		WHERE expires_at < NOW()`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired email change codes", "error", err)
+	}
+}
+
+func (s *scheduleService) removeExpiredOIDCStates(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM oidc_auth_states
+		WHERE expires_at < NOW()`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired OIDC authorization states", "error", err)
+	}
+}
+
+// removeExpiredWebhookDeliveries removes the delivery log of completed deliveries after 30 days
+func (s *scheduleService) removeExpiredWebhookDeliveries(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE status != 'pending' AND created_at < NOW() - INTERVAL '30 days'`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired webhook deliveries", "error", err)
+	}
+}
+
+// removeExpiredOutboxEvents removes handled and failed outbox events after 7 days
+func (s *scheduleService) removeExpiredOutboxEvents(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM outbox_events
+		WHERE status != 'pending' AND created_at < NOW() - INTERVAL '7 days'`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired outbox events", "error", err)
+	}
+}
+
+// removeExpiredEmails removes the delivery log of emails which are no longer queued after 30 days
+func (s *scheduleService) removeExpiredEmails(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM emails
+		WHERE status != 'queued' AND created_at < NOW() - INTERVAL '30 days'`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired emails", "error", err)
+	}
+}
+
+// removeExpiredStreamEvents removes stream events after a day, clients reconnecting later miss them
+func (s *scheduleService) removeExpiredStreamEvents(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM stream_events
+		WHERE created_at < NOW() - INTERVAL '1 day'`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error removing expired stream events", "error", err)
+	}
+}
+
+// expireOffers expires open offers left unanswered, and accepted offers left unpaid, notifying both parties
+func (s *scheduleService) expireOffers(ctx context.Context) {
+	count, err := s.offers.ExpireOffers(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error expiring offers", "error", err)
+	}
+	if count > 0 {
+		slog.InfoContext(ctx, "Expired offers", "count", count)
+	}
+}
+
+// dispatchOutbox dispatches outbox events until ctx is canceled
+func (s *scheduleService) dispatchOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.outbox.Dispatch(ctx)
+		}
+	}
+}
+
 // shouldRunJob checks if enough time has passed since the last run and updates the timestamp
 func (s *scheduleService) shouldRunJob(ctx context.Context, job types.Job, interval time.Duration) bool {
 	var lastRun sql.NullTime
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+)
+
+const (
+	streamMaxConnections = 5   // streams a user may have open on each instance
+	streamBatchSize      = 100 // events fetched at once when catching up
+	streamRetryDelay     = 5 * time.Second
+	streamTokenExpiry    = time.Minute // stream tokens are only used to open a stream
+)
+
+// ErrTooManyStreams is returned when subscribing a user who has streamMaxConnections streams open
+var ErrTooManyStreams = errors.New("too many streams")
+
+// StreamService streams events, such as new messages and order status changes, to users.
+// Events are stored and announced with Postgres NOTIFY, so a user's streams receive them
+// whichever instance the change happened on.
+type StreamService interface {
+	Publish(ctx context.Context, userID string, eventType types.StreamEventType, data interface{}) error
+	Subscribe(ctx context.Context, lastEventID string) (<-chan types.StreamEvent, error)
+	Listen(ctx context.Context)
+	CreateToken(ctx context.Context) (string, error)
+	ParseToken(token string) (*types.User, error)
+}
+
+type streamSubscriber struct {
+	userID string
+	lastID string        // ID of the last event sent, the user's events commit in ID order
+	wake   chan struct{} // signals that events may be due, buffered so notifying never blocks
+	events chan types.StreamEvent
+}
+
+type streamService struct {
+	repo        repositories.StreamRepository
+	hmacSecret  []byte
+	mu          sync.Mutex
+	subscribers map[string]map[*streamSubscriber]struct{} // by user ID
+	done        chan struct{}                             // closed once Listen returns, ending every stream
+}
+
+func NewStreamService(repo repositories.StreamRepository, hmacSecret []byte) StreamService {
+	return &streamService{
+		repo:        repo,
+		hmacSecret:  hmacSecret,
+		subscribers: make(map[string]map[*streamSubscriber]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Publish stores an event for the user and announces it to their streams
+func (s *streamService) Publish(ctx context.Context, userID string, eventType types.StreamEventType, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.repo.CreateEvent(ctx, &types.StreamEvent{
+		UserID: userID,
+		Type:   eventType,
+		Data:   payload,
+	})
+}
+
+// Subscribe returns the events of the authenticated user, until ctx is canceled or the service stops.
+// Events after lastEventID are sent first, so a reconnecting client misses nothing.
+// Without lastEventID, only events published from now on are sent.
+// Returns ErrTooManyStreams when the user has streamMaxConnections streams open.
+func (s *streamService) Subscribe(ctx context.Context, lastEventID string) (<-chan types.StreamEvent, error) {
+	userID := getUserID(ctx)
+	sub := &streamSubscriber{
+		userID: userID,
+		wake:   make(chan struct{}, 1),
+		events: make(chan types.StreamEvent),
+	}
+	if _, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+		sub.lastID = lastEventID
+		sub.wake <- struct{}{}
+	}
+
+	s.mu.Lock()
+	if len(s.subscribers[userID]) >= streamMaxConnections {
+		s.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	if s.subscribers[userID] == nil {
+		s.subscribers[userID] = make(map[*streamSubscriber]struct{})
+	}
+	s.subscribers[userID][sub] = struct{}{}
+	s.mu.Unlock()
+
+	// subscribed before reading the latest event, so no event in between is missed
+	if sub.lastID == "" {
+		latestID, err := s.repo.GetLatestEventID(ctx, userID)
+		if err != nil {
+			s.unsubscribe(sub)
+			return nil, err
+		}
+		sub.lastID = latestID
+	}
+
+	go s.run(ctx, sub)
+	return sub.events, nil
+}
+
+// run sends the subscriber's due events each time it is woken, until ctx is canceled or the service stops
+func (s *streamService) run(ctx context.Context, sub *streamSubscriber) {
+	defer close(sub.events)
+	defer s.unsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-sub.wake:
+		}
+
+		for {
+			events, err := s.repo.GetEvents(ctx, sub.userID, sub.lastID, streamBatchSize)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "Error fetching stream events", "user_id", sub.userID, "error", err)
+				}
+				break
+			}
+			for _, event := range events {
+				select {
+				case sub.events <- event:
+					sub.lastID = event.ID
+				case <-ctx.Done():
+					return
+				case <-s.done:
+					return
+				}
+			}
+			if len(events) < streamBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func (s *streamService) unsubscribe(sub *streamSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers[sub.userID], sub)
+	if len(s.subscribers[sub.userID]) == 0 {
+		delete(s.subscribers, sub.userID)
+	}
+}
+
+// Listen wakes the streams of users whose events are announced, until ctx is canceled.
+// Once it returns, every stream ends. Must be called once.
+func (s *streamService) Listen(ctx context.Context) {
+	defer close(s.done)
+	for {
+		err := s.repo.Listen(ctx, s.notify)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.ErrorContext(ctx, "Error listening for stream events", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryDelay):
+			s.notify("") // events may have been announced meanwhile
+		}
+	}
+}
+
+// notify wakes the streams of the user in the payload "<user_id>:<event_id>",
+// or every stream when the payload is empty, as events may have been missed
+func (s *streamService) notify(payload string) {
+	userID, _, _ := strings.Cut(payload, ":")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, subs := range s.subscribers {
+		if payload != "" && id != userID {
+			continue
+		}
+		for sub := range subs {
+			select {
+			case sub.wake <- struct{}{}:
+			default: // already woken
+			}
+		}
+	}
+}
+
+// CreateToken returns a short-lived token opening a stream as the authenticated user.
+// Browsers' EventSource cannot send an Authorization header, so it passes the token in the URL.
+func (s *streamService) CreateToken(ctx context.Context) (string, error) {
+	user, ok := ctx.Value(UserKey).(*types.User)
+	if !ok || user == nil {
+		return "", types.ErrNotFound
+	}
+	expiresAt := time.Now().Add(streamTokenExpiry).Unix()
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user.ID + ":" + string(user.Role) + ":" + strconv.FormatInt(expiresAt, 10)))
+	return payload + "." + s.signToken(payload), nil
+}
+
+// ParseToken returns the user of an unexpired stream token, or ErrInvalidInput
+func (s *streamService) ParseToken(token string) (*types.User, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signToken(payload))) {
+		return nil, types.ErrInvalidInput
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, types.ErrInvalidInput
+	}
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, types.ErrInvalidInput
+	}
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, types.ErrInvalidInput
+	}
+	return &types.User{ID: parts[0], Role: types.Role(parts[1])}, nil
+}
+
+// signToken returns the HMAC-SHA256 of the payload.
+// The secret is shared with other signatures, so the purpose is included in the signed data.
+func (s *streamService) signToken(payload string) string {
+	mac := hmac.New(sha256.New, s.hmacSecret)
+	mac.Write([]byte("stream:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
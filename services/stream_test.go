@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockStreamRepo struct {
+	mock.Mock
+}
+
+func (m *mockStreamRepo) CreateEvent(ctx context.Context, event *types.StreamEvent) error {
+	args := m.Called(ctx, event)
+	return args.Error(0)
+}
+
+func (m *mockStreamRepo) GetEvents(ctx context.Context, userID, afterID string, limit int) ([]types.StreamEvent, error) {
+	args := m.Called(ctx, userID, afterID, limit)
+	return args.Get(0).([]types.StreamEvent), args.Error(1)
+}
+
+func (m *mockStreamRepo) GetLatestEventID(ctx context.Context, userID string) (string, error) {
+	args := m.Called(ctx, userID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockStreamRepo) Listen(ctx context.Context, notify func(payload string)) error {
+	args := m.Called(ctx, notify)
+	return args.Error(0)
+}
+
+func userContext(userID string) (context.Context, context.CancelFunc) {
+	return context.WithCancel(context.WithValue(context.Background(), UserKey, &types.User{ID: userID}))
+}
+
+func receive(t *testing.T, events <-chan types.StreamEvent) types.StreamEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event")
+		return types.StreamEvent{}
+	}
+}
+
+func TestSubscribe_CatchesUpAfterLastEventID(t *testing.T) {
+	repo := new(mockStreamRepo)
+	svc := NewStreamService(repo, []byte("secret")).(*streamService)
+	ctx, cancel := userContext("7")
+	defer cancel()
+
+	repo.On("GetEvents", mock.Anything, "7", "40", streamBatchSize).Return([]types.StreamEvent{
+		{ID: "41", UserID: "7", Type: types.StreamMessage},
+		{ID: "42", UserID: "7", Type: types.StreamUnread},
+	}, nil).Once()
+	repo.On("GetEvents", mock.Anything, "7", "42", streamBatchSize).Return([]types.StreamEvent{
+		{ID: "43", UserID: "7", Type: types.StreamOrder},
+	}, nil).Once()
+
+	events, err := svc.Subscribe(ctx, "40")
+	assert.NoError(t, err)
+	assert.Equal(t, "41", receive(t, events).ID)
+	assert.Equal(t, "42", receive(t, events).ID)
+
+	// announced events of other users are ignored
+	svc.notify("8:44")
+	svc.notify("7:43")
+	assert.Equal(t, "43", receive(t, events).ID)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open, "Expected the stream to end with its context")
+	repo.AssertExpectations(t)
+	repo.AssertNotCalled(t, "GetLatestEventID", mock.Anything, mock.Anything)
+}
+
+func TestSubscribe_WithoutLastEventID(t *testing.T) {
+	repo := new(mockStreamRepo)
+	svc := NewStreamService(repo, []byte("secret")).(*streamService)
+	ctx, cancel := userContext("7")
+	defer cancel()
+
+	repo.On("GetLatestEventID", mock.Anything, "7").Return("99", nil).Once()
+	data, _ := json.Marshal(types.InboxUnread{Count: 1})
+	repo.On("GetEvents", mock.Anything, "7", "99", streamBatchSize).Return([]types.StreamEvent{
+		{ID: "100", UserID: "7", Type: types.StreamUnread, Data: data},
+	}, nil).Once()
+
+	events, err := svc.Subscribe(ctx, "not-a-number")
+	assert.NoError(t, err)
+
+	// reconnecting the listener wakes every stream
+	svc.notify("")
+	event := receive(t, events)
+	assert.Equal(t, "100", event.ID)
+	assert.JSONEq(t, `{"count":1}`, string(event.Data))
+	repo.AssertExpectations(t)
+}
+
+func TestSubscribe_ConnectionCap(t *testing.T) {
+	repo := new(mockStreamRepo)
+	svc := NewStreamService(repo, []byte("secret")).(*streamService)
+	repo.On("GetLatestEventID", mock.Anything, mock.Anything).Return("0", nil)
+
+	ctx, cancel := userContext("7")
+	defer cancel()
+	for i := 0; i < streamMaxConnections; i++ {
+		_, err := svc.Subscribe(ctx, "")
+		assert.NoError(t, err)
+	}
+	_, err := svc.Subscribe(ctx, "")
+	assert.Equal(t, ErrTooManyStreams, err)
+
+	// other users are not affected
+	other, cancelOther := userContext("8")
+	defer cancelOther()
+	_, err = svc.Subscribe(other, "")
+	assert.NoError(t, err)
+
+	// closed streams free their slot
+	cancel()
+	assert.Eventually(t, func() bool {
+		svc.mu.Lock()
+		defer svc.mu.Unlock()
+		return len(svc.subscribers["7"]) == 0
+	}, time.Second, 10*time.Millisecond)
+	ctx, cancel = userContext("7")
+	defer cancel()
+	_, err = svc.Subscribe(ctx, "")
+	assert.NoError(t, err)
+}
+
+func TestListen_EndsStreams(t *testing.T) {
+	repo := new(mockStreamRepo)
+	svc := NewStreamService(repo, []byte("secret")).(*streamService)
+	repo.On("GetLatestEventID", mock.Anything, "7").Return("0", nil)
+	repo.On("Listen", mock.Anything, mock.Anything).Return(nil)
+
+	ctx, cancel := userContext("7")
+	defer cancel()
+	events, err := svc.Subscribe(ctx, "")
+	assert.NoError(t, err)
+
+	listenCtx, stop := context.WithCancel(context.Background())
+	stop()
+	svc.Listen(listenCtx)
+
+	select {
+	case _, open := <-events:
+		assert.False(t, open, "Expected the stream to end once Listen returns")
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to end")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	repo := new(mockStreamRepo)
+	svc := NewStreamService(repo, []byte("secret"))
+	repo.On("CreateEvent", mock.Anything, mock.MatchedBy(func(event *types.StreamEvent) bool {
+		return event.UserID == "7" && event.Type == types.StreamUnread && string(event.Data) == `{"count":2}`
+	})).Return(nil).Once()
+
+	err := svc.Publish(context.Background(), "7", types.StreamUnread, types.InboxUnread{Count: 2})
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+}
+
+func TestStreamToken(t *testing.T) {
+	svc := NewStreamService(new(mockStreamRepo), []byte("secret"))
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7", Role: types.RoleUser})
+
+	token, err := svc.CreateToken(ctx)
+	assert.NoError(t, err)
+	user, err := svc.ParseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "7", user.ID)
+	assert.Equal(t, types.RoleUser, user.Role)
+
+	// tokens signed with another secret are rejected
+	other, err := NewStreamService(new(mockStreamRepo), []byte("other")).CreateToken(ctx)
+	assert.NoError(t, err)
+	_, err = svc.ParseToken(other)
+	assert.Equal(t, types.ErrInvalidInput, err)
+
+	// expired tokens are rejected
+	payload := base64.RawURLEncoding.EncodeToString([]byte("7:user:" + strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)))
+	_, err = svc.ParseToken(payload + "." + svc.(*streamService).signToken(payload))
+	assert.Equal(t, types.ErrInvalidInput, err)
+}
@@ -2,24 +2,47 @@ package services
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
 )
 
 const templatesDir = "./utilities/templates"
 
+// templateCacheTTL controls how long template overrides are cached before being reloaded,
+// so versions saved on another instance are rendered within seconds.
+const templateCacheTTL = 5 * time.Second
+
+// Subjects are written in English, and translated by the message catalog of the storefront language
 const (
 	SubjectPasswordReset string = "password reset"
 	SubjectEmailVerify   string = "verify your email"
+	SubjectAccountLocked string = "account temporarily locked"
+	SubjectEmailChange   string = "confirm your new email"
 	SubjectOrderConf     string = "order confirmation"
 	SubjectOrderUpdate   string = "order update"
+	SubjectOrderShipped  string = "your order has shipped"
+	SubjectOrderDeliv    string = "your order has been delivered"
+	SubjectOrderRefund   string = "your order has been refunded"
+	SubjectOrderCancel   string = "your order has been canceled"
 	SubjectOrderRecv     string = "new order received"
 	SubjectOfferConf     string = "offer confirmation"
 	SubjectOfferUpdate   string = "offer update"
 	SubjectOfferRecv     string = "new offer received"
+	SubjectOfferStatus   string = "offer status changed"
 )
 
 // HtmlTemplate identifies a template file by name.
@@ -29,54 +52,457 @@ type HtmlTemplate string
 const (
 	EmailPasswordReset HtmlTemplate = "email_password_reset.html"
 	EmailVerification  HtmlTemplate = "email_verification.html"
+	EmailAccountLocked HtmlTemplate = "email_account_locked.html"
+	EmailChange        HtmlTemplate = "email_change.html"
 	EmailOrderConf     HtmlTemplate = "email_order_confirmation.html"
+	EmailOrderShipped  HtmlTemplate = "email_order_shipped.html"
+	EmailOrderDeliv    HtmlTemplate = "email_order_delivered.html"
+	EmailOrderRefund   HtmlTemplate = "email_order_refunded.html"
+	EmailOrderCancel   HtmlTemplate = "email_order_canceled.html"
+	EmailFooter        HtmlTemplate = "email_footer.html"
 	EmailOfferConf     HtmlTemplate = "email_offer_confirmation.html"
+	EmailAnnouncement  HtmlTemplate = "email_announcement.html"
 )
 
 // Notification templates (rendered in the user inbox)
 const (
-	NotifyOrderConf   HtmlTemplate = "notify_order_confirmation.html"
-	NotifyOrderUpdate HtmlTemplate = "notify_order_update.html"
-	NotifyOrderRecv   HtmlTemplate = "notify_order_received.html"
-	NotifyOfferUpdate HtmlTemplate = "notify_offer_update.html"
-	NotifyOfferConf   HtmlTemplate = "notify_offer_confirmation.html"
-	NotifyOfferRecv   HtmlTemplate = "notify_offer_received.html"
+	NotifyOrderConf    HtmlTemplate = "notify_order_confirmation.html"
+	NotifyOrderUpdate  HtmlTemplate = "notify_order_update.html"
+	NotifyOrderRecv    HtmlTemplate = "notify_order_received.html"
+	NotifyOfferUpdate  HtmlTemplate = "notify_offer_update.html"
+	NotifyOfferConf    HtmlTemplate = "notify_offer_confirmation.html"
+	NotifyOfferRecv    HtmlTemplate = "notify_offer_received.html"
+	NotifyOfferStatus  HtmlTemplate = "notify_offer_status.html"
+	NotifyAnnouncement HtmlTemplate = "notify_announcement.html"
+)
+
+// Page templates (served by the API to visitors following email links)
+const (
+	PageUnsubscribe  HtmlTemplate = "page_unsubscribe.html"
+	PageUnsubscribed HtmlTemplate = "page_unsubscribed.html"
 )
 
-// TemplateService renders named HTML templates with the provided data.
+// TemplateService renders named HTML templates with the provided data,
+// in the storefront language (Locale.Language).
+// Admins can edit templates, whose latest version is rendered instead of the file.
 type TemplateService interface {
-	RenderHtmlToString(name HtmlTemplate, data interface{}) (string, error)
+	RenderHtmlToString(ctx context.Context, name HtmlTemplate, data interface{}) (string, error)
+	Translate(message string) string
+	GetTemplates(ctx context.Context) ([]types.Template, error)
+	GetTemplate(ctx context.Context, name HtmlTemplate) (types.Template, error)
+	GetTemplateVersions(ctx context.Context, name HtmlTemplate) ([]types.TemplateVersion, error)
+	SaveTemplate(ctx context.Context, name HtmlTemplate, body string) (types.TemplateVersion, error)
+	RevertTemplate(ctx context.Context, name HtmlTemplate) (types.TemplateVersion, error)
+	PreviewTemplate(ctx context.Context, name HtmlTemplate, body *string) (string, error)
 }
 
 type templateService struct {
-	templates *template.Template
+	language string
+	files    *template.Template // parsed from the template directory, never executed so it can be cloned
+	sources  map[string]string  // file contents, by template name
+	messages map[string]string  // message catalog, by English message
+	repo     repositories.TemplateRepository
+
+	mu        sync.Mutex
+	templates *template.Template      // files with the overrides applied
+	overrides []types.TemplateVersion // latest versions applied to templates
+	loadedAt  time.Time               // when overrides were last loaded, zero to reload on next render
 }
 
 // NewTemplateService loads all HTML templates at startup.
-func NewTemplateService() TemplateService {
-	templates, err := loadTemplates(templatesDir)
+func NewTemplateService(templateRepo repositories.TemplateRepository) TemplateService {
+	svc, err := newTemplateService(templatesDir, utilities.Locale.Language)
 	if err != nil {
-		slog.Error("Failed to load templates", "error", err, "directory", templatesDir)
+		slog.Error("Failed to load templates", "error", err, "directory", templatesDir, "language", utilities.Locale.Language)
 		os.Exit(1)
 	}
-	return &templateService{templates}
+	svc.repo = templateRepo
+	return svc
 }
 
-// loadTemplates parses all .html files in the given directory into a single template set.
-func loadTemplates(templateDir string) (*template.Template, error) {
-	files, err := filepath.Glob(filepath.Join(templateDir, "*.html"))
+// newTemplateService loads the templates and message catalog of a language, without overrides.
+//
+// Templates in the directory are English. A language overrides them with variants
+// in a subdirectory named after its base language (e.g. de/) and then its tag (e.g. de-DE/),
+// so a template without a variant falls back to the closest one. The same subdirectories
+// hold message catalogs (messages.json) translating subjects and the labels of the "t" func.
+func newTemplateService(dir, language string) (*templateService, error) {
+	variants := languageDirs(dir, language)
+	messages, err := loadMessages(variants)
 	if err != nil {
 		return nil, err
 	}
+	files, sources, err := loadTemplates(dir, variants, templateFuncs(language, messages))
+	if err != nil {
+		return nil, err
+	}
+	templates, err := files.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &templateService{
+		language:  language,
+		files:     files,
+		sources:   sources,
+		messages:  messages,
+		templates: templates,
+	}, nil
+}
+
+// languageDirs returns the subdirectories holding variants of a language, most general first
+func languageDirs(dir, language string) []string {
+	if language == "" {
+		return nil
+	}
+	base := utilities.BaseLanguage(language)
+	dirs := []string{filepath.Join(dir, base)}
+	if base != language {
+		dirs = append(dirs, filepath.Join(dir, language))
+	}
+	return dirs
+}
+
+// templateFuncs are available to every template, formatting for the given language
+func templateFuncs(language string, messages map[string]string) template.FuncMap {
+	return template.FuncMap{
+		// money formats an amount in minor units using the configured currency, e.g. "$19.99"
+		"money": func(amount int64) string {
+			return utilities.FormatMoney(amount, utilities.Locale.Currency, utilities.Locale.MinorUnits, language)
+		},
+		// date formats the date of a time, e.g. "Jan 2, 2006"
+		"date": func(t time.Time) string {
+			return utilities.FormatDate(t, language)
+		},
+		// datetime formats the date and time of a time, e.g. "Jan 2, 2006 3:04 PM MST"
+		"datetime": func(t time.Time) string {
+			return utilities.FormatDateTime(t, language)
+		},
+		// t translates a message using the message catalog, e.g. {{t "Subtotal"}}
+		"t": func(message string) string {
+			return translate(messages, message)
+		},
+	}
+}
+
+// loadTemplates parses all .html files in the given directory into a single template set,
+// then the .html files of each variant directory, replacing templates of the same name.
+// Returns the contents of the files parsed last for each template.
+func loadTemplates(templateDir string, variantDirs []string, funcs template.FuncMap) (*template.Template, map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(templateDir, "*.html"))
+	if err != nil {
+		return nil, nil, err
+	}
 	if len(files) == 0 {
-		return nil, fmt.Errorf("no templates found in directory: %s", templateDir)
+		return nil, nil, fmt.Errorf("no templates found in directory: %s", templateDir)
 	}
-	return template.ParseFiles(files...)
+	templates := template.New(filepath.Base(files[0])).Funcs(funcs)
+	sources := map[string]string{}
+	if err := parseFiles(templates, sources, files); err != nil {
+		return nil, nil, err
+	}
+
+	for _, dir := range variantDirs {
+		variants, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range variants {
+			if _, ok := sources[filepath.Base(file)]; !ok {
+				return nil, nil, fmt.Errorf("template variant without default: %s", file)
+			}
+		}
+		if err := parseFiles(templates, sources, variants); err != nil {
+			return nil, nil, err
+		}
+	}
+	return templates, sources, nil
+}
+
+// parseFiles parses each file as the template named after it, keeping its contents
+func parseFiles(templates *template.Template, sources map[string]string, files []string) error {
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		if err := parseTemplate(templates, name, string(data)); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		sources[name] = string(data)
+	}
+	return nil
+}
+
+// parseTemplate parses the body as the named template of the set, replacing it
+func parseTemplate(templates *template.Template, name, body string) error {
+	tmpl := templates
+	if name != templates.Name() {
+		tmpl = templates.New(name)
+	}
+	_, err := tmpl.Parse(body)
+	return err
+}
+
+// loadMessages merges the message catalogs of the variant directories,
+// later catalogs replacing the messages of earlier ones. Directories without a catalog are skipped.
+func loadMessages(variantDirs []string) (map[string]string, error) {
+	messages := map[string]string{}
+	for _, dir := range variantDirs {
+		data, err := os.ReadFile(filepath.Join(dir, "messages.json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("invalid message catalog %s: %w", dir, err)
+		}
+		for message, translation := range catalog {
+			messages[message] = translation
+		}
+	}
+	return messages, nil
+}
+
+// translate returns the translation of a message, or the message itself when it has none
+func translate(messages map[string]string, message string) string {
+	if translation, ok := messages[message]; ok && translation != "" {
+		return translation
+	}
+	return message
 }
 
 // RenderHtmlToString executes the named template with the given data and returns the result.
-func (s *templateService) RenderHtmlToString(name HtmlTemplate, data interface{}) (string, error) {
+func (s *templateService) RenderHtmlToString(ctx context.Context, name HtmlTemplate, data interface{}) (string, error) {
+	return execute(s.current(ctx), name, data)
+}
+
+func execute(templates *template.Template, name HtmlTemplate, data interface{}) (string, error) {
 	var buf bytes.Buffer
-	err := s.templates.ExecuteTemplate(&buf, string(name), data)
+	err := templates.ExecuteTemplate(&buf, string(name), data)
 	return buf.String(), err
 }
+
+// current returns the templates with the latest overrides applied. Overrides are cached
+// for templateCacheTTL, then reloaded and reparsed when an admin has saved a version since,
+// including on another instance. When overrides cannot be loaded, the templates last loaded are returned.
+func (s *templateService) current(ctx context.Context) *template.Template {
+	if s.repo == nil {
+		return s.templates
+	}
+	s.mu.Lock()
+	templates, loadedAt := s.templates, s.loadedAt
+	s.mu.Unlock()
+	if time.Since(loadedAt) < templateCacheTTL {
+		return templates
+	}
+
+	versions, err := s.repo.GetLatestVersions(ctx, s.language)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading template overrides", "error", err)
+		return s.templates
+	}
+	s.loadedAt = time.Now()
+	if sameVersions(s.overrides, versions) {
+		return s.templates
+	}
+	templates, err = s.withOverrides(versions)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error parsing template overrides", "error", err)
+		return s.templates
+	}
+	s.templates, s.overrides = templates, versions
+	return templates
+}
+
+// invalidate reloads the overrides on the next render, e.g. after saving a version
+func (s *templateService) invalidate() {
+	s.mu.Lock()
+	s.loadedAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// sameVersions reports whether both lists hold the same versions, in order
+func sameVersions(a, b []types.TemplateVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// withOverrides returns a copy of the files with the bodies of the versions parsed over them
+func (s *templateService) withOverrides(versions []types.TemplateVersion) (*template.Template, error) {
+	templates, err := s.files.Clone()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.Body == nil {
+			continue
+		}
+		if err := parseTemplate(templates, version.Name, *version.Body); err != nil {
+			return nil, fmt.Errorf("%s version %d: %w", version.Name, version.Version, err)
+		}
+	}
+	return templates, nil
+}
+
+// Translate returns a message, such as an email subject, in the storefront language
+func (s *templateService) Translate(message string) string {
+	return translate(s.messages, message)
+}
+
+// GetTemplates returns every template, with its latest version if edited
+func (s *templateService) GetTemplates(ctx context.Context) ([]types.Template, error) {
+	overrides, err := s.latestVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make([]types.Template, 0, len(names))
+	for _, name := range names {
+		templates = append(templates, s.template(name, overrides))
+	}
+	return templates, nil
+}
+
+func (s *templateService) GetTemplate(ctx context.Context, name HtmlTemplate) (types.Template, error) {
+	if _, ok := s.sources[string(name)]; !ok {
+		return types.Template{}, types.ErrNotFound
+	}
+	overrides, err := s.latestVersions(ctx)
+	if err != nil {
+		return types.Template{}, err
+	}
+	return s.template(string(name), overrides), nil
+}
+
+func (s *templateService) template(name string, overrides map[string]types.TemplateVersion) types.Template {
+	tmpl := types.Template{
+		Name:     name,
+		Language: s.language,
+		Default:  s.sources[name],
+	}
+	if version, ok := overrides[name]; ok {
+		tmpl.Override = &version
+	}
+	return tmpl
+}
+
+// latestVersions returns the latest version of each edited template, by name
+func (s *templateService) latestVersions(ctx context.Context) (map[string]types.TemplateVersion, error) {
+	overrides := map[string]types.TemplateVersion{}
+	if s.repo == nil {
+		return overrides, nil
+	}
+	versions, err := s.repo.GetLatestVersions(ctx, s.language)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		overrides[version.Name] = version
+	}
+	return overrides, nil
+}
+
+// GetTemplateVersions returns the saved versions of a template, newest first
+func (s *templateService) GetTemplateVersions(ctx context.Context, name HtmlTemplate) ([]types.TemplateVersion, error) {
+	if _, ok := s.sources[string(name)]; !ok {
+		return nil, types.ErrNotFound
+	}
+	return s.repo.GetVersions(ctx, string(name), s.language)
+}
+
+// SaveTemplate saves a new version of a template, rendered instead of its file from then on.
+// The body must parse and render the sample data, as must every other template, since the body
+// may define a partial they use. Otherwise InvalidTemplateError is returned.
+func (s *templateService) SaveTemplate(ctx context.Context, name HtmlTemplate, body string) (types.TemplateVersion, error) {
+	if _, ok := s.sources[string(name)]; !ok {
+		return types.TemplateVersion{}, types.ErrNotFound
+	}
+	templates, err := s.withVersion(ctx, name, &body)
+	if err != nil {
+		return types.TemplateVersion{}, &types.InvalidTemplateError{Message: err.Error()}
+	}
+	if _, err := execute(templates, name, templateSamples[name]); err != nil {
+		return types.TemplateVersion{}, &types.InvalidTemplateError{Message: err.Error()}
+	}
+	for other := range s.sources {
+		if HtmlTemplate(other) == name {
+			continue
+		}
+		if _, err := execute(templates, HtmlTemplate(other), templateSamples[HtmlTemplate(other)]); err != nil {
+			return types.TemplateVersion{}, &types.InvalidTemplateError{Message: fmt.Sprintf("breaks %s: %s", other, err)}
+		}
+	}
+	return s.createVersion(ctx, name, &body)
+}
+
+// RevertTemplate saves a version reverting a template to its file
+func (s *templateService) RevertTemplate(ctx context.Context, name HtmlTemplate) (types.TemplateVersion, error) {
+	if _, ok := s.sources[string(name)]; !ok {
+		return types.TemplateVersion{}, types.ErrNotFound
+	}
+	return s.createVersion(ctx, name, nil)
+}
+
+func (s *templateService) createVersion(ctx context.Context, name HtmlTemplate, body *string) (types.TemplateVersion, error) {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return types.TemplateVersion{}, err
+	}
+	version := types.TemplateVersion{
+		ID:        id,
+		Name:      string(name),
+		Language:  s.language,
+		Body:      body,
+		CreatedBy: getUserID(ctx),
+	}
+	if err := s.repo.CreateVersion(ctx, &version); err != nil {
+		return version, err
+	}
+	s.invalidate()
+	return version, nil
+}
+
+// PreviewTemplate renders a template with sample data.
+// The body, when given, is rendered in place of the template's current version without being saved.
+func (s *templateService) PreviewTemplate(ctx context.Context, name HtmlTemplate, body *string) (string, error) {
+	if _, ok := s.sources[string(name)]; !ok {
+		return "", types.ErrNotFound
+	}
+	if body == nil {
+		return s.RenderHtmlToString(ctx, name, templateSamples[name])
+	}
+	templates, err := s.withVersion(ctx, name, body)
+	if err != nil {
+		return "", err
+	}
+	return execute(templates, name, templateSamples[name])
+}
+
+// withVersion returns the templates with the latest overrides and the given body of a template applied
+func (s *templateService) withVersion(ctx context.Context, name HtmlTemplate, body *string) (*template.Template, error) {
+	s.current(ctx)
+	s.mu.Lock()
+	versions := append([]types.TemplateVersion{}, s.overrides...)
+	s.mu.Unlock()
+	versions = append(versions, types.TemplateVersion{Name: string(name), Body: body})
+	return s.withOverrides(versions)
+}
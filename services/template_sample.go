@@ -0,0 +1,75 @@
+package services
+
+import (
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+)
+
+// sampleOrderEmail is an order with an item, address and tracking, for previewing the order emails
+var sampleOrderEmail = func() orderEmail {
+	trackingURL := "https://carrier.example.com/track/1Z999AA10123456784"
+	return orderEmail{
+		Order: types.Order{
+			ID:             "1001",
+			Status:         types.OrderShipped,
+			Amount:         3998,
+			ShippingAmount: 500,
+			TaxAmount:      320,
+			TotalAmount:    4818,
+			Address: types.Address{
+				Line1:      "1 Main St",
+				City:       "Springfield",
+				PostalCode: "12345",
+				Country:    "US",
+			},
+			Tracking:  &types.Tracking{Carrier: "UPS", Number: "1Z999AA10123456784", URL: &trackingURL},
+			CreatedAt: time.Date(2025, time.March, 7, 14, 30, 0, 0, time.UTC),
+		},
+		Items: []orderEmailItem{
+			{Name: "Desk Lamp", Quantity: 2, UnitPrice: 1999, Total: 3998},
+		},
+		DetailsLink: "https://example.com/orders/1001",
+	}
+}()
+
+// sampleAnnouncement is a broadcast body of two paragraphs, for previewing the announcement templates
+var sampleAnnouncement = announcement{
+	Paragraphs: []string{
+		"Our spring collection has arrived, with new lamps and rugs.",
+		"Members get free shipping on every order this week.",
+	},
+}
+
+// templateSamples are the data each template is previewed and validated with,
+// matching the data it is rendered with
+var templateSamples = map[HtmlTemplate]interface{}{
+	EmailPasswordReset: map[string]string{"ResetLink": "https://example.com/auth/email/customer@example.com/password-reset/123456"},
+	EmailVerification:  map[string]string{"DetailsLink": "https://example.com/auth/email/verify/123456"},
+	EmailAccountLocked: map[string]interface{}{
+		"LockedUntil": time.Date(2025, time.March, 7, 14, 30, 0, 0, time.UTC),
+		"ResetLink":   "https://example.com/auth/email/customer@example.com/password-reset",
+	},
+	EmailChange:       map[string]string{"Code": "123456", "ConfirmLink": "https://example.com?email-change-code=123456"},
+	EmailOrderConf:    sampleOrderEmail,
+	EmailOrderShipped: sampleOrderEmail,
+	EmailOrderDeliv:   sampleOrderEmail,
+	EmailOrderRefund:  sampleOrderEmail,
+	EmailOrderCancel:  sampleOrderEmail,
+	EmailFooter: map[string]string{
+		"UnsubscribeLink": "https://example.com/api/notifications/unsubscribe?token=sample",
+		"PreferencesLink": "https://example.com/profile",
+	},
+	EmailOfferConf:     map[string]string{"DetailsLink": "https://example.com/offers/1001"},
+	NotifyOrderConf:    map[string]string{"Status": string(types.OrderPaid), "DetailsLink": "https://example.com/orders/1001"},
+	NotifyOrderUpdate:  map[string]string{"Status": string(types.OrderShipped), "DetailsLink": "https://example.com/orders/1001"},
+	NotifyOrderRecv:    map[string]string{"Status": string(types.OrderPaid), "DetailsLink": "https://example.com/admin/orders/1001"},
+	NotifyOfferUpdate:  map[string]string{"Status": string(types.OfferAccepted), "DetailsLink": "https://example.com/offers/1001"},
+	NotifyOfferConf:    map[string]string{"Status": string(types.OfferPending), "DetailsLink": "https://example.com/offers/1001"},
+	NotifyOfferRecv:    map[string]string{"Status": string(types.OfferPending), "DetailsLink": "https://example.com/admin/offers/1001"},
+	NotifyOfferStatus:  map[string]string{"Status": string(types.OfferAccepted), "DetailsLink": "https://example.com/admin/offers/1001"},
+	EmailAnnouncement:  sampleAnnouncement,
+	NotifyAnnouncement: sampleAnnouncement,
+	PageUnsubscribe:    map[string]string{"Token": "sample"},
+	PageUnsubscribed:   map[string]string{"PreferencesLink": "https://example.com/profile"},
+}
@@ -1,21 +1,275 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/dgyurics/marketplace/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestRenderToString(t *testing.T) {
-	templates, err := loadTemplates("../utilities/templates")
+	tmplMgr, err := newTemplateService("../utilities/templates", "en-US")
 	assert.NoError(t, err, "Loading templates should not return an error")
 
-	tmplMgr := &templateService{templates}
-
 	data := map[string]interface{}{
 		"ResetLink": "http://marketplace.com/user/password-reset/1234",
 	}
-	output, err := tmplMgr.RenderHtmlToString(EmailPasswordReset, data)
+	output, err := tmplMgr.RenderHtmlToString(context.Background(), EmailPasswordReset, data)
+	assert.NoError(t, err, "Rendering should not return an error")
+	assert.Contains(t, output, "If you did not request a password reset, disregard this email.")
+}
+
+func testOrderEmail() orderEmail {
+	trackingURL := "https://carrier.example.com/track/1Z999"
+	return orderEmail{
+		Order: types.Order{
+			ID:             "42",
+			CreatedAt:      time.Date(2025, time.March, 7, 14, 30, 0, 0, time.UTC),
+			Amount:         3998,
+			ShippingAmount: 500,
+			TaxAmount:      320,
+			TotalAmount:    4818,
+			Address:        types.Address{Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"},
+			Tracking:       &types.Tracking{Carrier: "UPS", Number: "1Z999", URL: &trackingURL},
+		},
+		Items: []orderEmailItem{
+			{Name: "Lamp", Thumbnail: "https://example.com/lamp.webp", AltText: "Desk lamp", Quantity: 2, UnitPrice: 1999, Total: 3998},
+		},
+		DetailsLink: "https://example.com/orders/42",
+	}
+}
+
+func TestRenderOrderEmail(t *testing.T) {
+	tmplMgr, err := newTemplateService("../utilities/templates", "en-US")
+	assert.NoError(t, err, "Loading templates should not return an error")
+
+	output, err := tmplMgr.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+	assert.NoError(t, err, "Rendering should not return an error")
+	assert.Contains(t, output, `<img src="https://example.com/lamp.webp" alt="Desk lamp"`)
+	assert.Contains(t, output, "Good news, your order is on its way.")
+	assert.Contains(t, output, "Order #42, Mar 7, 2025")
+	assert.Contains(t, output, "2 &times; $19.99")
+	assert.Contains(t, output, "Total: $48.18")
+	assert.Contains(t, output, "Springfield")
+	assert.Contains(t, output, `<a href="https://carrier.example.com/track/1Z999">1Z999</a>`)
+	assert.Contains(t, output, "https://example.com/orders/42")
+}
+
+func TestRenderOrderEmail_Localized(t *testing.T) {
+	tmplMgr, err := newTemplateService("../utilities/templates", "de-DE")
+	assert.NoError(t, err, "Loading templates should not return an error")
+
+	output, err := tmplMgr.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+	assert.NoError(t, err, "Rendering should not return an error")
+	assert.Contains(t, output, "Ihre Bestellung ist unterwegs.")
+	assert.Contains(t, output, "Bestellung #42, 07.03.2025")
+	assert.Contains(t, output, "2 &times; 19,99 $")
+	assert.Contains(t, output, "Gesamt: 48,18 $")
+	assert.Equal(t, "Ihre Bestellung wurde versandt", tmplMgr.Translate(SubjectOrderShipped))
+
+	// templates without a variant fall back to English
+	output, err = tmplMgr.RenderHtmlToString(context.Background(), EmailPasswordReset, map[string]string{"ResetLink": "https://example.com/reset"})
 	assert.NoError(t, err, "Rendering should not return an error")
 	assert.Contains(t, output, "If you did not request a password reset, disregard this email.")
 }
+
+func TestTemplateVariantFallback(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	write("greeting.html", `Hello {{t "friend"}}`)
+	write("farewell.html", `Goodbye`)
+	write("fr/greeting.html", `Bonjour {{t "friend"}}`)
+	write("fr/farewell.html", `Au revoir`)
+	write("fr/messages.json", `{"friend": "ami", "welcome": "bienvenue"}`)
+	write("fr-CA/greeting.html", `Allô {{t "friend"}}`)
+	write("fr-CA/messages.json", `{"friend": "chum"}`)
+
+	tests := []struct {
+		language string
+		greeting string
+		farewell string
+		welcome  string
+	}{
+		{"en-US", "Hello friend", "Goodbye", "welcome"},
+		{"fr-FR", "Bonjour ami", "Au revoir", "bienvenue"},
+		{"fr-CA", "Allô chum", "Au revoir", "bienvenue"},
+	}
+	for _, test := range tests {
+		tmplMgr, err := newTemplateService(dir, test.language)
+		assert.NoError(t, err, "Loading templates should not return an error")
+
+		greeting, err := tmplMgr.RenderHtmlToString(context.Background(), "greeting.html", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.greeting, greeting, test.language)
+		farewell, err := tmplMgr.RenderHtmlToString(context.Background(), "farewell.html", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.farewell, farewell, test.language)
+		assert.Equal(t, test.welcome, tmplMgr.Translate("welcome"), test.language)
+	}
+
+	// variants must override an English template
+	write("fr/unknown.html", `Inconnu`)
+	_, err := newTemplateService(dir, "fr-FR")
+	assert.Error(t, err, "Expected a variant without a default template to be rejected")
+}
+
+type mockTemplateRepo struct {
+	mock.Mock
+}
+
+func (m *mockTemplateRepo) CreateVersion(ctx context.Context, version *types.TemplateVersion) error {
+	args := m.Called(ctx, version)
+	return args.Error(0)
+}
+
+func (m *mockTemplateRepo) GetVersions(ctx context.Context, name, language string) ([]types.TemplateVersion, error) {
+	args := m.Called(ctx, name, language)
+	return args.Get(0).([]types.TemplateVersion), args.Error(1)
+}
+
+func (m *mockTemplateRepo) GetLatestVersions(ctx context.Context, language string) ([]types.TemplateVersion, error) {
+	args := m.Called(ctx, language)
+	return args.Get(0).([]types.TemplateVersion), args.Error(1)
+}
+
+func newTestTemplateService(t *testing.T) (*templateService, *mockTemplateRepo) {
+	svc, err := newTemplateService("../utilities/templates", "en-US")
+	assert.NoError(t, err, "Loading templates should not return an error")
+	repo := new(mockTemplateRepo)
+	svc.repo = repo
+	return svc, repo
+}
+
+func TestRenderOverride(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	edited := `<html><body><p>Shipped! {{t "Total"}}: {{money .Order.TotalAmount}}</p>{{template "order_details" .}}</body></html>`
+	partial := `{{define "order_details"}}<p>Order {{.Order.ID}}</p>{{end}}`
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{
+		{ID: "1", Name: string(EmailOrderDeliv), Version: 2, Body: nil},
+		{ID: "2", Name: string(EmailOrderShipped), Version: 1, Body: &edited},
+		{ID: "3", Name: "email_order_details.html", Version: 1, Body: &partial},
+	}, nil).Once()
+
+	output, err := svc.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+	assert.NoError(t, err)
+	assert.Contains(t, output, "Shipped! Total: $48.18")
+	assert.Contains(t, output, "<p>Order 42</p>", "Expected overridden partial")
+	assert.NotContains(t, output, "Springfield")
+
+	// reverted templates render the file once the cache is invalidated
+	svc.invalidate()
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{
+		{ID: "1", Name: string(EmailOrderDeliv), Version: 2, Body: nil},
+		{ID: "4", Name: string(EmailOrderShipped), Version: 2, Body: nil},
+	}, nil).Once()
+
+	output, err = svc.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+	assert.NoError(t, err)
+	assert.Contains(t, output, "Good news, your order is on its way.")
+	assert.Contains(t, output, "Springfield")
+	repo.AssertExpectations(t)
+}
+
+func TestRenderOverride_Cached(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{}, nil).Once()
+
+	for i := 0; i < 3; i++ {
+		_, err := svc.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+		assert.NoError(t, err)
+	}
+	repo.AssertNumberOfCalls(t, "GetLatestVersions", 1)
+}
+
+func TestRenderOverride_RepositoryError(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{}, errors.New("connection refused"))
+
+	output, err := svc.RenderHtmlToString(context.Background(), EmailOrderShipped, testOrderEmail())
+	assert.NoError(t, err, "Expected the files to be rendered when overrides cannot be loaded")
+	assert.Contains(t, output, "Good news, your order is on its way.")
+}
+
+func TestSaveTemplate(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{}, nil)
+	ctx := context.WithValue(context.Background(), UserKey, &types.User{ID: "7"})
+
+	body := `<html><body><p>Reset: <a href="{{.ResetLink}}">here</a></p></body></html>`
+	repo.On("CreateVersion", mock.Anything, mock.MatchedBy(func(v *types.TemplateVersion) bool {
+		return v.Name == string(EmailPasswordReset) && v.Language == "en-US" && *v.Body == body && v.CreatedBy == "7"
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*types.TemplateVersion).Version = 3
+	}).Return(nil).Once()
+
+	version, err := svc.SaveTemplate(ctx, EmailPasswordReset, body)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version.Version)
+	repo.AssertExpectations(t)
+}
+
+func TestSaveTemplate_Invalid(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{}, nil)
+
+	tests := []string{
+		`<p>{{.ResetLink</p>`,       // does not parse
+		`<p>{{unknown .ResetLink}}`, // undefined function
+		`{{template "missing" .}}`,  // undefined template
+		`<p>{{.Order.Missing}}</p>`, // field missing from the data it is rendered with
+	}
+	names := []HtmlTemplate{EmailPasswordReset, EmailPasswordReset, EmailPasswordReset, EmailOrderConf}
+	for i, body := range tests {
+		_, err := svc.SaveTemplate(context.Background(), names[i], body)
+		var invalidErr *types.InvalidTemplateError
+		assert.ErrorAs(t, err, &invalidErr, "Expected %q to be rejected", body)
+	}
+
+	// partials must still render in every template that uses them
+	_, err := svc.SaveTemplate(context.Background(), "email_order_details.html", `{{define "order_details"}}{{.Order.Missing}}{{end}}`)
+	var invalidErr *types.InvalidTemplateError
+	assert.ErrorAs(t, err, &invalidErr, "Expected a partial breaking other templates to be rejected")
+
+	_, err = svc.SaveTemplate(context.Background(), "missing.html", "<p></p>")
+	assert.Equal(t, types.ErrNotFound, err)
+	repo.AssertNotCalled(t, "CreateVersion", mock.Anything, mock.Anything)
+}
+
+func TestPreviewTemplate(t *testing.T) {
+	svc, repo := newTestTemplateService(t)
+	repo.On("GetLatestVersions", mock.Anything, "en-US").Return([]types.TemplateVersion{}, nil)
+
+	output, err := svc.PreviewTemplate(context.Background(), EmailOrderConf, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, output, "Desk Lamp")
+
+	body := `<p>Thanks for order {{.Order.ID}}</p>`
+	output, err = svc.PreviewTemplate(context.Background(), EmailOrderConf, &body)
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Thanks for order 1001</p>", output)
+
+	// the preview is not saved
+	output, err = svc.RenderHtmlToString(context.Background(), EmailOrderConf, sampleOrderEmail)
+	assert.NoError(t, err)
+	assert.Contains(t, output, "We received your order")
+}
+
+func TestTemplateSamples(t *testing.T) {
+	svc, err := newTemplateService("../utilities/templates", "en-US")
+	assert.NoError(t, err, "Loading templates should not return an error")
+
+	for name := range svc.sources {
+		_, err := svc.PreviewTemplate(context.Background(), HtmlTemplate(name), nil)
+		assert.NoError(t, err, "Expected %s to render its sample data", name)
+	}
+}
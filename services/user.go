@@ -4,7 +4,11 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"log/slog"
 	"math/big"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/dgyurics/marketplace/repositories"
 	"github.com/dgyurics/marketplace/types"
@@ -23,22 +27,39 @@ type UserService interface {
 	SetPassword(ctx context.Context, newPass string) (*types.User, error)
 	UpdatePassword(ctx context.Context, curPass, newPass string) (*types.User, error)
 	UpdateEmail(ctx context.Context, newEmail string) (*types.User, error)
+	UpgradeGuest(ctx context.Context, credential *types.Credential) (*types.User, error)
+	MergeGuest(ctx context.Context, credential *types.Credential) (*types.User, error)
+	UpdateRole(ctx context.Context, userID string, role types.Role) (*types.User, error)
+	UpdateProfile(ctx context.Context, name, phone *string) (*types.User, error)
+	RequestEmailChange(ctx context.Context, credential *types.Credential) (string, error)
+	ConfirmEmailChange(ctx context.Context, code string) (*types.User, error)
+	// EXPORT
+	ExportData(ctx context.Context) (*types.UserExport, error)
 	// GET
 	Login(ctx context.Context, credential *types.Credential) (*types.User, error)
 	GetUserByID(ctx context.Context, userID string) (*types.User, error)
+	GetProfile(ctx context.Context) (*types.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*types.User, error)
 	GetAllUsers(ctx context.Context, page, limit int) ([]types.User, error)
 	GetAllAdmins(ctx context.Context) ([]types.User, error)
 	// DELETE
 	RemoveUser(ctx context.Context, userID string) error
+	DeleteAccount(ctx context.Context, password string) error
 }
 
+// emailChangeExpiry is how long an email change confirmation code is valid
+const emailChangeExpiry = time.Hour
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ()\-.]{7,20}$`)
+
 type userService struct {
-	repo repositories.UserRepository
+	repo              repositories.UserRepository
+	revocationService TokenRevocationService
+	attachmentService AttachmentService
 }
 
-func NewUserService(repo repositories.UserRepository) UserService {
-	return &userService{repo: repo}
+func NewUserService(repo repositories.UserRepository, revocationService TokenRevocationService, attachmentService AttachmentService) UserService {
+	return &userService{repo: repo, revocationService: revocationService, attachmentService: attachmentService}
 }
 
 func (s *userService) CreateUser(ctx context.Context, user *types.User) error {
@@ -59,8 +80,16 @@ func (s *userService) CreateUser(ctx context.Context, user *types.User) error {
 	return s.repo.CreateUser(ctx, user)
 }
 
+// UpdateEmail changes the authenticated user's email and revokes their existing access tokens
 func (s *userService) UpdateEmail(ctx context.Context, newEmail string) (*types.User, error) {
-	return s.repo.UpdateEmail(ctx, getUserID(ctx), newEmail)
+	usr, err := s.repo.UpdateEmail(ctx, getUserID(ctx), newEmail)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revocationService.RevokeTokens(ctx, usr.ID); err != nil {
+		return nil, err
+	}
+	return usr, nil
 }
 
 func (s *userService) SetPassword(ctx context.Context, password string) (*types.User, error) {
@@ -103,7 +132,174 @@ func (s *userService) UpdatePassword(ctx context.Context, curPass, newPass strin
 	}
 
 	// update password
-	return s.repo.UpdatePassword(ctx, userID, string(hashedPassword))
+	usr, err = s.repo.UpdatePassword(ctx, userID, string(hashedPassword))
+	if err != nil {
+		return nil, err
+	}
+
+	// sign out other sessions
+	if err := s.revocationService.RevokeTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// UpgradeGuest turns the authenticated guest into an unverified user,
+// keeping the same user ID along with its cart, orders and inbox.
+func (s *userService) UpgradeGuest(ctx context.Context, credential *types.Credential) (*types.User, error) {
+	hashedPassword, err := generateFromPassword(credential.Password)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.UpgradeGuest(ctx, getUserID(ctx), credential.Email, string(hashedPassword))
+}
+
+// MergeGuest verifies the credentials of an existing account and moves
+// the authenticated guest's cart, orders, addresses and conversations into it.
+func (s *userService) MergeGuest(ctx context.Context, credential *types.Credential) (*types.User, error) {
+	target, err := s.verifyEmail(ctx, credential)
+	if err != nil {
+		return nil, err
+	}
+	err = s.repo.MergeUsers(ctx, getUserID(ctx), target.ID)
+	if err == types.ErrNotFound {
+		return nil, types.ErrConstraintViolation // caller is not a guest
+	}
+	if err != nil {
+		return nil, err
+	}
+	// guest no longer exists
+	if err := s.revocationService.RevokeTokens(ctx, getUserID(ctx)); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// UpdateRole changes a user's role. Tokens carrying the previous role are revoked,
+// so a demotion takes effect immediately. Admins cannot change their own role.
+func (s *userService) UpdateRole(ctx context.Context, userID string, role types.Role) (*types.User, error) {
+	if !role.IsValid() {
+		return nil, types.ErrInvalidInput
+	}
+	if userID == getUserID(ctx) {
+		return nil, types.ErrConstraintViolation
+	}
+	usr, err := s.repo.UpdateRole(ctx, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revocationService.RevokeTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// UpdateProfile sets the authenticated user's name and phone number.
+// Empty values clear the field.
+func (s *userService) UpdateProfile(ctx context.Context, name, phone *string) (*types.User, error) {
+	name, phone = trimToNil(name), trimToNil(phone)
+	if name != nil && len(*name) > 255 {
+		return nil, types.ErrInvalidInput
+	}
+	if phone != nil && !phonePattern.MatchString(*phone) {
+		return nil, types.ErrInvalidInput
+	}
+	return s.repo.UpdateProfile(ctx, getUserID(ctx), name, phone)
+}
+
+// trimToNil trims whitespace, returning nil for empty values
+func trimToNil(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	trimmed := strings.TrimSpace(*value)
+	if trimmed == "" {
+		return nil
+	}
+	return &trimmed
+}
+
+// RequestEmailChange verifies the current password and creates a confirmation
+// code for the new email address. The email is not changed until confirmed.
+func (s *userService) RequestEmailChange(ctx context.Context, credential *types.Credential) (string, error) {
+	usr, err := s.repo.GetUserByID(ctx, getUserID(ctx))
+	if err != nil {
+		return "", err
+	}
+	if usr.PasswordHash == nil {
+		return "", types.ErrConstraintViolation
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(*usr.PasswordHash), []byte(credential.Password)); err != nil {
+		return "", types.ErrNotFound
+	}
+
+	// new email must not belong to another account
+	_, err = s.repo.GetUserByEmail(ctx, credential.Email)
+	if err == nil {
+		return "", types.ErrUniqueConstraintViolation
+	}
+	if err != types.ErrNotFound {
+		return "", err
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().UTC().Add(emailChangeExpiry)
+	if err := s.repo.CreateEmailChange(ctx, usr.ID, credential.Email, code, expiresAt); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ConfirmEmailChange applies a pending email change and revokes existing access tokens
+func (s *userService) ConfirmEmailChange(ctx context.Context, code string) (*types.User, error) {
+	userID := getUserID(ctx)
+	usr, err := s.repo.ConfirmEmailChange(ctx, userID, strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revocationService.RevokeTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// ExportData returns the personal data held for the authenticated user
+func (s *userService) ExportData(ctx context.Context) (*types.UserExport, error) {
+	return s.repo.ExportUser(ctx, getUserID(ctx))
+}
+
+// DeleteAccount anonymizes the authenticated user's account, removing the attachments of their conversations.
+// Accounts with a password must confirm it. Admins cannot delete their own account.
+func (s *userService) DeleteAccount(ctx context.Context, password string) error {
+	userID := getUserID(ctx)
+	usr, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if usr.Role == types.RoleAdmin {
+		return types.ErrConstraintViolation
+	}
+	if usr.PasswordHash != nil {
+		if err := bcrypt.CompareHashAndPassword([]byte(*usr.PasswordHash), []byte(password)); err != nil {
+			return types.ErrNotFound
+		}
+	}
+
+	conversationIDs, err := s.repo.AnonymizeUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	// the account is deleted regardless, leftover files are logged for cleanup
+	for _, conversationID := range conversationIDs {
+		if err := s.attachmentService.RemoveConversation(conversationID); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove attachments of deleted conversation",
+				"conversation_id", conversationID, "error", err)
+		}
+	}
+	return s.revocationService.RevokeTokens(ctx, userID)
 }
 
 // generateFromPassword generates a hashed password from a plaintext password
@@ -115,6 +311,11 @@ func (s *userService) GetUserByID(ctx context.Context, userID string) (*types.Us
 	return s.repo.GetUserByID(ctx, userID)
 }
 
+// GetProfile returns the authenticated user
+func (s *userService) GetProfile(ctx context.Context) (*types.User, error) {
+	return s.repo.GetUserByID(ctx, getUserID(ctx))
+}
+
 func (s *userService) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
 	return s.repo.GetUserByEmail(ctx, email)
 }
@@ -148,8 +349,12 @@ func (s *userService) GetAllAdmins(ctx context.Context) ([]types.User, error) {
 	return s.repo.GetAllAdmins(ctx)
 }
 
+// RemoveUser deletes the user and revokes their access tokens
 func (s *userService) RemoveUser(ctx context.Context, userID string) error {
-	return s.repo.RemoveUser(ctx, userID)
+	if err := s.repo.RemoveUser(ctx, userID); err != nil {
+		return err
+	}
+	return s.revocationService.RevokeTokens(ctx, userID)
 }
 
 // Allowed characters for the registration code
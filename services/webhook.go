@@ -0,0 +1,384 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgyurics/marketplace/repositories"
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+)
+
+const (
+	webhookMaxAttempts  = 10               // attempts before a delivery is marked failed, spanning roughly 8.5 hours
+	webhookRetryBase    = time.Minute      // delay before the first retry, doubled on each further retry
+	webhookTimeout      = 10 * time.Second // maximum time allowed for a receiver to respond
+	webhookLease        = time.Minute      // time a claimed delivery is hidden from other instances
+	webhookBatchSize    = 20
+	webhookPollInterval = 30 * time.Second
+
+	// WebhookSignatureHeader holds the timestamp and HMAC-SHA256 signature of the payload,
+	// formatted as "t=<unix timestamp>,v1=<hex signature>" like Stripe's Stripe-Signature header
+	WebhookSignatureHeader = "Marketplace-Signature"
+)
+
+// WebhookService delivers events to subscribed endpoints.
+// Deliveries are stored before being sent, and retried with exponential backoff until they succeed.
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, webhook *types.Webhook) error
+	GetWebhooks(ctx context.Context) ([]types.Webhook, error)
+	UpdateWebhook(ctx context.Context, webhook *types.Webhook) error
+	RemoveWebhook(ctx context.Context, id string) error
+	GetDeliveries(ctx context.Context, webhookID string, page, limit int) ([]types.WebhookDelivery, error)
+	Redeliver(ctx context.Context, deliveryID string) (types.WebhookDelivery, error)
+	Publish(ctx context.Context, eventID string, event types.WebhookEvent, data interface{}) error
+	GetUserWebhook(ctx context.Context, userID string) (types.Webhook, error)
+	SetUserWebhook(ctx context.Context, userID, url string) (types.Webhook, error)
+	RemoveUserWebhook(ctx context.Context, userID string) error
+	PublishToUser(ctx context.Context, userID string, data interface{}) error
+	DeliverPending(ctx context.Context)
+	Start(ctx context.Context)
+}
+
+type webhookService struct {
+	repo       repositories.WebhookRepository
+	httpClient utilities.HTTPClient // delivers to webhooks created by admins
+	userClient utilities.HTTPClient // delivers to webhooks set by users, must refuse non-public addresses
+	wake       chan struct{}
+}
+
+func NewWebhookService(repo repositories.WebhookRepository, httpClient, userClient utilities.HTTPClient) WebhookService {
+	return &webhookService{
+		repo:       repo,
+		httpClient: httpClient,
+		userClient: userClient,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// CreateWebhook creates a webhook with a generated signing secret
+func (s *webhookService) CreateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	if err := validateWebhook(webhook); err != nil {
+		return err
+	}
+	return s.createWebhook(ctx, webhook)
+}
+
+func (s *webhookService) createWebhook(ctx context.Context, webhook *types.Webhook) error {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	webhook.ID = id
+	webhook.Secret = "whsec_" + hex.EncodeToString(secret)
+	return s.repo.CreateWebhook(ctx, webhook)
+}
+
+func (s *webhookService) GetWebhooks(ctx context.Context) ([]types.Webhook, error) {
+	return s.repo.GetWebhooks(ctx)
+}
+
+func (s *webhookService) UpdateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	if err := validateWebhook(webhook); err != nil {
+		return err
+	}
+	webhook.Secret = ""
+	return s.repo.UpdateWebhook(ctx, webhook)
+}
+
+func (s *webhookService) RemoveWebhook(ctx context.Context, id string) error {
+	return s.repo.RemoveWebhook(ctx, id)
+}
+
+func (s *webhookService) GetDeliveries(ctx context.Context, webhookID string, page, limit int) ([]types.WebhookDelivery, error) {
+	return s.repo.GetDeliveries(ctx, webhookID, page, limit)
+}
+
+// Redeliver queues a new delivery of a previous delivery's payload.
+// The event ID is unchanged, so receivers can recognize duplicates.
+func (s *webhookService) Redeliver(ctx context.Context, deliveryID string) (types.WebhookDelivery, error) {
+	prev, err := s.repo.GetDelivery(ctx, deliveryID)
+	if err != nil {
+		return types.WebhookDelivery{}, err
+	}
+	delivery, err := newDelivery(prev.WebhookID, prev.Event, prev.Payload)
+	if err != nil {
+		return types.WebhookDelivery{}, err
+	}
+	if err := s.repo.CreateDelivery(ctx, &delivery); err != nil {
+		return types.WebhookDelivery{}, err
+	}
+	s.notify()
+	return delivery, nil
+}
+
+// Publish queues delivery of the event to every subscribed webhook.
+// eventID is sent in the payload, and should be stable across retries so receivers can recognize duplicates.
+func (s *webhookService) Publish(ctx context.Context, eventID string, event types.WebhookEvent, data interface{}) error {
+	webhooks, err := s.repo.GetSubscribers(ctx, event)
+	if err != nil {
+		return err
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(types.WebhookPayload{
+		ID:        eventID,
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		delivery, err := newDelivery(webhook.ID, event, payload)
+		if err != nil {
+			return err
+		}
+		if err := s.repo.CreateDelivery(ctx, &delivery); err != nil {
+			return err
+		}
+	}
+	s.notify()
+	return nil
+}
+
+func (s *webhookService) GetUserWebhook(ctx context.Context, userID string) (types.Webhook, error) {
+	return s.repo.GetUserWebhook(ctx, userID)
+}
+
+// SetUserWebhook replaces the webhook a user receives their notifications at.
+// A new signing secret is generated, and returned once.
+// URLs resolving to loopback, private or link-local addresses are rejected.
+func (s *webhookService) SetUserWebhook(ctx context.Context, userID, rawURL string) (types.Webhook, error) {
+	webhook := types.Webhook{
+		URL:     rawURL,
+		Events:  []types.WebhookEvent{types.EventNotification},
+		Enabled: true,
+		UserID:  userID,
+	}
+	if !validWebhookURL(rawURL) {
+		return webhook, types.ErrInvalidInput
+	}
+	u, _ := url.Parse(rawURL)
+	if err := utilities.ResolvePublicHost(ctx, u.Hostname()); err != nil {
+		slog.WarnContext(ctx, "Rejected user webhook URL", "url", rawURL, "error", err)
+		return webhook, types.ErrInvalidInput
+	}
+	if err := s.repo.RemoveUserWebhook(ctx, userID); err != nil {
+		return webhook, err
+	}
+	err := s.createWebhook(ctx, &webhook)
+	return webhook, err
+}
+
+func (s *webhookService) RemoveUserWebhook(ctx context.Context, userID string) error {
+	return s.repo.RemoveUserWebhook(ctx, userID)
+}
+
+// PublishToUser queues delivery of a notification to the user's webhook, if they have one
+func (s *webhookService) PublishToUser(ctx context.Context, userID string, data interface{}) error {
+	webhook, err := s.repo.GetUserWebhook(ctx, userID)
+	if err == types.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !webhook.Enabled {
+		return nil
+	}
+
+	eventID, err := utilities.GenerateIDString()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(types.WebhookPayload{
+		ID:        eventID,
+		Type:      types.EventNotification,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	delivery, err := newDelivery(webhook.ID, types.EventNotification, payload)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.CreateDelivery(ctx, &delivery); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Start delivers pending deliveries until ctx is canceled.
+// Pass it root context to allow for clean shutdown.
+func (s *webhookService) Start(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	slog.Info("Webhook delivery started")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Webhook delivery stopped")
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.DeliverPending(ctx)
+	}
+}
+
+// DeliverPending sends deliveries which are due, until none remain
+func (s *webhookService) DeliverPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := s.repo.ClaimDeliveries(ctx, webhookBatchSize, webhookLease)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming webhook deliveries", "error", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *types.WebhookDelivery) {
+				defer wg.Done()
+				s.deliver(ctx, delivery)
+			}(&deliveries[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// deliver attempts a delivery and records the outcome, scheduling a retry on failure
+func (s *webhookService) deliver(ctx context.Context, delivery *types.WebhookDelivery) {
+	status, err := s.send(ctx, delivery)
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.ResponseStatus = nil
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+	switch {
+	case err == nil:
+		delivery.Status = types.DeliverySucceeded
+		delivery.Error = nil
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = types.DeliveryFailed
+		delivery.Error = utilities.StringPtr(err.Error())
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(webhookRetryBase << (delivery.Attempts - 1))
+		delivery.Error = utilities.StringPtr(err.Error())
+		delivery.NextAttemptAt = &next
+	}
+
+	if err := s.repo.UpdateDelivery(context.WithoutCancel(ctx), delivery); err != nil {
+		slog.ErrorContext(ctx, "Error recording webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+}
+
+// send posts the signed payload, returning the response status code.
+// Any status outside of 2xx is an error.
+func (s *webhookService) send(ctx context.Context, delivery *types.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := s.httpClient.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now()
+	signature := ComputeSignature(ts, delivery.Payload, delivery.Webhook.Secret)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Marketplace-Event", string(delivery.Event))
+	req.Header.Set("Marketplace-Delivery", delivery.ID)
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", ts.Unix(), hex.EncodeToString(signature)))
+
+	client := s.httpClient
+	if delivery.Webhook.UserID != "" {
+		client = s.userClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// notify wakes the delivery loop, without blocking if it is already awake
+func (s *webhookService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func newDelivery(webhookID string, event types.WebhookEvent, payload []byte) (types.WebhookDelivery, error) {
+	id, err := utilities.GenerateIDString()
+	if err != nil {
+		return types.WebhookDelivery{}, err
+	}
+	now := time.Now().UTC()
+	return types.WebhookDelivery{
+		ID:            id,
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        types.DeliveryPending,
+		NextAttemptAt: &now,
+	}, nil
+}
+
+func validateWebhook(webhook *types.Webhook) error {
+	if !validWebhookURL(webhook.URL) {
+		return types.ErrInvalidInput
+	}
+	if len(webhook.Events) == 0 {
+		return types.ErrInvalidInput
+	}
+	for _, event := range webhook.Events {
+		if !event.IsValid() {
+			return types.ErrInvalidInput
+		}
+	}
+	return nil
+}
+
+func validWebhookURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
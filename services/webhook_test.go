@@ -0,0 +1,318 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgyurics/marketplace/types"
+	"github.com/dgyurics/marketplace/utilities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockWebhookRepo struct {
+	mock.Mock
+}
+
+func (m *mockWebhookRepo) CreateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	args := m.Called(ctx, webhook)
+	return args.Error(0)
+}
+
+func (m *mockWebhookRepo) GetWebhooks(ctx context.Context) ([]types.Webhook, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]types.Webhook), args.Error(1)
+}
+
+func (m *mockWebhookRepo) UpdateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	args := m.Called(ctx, webhook)
+	return args.Error(0)
+}
+
+func (m *mockWebhookRepo) RemoveWebhook(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *mockWebhookRepo) GetUserWebhook(ctx context.Context, userID string) (types.Webhook, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).(types.Webhook), args.Error(1)
+}
+
+func (m *mockWebhookRepo) RemoveUserWebhook(ctx context.Context, userID string) error {
+	args := m.Called(ctx, userID)
+	return args.Error(0)
+}
+
+func (m *mockWebhookRepo) GetSubscribers(ctx context.Context, event types.WebhookEvent) ([]types.Webhook, error) {
+	args := m.Called(ctx, event)
+	return args.Get(0).([]types.Webhook), args.Error(1)
+}
+
+func (m *mockWebhookRepo) CreateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error {
+	args := m.Called(ctx, delivery)
+	return args.Error(0)
+}
+
+func (m *mockWebhookRepo) GetDelivery(ctx context.Context, id string) (types.WebhookDelivery, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(types.WebhookDelivery), args.Error(1)
+}
+
+func (m *mockWebhookRepo) GetDeliveries(ctx context.Context, webhookID string, page, limit int) ([]types.WebhookDelivery, error) {
+	args := m.Called(ctx, webhookID, page, limit)
+	return args.Get(0).([]types.WebhookDelivery), args.Error(1)
+}
+
+func (m *mockWebhookRepo) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]types.WebhookDelivery, error) {
+	args := m.Called(ctx, limit, lease)
+	return args.Get(0).([]types.WebhookDelivery), args.Error(1)
+}
+
+func (m *mockWebhookRepo) UpdateDelivery(ctx context.Context, delivery *types.WebhookDelivery) error {
+	args := m.Called(ctx, delivery)
+	return args.Error(0)
+}
+
+// verifyWebhookSignature checks the signature header the way a receiver would
+func verifyWebhookSignature(header string, payload []byte, secret string) error {
+	var ts int64
+	var signature []byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			ts, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature, _ = hex.DecodeString(value)
+		}
+	}
+	if !hmac.Equal(signature, ComputeSignature(time.Unix(ts, 0), payload, secret)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func pendingDelivery(url, payload string) types.WebhookDelivery {
+	return types.WebhookDelivery{
+		ID:        "10",
+		WebhookID: "1",
+		Event:     types.EventOrderPaid,
+		Payload:   json.RawMessage(payload),
+		Status:    types.DeliveryPending,
+		Webhook:   &types.Webhook{ID: "1", URL: url, Secret: "whsec_test"},
+	}
+}
+
+func TestDeliverPending_SignsPayload(t *testing.T) {
+	payload := `{"id":"5","type":"order.paid","data":{}}`
+	var received *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(5*time.Second), utilities.NewDefaultHTTPClient(5*time.Second))
+	ctx := context.Background()
+
+	var updated *types.WebhookDelivery
+	repo.On("ClaimDeliveries", ctx, webhookBatchSize, webhookLease).Return([]types.WebhookDelivery{pendingDelivery(receiver.URL, payload)}, nil).Once()
+	repo.On("UpdateDelivery", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.WebhookDelivery)
+	}).Return(nil).Once()
+
+	svc.DeliverPending(ctx)
+
+	assert.NotNil(t, received, "expected receiver to be called")
+	assert.JSONEq(t, payload, string(body))
+	assert.Equal(t, "order.paid", received.Header.Get("Marketplace-Event"))
+	assert.Equal(t, "10", received.Header.Get("Marketplace-Delivery"))
+	assert.NoError(t, verifyWebhookSignature(received.Header.Get(WebhookSignatureHeader), body, "whsec_test"))
+
+	assert.Equal(t, types.DeliverySucceeded, updated.Status)
+	assert.Equal(t, 1, updated.Attempts)
+	assert.Equal(t, http.StatusNoContent, *updated.ResponseStatus)
+	assert.NotNil(t, updated.DeliveredAt)
+	assert.Nil(t, updated.NextAttemptAt)
+	repo.AssertExpectations(t)
+}
+
+func TestDeliverPending_RetriesWithBackoff(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(5*time.Second), utilities.NewDefaultHTTPClient(5*time.Second))
+	ctx := context.Background()
+
+	delivery := pendingDelivery(receiver.URL, `{}`)
+	delivery.Attempts = 3
+	var updated *types.WebhookDelivery
+	repo.On("ClaimDeliveries", ctx, webhookBatchSize, webhookLease).Return([]types.WebhookDelivery{delivery}, nil).Once()
+	repo.On("UpdateDelivery", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.WebhookDelivery)
+	}).Return(nil).Once()
+
+	svc.DeliverPending(ctx)
+
+	assert.Equal(t, types.DeliveryPending, updated.Status)
+	assert.Equal(t, 4, updated.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, *updated.ResponseStatus)
+	assert.NotNil(t, updated.Error)
+	// fourth attempt failed, the next retry waits 2^3 minutes
+	assert.WithinDuration(t, time.Now().Add(8*time.Minute), *updated.NextAttemptAt, 5*time.Second)
+}
+
+func TestDeliverPending_GivesUpAfterMaxAttempts(t *testing.T) {
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewDefaultHTTPClient(time.Second))
+	ctx := context.Background()
+
+	// nothing is listening on this receiver
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	receiver.Close()
+
+	delivery := pendingDelivery(receiver.URL, `{}`)
+	delivery.Attempts = webhookMaxAttempts - 1
+	var updated *types.WebhookDelivery
+	repo.On("ClaimDeliveries", ctx, webhookBatchSize, webhookLease).Return([]types.WebhookDelivery{delivery}, nil).Once()
+	repo.On("UpdateDelivery", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.WebhookDelivery)
+	}).Return(nil).Once()
+
+	svc.DeliverPending(ctx)
+
+	assert.Equal(t, types.DeliveryFailed, updated.Status)
+	assert.Nil(t, updated.ResponseStatus)
+	assert.Nil(t, updated.NextAttemptAt)
+	assert.NotNil(t, updated.Error)
+}
+
+func TestPublish_QueuesDeliveryPerSubscriber(t *testing.T) {
+	utilities.InitIDGenerator(0)
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewDefaultHTTPClient(time.Second))
+	ctx := context.Background()
+
+	repo.On("GetSubscribers", ctx, types.EventOrderShipped).Return([]types.Webhook{{ID: "1"}, {ID: "2"}}, nil).Once()
+	var deliveries []*types.WebhookDelivery
+	repo.On("CreateDelivery", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		deliveries = append(deliveries, args.Get(1).(*types.WebhookDelivery))
+	}).Return(nil).Twice()
+
+	err := svc.Publish(ctx, "7", types.EventOrderShipped, types.Order{ID: "42"})
+	assert.NoError(t, err)
+
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, "1", deliveries[0].WebhookID)
+	assert.Equal(t, "2", deliveries[1].WebhookID)
+	assert.Equal(t, deliveries[0].Payload, deliveries[1].Payload, "expected subscribers to share the event payload")
+
+	var payload struct {
+		ID   string             `json:"id"`
+		Type types.WebhookEvent `json:"type"`
+		Data types.Order        `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(deliveries[0].Payload, &payload))
+	assert.Equal(t, "7", payload.ID)
+	assert.Equal(t, types.EventOrderShipped, payload.Type)
+	assert.Equal(t, "42", payload.Data.ID)
+}
+
+func TestRedeliver_CopiesPayload(t *testing.T) {
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewDefaultHTTPClient(time.Second))
+	ctx := context.Background()
+
+	prev := pendingDelivery("https://example.com", `{"id":"5"}`)
+	prev.Status = types.DeliveryFailed
+	repo.On("GetDelivery", ctx, "10").Return(prev, nil).Once()
+	repo.On("CreateDelivery", ctx, mock.Anything).Return(nil).Once()
+
+	delivery, err := svc.Redeliver(ctx, "10")
+	assert.NoError(t, err)
+	assert.NotEqual(t, prev.ID, delivery.ID)
+	assert.Equal(t, types.DeliveryPending, delivery.Status)
+	assert.Equal(t, prev.Payload, delivery.Payload)
+	assert.Equal(t, prev.WebhookID, delivery.WebhookID)
+}
+
+func TestCreateWebhook_Invalid(t *testing.T) {
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewDefaultHTTPClient(time.Second))
+	ctx := context.Background()
+
+	err := svc.CreateWebhook(ctx, &types.Webhook{URL: "ftp://example.com", Events: []types.WebhookEvent{types.EventOrderPaid}})
+	assert.Equal(t, types.ErrInvalidInput, err)
+
+	err = svc.CreateWebhook(ctx, &types.Webhook{URL: "https://example.com/hook", Events: []types.WebhookEvent{"order.teleported"}})
+	assert.Equal(t, types.ErrInvalidInput, err)
+
+	err = svc.CreateWebhook(ctx, &types.Webhook{URL: "https://example.com/hook"})
+	assert.Equal(t, types.ErrInvalidInput, err)
+
+	repo.AssertNotCalled(t, "CreateWebhook", mock.Anything, mock.Anything)
+}
+
+func TestSetUserWebhook_RejectsInternalAddresses(t *testing.T) {
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewPublicHTTPClient(time.Second))
+	ctx := context.Background()
+
+	for _, url := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8000/hook",
+		"http://10.0.0.5/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+	} {
+		_, err := svc.SetUserWebhook(ctx, "7", url)
+		assert.Equal(t, types.ErrInvalidInput, err, "expected %s to be rejected", url)
+	}
+	repo.AssertNotCalled(t, "RemoveUserWebhook", mock.Anything, mock.Anything)
+	repo.AssertNotCalled(t, "CreateWebhook", mock.Anything, mock.Anything)
+}
+
+func TestDeliverPending_UserWebhookRefusesInternalAddress(t *testing.T) {
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	repo := new(mockWebhookRepo)
+	svc := NewWebhookService(repo, utilities.NewDefaultHTTPClient(time.Second), utilities.NewPublicHTTPClient(time.Second))
+	ctx := context.Background()
+
+	// the URL was public when saved, but now points at a loopback address
+	delivery := pendingDelivery(receiver.URL, `{}`)
+	delivery.Webhook.UserID = "7"
+	var updated *types.WebhookDelivery
+	repo.On("ClaimDeliveries", ctx, webhookBatchSize, webhookLease).Return([]types.WebhookDelivery{delivery}, nil).Once()
+	repo.On("UpdateDelivery", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		updated = args.Get(1).(*types.WebhookDelivery)
+	}).Return(nil).Once()
+
+	svc.DeliverPending(ctx)
+
+	assert.False(t, called, "expected connection to loopback address to be refused")
+	assert.Nil(t, updated.ResponseStatus)
+	assert.NotNil(t, updated.Error)
+}
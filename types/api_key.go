@@ -0,0 +1,19 @@
+package types
+
+import "time"
+
+// APIKey is a long-lived credential used by scripts and integrations.
+// Only the hash of the key is stored, the key itself is shown once on creation.
+type APIKey struct {
+	ID          string       `json:"id"`
+	UserID      string       `json:"user_id"`
+	Name        string       `json:"name"`
+	Prefix      string       `json:"prefix"` // first characters of the key, to identify it in listings
+	KeyHash     string       `json:"-"`
+	Role        Role         `json:"role"`                  // acts as this role, capped at the owner's current role
+	Permissions []Permission `json:"permissions,omitempty"` // when set, only these permissions are granted
+	ExpiresAt   time.Time    `json:"expires_at"`
+	LastUsedAt  *time.Time   `json:"last_used_at,omitempty"`
+	Revoked     bool         `json:"revoked"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
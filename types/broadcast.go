@@ -0,0 +1,55 @@
+package types
+
+import "time"
+
+// BroadcastSegment selects the users a broadcast is sent to
+type BroadcastSegment string
+
+const (
+	SegmentAll          BroadcastSegment = "all"           // every registered user, guests excluded
+	SegmentRole         BroadcastSegment = "role"          // users with the broadcast's role
+	SegmentCategory     BroadcastSegment = "category"      // customers who bought from the broadcast's category, or its subcategories
+	SegmentPendingOffer BroadcastSegment = "pending_offer" // users with an offer awaiting a response
+)
+
+// IsValid reports whether the segment is a known segment
+func (s BroadcastSegment) IsValid() bool {
+	switch s {
+	case SegmentAll, SegmentRole, SegmentCategory, SegmentPendingOffer:
+		return true
+	}
+	return false
+}
+
+type BroadcastStatus string
+
+const (
+	BroadcastScheduled BroadcastStatus = "scheduled" // awaiting its send time
+	BroadcastSending   BroadcastStatus = "sending"
+	BroadcastCompleted BroadcastStatus = "completed"
+	BroadcastCanceled  BroadcastStatus = "canceled"
+)
+
+// Broadcast is an announcement sent to the inbox of every user in a segment, and optionally emailed.
+// Recipients are resolved when sending, in batches ordered by user ID.
+type Broadcast struct {
+	ID              string           `json:"id"`
+	Subject         string           `json:"subject"`
+	Body            string           `json:"body"` // plain text, paragraphs separated by blank lines
+	Segment         BroadcastSegment `json:"segment"`
+	Role            Role             `json:"role,omitempty"`        // SegmentRole only
+	CategoryID      string           `json:"category_id,omitempty"` // SegmentCategory only
+	Email           bool             `json:"email"`                 // also email recipients who have not disabled announcement emails
+	Status          BroadcastStatus  `json:"status"`
+	SendAt          time.Time        `json:"send_at"`
+	RecipientCount  int              `json:"recipient_count"` // counted when sending starts
+	SentCount       int              `json:"sent_count"`
+	FailedCount     int              `json:"failed_count"`
+	LastRecipientID string           `json:"-"` // sending resumes after this user
+	ClaimToken      string           `json:"-"` // claim of the instance sending the broadcast, set by ClaimBroadcast
+	CreatedBy       string           `json:"created_by"`
+	StartedAt       *time.Time       `json:"started_at,omitempty"`
+	CompletedAt     *time.Time       `json:"completed_at,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+}
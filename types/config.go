@@ -1,12 +1,15 @@
 package types
 
 import (
+	"fmt"
 	"log"
 	"log/slog"
 	"time"
 )
 
 type Config struct {
+	Attachment        AttachmentConfig
+	Audit             AuditConfig
 	Auth              AuthConfig
 	BaseURL           string
 	Country           string
@@ -18,6 +21,7 @@ type Config struct {
 	JWT               JWTConfig
 	Logger            LoggerConfig
 	MachineID         uint8
+	OIDC              []OIDCProviderConfig
 	Payment           PaymentConfig
 	RateLimit         bool
 	Server            ServerConfig
@@ -49,12 +53,24 @@ type EmailConfig struct {
 	UseTLS   bool
 	From     string
 	FromName string
+	ReplyTo  string // optional Reply-To address
+
+	// DKIM signing is enabled when a domain is configured.
+	// The public key is published in DNS at <selector>._domainkey.<domain>.
+	DKIMDomain     string
+	DKIMSelector   string
+	DKIMPrivateKey []byte // PEM encoded RSA or Ed25519 private key
+}
+
+type AuditConfig struct {
+	Retention time.Duration // how long audit log entries are kept
 }
 
 type JWTConfig struct {
-	PrivateKey []byte        // asymmetric key for signing access tokens
-	PublicKey  []byte        // asymmetric key for verifying access tokens
-	Expiry     time.Duration // duration for which the access token is valid
+	PrivateKey         []byte        // asymmetric key for signing access tokens
+	PublicKey          []byte        // asymmetric key for verifying access tokens
+	PreviousPublicKeys [][]byte      // rotated out keys, still accepted until tokens signed with them expire
+	Expiry             time.Duration // duration for which the access token is valid
 }
 
 type DBConfig struct {
@@ -70,6 +86,12 @@ type DBConfig struct {
 	ConnMaxIdleTime time.Duration // max time a connection may be idle
 }
 
+// DataSourceName returns the connection string of the database, as used by lib/pq
+func (c DBConfig) DataSourceName() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+}
+
 type LoggerConfig struct {
 	Level slog.Level
 }
@@ -112,6 +134,21 @@ type ImageConfig struct {
 	MaxFileSizeBytes int    // maximum allowed file size (in bytes)
 }
 
+type AttachmentConfig struct {
+	UploadPath       string            // directory for storing message attachments, apart from images served by imgproxy
+	MaxFileSizeBytes int               // maximum allowed file size (in bytes)
+	Scanner          AttachmentScanner // malware scanner for uploaded attachments
+	ClamAVAddr       string            // address of clamd, e.g. clamav:3310, when Scanner is ScannerClamAV
+}
+
+// AttachmentScanner identifies the malware scanner used for attachments
+type AttachmentScanner string
+
+const (
+	ScannerLocal  AttachmentScanner = "local"  // stand-in for local development, accepts every file
+	ScannerClamAV AttachmentScanner = "clamav" // scans files with clamd
+)
+
 type PaymentConfig struct {
 	Stripe      StripeConfig
 	Tax         TaxConfig
@@ -6,18 +6,45 @@ type ConversationType string
 
 // Conversation types:
 // - notification: System/admin initiated one-way communication to notify users of events
-// - support: Admin response to customer tickets, allows customer to reply back and forth
+// - support: Customer tickets, or admin initiated threads, allows customer to reply back and forth
 const (
 	Support      ConversationType = "support"
 	Notification ConversationType = "notification"
 )
 
+type TicketStatus string
+
+// Ticket statuses, of support conversations only:
+// - open: awaiting a staff response
+// - awaiting_customer: answered by staff, awaiting the customer
+// - closed: resolved, reopened should the customer reply
+const (
+	TicketOpen             TicketStatus = "open"
+	TicketAwaitingCustomer TicketStatus = "awaiting_customer"
+	TicketClosed           TicketStatus = "closed"
+)
+
+// IsValid reports whether the status is a known ticket status
+func (s TicketStatus) IsValid() bool {
+	switch s {
+	case TicketOpen, TicketAwaitingCustomer, TicketClosed:
+		return true
+	}
+	return false
+}
+
 type Conversation struct {
 	ID                  string           `json:"id"`
 	Type                ConversationType `json:"type"`
 	Subject             string           `json:"subject"`
 	RecipientID         string           `json:"recipient_id"`
 	RecipientLastReadAt time.Time        `json:"recipient_last_read_at"`
+	Status              TicketStatus     `json:"status,omitempty"`
+	OrderID             string           `json:"order_id,omitempty"`
+	ProductID           string           `json:"product_id,omitempty"`
+	AssigneeID          string           `json:"assignee_id,omitempty"` // staff member handling the ticket
+	StaffUnread         bool             `json:"staff_unread,omitempty"`
+	UnreadCount         int              `json:"unread_count"` // messages unread by the recipient, when listing their conversations or until opening one
 	Messages            []Message        `json:"messages"`
 	IsDeleted           bool             `json:"-"`
 	UpdatedAt           time.Time        `json:"updated_at"`
@@ -25,9 +52,40 @@ type Conversation struct {
 }
 
 type Message struct {
+	ID             string       `json:"id"`
+	SenderID       string       `json:"sender_id"`
+	ConversationID string       `json:"conversation_id"`
+	Body           string       `json:"body"`
+	RecipientID    string       `json:"-"` // recipient of the conversation, set once created
+	Attachments    []Attachment `json:"attachments,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+// Attachment is a file attached to a message, downloaded from URL by the conversation's participants
+type Attachment struct {
 	ID             string    `json:"id"`
-	SenderID       string    `json:"sender_id"`
-	ConversationID string    `json:"conversation_id"`
-	Body           string    `json:"body"`
+	ConversationID string    `json:"-"`
+	MessageID      string    `json:"-"`
+	Filename       string    `json:"filename"` // as uploaded
+	ContentType    string    `json:"content_type"`
+	Size           int64     `json:"size"`
+	URL            string    `json:"url"`
 	CreatedAt      time.Time `json:"created_at"`
 }
+
+// Ticket is a support conversation opened by a customer, with their first message
+type Ticket struct {
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	OrderID   string `json:"order_id"`   // optional, an order of the customer
+	ProductID string `json:"product_id"` // optional
+}
+
+// TicketFilter selects tickets of the staff queue
+type TicketFilter struct {
+	Status   TicketStatus
+	Assignee string // user ID, "me" or "none"
+	Unread   bool   // only tickets with customer messages unread by staff
+	Page     int
+	Limit    int
+}
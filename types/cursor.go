@@ -0,0 +1,40 @@
+package types
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor is a position in a list ordered by time and then ID, e.g. conversations by updated_at.
+// Unlike page numbers, cursors keep their position while items are added.
+type Cursor struct {
+	Time time.Time
+	ID   string
+}
+
+// String encodes the cursor for clients, who should treat it as opaque
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Time.Format(time.RFC3339Nano) + "," + c.ID))
+}
+
+// ParseCursor decodes a cursor encoded by String, returning ErrInvalidInput for malformed cursors
+func ParseCursor(s string) (Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidInput
+	}
+	timestamp, id, ok := strings.Cut(string(decoded), ",")
+	if !ok {
+		return Cursor{}, ErrInvalidInput
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return Cursor{}, ErrInvalidInput
+	}
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return Cursor{}, ErrInvalidInput
+	}
+	return Cursor{Time: t, ID: id}, nil
+}
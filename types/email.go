@@ -1,8 +1,44 @@
 package types
 
+import "time"
+
+type EmailStatus string
+
+const (
+	EmailQueued    EmailStatus = "queued"
+	EmailSent      EmailStatus = "sent"
+	EmailFailed    EmailStatus = "failed"    // retries exhausted, or rejected permanently by the server
+	EmailThrottled EmailStatus = "throttled" // not sent, a recipient exceeded the send limit
+)
+
+// Email is an outgoing email, stored before being sent so it survives restarts and SMTP outages
 type Email struct {
-	To      []string
-	Subject string
-	Body    string
-	IsHTML  bool
+	ID              string            `json:"id"`
+	To              []string          `json:"to"`
+	Subject         string            `json:"subject"`
+	Body            string            `json:"body,omitempty"`      // omitted when listing
+	TextBody        string            `json:"text_body,omitempty"` // plain-text alternative of an HTML body, generated when empty
+	IsHTML          bool              `json:"is_html"`
+	Template        string            `json:"template,omitempty"`         // template the body was rendered from, if any
+	ReplyTo         string            `json:"reply_to,omitempty"`         // overrides the configured Reply-To address
+	ListUnsubscribe string            `json:"list_unsubscribe,omitempty"` // https or mailto URL, sent in the List-Unsubscribe header
+	Attachments     []EmailAttachment `json:"attachments,omitempty"`      // omitted when listing
+	Event           NotificationEvent `json:"-"`                          // notification the email was sent for, account emails are never throttled
+	Status          EmailStatus       `json:"status"`
+	Attempts        int               `json:"attempts"`
+	Response        *string           `json:"response,omitempty"` // SMTP reply to the last attempt, e.g. "250 2.0.0 Ok: queued as 1A2B3C"
+	Error           *string           `json:"error,omitempty"`    // error of the last attempt
+	NextAttemptAt   *time.Time        `json:"next_attempt_at,omitempty"`
+	SentAt          *time.Time        `json:"sent_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// EmailAttachment is a file attached to an email.
+// Attachments with a ContentID are inline, and referenced from the HTML body as cid:<ContentID>, e.g. images.
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Data        []byte `json:"data"`
 }
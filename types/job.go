@@ -10,4 +10,14 @@ const (
 	ExpiredRegistrationCodes Job = "expired_registration_codes"
 	ExpiredRefreshTokens     Job = "expired_refresh_tokens"
 	ExpiredPasswordResets    Job = "expired_password_resets"
+	ExpiredAuditEntries      Job = "expired_audit_entries"
+	ExpiredLockouts          Job = "expired_lockouts"
+	ExpiredTokenRevocations  Job = "expired_token_revocations"
+	ExpiredEmailChanges      Job = "expired_email_changes"
+	ExpiredOIDCStates        Job = "expired_oidc_states"
+	ExpiredWebhookDeliveries Job = "expired_webhook_deliveries"
+	ExpiredOutboxEvents      Job = "expired_outbox_events"
+	ExpiredEmails            Job = "expired_emails"
+	ExpiredStreamEvents      Job = "expired_stream_events"
+	ExpiredOffers            Job = "expired_offers"
 )
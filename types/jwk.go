@@ -0,0 +1,16 @@
+package types
+
+// JWK is an RSA public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"` // key type, always "RSA"
+	Use string `json:"use"` // intended use, always "sig"
+	Alg string `json:"alg"` // signing algorithm, e.g. RS256
+	Kid string `json:"kid"` // key ID, matches the kid header of tokens signed with this key
+	N   string `json:"n"`   // base64url encoded modulus
+	E   string `json:"e"`   // base64url encoded exponent
+}
+
+// JWKS is a set of public keys used to verify access tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
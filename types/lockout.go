@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// LockoutScope identifies what is being protected against brute force
+type LockoutScope string
+
+const (
+	LockoutLogin         LockoutScope = "login"          // subject is the account email
+	LockoutPasswordReset LockoutScope = "password_reset" // subject is the account email
+	LockoutRegistration  LockoutScope = "registration"   // subject is the account email
+)
+
+// Lockout tracks consecutive failed attempts for a subject within a scope
+type Lockout struct {
+	Scope       LockoutScope `json:"scope"`
+	Subject     string       `json:"subject"`
+	Failures    int          `json:"failures"`
+	LockedUntil *time.Time   `json:"locked_until,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
@@ -0,0 +1,91 @@
+package types
+
+// NotificationEvent is a kind of notification, which users choose the channels of
+type NotificationEvent string
+
+const (
+	NotificationAccount      NotificationEvent = "account"            // verification, password reset and security emails, always sent
+	NotificationOrderConf    NotificationEvent = "order_confirmation" // order paid
+	NotificationOrderUpdates NotificationEvent = "order_updates"      // order shipped, delivered, refunded or canceled
+	NotificationOfferUpdates NotificationEvent = "offer_updates"      // offer placed, or its status changed
+	NotificationOrderRecv    NotificationEvent = "order_received"     // new order, sent to admins
+	NotificationOfferRecv    NotificationEvent = "offer_received"     // new offer, sent to admins
+	NotificationAnnouncement NotificationEvent = "announcements"      // broadcast by staff to a segment of users
+)
+
+// NotificationEvents lists the events users can choose the channels of
+var NotificationEvents = []NotificationEvent{
+	NotificationOrderConf,
+	NotificationOrderUpdates,
+	NotificationOfferUpdates,
+	NotificationOrderRecv,
+	NotificationOfferRecv,
+	NotificationAnnouncement,
+}
+
+// IsValid reports whether the event is one users can choose the channels of
+func (e NotificationEvent) IsValid() bool {
+	for _, event := range NotificationEvents {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationChannel is a way of delivering notifications
+type NotificationChannel string
+
+const (
+	ChannelInbox   NotificationChannel = "inbox"   // conversation inbox
+	ChannelEmail   NotificationChannel = "email"   // email to the user's address
+	ChannelWebhook NotificationChannel = "webhook" // the user's own webhook
+)
+
+// NotificationChannels lists every channel
+var NotificationChannels = []NotificationChannel{
+	ChannelInbox,
+	ChannelEmail,
+	ChannelWebhook,
+}
+
+// IsValid reports whether the channel is a known channel
+func (c NotificationChannel) IsValid() bool {
+	for _, channel := range NotificationChannels {
+		if channel == c {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultNotificationChannels are the channels enabled for each event until a user changes them.
+// Webhook deliveries are only made once the user has set up a webhook.
+var DefaultNotificationChannels = map[NotificationEvent][]NotificationChannel{
+	NotificationOrderConf:    {ChannelInbox, ChannelEmail, ChannelWebhook},
+	NotificationOrderUpdates: {ChannelInbox, ChannelEmail, ChannelWebhook},
+	NotificationOfferUpdates: {ChannelInbox, ChannelEmail, ChannelWebhook},
+	NotificationOrderRecv:    {ChannelInbox, ChannelWebhook},
+	NotificationOfferRecv:    {ChannelInbox, ChannelWebhook},
+	NotificationAnnouncement: {ChannelInbox, ChannelEmail, ChannelWebhook},
+}
+
+// NotificationPreference enables or disables a channel for an event
+type NotificationPreference struct {
+	Event   NotificationEvent   `json:"event"`
+	Channel NotificationChannel `json:"channel"`
+	Enabled bool                `json:"enabled"`
+}
+
+// NotificationSettings are a user's preferences for every event and channel, and their webhook
+type NotificationSettings struct {
+	Preferences []NotificationPreference `json:"preferences"`
+	Webhook     *Webhook                 `json:"webhook"` // nil until configured
+}
+
+// NotificationPayload is the data of a notification delivered to a user's webhook
+type NotificationPayload struct {
+	Event   NotificationEvent `json:"event"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"` // HTML, as shown in the inbox
+}
@@ -10,8 +10,15 @@ const (
 	OfferRejected  OfferStatus = "rejected"
 	OfferCanceled  OfferStatus = "canceled"
 	OfferCompleted OfferStatus = "completed"
+	OfferCountered OfferStatus = "countered" // the seller countered, awaiting the buyer
+	OfferExpired   OfferStatus = "expired"   // left unanswered while pending or countered
 )
 
+// IsOpen reports whether the offer awaits a response, from the seller when pending or the buyer when countered
+func (s OfferStatus) IsOpen() bool {
+	return s == OfferPending || s == OfferCountered
+}
+
 type Offer struct {
 	ID        string      `json:"id"`
 	UserID    string      `json:"user_id"`
@@ -19,6 +26,26 @@ type Offer struct {
 	Amount    int64       `json:"amount"`
 	Status    OfferStatus `json:"status"`
 	Comment   *string     `json:"comment"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"` // set while open, and while accepted as the payment deadline
 	CreatedAt time.Time   `json:"created_at"`
 	UpdatedAt time.Time   `json:"updated_at"`
+
+	Revisions []OfferRevision `json:"revisions,omitempty"` // negotiation history, loaded with a single offer
+}
+
+// OfferRevision is a step of an offer's negotiation, e.g. a counter-offer
+type OfferRevision struct {
+	ID        string      `json:"id"`
+	OfferID   string      `json:"offer_id"`
+	AuthorID  string      `json:"author_id,omitempty"` // empty for the system, e.g. expiry or a price floor, and for staff when shown to the buyer
+	Amount    int64       `json:"amount"`
+	Status    OfferStatus `json:"status"`
+	Comment   *string     `json:"comment,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// OfferFloor is the lowest amount a product accepts offers for, offers below it are rejected automatically
+type OfferFloor struct {
+	ProductID string `json:"product_id"`
+	Floor     *int64 `json:"floor"` // nil when any amount is considered
 }
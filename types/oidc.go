@@ -0,0 +1,32 @@
+package types
+
+import "time"
+
+// OIDCProviderConfig configures an OpenID Connect identity provider
+type OIDCProviderConfig struct {
+	Name         string   // provider name used in URLs, e.g. google
+	Issuer       string   // issuer URL, used for discovery and ID token validation
+	ClientID     string   // client ID registered with the provider
+	ClientSecret string   // client secret, empty for public clients
+	RedirectURL  string   // frontend callback URL registered with the provider
+	Scopes       []string // requested scopes, must include openid
+}
+
+// UserIdentity links an external identity to a user
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    string    `json:"user_id"`
+	Email     *string   `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCAuthState holds the values generated when starting an authorization request,
+// so they can be verified when the provider redirects back
+type OIDCAuthState struct {
+	State        string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
@@ -26,10 +26,19 @@ type Order struct {
 	TotalAmount    int64       `json:"total_amount"`
 	Status         OrderStatus `json:"status"`
 	Items          []OrderItem `json:"items"`
+	Tracking       *Tracking   `json:"tracking,omitempty"` // set when shipped
+	OfferID        string      `json:"offer_id,omitempty"` // accepted offer checked out, at its amount
 	CreatedAt      time.Time   `json:"created_at"`
 	UpdatedAt      time.Time   `json:"updated_at"`
 }
 
+// Tracking identifies the shipment of an order
+type Tracking struct {
+	Carrier string  `json:"carrier"`
+	Number  string  `json:"number"`
+	URL     *string `json:"url,omitempty"`
+}
+
 type OrderItem struct {
 	Product   Product `json:"product"`
 	Thumbnail string  `json:"thumbnail"`
@@ -0,0 +1,59 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DomainEventType identifies a state change recorded in the outbox
+type DomainEventType string
+
+const (
+	EventTypeOrderStatusChanged DomainEventType = "order.status_changed" // payload is OrderStatusChange
+	EventTypeOfferCreated       DomainEventType = "offer.created"        // payload is OfferStatusChange
+	EventTypeOfferStatusChanged DomainEventType = "offer.status_changed" // payload is OfferStatusChange
+	EventTypeInventoryChanged   DomainEventType = "inventory.changed"    // payload is InventoryUpdate
+)
+
+type DomainEventStatus string
+
+const (
+	DomainEventPending   DomainEventStatus = "pending"
+	DomainEventProcessed DomainEventStatus = "processed"
+	DomainEventFailed    DomainEventStatus = "failed" // retries exhausted
+)
+
+// DomainEvent is written to the outbox in the same transaction as the state change it describes,
+// and dispatched to event handlers once committed.
+type DomainEvent struct {
+	ID            string            `json:"id"`
+	AggregateType string            `json:"aggregate_type"` // e.g. order, events of an aggregate are handled in order
+	AggregateID   string            `json:"aggregate_id"`
+	Type          DomainEventType   `json:"type"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        DomainEventStatus `json:"status"`
+	Attempts      int               `json:"attempts"`
+	Handled       []string          `json:"handled"` // names of handlers which have completed, skipped on retry
+	LastError     *string           `json:"last_error,omitempty"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	ProcessedAt   *time.Time        `json:"processed_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+// OrderStatusChange is the payload of order.status_changed events
+type OrderStatusChange struct {
+	OrderID string      `json:"order_id"`
+	UserID  string      `json:"user_id"`
+	Status  OrderStatus `json:"status"`
+	Items   []OrderItem `json:"items,omitempty"` // items removed from a refunded or canceled order
+}
+
+// OfferStatusChange is the payload of offer events
+type OfferStatusChange struct {
+	OfferID   string      `json:"offer_id"`
+	UserID    string      `json:"user_id"`
+	ProductID string      `json:"product_id"`
+	Status    OfferStatus `json:"status"`
+	Amount    int64       `json:"amount"`
+	UpdatedBy string      `json:"updated_by,omitempty"` // user who made the change, empty for the system
+}
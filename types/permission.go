@@ -0,0 +1,64 @@
+package types
+
+// Permission is a named capability granted to roles, e.g. "orders:fulfill".
+type Permission string
+
+const (
+	PermAuditRead          Permission = "audit:read"
+	PermBroadcastsWrite    Permission = "broadcasts:write"
+	PermCategoriesWrite    Permission = "categories:write"
+	PermConversationsRead  Permission = "conversations:read"
+	PermConversationsWrite Permission = "conversations:write"
+	PermEmailsAdmin        Permission = "emails:admin"
+	PermOffersCreate       Permission = "offers:create"
+	PermOffersRead         Permission = "offers:read"
+	PermOffersWrite        Permission = "offers:write"
+	PermOrdersRead         Permission = "orders:read"
+	PermOrdersFulfill      Permission = "orders:fulfill"
+	PermProductsWrite      Permission = "products:write"
+	PermRefundsCreate      Permission = "refunds:create"
+	PermShippingRead       Permission = "shipping:read"
+	PermShippingWrite      Permission = "shipping:write"
+	PermTemplatesWrite     Permission = "templates:write"
+	PermUsersRead          Permission = "users:read"
+	PermUsersAdmin         Permission = "users:admin"
+	PermWebhooksAdmin      Permission = "webhooks:admin"
+)
+
+// Permissions lists every known permission
+var Permissions = []Permission{
+	PermAuditRead,
+	PermBroadcastsWrite,
+	PermCategoriesWrite,
+	PermConversationsRead,
+	PermConversationsWrite,
+	PermEmailsAdmin,
+	PermOffersCreate,
+	PermOffersRead,
+	PermOffersWrite,
+	PermOrdersRead,
+	PermOrdersFulfill,
+	PermProductsWrite,
+	PermRefundsCreate,
+	PermShippingRead,
+	PermShippingWrite,
+	PermTemplatesWrite,
+	PermUsersRead,
+	PermUsersAdmin,
+	PermWebhooksAdmin,
+}
+
+// IsValid reports whether the permission is a known permission
+func (p Permission) IsValid() bool {
+	for _, perm := range Permissions {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
+type RolePermissions struct {
+	Role        Role         `json:"role"`
+	Permissions []Permission `json:"permissions"`
+}
@@ -0,0 +1,39 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// StreamEventType identifies an event streamed to a user, and is the SSE event name
+type StreamEventType string
+
+const (
+	StreamMessage StreamEventType = "message" // data is InboxMessage
+	StreamUnread  StreamEventType = "unread"  // data is InboxUnread
+	StreamOrder   StreamEventType = "order"   // data is OrderStatusChange
+	StreamOffer   StreamEventType = "offer"   // data is OfferStatusChange
+)
+
+// StreamEvent is streamed to a user over SSE. Events are kept for a while,
+// so clients reconnecting with the ID of the last event received can catch up.
+type StreamEvent struct {
+	ID        string          `json:"id"` // increasing per user, in commit order
+	UserID    string          `json:"user_id"`
+	Type      StreamEventType `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// InboxMessage is the data of message events, the message itself is fetched with its conversation
+type InboxMessage struct {
+	ConversationID string    `json:"conversation_id"`
+	MessageID      string    `json:"message_id"`
+	SenderID       string    `json:"sender_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// InboxUnread is the data of unread events
+type InboxUnread struct {
+	Count int `json:"count"` // conversations with messages the user has not read
+}
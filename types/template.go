@@ -0,0 +1,32 @@
+package types
+
+import "time"
+
+// Template is a notification, email or page template, and the admin's edits of it
+type Template struct {
+	Name     string           `json:"name"` // file name, e.g. "email_order_confirmation.html"
+	Language string           `json:"language"`
+	Default  string           `json:"default"`            // contents of the file
+	Override *TemplateVersion `json:"override,omitempty"` // latest version, nil until edited
+}
+
+// TemplateVersion is a saved edit of a template.
+// A version without a body reverts the template to its file.
+type TemplateVersion struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Language  string    `json:"language"`
+	Version   int       `json:"version"`
+	Body      *string   `json:"body"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InvalidTemplateError is returned when saving a template that does not parse
+type InvalidTemplateError struct {
+	Message string `json:"message"`
+}
+
+func (e *InvalidTemplateError) Error() string {
+	return "invalid template: " + e.Message
+}
@@ -1,18 +1,37 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 )
 
 type User struct {
-	ID           string    `json:"id"`
-	Email        *string   `json:"email,omitempty"`
-	Password     *string   `json:"-"`
-	PasswordHash *string   `json:"-"`
-	Role         Role      `json:"role"`
-	Verified     bool      `json:"verified"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           string       `json:"id"`
+	Email        *string      `json:"email,omitempty"`
+	Name         *string      `json:"name,omitempty"`
+	Phone        *string      `json:"phone,omitempty"`
+	Password     *string      `json:"-"`
+	PasswordHash *string      `json:"-"`
+	Role         Role         `json:"role"`
+	Verified     bool         `json:"verified"`
+	LockedUntil  *time.Time   `json:"locked_until,omitempty"`  // admin view only
+	FailedLogins int          `json:"failed_logins,omitempty"` // admin view only
+	UpdatedAt    time.Time    `json:"updated_at"`
+	CreatedAt    time.Time    `json:"created_at"`
+	IssuedAt     time.Time    `json:"-"` // set when parsed from an access token
+	APIKeyID     string       `json:"-"` // set when authenticated with an API key
+	Scopes       []Permission `json:"-"` // when set, limits the permissions granted by the role
+}
+
+// UserExport is a copy of the personal data held for a user
+type UserExport struct {
+	User          User            `json:"user"`
+	Addresses     json.RawMessage `json:"addresses"`
+	CartItems     json.RawMessage `json:"cart_items"`
+	Orders        json.RawMessage `json:"orders"`
+	Offers        json.RawMessage `json:"offers"`
+	Conversations json.RawMessage `json:"conversations"`
+	ExportedAt    time.Time       `json:"exported_at"`
 }
 
 type Role string
@@ -33,6 +52,12 @@ var hierarchy = map[Role]int{
 	RoleAdmin:  4,
 }
 
+// IsValid checks if the role is a known role
+func (r Role) IsValid() bool {
+	_, ok := hierarchy[r]
+	return ok
+}
+
 // HasMinimumRole checks if the user has a role equal to
 // or higher than the specified role in the hierarchy.
 func (u *User) HasMinimumRole(role Role) bool {
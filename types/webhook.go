@@ -0,0 +1,106 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebhookEvent is the type of event delivered to webhook subscribers, e.g. "order.paid"
+type WebhookEvent string
+
+const (
+	EventOrderPaid        WebhookEvent = "order.paid"
+	EventOrderShipped     WebhookEvent = "order.shipped"
+	EventOrderDelivered   WebhookEvent = "order.delivered"
+	EventOrderRefunded    WebhookEvent = "order.refunded"
+	EventOrderCanceled    WebhookEvent = "order.canceled"
+	EventOfferCreated     WebhookEvent = "offer.created"
+	EventOfferAccepted    WebhookEvent = "offer.accepted"
+	EventOfferRejected    WebhookEvent = "offer.rejected"
+	EventOfferCanceled    WebhookEvent = "offer.canceled"
+	EventOfferCompleted   WebhookEvent = "offer.completed"
+	EventOfferCountered   WebhookEvent = "offer.countered"
+	EventOfferExpired     WebhookEvent = "offer.expired"
+	EventInventoryUpdated WebhookEvent = "inventory.updated"
+
+	// EventNotification is delivered to webhooks owned by users, and cannot be subscribed to
+	EventNotification WebhookEvent = "notification"
+)
+
+// WebhookEvents lists every event which can be subscribed to
+var WebhookEvents = []WebhookEvent{
+	EventOrderPaid,
+	EventOrderShipped,
+	EventOrderDelivered,
+	EventOrderRefunded,
+	EventOrderCanceled,
+	EventOfferCreated,
+	EventOfferAccepted,
+	EventOfferRejected,
+	EventOfferCanceled,
+	EventOfferCompleted,
+	EventOfferCountered,
+	EventOfferExpired,
+	EventInventoryUpdated,
+}
+
+// IsValid reports whether the event is a known event
+func (e WebhookEvent) IsValid() bool {
+	for _, event := range WebhookEvents {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is an endpoint subscribed to a set of events
+type Webhook struct {
+	ID        string         `json:"id"`
+	URL       string         `json:"url"`
+	Secret    string         `json:"secret,omitempty"` // signing secret, only returned on creation
+	Events    []WebhookEvent `json:"events"`
+	Enabled   bool           `json:"enabled"`
+	UserID    string         `json:"-"` // owner of a user's notification webhook, empty for store webhooks
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	DeliveryPending   WebhookDeliveryStatus = "pending"
+	DeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	DeliveryFailed    WebhookDeliveryStatus = "failed" // retries exhausted
+)
+
+// WebhookDelivery records the delivery of an event to a webhook, including retries
+type WebhookDelivery struct {
+	ID             string                `json:"id"`
+	WebhookID      string                `json:"webhook_id"`
+	Event          WebhookEvent          `json:"event"`
+	Payload        json.RawMessage       `json:"payload"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`
+	ResponseStatus *int                  `json:"response_status,omitempty"` // status code of the last attempt
+	Error          *string               `json:"error,omitempty"`           // error of the last attempt
+	NextAttemptAt  *time.Time            `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time            `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time             `json:"created_at"`
+	UpdatedAt      time.Time             `json:"updated_at"`
+	Webhook        *Webhook              `json:"-"` // target, loaded when claimed for delivery
+}
+
+// WebhookPayload is the body posted to webhook endpoints
+type WebhookPayload struct {
+	ID        string       `json:"id"` // event ID, shared by all deliveries of the event
+	Type      WebhookEvent `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      interface{}  `json:"data"`
+}
+
+// InventoryUpdate is the data of an inventory.updated event
+type InventoryUpdate struct {
+	ProductID string `json:"product_id"`
+	Inventory int    `json:"inventory"`
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +19,8 @@ func LoadConfig() types.Config {
 	environment := loadEnvironment()
 
 	return types.Config{
+		Attachment:        loadAttachmentConfig(),
+		Audit:             loadAuditConfig(),
 		BaseURL:           loadBaseURL(),
 		Country:           loadCountry(),
 		Environment:       environment,
@@ -27,6 +30,7 @@ func LoadConfig() types.Config {
 		Email:             loadEmailConfig(),
 		Logger:            loadLoggerConfig(),
 		MachineID:         loadMachineID(),
+		OIDC:              loadOIDCConfig(),
 		Payment:           loadPaymentConfig(environment),
 		JWT:               loadJWTConfig(),
 		HTTPClientTimeout: loadHttpClientTimeout(),
@@ -36,6 +40,34 @@ func LoadConfig() types.Config {
 	}
 }
 
+// loadOIDCConfig loads the OpenID Connect providers listed in OIDC_PROVIDERS.
+// Each provider is configured by OIDC_<NAME>_* variables.
+func loadOIDCConfig() []types.OIDCProviderConfig {
+	var providers []types.OIDCProviderConfig
+	for _, name := range strings.Split(getEnvOrDefault("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !oidcProviderName.MatchString(name) {
+			slog.Error("Invalid OIDC provider name", "name", name)
+			os.Exit(1)
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, types.OIDCProviderConfig{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(mustLookupEnv(prefix+"ISSUER"), "/"),
+			ClientID:     mustLookupEnv(prefix + "CLIENT_ID"),
+			ClientSecret: getEnvOrDefault(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getEnvOrDefault(prefix+"REDIRECT_URL", loadBaseURL()+"/auth/oidc/"+name+"/callback"),
+			Scopes:       strings.Fields(getEnvOrDefault(prefix+"SCOPES", "openid email profile")),
+		})
+	}
+	return providers
+}
+
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9]+$`)
+
 func loadServerConfig() types.ServerConfig {
 	return types.ServerConfig{
 		Addr:           mustLookupEnv("SERVER_ADDR"),
@@ -54,6 +86,17 @@ func loadAuthConfig() types.AuthConfig {
 	}
 }
 
+func loadAuditConfig() types.AuditConfig {
+	retention, err := time.ParseDuration(getEnvOrDefault("AUDIT_RETENTION", "8760h"))
+	if err != nil {
+		slog.Error("Error parsing duration", "key", "AUDIT_RETENTION", "error", err)
+		os.Exit(1)
+	}
+	return types.AuditConfig{
+		Retention: retention,
+	}
+}
+
 func loadDBConfig() types.DBConfig {
 	return types.DBConfig{
 		Host:            mustLookupEnv("POSTGRES_HOST"),
@@ -99,10 +142,26 @@ func loadJWTConfig() types.JWTConfig {
 		os.Exit(1)
 	}
 
+	// public keys of previous signing keys, comma separated
+	var previousKeys [][]byte
+	for _, path := range strings.Split(getEnvOrDefault("PREVIOUS_PUBLIC_KEY_PATHS", ""), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		key := mustReadFile(path)
+		if len(key) == 0 {
+			slog.Error("Public key file empty", "file path", path)
+			os.Exit(1)
+		}
+		previousKeys = append(previousKeys, key)
+	}
+
 	return types.JWTConfig{
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
-		Expiry:     mustParseDuration("JWT_EXPIRY"),
+		PrivateKey:         privateKey,
+		PublicKey:          publicKey,
+		PreviousPublicKeys: previousKeys,
+		Expiry:             mustParseDuration("JWT_EXPIRY"),
 	}
 }
 
@@ -145,6 +204,28 @@ func loadImageConfig() types.ImageConfig {
 	}
 }
 
+func loadAttachmentConfig() types.AttachmentConfig {
+	maxFileSize, err := strconv.Atoi(getEnvOrDefault("ATTACHMENT_MAX_FILE_SIZE", "10485760"))
+	if err != nil {
+		slog.Error("Error converting string to int", "key", "ATTACHMENT_MAX_FILE_SIZE", "error", err)
+		os.Exit(1)
+	}
+	config := types.AttachmentConfig{
+		UploadPath:       getEnvOrDefault("ATTACHMENT_DIR", "attachments"),
+		MaxFileSizeBytes: maxFileSize,
+		Scanner:          types.AttachmentScanner(getEnvOrDefault("ATTACHMENT_SCANNER", string(types.ScannerLocal))),
+	}
+	switch config.Scanner {
+	case types.ScannerLocal:
+	case types.ScannerClamAV:
+		config.ClamAVAddr = mustLookupEnv("ATTACHMENT_CLAMAV_ADDR")
+	default:
+		slog.Error("Invalid attachment scanner", "key", "ATTACHMENT_SCANNER", "value", config.Scanner)
+		os.Exit(1)
+	}
+	return config
+}
+
 func loadPaymentConfig(env types.Environment) types.PaymentConfig {
 	return types.PaymentConfig{
 		Stripe:      loadStripeConfig(),
@@ -202,7 +283,7 @@ func loadRateLimit() bool {
 
 func loadEmailConfig() types.EmailConfig {
 	if isFeatureEnabled("MAIL_ENABLED") {
-		return types.EmailConfig{
+		config := types.EmailConfig{
 			Enabled:  true,
 			Host:     mustLookupEnv("MAIL_SMTP_HOST"),
 			Port:     mustAtoI("MAIL_SMTP_PORT"),
@@ -211,7 +292,14 @@ func loadEmailConfig() types.EmailConfig {
 			UseTLS:   isFeatureEnabled("MAIL_SMTP_USE_TLS"),
 			From:     mustLookupEnv("MAIL_FROM_EMAIL"),
 			FromName: mustLookupEnv("MAIL_FROM_NAME"),
+			ReplyTo:  os.Getenv("MAIL_REPLY_TO"),
+		}
+		if domain := os.Getenv("MAIL_DKIM_DOMAIN"); domain != "" {
+			config.DKIMDomain = domain
+			config.DKIMSelector = mustLookupEnv("MAIL_DKIM_SELECTOR")
+			config.DKIMPrivateKey = mustReadFile(mustLookupEnv("MAIL_DKIM_PRIVATE_KEY_PATH"))
 		}
+		return config
 	}
 	return types.EmailConfig{
 		Enabled: false,
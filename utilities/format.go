@@ -0,0 +1,127 @@
+package utilities
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// numberFormat describes how a language writes amounts of money
+type numberFormat struct {
+	Decimal     string // e.g. "." in English, "," in German
+	Group       string // thousands separator, e.g. "," in English, "." in German
+	SymbolAfter bool   // whether the currency symbol follows the amount, e.g. "19,99 €"
+}
+
+// numberFormats by language tag or base language, e.g. "de-CH" or "de"
+var numberFormats = map[string]numberFormat{
+	"en": {Decimal: ".", Group: ",", SymbolAfter: false},
+	"cy": {Decimal: ".", Group: ",", SymbolAfter: false},
+	"de": {Decimal: ",", Group: ".", SymbolAfter: true},
+	"es": {Decimal: ",", Group: ".", SymbolAfter: true},
+	"fr": {Decimal: ",", Group: " ", SymbolAfter: true},
+	"ja": {Decimal: ".", Group: ",", SymbolAfter: false},
+}
+
+// currencySymbols of the supported currencies, other currencies are written with their code
+var currencySymbols = map[string]string{
+	"CAD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"USD": "$",
+}
+
+// dateFormats by language tag or base language, as time layouts for dates and for dates with times
+var dateFormats = map[string][2]string{
+	"en":    {"2 Jan 2006", "2 Jan 2006 15:04 MST"},
+	"en-US": {"Jan 2, 2006", "Jan 2, 2006 3:04 PM MST"},
+	"en-CA": {"2006-01-02", "2006-01-02 15:04 MST"},
+	"cy":    {"2 Jan 2006", "2 Jan 2006 15:04 MST"},
+	"de":    {"02.01.2006", "02.01.2006 15:04 MST"},
+	"es":    {"02/01/2006", "02/01/2006 15:04 MST"},
+	"fr":    {"02/01/2006", "02/01/2006 15:04 MST"},
+	"fr-CA": {"2006-01-02", "2006-01-02 15:04 MST"},
+	"ja":    {"2006/01/02", "2006/01/02 15:04 MST"},
+}
+
+// localized returns the entry for a language tag, falling back to its base language
+func localized[T any](entries map[string]T, language string) (T, bool) {
+	if entry, ok := entries[language]; ok {
+		return entry, true
+	}
+	entry, ok := entries[BaseLanguage(language)]
+	return entry, ok
+}
+
+// BaseLanguage returns the language of a tag without its region, e.g. "de" for "de-DE"
+func BaseLanguage(language string) string {
+	base, _, _ := strings.Cut(language, "-")
+	return base
+}
+
+// FormatMoney formats an amount in minor units as written in the given language,
+// e.g. 123456 USD as "$1,234.56" in "en-US" and 123456 EUR as "1.234,56 €" in "de-DE".
+// Languages without a known format are written as in English.
+func FormatMoney(amount int64, currency string, minorUnits int, language string) string {
+	format, ok := localized(numberFormats, language)
+	if !ok {
+		format = numberFormats["en"]
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	divisor := int64(1)
+	for i := 0; i < minorUnits; i++ {
+		divisor *= 10
+	}
+	number := groupDigits(amount/divisor, format.Group)
+	if minorUnits > 0 {
+		number += fmt.Sprintf("%s%0*d", format.Decimal, minorUnits, amount%divisor)
+	}
+
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = currency
+		if !format.SymbolAfter {
+			symbol += " "
+		}
+	}
+	if format.SymbolAfter {
+		return sign + number + " " + symbol
+	}
+	return sign + symbol + number
+}
+
+// groupDigits writes n with the separator between each group of three digits
+func groupDigits(n int64, separator string) string {
+	digits := fmt.Sprintf("%d", n)
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(separator)
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// FormatDate formats the date of t as written in the given language, e.g. "Jan 2, 2006" in "en-US"
+// and "02.01.2006" in "de-DE". Languages without a known format use ISO 8601.
+func FormatDate(t time.Time, language string) string {
+	if format, ok := localized(dateFormats, language); ok {
+		return t.Format(format[0])
+	}
+	return t.Format("2006-01-02")
+}
+
+// FormatDateTime formats the date and time of t as written in the given language,
+// e.g. "Jan 2, 2006 3:04 PM MST" in "en-US" and "02.01.2006 15:04 MST" in "de-DE"
+func FormatDateTime(t time.Time, language string) string {
+	if format, ok := localized(dateFormats, language); ok {
+		return t.Format(format[1])
+	}
+	return t.Format("2006-01-02 15:04 MST")
+}
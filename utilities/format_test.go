@@ -0,0 +1,54 @@
+package utilities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount     int64
+		currency   string
+		minorUnits int
+		language   string
+		expected   string
+	}{
+		{123456, "USD", 2, "en-US", "$1,234.56"},
+		{123456, "EUR", 2, "de-DE", "1.234,56 €"},
+		{123456, "EUR", 2, "de-AT", "1.234,56 €"},
+		{123456, "CAD", 2, "fr-CA", "1 234,56 $"},
+		{-999, "GBP", 2, "en-GB", "-£9.99"},
+		{1500000, "JPY", 0, "ja-JP", "¥1,500,000"},
+		{1999, "CHF", 2, "en", "CHF 19.99"},
+		{1999, "CHF", 2, "de-CH", "19,99 CHF"},
+		{1999, "USD", 2, "xx", "$19.99"},
+	}
+	for _, test := range tests {
+		if got := FormatMoney(test.amount, test.currency, test.minorUnits, test.language); got != test.expected {
+			t.Errorf("Expected %d %s in %s to format as %q, got %q", test.amount, test.currency, test.language, test.expected, got)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	date := time.Date(2025, time.March, 7, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		language string
+		date     string
+		dateTime string
+	}{
+		{"en-US", "Mar 7, 2025", "Mar 7, 2025 2:30 PM UTC"},
+		{"en-GB", "7 Mar 2025", "7 Mar 2025 14:30 UTC"},
+		{"de-DE", "07.03.2025", "07.03.2025 14:30 UTC"},
+		{"ja-JP", "2025/03/07", "2025/03/07 14:30 UTC"},
+		{"xx", "2025-03-07", "2025-03-07 14:30 UTC"},
+	}
+	for _, test := range tests {
+		if got := FormatDate(date, test.language); got != test.date {
+			t.Errorf("Expected date in %s to format as %q, got %q", test.language, test.date, got)
+		}
+		if got := FormatDateTime(date, test.language); got != test.dateTime {
+			t.Errorf("Expected date and time in %s to format as %q, got %q", test.language, test.dateTime, got)
+		}
+	}
+}
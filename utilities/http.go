@@ -2,8 +2,12 @@ package utilities
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"syscall"
 	"time"
 )
 
@@ -31,3 +35,58 @@ func (c *DefaultHTTPClient) Do(req *http.Request) (*http.Response, error) {
 func (c *DefaultHTTPClient) NewRequestWithContext(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
 	return http.NewRequestWithContext(ctx, method, url, body)
 }
+
+// NewPublicHTTPClient returns a client which only connects to public IP addresses,
+// for requests to user supplied URLs. The address is checked when connecting,
+// after DNS resolution, so a host cannot be rebound to an internal address.
+func NewPublicHTTPClient(timeout time.Duration) *DefaultHTTPClient {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return fmt.Errorf("connection to non-public address %s refused", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would connect on our behalf, bypassing the check
+	transport.DialContext = dialer.DialContext
+	return &DefaultHTTPClient{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+	}
+}
+
+// carrier-grade NAT range (RFC 6598), not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP reports whether ip is a globally routable unicast address.
+// Loopback, private, link-local (including cloud metadata endpoints) and unspecified addresses are not.
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// ErrNonPublicHost is returned by ResolvePublicHost when the host resolves to a non-public address
+var ErrNonPublicHost = errors.New("host resolves to a non-public address")
+
+// ResolvePublicHost checks that every address host resolves to is public
+func ResolvePublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !IsPublicIP(addr.IP) {
+			return ErrNonPublicHost
+		}
+	}
+	return nil
+}
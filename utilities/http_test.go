@@ -0,0 +1,33 @@
+package utilities
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fd00:ec2::254", false},   // cloud metadata over IPv6
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if result := IsPublicIP(net.ParseIP(test.ip)); result != test.expected {
+			t.Errorf("IsPublicIP(%s) = %v; want %v", test.ip, result, test.expected)
+		}
+	}
+}
@@ -32,6 +32,11 @@ type locale struct {
 	// TODO InclusiveTax bool
 }
 
+// FormatAmount formats an amount in minor units in the locale's currency and language, e.g. 1999 as "$19.99" in the US
+func (l *locale) FormatAmount(amount int64) string {
+	return FormatMoney(amount, l.Currency, l.MinorUnits, l.Language)
+}
+
 var LocaleData = map[string]*locale{
 	"US": {
 		CountryCode:       "US",
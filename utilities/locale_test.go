@@ -262,3 +262,25 @@ func TestValidatePostalCode_AdditionalCountries(t *testing.T) {
 		t.Error("Expected invalid France postal code to return error")
 	}
 }
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		country  string
+		amount   int64
+		expected string
+	}{
+		{"US", 1999, "$19.99"},
+		{"US", 5, "$0.05"},
+		{"US", 0, "$0.00"},
+		{"US", -1250, "-$12.50"},
+		{"US", 123456789, "$1,234,567.89"},
+		{"GB", 1999, "£19.99"},
+		{"DE", 100000, "1.000,00 €"},
+		{"JP", 1500, "¥1,500"},
+	}
+	for _, test := range tests {
+		if got := LocaleData[test.country].FormatAmount(test.amount); got != test.expected {
+			t.Errorf("Expected %d in %s to format as %q, got %q", test.amount, test.country, test.expected, got)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package utilities
 import (
 	"net/http"
 	"strconv"
+
+	"github.com/dgyurics/marketplace/types"
 )
 
 type PaginationParams struct {
@@ -30,3 +32,22 @@ func ParsePaginationParams(r *http.Request, defaultPage, defaultLimit int) Pagin
 
 	return PaginationParams{Page: page, Limit: limit}
 }
+
+type CursorParams struct {
+	Cursor *types.Cursor // nil for the first page
+	Limit  int
+}
+
+// ParseCursorParams parses the cursor and limit query parameters of cursor paginated lists.
+// Returns ErrInvalidInput for malformed cursors.
+func ParseCursorParams(r *http.Request, defaultLimit int) (CursorParams, error) {
+	params := CursorParams{Limit: ParsePaginationParams(r, 1, defaultLimit).Limit}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := types.ParseCursor(value)
+		if err != nil {
+			return params, err
+		}
+		params.Cursor = &cursor
+	}
+	return params, nil
+}
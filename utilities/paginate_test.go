@@ -1,10 +1,14 @@
 package utilities
 
 import (
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/dgyurics/marketplace/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,3 +77,38 @@ func TestParsePaginationParams_ExceedingLimit(t *testing.T) {
 	assert.Equal(t, 1, params.Page)    // Valid page should be applied
 	assert.Equal(t, 100, params.Limit) // Limit should be capped at 100
 }
+
+func TestParseCursorParams(t *testing.T) {
+	cursor := types.Cursor{Time: time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC), ID: "42"}
+	req := httptest.NewRequest(http.MethodGet, "/?limit=20&cursor="+cursor.String(), nil)
+
+	params, err := ParseCursorParams(req, 50)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 20, params.Limit)
+	assert.True(t, cursor.Time.Equal(params.Cursor.Time), "Expected cursor time to round-trip")
+	assert.Equal(t, cursor.ID, params.Cursor.ID)
+}
+
+func TestParseCursorParams_FirstPage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	params, err := ParseCursorParams(req, 50)
+
+	assert.NoError(t, err)
+	assert.Nil(t, params.Cursor)
+	assert.Equal(t, 50, params.Limit)
+}
+
+func TestParseCursorParams_Invalid(t *testing.T) {
+	for _, cursor := range []string{
+		"not-base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("2024-05-01T12:30:00Z")),
+		base64.RawURLEncoding.EncodeToString([]byte("yesterday,42")),
+		base64.RawURLEncoding.EncodeToString([]byte("2024-05-01T12:30:00Z,1 OR 1=1")),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?cursor="+url.QueryEscape(cursor), nil)
+		_, err := ParseCursorParams(req, 50)
+		assert.Equal(t, types.ErrInvalidInput, err, "Expected cursor %q to be rejected", cursor)
+	}
+}
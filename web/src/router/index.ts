@@ -147,9 +147,9 @@ export async function createAppRouter() {
     return undefined
   })
 
-  // fetch inbox on every navigation
+  // refresh the unread badge on every navigation
   router.afterEach(() => {
-    useInboxStore().fetchConversations()
+    useInboxStore().fetchUnreadCount()
   })
 
   return router
@@ -158,14 +158,17 @@ export async function createAppRouter() {
 // Handle registration code confirmation
 async function handleRegistrationCode(to: RouteLocationNormalized) {
   try {
-    const authTokens = await registerConfirm(to.query['registration-code'] as string)
+    const authTokens = await registerConfirm(
+      to.query['email'] as string,
+      to.query['registration-code'] as string
+    )
     const authStore = useAuthStore()
     authStore.setTokens(authTokens)
   } catch (error) {
     console.error('Registration confirmation failed:', error)
   }
 
-  // Remove registration-code from query params
-  const { 'registration-code': _, ...cleanQuery } = to.query
+  // Remove registration-code and email from query params
+  const { 'registration-code': _, email: __, ...cleanQuery } = to.query
   return { ...to, query: cleanQuery, replace: true }
 }
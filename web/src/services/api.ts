@@ -26,7 +26,7 @@ import type {
   CreateOrderConflict,
   CreateOrderResult,
 } from '@/types'
-import type { Conversation } from '@/types/conversation'
+import type { Conversation, ConversationPage } from '@/types/conversation'
 
 const apiClient = axios.create({
   baseURL,
@@ -80,8 +80,12 @@ export const register = async (email: string, password: string): Promise<void> =
 }
 
 // used to confirm a new user's email after registration
-export const registerConfirm = async (registrationCode: string): Promise<AuthTokens> => {
+export const registerConfirm = async (
+  email: string,
+  registrationCode: string
+): Promise<AuthTokens> => {
   const response = await apiClient.post('/register/confirm', {
+    email,
     registration_code: registrationCode,
   })
   return response.data
@@ -283,6 +287,20 @@ export const createOrder = async (
   return { success: true, data: response.data }
 }
 
+export const createOfferOrder = async (
+  offerID: string,
+  shippingID: string,
+  idempotencyKey: string
+): Promise<CreateOrderResult> => {
+  const params = new URLSearchParams()
+  params.append('shipping_id', shippingID)
+
+  const response = await apiClient.post(`/orders/offers/${offerID}?${params}`, null, {
+    headers: { 'Idempotency-Key': idempotencyKey },
+  })
+  return { success: true, data: response.data }
+}
+
 export const getUsers = async (page: number = 1, limit: number = 50): Promise<UserRecord[]> => {
   const params = new URLSearchParams()
 
@@ -448,9 +466,17 @@ export const getOffersByProductId = async (id: string): Promise<Offer[]> => {
 }
 
 /* Conversation endpoints */
-export const getConversations = async (): Promise<Conversation[]> => {
-  const response = await apiClient.get('/conversations')
-  return response.data
+export const getConversations = async (cursor?: string): Promise<ConversationPage> => {
+  const response = await apiClient.get('/conversations', { params: cursor ? { cursor } : {} })
+  return {
+    conversations: response.data,
+    nextCursor: response.headers['x-next-cursor'] ?? null,
+  }
+}
+
+export const getUnreadCount = async (): Promise<number> => {
+  const response = await apiClient.get('/conversations/unread-count')
+  return response.data.count
 }
 
 export const getConversationById = async (id: string): Promise<Conversation> => {
@@ -4,13 +4,15 @@ import {
   createAddress as apiCreateAddress,
   updateAddress as apiUpdateAddress,
   createOrder as apiCreateOrder,
+  createOfferOrder as apiCreateOfferOrder,
   getTaxEstimate as apiGetTaxEstimate,
 } from '@/services/api'
-import type { Address, CreateOrderResponse, InsufficientStockItem } from '@/types'
+import type { Address, CreateOrderResponse, InsufficientStockItem, Offer } from '@/types'
 
 export const useCheckoutStore = defineStore('checkout', {
   state: () => ({
     shippingAddress: {} as Address,
+    offer: null as Offer | null, // accepted offer checked out instead of the cart
     stripe_client_secret: '',
     order_id: '',
     shippingError: null as string | null,
@@ -49,7 +51,9 @@ export const useCheckoutStore = defineStore('checkout', {
       }
 
       const idempotencyKey = window.crypto.randomUUID()
-      const result = await apiCreateOrder(this.shippingAddress.id, idempotencyKey)
+      const result = this.offer
+        ? await apiCreateOfferOrder(this.offer.id, this.shippingAddress.id, idempotencyKey)
+        : await apiCreateOrder(this.shippingAddress.id, idempotencyKey)
 
       if (!result.success) {
         this.insufficientStock = result.items
@@ -63,8 +67,14 @@ export const useCheckoutStore = defineStore('checkout', {
       return result.data
     },
 
+    checkoutOffer(offer: Offer) {
+      this.resetCheckout()
+      this.offer = offer
+    },
+
     resetCheckout() {
       this.shippingAddress = {} as Address
+      this.offer = null
       this.stripe_client_secret = ''
       this.order_id = ''
       this.shippingError = null
@@ -3,6 +3,7 @@ import { defineStore } from 'pinia'
 import {
   getConversations as apiGetConversations,
   getConversationById as apiGetConversationById,
+  getUnreadCount as apiGetUnreadCount,
   removeConversation as apiRemoveConversation,
 } from '@/services/api'
 import type { Conversation } from '@/types/conversation'
@@ -10,35 +11,51 @@ import type { Conversation } from '@/types/conversation'
 export const useInboxStore = defineStore('inbox', {
   state: () => ({
     conversations: [] as Conversation[],
+    nextCursor: null as string | null, // null once every page is loaded
+    unreadCount: 0, // conversations with unread messages, across all pages
   }),
 
   getters: {
-    unreadCount: (state) =>
-      state.conversations.filter((c) => {
-        const lastRead = new Date(c.recipient_last_read_at).getTime()
-        const updatedAt = new Date(c.updated_at).getTime()
-        return updatedAt + 50 > lastRead
-      }).length,
+    hasMore: (state) => state.nextCursor !== null,
 
-    isUnread: () => (conversation: Conversation) => {
-      const lastRead = new Date(conversation.recipient_last_read_at).getTime()
-      const updatedAt = new Date(conversation.updated_at).getTime()
-      return updatedAt + 50 > lastRead
-    },
+    isUnread: () => (conversation: Conversation) => conversation.unread_count > 0,
   },
 
   actions: {
+    // fetchConversations loads the first page of conversations
     async fetchConversations() {
       try {
-        this.conversations = await apiGetConversations()
-        console.log('Fetched conversations:', this.conversations)
+        const page = await apiGetConversations()
+        this.conversations = page.conversations
+        this.nextCursor = page.nextCursor
         return this.conversations
       } catch {
         this.conversations = []
+        this.nextCursor = null
         return []
       }
     },
 
+    // fetchMoreConversations appends the next page of conversations, if any
+    async fetchMoreConversations() {
+      if (this.nextCursor === null) return
+      try {
+        const page = await apiGetConversations(this.nextCursor)
+        this.conversations.push(...page.conversations)
+        this.nextCursor = page.nextCursor
+      } catch (err) {
+        console.error('Error fetching conversations:', err)
+      }
+    },
+
+    async fetchUnreadCount() {
+      try {
+        this.unreadCount = await apiGetUnreadCount()
+      } catch {
+        this.unreadCount = 0
+      }
+    },
+
     async fetchConversationById(id: string) {
       try {
         return await apiGetConversationById(id)
@@ -51,7 +68,8 @@ export const useInboxStore = defineStore('inbox', {
     async removeConversation(id: string) {
       try {
         await apiRemoveConversation(id)
-        await this.fetchConversations()
+        this.conversations = this.conversations.filter((c) => c.id !== id)
+        await this.fetchUnreadCount()
       } catch (err) {
         console.error('Error removing conversation:', err)
         throw err
@@ -60,6 +78,8 @@ export const useInboxStore = defineStore('inbox', {
 
     clearInbox() {
       this.conversations = []
+      this.nextCursor = null
+      this.unreadCount = 0
     },
   },
 })
@@ -4,6 +4,7 @@ export interface Conversation {
   subject: string
   recipient_id: string
   recipient_last_read_at: string
+  unread_count: number
   messages: Message[]
   updated_at: string
   created_at: string
@@ -16,3 +17,9 @@ export interface Message {
   body: string
   created_at: string
 }
+
+// ConversationPage is a page of conversations, most recently updated first
+export interface ConversationPage {
+  conversations: Conversation[]
+  nextCursor: string | null // requests the next page, null on the last page
+}
@@ -1,6 +1,22 @@
 import type { Product } from './product'
 
-export type OfferStatus = 'pending' | 'accepted' | 'rejected' | 'canceled' | 'completed'
+export type OfferStatus =
+  | 'pending'
+  | 'countered'
+  | 'accepted'
+  | 'rejected'
+  | 'canceled'
+  | 'completed'
+  | 'expired'
+export interface OfferRevision {
+  id: string
+  offer_id: string
+  author_id?: string
+  amount: number
+  status: OfferStatus
+  comment?: string
+  created_at: string
+}
 export interface Offer {
   id: string
   user_id: string
@@ -8,6 +24,8 @@ export interface Offer {
   amount: number
   comment: string
   status: OfferStatus
+  expires_at?: string
+  revisions?: OfferRevision[]
   created_at: string
   updated_at: string
 }
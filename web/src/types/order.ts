@@ -23,6 +23,7 @@ export interface Order {
   tax_amount: number
   shipping_amount: number
   total_amount: number
+  offer_id?: string
   created_at: string
   updated_at: string
 }